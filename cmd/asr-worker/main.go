@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"os"
@@ -27,7 +28,7 @@ func main() {
 	cfg := config.Load()
 
 	// Connect to NATS
-	busClient, err := bus.NewClient(cfg.NATS.URL)
+	busClient, err := bus.New(cfg)
 	if err != nil {
 		log.Fatalf("Failed to connect to NATS: %v", err)
 	}
@@ -56,10 +57,17 @@ func main() {
 	// - Azure Speech Service
 
 	// Simulate processing (in reality, this would subscribe to AUDIO stream)
-	// busClient.SubscribeAudio("*", func(msg *bus.Message) {
+	// busClient.SubscribeAudioGroup("asr-workers", func(msg *bus.Message) error {
+	//     // msg.Audio describes the payload (codec, sample rate, channels,
+	//     // sequence, media timestamp, VAD flags)
 	//     // Process audio chunk
 	//     // Send to ASR service
-	//     // Publish transcript
+	//     // Publish transcript, passing msg.Context() so it continues
+	//     // the audio's trace:
+	//     //   processAudioChunk(msg.Context(), msg.SessionID, msg.Data, busClient)
+	//     // Return an error to have the chunk redelivered, or
+	//     // bus.Terminate(err) to dead-letter it
+	//     return nil
 	// })
 
 	log.Println("ASR Worker ready (stub mode)")
@@ -78,7 +86,7 @@ func main() {
 }
 
 // Example ASR integration function (to be implemented)
-func processAudioChunk(sessionID string, audioData []byte, busClient *bus.Client) error {
+func processAudioChunk(ctx context.Context, sessionID string, audioData []byte, busClient bus.Bus) error {
 	// TODO: Implement real ASR here
 	// This is where you would:
 	// 1. Send audioData to your ASR service
@@ -99,7 +107,17 @@ func processAudioChunk(sessionID string, audioData []byte, busClient *bus.Client
 		return err
 	}
 
-	return busClient.PublishText(sessionID, data)
+	if err := busClient.PublishText(ctx, sessionID, data); err != nil {
+		return err
+	}
+
+	// Let the gateway record what the caller said
+	event := bus.NewEvent(bus.EventTranscript, sessionID)
+	event.Source = "asr-worker"
+	event.Speaker = "user"
+	event.Text = transcript.Text
+	event.IsFinal = transcript.IsFinal
+	return busClient.PublishEvent(ctx, event)
 }
 
 // Example real ASR integration patterns:
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"voice-gateway/internal/bus"
+	"voice-gateway/internal/config"
+)
+
+// Compares per-frame audio latency across bus transports. Each run publishes
+// 20ms PCM frames for one session and measures publish call time and
+// end-to-end latency from the envelope capture time to the subscriber.
+func main() {
+	frames := flag.Int("frames", 1000, "frames to publish per transport")
+	realtime := flag.Bool("realtime", false, "pace frames at 20ms like a live call")
+	transports := flag.String("transports", "jetstream,async,core", "comma-separated transports to compare")
+	flag.Parse()
+
+	cfg := config.Load()
+
+	// Keep benchmark traffic away from real streams on a shared server
+	cfg.NATS.Subject = "bench."
+	cfg.NATS.StreamPrefix = "BENCH_"
+
+	fmt.Printf("%-10s %10s %10s %10s %10s %10s %8s\n",
+		"transport", "pub p50", "pub p99", "e2e p50", "e2e p95", "e2e p99", "lost")
+
+	for _, name := range strings.Split(*transports, ",") {
+		if _, err := bus.ParseTransport(name); err != nil {
+			log.Fatalf("%v", err)
+		}
+
+		natsCfg := cfg.NATS
+		natsCfg.AudioStream.Transport = name
+		natsCfg.AudioStream.Storage = "memory"
+
+		result, err := run(natsCfg, *frames, *realtime)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+
+		fmt.Printf("%-10s %10s %10s %10s %10s %10s %8d\n", name,
+			percentile(result.publish, 50), percentile(result.publish, 99),
+			percentile(result.e2e, 50), percentile(result.e2e, 95), percentile(result.e2e, 99),
+			*frames-len(result.e2e))
+	}
+}
+
+type result struct {
+	publish []time.Duration
+	e2e     []time.Duration
+}
+
+func run(cfg config.NATSConfig, frames int, realtime bool) (*result, error) {
+	client, err := bus.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	sessionID := fmt.Sprintf("bench-%d", time.Now().UnixNano())
+	res := &result{}
+
+	var mu sync.Mutex
+	done := make(chan struct{})
+
+	_, err = client.SubscribeAudio(sessionID, func(msg *bus.Message) error {
+		latency := time.Since(msg.Audio.CaptureTime)
+
+		mu.Lock()
+		defer mu.Unlock()
+		res.e2e = append(res.e2e, latency)
+		if len(res.e2e) == frames {
+			close(done)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 20ms of 16kHz mono 16-bit PCM
+	payload := make([]byte, 640)
+
+	for i := 0; i < frames; i++ {
+		chunk := &bus.AudioChunk{
+			Codec:          bus.CodecPCM16,
+			SampleRate:     16000,
+			Channels:       1,
+			Sequence:       uint64(i),
+			MediaTimestamp: time.Duration(i) * 20 * time.Millisecond,
+			CaptureTime:    time.Now(),
+			Data:           payload,
+		}
+
+		start := time.Now()
+		if err := client.PublishAudio(context.Background(), sessionID, chunk); err != nil {
+			return nil, err
+		}
+		res.publish = append(res.publish, time.Since(start))
+
+		if realtime {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return &result{publish: res.publish, e2e: append([]time.Duration(nil), res.e2e...)}, nil
+}
+
+func percentile(samples []time.Duration, p int) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := len(sorted) * p / 100
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx].Round(time.Microsecond)
+}
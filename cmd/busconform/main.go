@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"voice-gateway/internal/bus"
+	"voice-gateway/internal/bus/bustest"
+	"voice-gateway/internal/config"
+)
+
+// Runs the bus conformance checks against each backend. The memory backend
+// needs nothing; NATS uses NATS_URL and Redis REDIS_URL unless -redis-url
+// is given. Point it at scratch servers: checks leave their keys behind in
+// Redis, and NATS streams are deleted afterwards. The package's tests run
+// the same checks against in-process servers.
+func main() {
+	backends := flag.String("backends", "memory,nats,redis", "comma-separated backends to check")
+	redisURL := flag.String("redis-url", "", "Redis to check against instead of REDIS_URL")
+	flag.Parse()
+
+	cfg := config.Load()
+	failed := false
+
+	for _, name := range strings.Split(*backends, ",") {
+		factory, cleanup, err := newFactory(name, cfg, *redisURL)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+
+		fmt.Printf("== %s\n", name)
+		for _, r := range bustest.Run(factory) {
+			status := "PASS"
+			if r.Err != nil {
+				status = "FAIL"
+				failed = true
+			}
+			fmt.Printf("%-4s %-32s %8s", status, r.Name, r.Duration.Round(time.Millisecond))
+			if r.Err != nil {
+				fmt.Printf("  %v", r.Err)
+			}
+			fmt.Println()
+		}
+
+		cleanup()
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func newFactory(name string, cfg *config.Config, redisURL string) (bustest.Factory, func(), error) {
+	// Settings shared by every backend
+	busConfig := func(prefix string) config.NATSConfig {
+		c := cfg.NATS
+		c.Subject = prefix + "."
+		c.DeadLetterSubject = ""
+		c.MaxDeliver = bustest.MaxDeliver
+		return c
+	}
+
+	switch name {
+	case bus.BackendMemory:
+		return func(prefix string) (bus.Bus, error) {
+			return bus.NewMemoryBus(busConfig(prefix))
+		}, func() {}, nil
+
+	case bus.BackendNATS:
+		factory := func(prefix string) (bus.Bus, error) {
+			c := busConfig(prefix)
+			c.StreamPrefix = strings.ToUpper(prefix) + "_"
+			for _, sc := range []*config.StreamConfig{&c.AudioStream, &c.TextStream, &c.TTSStream, &c.ControlStream, &c.DeadLetterStream} {
+				sc.Storage = "memory"
+			}
+			return bus.NewClient(c)
+		}
+		return factory, func() { deleteStreams(cfg.NATS.URL, "CONFORM") }, nil
+
+	case bus.BackendRedis:
+		rc := cfg.Redis
+		if redisURL != "" {
+			rc.URL = redisURL
+		}
+		return func(prefix string) (bus.Bus, error) {
+			return bus.NewRedisBus(rc, busConfig(prefix))
+		}, func() {}, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown backend %q", name)
+	}
+}
+
+// deleteStreams removes the streams created by the NATS checks
+func deleteStreams(url, prefix string) {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		log.Printf("Warning: failed to clean up streams: %v", err)
+		return
+	}
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		log.Printf("Warning: failed to clean up streams: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	names := js.StreamNames(ctx)
+	var stale []string
+	for name := range names.Name() {
+		if strings.HasPrefix(name, prefix) {
+			stale = append(stale, name)
+		}
+	}
+	for _, name := range stale {
+		if err := js.DeleteStream(ctx, name); err != nil {
+			log.Printf("Warning: failed to delete stream %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/envelope"
+	"voice-gateway/internal/session"
+	"voice-gateway/internal/storage"
+)
+
+// Exports recordings as plaintext: each session's recording is read from
+// recording storage (RECORDING_STORAGE), or from -dir, decrypted with the
+// configured key encryption key (RECORDING_KEK or RECORDING_KEK_FILE) and
+// written to <out>/<session>/ as an unencrypted recording would be laid
+// out. Unencrypted recordings are copied as they are. The transcript is
+// also written as subtitles and a conversation timeline, in the formats
+// given by -transcripts.
+func main() {
+	cfg := config.Load()
+
+	dir := flag.String("dir", "", "read recordings from this directory rather than recording storage")
+	out := flag.String("out", "", "directory to write the plaintext recordings to")
+	transcripts := flag.String("transcripts", "vtt,srt,json", "comma-separated transcript formats to write with each recording: vtt, srt or json")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -out DIR [-dir DIR] SESSION_ID...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *out == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var formats []string
+	for _, format := range strings.Split(*transcripts, ",") {
+		if format = strings.TrimSpace(format); format == "" {
+			continue
+		}
+		if err := session.ValidateTranscriptFormat(format); err != nil {
+			log.Fatal(err)
+		}
+		formats = append(formats, format)
+	}
+
+	var store storage.Storage
+	var err error
+	if *dir != "" {
+		store, err = storage.NewLocal(*dir)
+	} else {
+		store, err = storage.New(cfg.Recording)
+	}
+	if err != nil {
+		log.Fatalf("Failed to set up recording storage: %v", err)
+	}
+
+	var kek *envelope.KEK
+	if cfg.Recording.Encryption.KEK != "" || cfg.Recording.Encryption.KEKFile != "" {
+		if kek, err = envelope.LoadKEK(cfg.Recording.Encryption); err != nil {
+			log.Fatalf("Failed to load recording encryption key: %v", err)
+		}
+	}
+
+	failed := false
+	for _, sessionID := range flag.Args() {
+		outputDir := filepath.Join(*out, sessionID)
+		metadata, err := session.ExportRecording(context.Background(), store, sessionID, outputDir, kek)
+		if err != nil {
+			log.Printf("Session %s: failed to export recording: %v", sessionID, err)
+			failed = true
+			continue
+		}
+		if err := writeTranscripts(outputDir, metadata, formats); err != nil {
+			log.Printf("Session %s: failed to export transcript: %v", sessionID, err)
+			failed = true
+			continue
+		}
+		log.Printf("Session %s: exported %.1fs of audio and %d transcripts to %s",
+			sessionID, metadata.Duration, len(metadata.Transcripts), outputDir)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// transcriptFiles names the file each transcript format is written to
+var transcriptFiles = map[string]string{
+	session.TranscriptVTT:  "transcript.vtt",
+	session.TranscriptSRT:  "transcript.srt",
+	session.TranscriptJSON: "timeline.json",
+}
+
+// writeTranscripts writes a recording's transcript to outputDir in each
+// format
+func writeTranscripts(outputDir string, metadata *session.RecordingMetadata, formats []string) error {
+	timeline := session.NewTimeline(metadata)
+	for _, format := range formats {
+		file, err := os.OpenFile(filepath.Join(outputDir, transcriptFiles[format]), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if err := timeline.Write(file, format); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,13 +6,20 @@ import (
 	"log"
 	"net/http"
 
+	"voice-gateway/internal/bus"
 	"voice-gateway/internal/config"
+	"voice-gateway/internal/envelope"
+	"voice-gateway/internal/retention"
 	"voice-gateway/internal/session"
+	"voice-gateway/internal/storage"
 	"voice-gateway/internal/webrtc"
 )
 
 type OfferRequest struct {
 	SDP string `json:"sdp"`
+	// Optional; the X-Tenant-ID header is used if unset. Must match the
+	// tenant of the bearer token, if one is given.
+	TenantID string `json:"tenant_id,omitempty"`
 }
 
 type AnswerResponse struct {
@@ -28,6 +35,70 @@ func main() {
 
 	// Create WebRTC handler
 	webrtcHandler := webrtc.NewHandler(cfg.WebRTC.ICEServers, sessionMgr)
+	webrtcHandler.SetAudio(cfg.Audio)
+
+	// Recording storage is also needed to manage existing recordings when
+	// new calls aren't recorded
+	policy, err := retention.NewPolicy(cfg.Recording.Retention)
+	if err != nil {
+		log.Fatalf("Invalid recording retention: %v", err)
+	}
+	var store storage.Storage
+	if cfg.Recording.Enabled || cfg.Recording.APIToken != "" || policy.Enabled() {
+		if store, err = storage.New(cfg.Recording); err != nil {
+			log.Fatalf("Failed to set up recording storage: %v", err)
+		}
+	}
+
+	// A configured key encryption key also decrypts existing recordings for
+	// playback when new calls aren't encrypted
+	encryption := cfg.Recording.Encryption
+	var kek *envelope.KEK
+	if encryption.Enabled || encryption.KEK != "" || encryption.KEKFile != "" {
+		if kek, err = envelope.LoadKEK(encryption); err != nil {
+			log.Fatalf("Failed to load recording encryption key: %v", err)
+		}
+	}
+
+	if cfg.Recording.Enabled {
+		if err := session.ValidateFormat(cfg.Recording.Format); err != nil {
+			log.Fatalf("Invalid recording configuration: %v", err)
+		}
+		var recordingKEK *envelope.KEK
+		if encryption.Enabled {
+			recordingKEK = kek
+		}
+		webrtcHandler.SetRecording(cfg.Recording, store, recordingKEK)
+		location := cfg.Recording.Dir
+		if s3, ok := store.(*storage.S3); ok {
+			location = s3.String()
+		}
+		log.Printf("Recording calls to %s as %s", location, cfg.Recording.Format)
+		if recordingKEK != nil {
+			log.Printf("Encrypting recordings with key encryption key %s", recordingKEK.ID)
+		}
+	}
+
+	if store != nil {
+		manageRecordings(cfg.Recording, store, policy, kek)
+	}
+
+	// Connect to the bus for session events (optional in echo mode). With
+	// BUS_BACKEND=memory everything runs inside this process.
+	busClient, err := bus.New(cfg)
+	if err != nil {
+		log.Printf("Warning: running without a bus: %v", err)
+	} else {
+		defer busClient.Close()
+		webrtcHandler.SetBus(busClient)
+	}
+
+	// Tenants are only trusted, e.g. to opt out of recording, if they
+	// authenticate
+	tenants, err := newTenantTokens(cfg.Server.TenantTokens)
+	if err != nil {
+		log.Fatalf("Invalid TENANT_TOKENS: %v", err)
+	}
 
 	// Set up HTTP handlers
 	http.HandleFunc("/offer", func(w http.ResponseWriter, r *http.Request) {
@@ -42,7 +113,15 @@ func main() {
 			return
 		}
 
-		answer, err := webrtcHandler.HandleOffer(req.SDP)
+		tenantID, authenticated, err := tenants.offerTenant(r, req.TenantID)
+		if err != nil {
+			log.Printf("Rejected offer from %s: %v", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="offer"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		answer, err := webrtcHandler.HandleOffer(req.SDP, tenantID, authenticated)
 		if err != nil {
 			log.Printf("Error handling offer: %v", err)
 			http.Error(w, fmt.Sprintf("Failed to process offer: %v", err), http.StatusInternalServerError)
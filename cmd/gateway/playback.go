@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"voice-gateway/internal/session"
+)
+
+const (
+	// Cookie letting a browser play recordings, which it can't fetch for
+	// an audio element with a bearer token
+	viewerCookie    = "recordings_viewer"
+	viewerCookieAge = 12 * time.Hour
+)
+
+// recordingSummary describes a recording without its transcripts, which
+// are fetched separately
+type recordingSummary struct {
+	SessionID  string                     `json:"session_id"`
+	Size       int64                      `json:"size_bytes"`
+	Modified   time.Time                  `json:"modified"`
+	InProgress bool                       `json:"in_progress"`
+	Metadata   *session.RecordingMetadata `json:"metadata"`
+}
+
+func summarizeRecording(info session.RecordingInfo, now time.Time) recordingSummary {
+	metadata := info.Metadata
+	if metadata != nil {
+		trimmed := *metadata
+		trimmed.Transcripts, trimmed.ToolCalls = []session.TranscriptEntry{}, nil
+		metadata = &trimmed
+	}
+	return recordingSummary{
+		SessionID:  info.SessionID,
+		Size:       info.Size,
+		Modified:   info.ModTime,
+		InProgress: info.InProgress(now),
+		Metadata:   metadata,
+	}
+}
+
+// viewer rejects requests without the API token, as a bearer token or in
+// the cookie set by login
+func (a *recordingAPI) viewer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(viewerCookie); err == nil && a.validViewerToken(cookie.Value, time.Now()) {
+			next(w, r)
+			return
+		}
+		a.authorized(next)(w, r)
+	}
+}
+
+// viewerToken returns a value for the viewer cookie valid until expires:
+// the expiry signed with the API token, so the token itself isn't kept by
+// the browser and a copied cookie stops working
+func (a *recordingAPI) viewerToken(expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + a.viewerSignature(expiry)
+}
+
+// validViewerToken reports whether value was issued by viewerToken and has
+// not expired by now
+func (a *recordingAPI) validViewerToken(value string, now time.Time) bool {
+	expiry, signature, found := strings.Cut(value, ".")
+	if !found {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(a.viewerSignature(expiry))) != 1 {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && now.Unix() < expires
+}
+
+func (a *recordingAPI) viewerSignature(expiry string) string {
+	mac := hmac.New(sha256.New, []byte(a.token))
+	mac.Write([]byte(viewerCookie + "\x00" + expiry))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type loginRequest struct {
+	Token string `json:"token"`
+}
+
+// login sets the viewer cookie for a browser given the API token. The
+// cookie only lets it read recordings; changes still need the token.
+func (a *recordingAPI) login(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "A JSON body with a token is required", http.StatusBadRequest)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(a.token)) != 1 {
+		log.Printf("Recording API: rejected login from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	a.setViewerCookie(w, r, a.viewerToken(time.Now().Add(viewerCookieAge)), viewerCookieAge)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// logout clears the viewer cookie
+func (a *recordingAPI) logout(w http.ResponseWriter, r *http.Request) {
+	a.setViewerCookie(w, r, "", -1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *recordingAPI) setViewerCookie(w http.ResponseWriter, r *http.Request, value string, age time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     viewerCookie,
+		Value:    value,
+		Path:     "/recordings",
+		MaxAge:   int(age.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// listRecordings lists the recordings in storage, newest first, optionally
+// only a tenant's
+func (a *recordingAPI) listRecordings(w http.ResponseWriter, r *http.Request) {
+	recordings, err := session.ListRecordings(r.Context(), a.store)
+	if err != nil {
+		writeRecordingError(w, err)
+		return
+	}
+
+	tenant := r.URL.Query().Get("tenant")
+	now := time.Now()
+	summaries := []recordingSummary{}
+	for _, info := range recordings {
+		if tenant == "" || info.TenantID() == tenant {
+			summaries = append(summaries, summarizeRecording(info, now))
+		}
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return recordingStart(summaries[i]).After(recordingStart(summaries[j]))
+	})
+	writeJSON(w, map[string]any{"recordings": summaries})
+}
+
+func recordingStart(s recordingSummary) time.Time {
+	if s.Metadata != nil && !s.Metadata.StartTime.IsZero() {
+		return s.Metadata.StartTime
+	}
+	return s.Modified
+}
+
+// getRecording describes one recording
+func (a *recordingAPI) getRecording(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := requestedSession(w, r)
+	if !ok {
+		return
+	}
+	info, err := session.StatRecording(r.Context(), a.store, sessionID)
+	if err != nil {
+		writeRecordingError(w, err)
+		return
+	}
+	writeJSON(w, summarizeRecording(info, time.Now()))
+}
+
+// streamAudio serves a recording's stereo audio, or for one kept as Ogg the
+// channel named in the query, with range requests for seeking
+func (a *recordingAPI) streamAudio(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := requestedSession(w, r)
+	if !ok {
+		return
+	}
+	channel := r.URL.Query().Get("channel")
+	playback, err := session.OpenPlayback(r.Context(), a.store, sessionID, channel, a.kek)
+	if err != nil {
+		writeRecordingError(w, err)
+		return
+	}
+	defer playback.Close()
+
+	w.Header().Set("Content-Type", playback.ContentType)
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, "", playback.ModTime, playback)
+}
+
+// getTranscript serves a recording's transcript as WebVTT, SRT or a JSON
+// timeline, by the format in the query
+func (a *recordingAPI) getTranscript(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := requestedSession(w, r)
+	if !ok {
+		return
+	}
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = session.TranscriptJSON
+	}
+	if err := session.ValidateTranscriptFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := session.ReadTranscripts(r.Context(), a.store, sessionID, a.kek)
+	if err != nil {
+		writeRecordingError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", session.TranscriptContentType(format))
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := session.NewTimeline(metadata).Write(w, format); err != nil {
+		log.Printf("Session %s: failed to write transcript: %v", sessionID, err)
+	}
+}
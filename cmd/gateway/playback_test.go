@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestViewerCookie(t *testing.T) {
+	a := &recordingAPI{token: "secret"}
+	now := time.Now()
+	valid := a.viewerToken(now.Add(time.Hour))
+	expiry, _, _ := strings.Cut(valid, ".")
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"expired", a.viewerToken(now.Add(-time.Second)), false},
+		{"extended expiry", a.viewerToken(now.Add(-time.Second))[:len(expiry)] + valid[len(expiry):], false},
+		{"other token", (&recordingAPI{token: "other"}).viewerToken(now.Add(time.Hour)), false},
+		{"unsigned", expiry, false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := a.validViewerToken(tt.value, now); ok != tt.ok {
+				t.Errorf("valid %v, want %v", ok, tt.ok)
+			}
+
+			r := httptest.NewRequest("GET", "/recordings", nil)
+			r.AddCookie(&http.Cookie{Name: viewerCookie, Value: tt.value})
+			w := httptest.NewRecorder()
+			a.viewer(func(w http.ResponseWriter, r *http.Request) {})(w, r)
+			if ok := w.Code == http.StatusOK; ok != tt.ok {
+				t.Errorf("status %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestLoginCookie(t *testing.T) {
+	a := &recordingAPI{token: "secret"}
+	w := httptest.NewRecorder()
+	a.login(w, httptest.NewRequest("POST", "/recordings/login", strings.NewReader(`{"token":"secret"}`)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != viewerCookie {
+		t.Fatalf("cookies %v", cookies)
+	}
+	if strings.Contains(cookies[0].Value, "secret") {
+		t.Error("cookie holds the API token")
+	}
+	if !a.validViewerToken(cookies[0].Value, time.Now()) {
+		t.Error("cookie not valid now")
+	}
+	if a.validViewerToken(cookies[0].Value, time.Now().Add(viewerCookieAge+time.Second)) {
+		t.Error("cookie valid after it expired")
+	}
+}
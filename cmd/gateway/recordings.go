@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/envelope"
+	"voice-gateway/internal/retention"
+	"voice-gateway/internal/session"
+	"voice-gateway/internal/storage"
+)
+
+// manageRecordings starts the retention purge job and serves the recording
+// API, as configured. Encrypted recordings are played back with kek.
+func manageRecordings(cfg config.RecordingConfig, store storage.Storage, policy retention.Policy, kek *envelope.KEK) {
+	purge := policy.Enabled() && cfg.Retention.Interval > 0
+	if !purge && cfg.APIToken == "" {
+		return
+	}
+
+	audit, err := retention.OpenAuditLog(store, cfg.Retention.AuditLog)
+	if err != nil {
+		log.Fatalf("Failed to open recording audit log: %v", err)
+	}
+
+	if purge {
+		go retention.NewPurger(store, policy, audit).Run(context.Background(), cfg.Retention.Interval)
+		log.Printf("Purging expired recordings every %s", cfg.Retention.Interval)
+	}
+
+	if cfg.APIToken != "" {
+		api := &recordingAPI{store: store, token: cfg.APIToken, audit: audit, kek: kek}
+		api.register()
+		log.Printf("Recording API enabled at /recordings")
+	}
+}
+
+// recordingAPI manages and plays back the recordings in storage for callers
+// holding the API token
+type recordingAPI struct {
+	store storage.Storage
+	token string
+	audit *retention.AuditLog
+	kek   *envelope.KEK
+}
+
+func (a *recordingAPI) register() {
+	http.HandleFunc("DELETE /recordings/{id}", a.authorized(a.deleteRecording))
+	http.HandleFunc("PUT /recordings/{id}/legal-hold", a.authorized(a.setLegalHold))
+	http.HandleFunc("DELETE /recordings/{id}/legal-hold", a.authorized(a.releaseLegalHold))
+
+	http.HandleFunc("POST /recordings/login", a.login)
+	http.HandleFunc("POST /recordings/logout", a.logout)
+	http.HandleFunc("GET /recordings", a.viewer(a.listRecordings))
+	http.HandleFunc("GET /recordings/{id}", a.viewer(a.getRecording))
+	http.HandleFunc("GET /recordings/{id}/audio", a.viewer(a.streamAudio))
+	http.HandleFunc("GET /recordings/{id}/transcript", a.viewer(a.getTranscript))
+}
+
+// authorized rejects requests without the API token as a bearer token
+func (a *recordingAPI) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="recordings"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requestedSession returns the session whose recording is requested
+func requestedSession(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.PathValue("id")
+	if !session.ValidSessionID(id) {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return "", false
+	}
+	return id, true
+}
+
+// actor returns who the caller says is making a change, as required for the
+// audit log
+func actor(w http.ResponseWriter, r *http.Request) (string, bool) {
+	actor := strings.TrimSpace(r.Header.Get("X-Actor"))
+	if actor == "" {
+		http.Error(w, "X-Actor header required", http.StatusBadRequest)
+		return "", false
+	}
+	return actor, true
+}
+
+// deleteRecording handles a data subject's request to erase a recording.
+// The reason, e.g. a request reference, is taken from the query.
+func (a *recordingAPI) deleteRecording(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := requestedSession(w, r)
+	if !ok {
+		return
+	}
+	who, ok := actor(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := retention.DeleteRecording(r.Context(), a.store, a.audit, retention.AuditEntry{
+		SessionID: sessionID,
+		Actor:     who,
+		Reason:    r.URL.Query().Get("reason"),
+	})
+	if err != nil {
+		// Including a deletion done but not audited
+		writeRecordingError(w, err)
+		return
+	}
+	writeJSON(w, map[string]any{"session_id": sessionID, "objects": len(info.Objects), "bytes": info.Size})
+}
+
+type legalHoldRequest struct {
+	Reason string `json:"reason"`
+}
+
+// setLegalHold exempts a recording from deletion
+func (a *recordingAPI) setLegalHold(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := requestedSession(w, r)
+	if !ok {
+		return
+	}
+	who, ok := actor(w, r)
+	if !ok {
+		return
+	}
+	var req legalHoldRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, "A JSON body with a reason is required", http.StatusBadRequest)
+		return
+	}
+
+	hold := &session.LegalHold{Reason: req.Reason, SetBy: who, SetAt: time.Now().UTC()}
+	a.changeLegalHold(w, r, sessionID, retention.ActionLegalHold, who, req.Reason, hold)
+}
+
+// releaseLegalHold lets a recording be deleted again
+func (a *recordingAPI) releaseLegalHold(w http.ResponseWriter, r *http.Request) {
+	sessionID, ok := requestedSession(w, r)
+	if !ok {
+		return
+	}
+	who, ok := actor(w, r)
+	if !ok {
+		return
+	}
+	a.changeLegalHold(w, r, sessionID, retention.ActionReleaseHold, who, r.URL.Query().Get("reason"), nil)
+}
+
+func (a *recordingAPI) changeLegalHold(w http.ResponseWriter, r *http.Request, sessionID, action, who, reason string, hold *session.LegalHold) {
+	info, err := session.SetLegalHold(r.Context(), a.store, sessionID, hold)
+	entry := retention.AuditEntry{
+		Action:    action,
+		SessionID: sessionID,
+		TenantID:  info.TenantID(),
+		Actor:     who,
+		Reason:    reason,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if auditErr := a.audit.Record(r.Context(), entry); auditErr != nil {
+		log.Printf("Session %s: %v", sessionID, auditErr)
+	}
+
+	if err != nil {
+		writeRecordingError(w, err)
+		return
+	}
+	writeJSON(w, map[string]any{"session_id": sessionID, "legal_hold": hold})
+}
+
+// writeRecordingError responds with the status matching an error from the
+// session package's recording functions
+func writeRecordingError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "Recording not found", http.StatusNotFound)
+	case errors.Is(err, session.ErrNotPlayable):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, session.ErrLegalHold), errors.Is(err, session.ErrInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Recording API error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errUnknownToken is returned for a bearer token no tenant has
+var errUnknownToken = errors.New("unknown tenant token")
+
+// tenantTokens identifies tenants by their bearer tokens
+type tenantTokens struct {
+	tenants []string
+	tokens  [][]byte
+}
+
+// newTenantTokens parses "tenant=token" pairs
+func newTenantTokens(pairs []string) (*tenantTokens, error) {
+	t := &tenantTokens{}
+	for _, pair := range pairs {
+		tenant, token, found := strings.Cut(pair, "=")
+		tenant, token = strings.TrimSpace(tenant), strings.TrimSpace(token)
+		if !found || tenant == "" || token == "" {
+			return nil, fmt.Errorf("invalid tenant token for %q, expected tenant=token", tenant)
+		}
+		t.tenants = append(t.tenants, tenant)
+		t.tokens = append(t.tokens, []byte(token))
+	}
+	return t, nil
+}
+
+// authenticate returns the tenant whose bearer token a request carries, or
+// false if it carries none
+func (t *tenantTokens) authenticate(r *http.Request) (string, bool, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return "", false, nil
+	}
+
+	// Every token is compared, so the time taken doesn't give away which
+	// tenant's was close
+	match := -1
+	for i, want := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), want) == 1 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return "", false, errUnknownToken
+	}
+	return t.tenants[match], true, nil
+}
+
+// offerTenant returns the tenant making an offer and whether it was
+// authenticated. One named by the client, in the request or the
+// X-Tenant-ID header, is only taken if the request has no token, and
+// isn't authenticated.
+func (t *tenantTokens) offerTenant(r *http.Request, claimed string) (string, bool, error) {
+	if claimed == "" {
+		claimed = r.Header.Get("X-Tenant-ID")
+	}
+
+	tenant, ok, err := t.authenticate(r)
+	if err != nil || !ok {
+		return claimed, false, err
+	}
+	if claimed != "" && claimed != tenant {
+		return "", false, fmt.Errorf("token is not for tenant %s", claimed)
+	}
+	return tenant, true, nil
+}
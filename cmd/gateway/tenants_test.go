@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOfferTenant(t *testing.T) {
+	tenants, err := newTenantTokens([]string{"acme=secret-a", " globex = secret-g "})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		token         string
+		header        string
+		claimed       string
+		tenant        string
+		authenticated bool
+		err           bool
+	}{
+		{"token", "secret-a", "", "", "acme", true, false},
+		{"trimmed token", "secret-g", "", "", "globex", true, false},
+		{"token and matching claim", "secret-a", "", "acme", "acme", true, false},
+		{"token and matching header", "secret-g", "globex", "", "globex", true, false},
+		{"token for another tenant", "secret-a", "", "globex", "", false, true},
+		{"header for another tenant", "secret-a", "globex", "", "", false, true},
+		{"unknown token", "secret", "", "acme", "", false, true},
+		{"claim only", "", "", "acme", "acme", false, false},
+		{"header only", "", "acme", "", "acme", false, false},
+		{"claim over header", "", "globex", "acme", "acme", false, false},
+		{"nothing", "", "", "", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/offer", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.header != "" {
+				r.Header.Set("X-Tenant-ID", tt.header)
+			}
+
+			tenant, authenticated, err := tenants.offerTenant(r, tt.claimed)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if err == nil && (tenant != tt.tenant || authenticated != tt.authenticated) {
+				t.Errorf("got %q authenticated %v, want %q authenticated %v", tenant, authenticated, tt.tenant, tt.authenticated)
+			}
+		})
+	}
+
+	if _, _, err := tenants.authenticate(httptest.NewRequest("POST", "/offer", nil)); err != nil {
+		t.Errorf("request without a token: %v", err)
+	}
+	r := httptest.NewRequest("POST", "/offer", nil)
+	r.Header.Set("Authorization", "Bearer nope")
+	if _, _, err := tenants.authenticate(r); !errors.Is(err, errUnknownToken) {
+		t.Errorf("unknown token returned %v", err)
+	}
+}
+
+func TestNewTenantTokens(t *testing.T) {
+	for _, pairs := range [][]string{{"acme"}, {"=secret"}, {"acme="}} {
+		if _, err := newTenantTokens(pairs); err == nil {
+			t.Errorf("%q accepted", pairs)
+		}
+	}
+}
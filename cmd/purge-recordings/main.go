@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/retention"
+	"voice-gateway/internal/storage"
+)
+
+// Applies the recording retention rules (RECORDING_RETENTION_*) once, as
+// the gateway's purge job does every RECORDING_RETENTION_INTERVAL, e.g. from
+// cron when that is disabled. Deletions are audited in recording storage and
+// appended to RECORDING_AUDIT_LOG. Legal holds are only serialized with
+// deletions within one process, so it refuses to delete anything unless told
+// no gateway is serving the same storage.
+func main() {
+	cfg := config.Load()
+
+	dryRun := flag.Bool("dry-run", false, "list recordings that would be deleted without deleting them")
+	stopped := flag.Bool("gateways-stopped", false, "confirm no gateway is serving the recording storage, so none can place a legal hold during the purge")
+	flag.Parse()
+
+	policy, err := retention.NewPolicy(cfg.Recording.Retention)
+	if err != nil {
+		log.Fatalf("Invalid recording retention: %v", err)
+	}
+	if !policy.Enabled() {
+		log.Printf("No retention rules configured, nothing to purge")
+		return
+	}
+
+	if !*dryRun && !*stopped {
+		log.Fatalf("A gateway could place a legal hold on a recording as it is deleted; stop the gateways and pass -gateways-stopped, or use -dry-run")
+	}
+
+	store, err := storage.New(cfg.Recording)
+	if err != nil {
+		log.Fatalf("Failed to set up recording storage: %v", err)
+	}
+
+	var audit *retention.AuditLog
+	if !*dryRun {
+		if audit, err = retention.OpenAuditLog(store, cfg.Recording.Retention.AuditLog); err != nil {
+			log.Fatalf("Failed to open recording audit log: %v", err)
+		}
+		defer audit.Close()
+	}
+
+	deletions, err := retention.NewPurger(store, policy, audit).Purge(context.Background(), *dryRun)
+	for _, d := range deletions {
+		verb := "deleted"
+		if *dryRun {
+			verb = "would delete"
+		}
+		log.Printf("Session %s: %s %d bytes, %s", d.Recording.SessionID, verb, d.Recording.Size, d.Reason)
+	}
+	if err != nil {
+		log.Printf("Purge failed: %v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/envelope"
+	"voice-gateway/internal/session"
+	"voice-gateway/internal/storage"
+)
+
+// Repairs recordings left incomplete by a gateway crash: any session
+// directory under RECORDING_DIR whose metadata still says "recording" (or
+// that has audio but no metadata) and hasn't been written to for -min-age.
+// The age check keeps it away from calls still in progress, so it is safe
+// to run alongside live gateways, e.g. from cron or at gateway startup.
+// With remote storage (RECORDING_STORAGE) repaired recordings are uploaded,
+// as are finished ones a gateway failed to upload. Encrypted recordings are
+// repaired with the configured key encryption key (RECORDING_KEK or
+// RECORDING_KEK_FILE).
+func main() {
+	cfg := config.Load()
+
+	dir := flag.String("dir", cfg.Recording.Dir, "recording directory to scan")
+	minAge := flag.Duration("min-age", 10*time.Minute, "only repair recordings untouched for at least this long")
+	dryRun := flag.Bool("dry-run", false, "list recordings that need repair without changing them")
+	flag.Parse()
+
+	store, err := storage.New(cfg.Recording)
+	if err != nil {
+		log.Fatalf("Failed to set up recording storage: %v", err)
+	}
+	if _, local := store.(*storage.Local); local {
+		store = nil
+	}
+
+	// Loaded whenever configured, as recordings made while encryption was
+	// enabled need it even if it no longer is
+	var kek *envelope.KEK
+	if cfg.Recording.Encryption.KEK != "" || cfg.Recording.Encryption.KEKFile != "" {
+		if kek, err = envelope.LoadKEK(cfg.Recording.Encryption); err != nil {
+			log.Fatalf("Failed to load recording encryption key: %v", err)
+		}
+	}
+
+	entries, err := os.ReadDir(*dir)
+	if err != nil {
+		log.Fatalf("Failed to read recording directory: %v", err)
+	}
+
+	failed := false
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		sessionDir := filepath.Join(*dir, entry.Name())
+
+		repair := needsRecovery(sessionDir)
+		if !repair && (store == nil || !finished(sessionDir)) {
+			continue
+		}
+
+		lastWrite, err := lastModified(sessionDir)
+		if err != nil {
+			log.Printf("Session %s: failed to check recording: %v", entry.Name(), err)
+			failed = true
+			continue
+		}
+		if age := time.Since(lastWrite); age < *minAge {
+			log.Printf("Session %s: skipping, written to %s ago and may still be in progress", entry.Name(), age.Round(time.Second))
+			continue
+		}
+
+		if *dryRun {
+			action := "upload"
+			if repair {
+				action = "repair"
+			}
+			log.Printf("Session %s: needs %s (last written %s)", entry.Name(), action, lastWrite.Format(time.RFC3339))
+			continue
+		}
+
+		if repair {
+			metadata, err := session.RecoverRecording(sessionDir, kek)
+			if err != nil {
+				log.Printf("Session %s: failed to recover recording: %v", entry.Name(), err)
+				failed = true
+				continue
+			}
+			log.Printf("Session %s: recovered %.1fs of audio and %d transcripts",
+				entry.Name(), metadata.Duration, metadata.Stats.TranscriptCount)
+		}
+
+		if store != nil {
+			if err := session.UploadRecording(context.Background(), store, sessionDir); err != nil {
+				log.Printf("Session %s: failed to upload recording: %v", entry.Name(), err)
+				failed = true
+				continue
+			}
+			log.Printf("Session %s: uploaded recording", entry.Name())
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// needsRecovery reports whether a directory holds a recording that was
+// never completed
+func needsRecovery(sessionDir string) bool {
+	metadata, err := session.ReadMetadata(sessionDir)
+	if err == nil {
+		return metadata.Status == session.StatusRecording
+	}
+
+	// Metadata lost or corrupt: a recording if there's channel audio
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Session %s: unreadable metadata: %v", filepath.Base(sessionDir), err)
+	}
+	_, statErr := os.Stat(filepath.Join(sessionDir, "caller.wav"))
+	return statErr == nil
+}
+
+// finished reports whether a directory holds a completed recording, which
+// with remote storage means its upload failed
+func finished(sessionDir string) bool {
+	metadata, err := session.ReadMetadata(sessionDir)
+	return err == nil && metadata.Status != session.StatusRecording
+}
+
+// lastModified returns the newest modification time of the files in a
+// directory
+func lastModified(dir string) (time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var latest time.Time
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/storage"
+	"voice-gateway/internal/storage/storagetest"
+)
+
+// Runs the storage conformance checks against each backend. Local storage
+// uses a temporary directory; S3 uses an in-process stand-in, which fails
+// every few requests so retries are exercised, unless -s3-endpoint is
+// given, when the RECORDING_S3_* settings apply. Point it at a scratch
+// bucket: checks leave their objects behind.
+func main() {
+	backends := flag.String("backends", "local,s3", "comma-separated backends to check")
+	endpoint := flag.String("s3-endpoint", "", "S3-compatible store to check against instead of an in-process stand-in")
+	flag.Parse()
+
+	cfg := config.Load()
+	failed := false
+
+	for _, name := range strings.Split(*backends, ",") {
+		factory, cleanup, err := newFactory(name, cfg.Recording.S3, *endpoint)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+
+		fmt.Printf("== %s\n", name)
+		for _, r := range storagetest.Run(factory) {
+			status := "PASS"
+			if r.Err != nil {
+				status = "FAIL"
+				failed = true
+			}
+			fmt.Printf("%-4s %-32s %8s", status, r.Name, r.Duration.Round(time.Millisecond))
+			if r.Err != nil {
+				fmt.Printf("  %v", r.Err)
+			}
+			fmt.Println()
+		}
+
+		if err := cleanup(); err != nil {
+			fmt.Printf("FAIL %v\n", err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func newFactory(name string, s3Config config.S3Config, endpoint string) (storagetest.Factory, func() error, error) {
+	switch name {
+	case storage.BackendLocal:
+		dir, err := os.MkdirTemp("", "storageconform")
+		if err != nil {
+			return nil, nil, err
+		}
+		factory := func(prefix string) (storage.Storage, error) {
+			return storage.NewLocal(filepath.Join(dir, prefix))
+		}
+		return factory, func() error { return os.RemoveAll(dir) }, nil
+
+	case storage.BackendS3:
+		cleanup := func() error { return nil }
+		if endpoint == "" {
+			standin := storagetest.NewFakeS3()
+			standin.FailEvery(7)
+			standin.SetPageSize(2)
+
+			s3Config = config.S3Config{
+				Endpoint:        standin.URL(),
+				Region:          standin.Region,
+				Bucket:          standin.Bucket,
+				AccessKeyID:     standin.AccessKeyID,
+				SecretAccessKey: standin.SecretAccessKey,
+				PathStyle:       true,
+				SSE:             storage.SSES3,
+				PartSize:        s3Config.PartSize,
+				MaxRetries:      3,
+			}
+			cleanup = func() error {
+				defer standin.Close()
+				if n := standin.PendingUploads(); n > 0 {
+					return fmt.Errorf("%d multipart uploads left incomplete", n)
+				}
+				return nil
+			}
+		} else {
+			s3Config.Endpoint = endpoint
+		}
+
+		factory := func(prefix string) (storage.Storage, error) {
+			c := s3Config
+			c.Prefix += prefix
+			return storage.NewS3(c)
+		}
+		return factory, cleanup, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown backend %q", name)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"log"
 	"os"
 	"os/signal"
@@ -20,13 +22,20 @@ type TextMessage struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 
+// Voice describes a voice available for synthesis
+type Voice struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Language string `json:"language"`
+}
+
 func main() {
 	log.Println("Starting TTS Worker (stub implementation)...")
 
 	cfg := config.Load()
 
 	// Connect to NATS
-	busClient, err := bus.NewClient(cfg.NATS.URL)
+	busClient, err := bus.New(cfg)
 	if err != nil {
 		log.Fatalf("Failed to connect to NATS: %v", err)
 	}
@@ -55,12 +64,37 @@ func main() {
 	log.Println("  4. Handle voice selection, speed, pitch controls")
 
 	// Example subscription (commented out - implement when ready)
-	// busClient.SubscribeText("*", func(msg *bus.Message) {
+	// busClient.SubscribeTextGroup("tts-workers", func(msg *bus.Message) error {
 	//     var textMsg TextMessage
-	//     json.Unmarshal(msg.Data, &textMsg)
-	//     processText(textMsg, busClient)
+	//     if err := json.Unmarshal(msg.Data, &textMsg); err != nil {
+	//         return bus.Terminate(err)
+	//     }
+	//     return processText(msg.Context(), textMsg, busClient)
 	// })
 
+	// Stop synthesis when the gateway cancels it (e.g. on barge-in)
+	_, err = busClient.SubscribeControl("", func(msg *bus.Message) error {
+		if msg.Event.Type == bus.EventCancelSynthesis {
+			log.Printf("Session %s: synthesis cancelled (%s)", msg.SessionID, msg.Event.Reason)
+			// TODO: abort the in-flight TTS stream for this session
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to control channel: %v", err)
+	}
+
+	// Answer synchronous queries from the gateway
+	service := busClient.NewService("tts", "v1")
+	service.Handle("list_voices", func(ctx context.Context, req json.RawMessage) (interface{}, error) {
+		// Stub: return the voices supported by your TTS provider
+		return []Voice{{ID: "default", Name: "Default", Language: "en-US"}}, nil
+	})
+	if err := service.Start(); err != nil {
+		log.Fatalf("Failed to start TTS service: %v", err)
+	}
+	defer service.Stop()
+
 	// Wait for interrupt
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -70,15 +104,26 @@ func main() {
 }
 
 // Example TTS integration function (to be implemented)
-func processText(textMsg TextMessage, busClient *bus.Client) error {
+func processText(ctx context.Context, textMsg TextMessage, busClient bus.Bus) error {
 	// TODO: Implement real TTS here
 	// This is where you would:
 	// 1. Send text to your TTS service
 	// 2. Receive audio chunks (streaming)
-	// 3. Publish each chunk to NATS
+	// 3. Publish each chunk to NATS with ctx, continuing the transcript's
+	//    trace
 
 	log.Printf("Processing text: %s (session: %s)", textMsg.Text, textMsg.SessionID)
 
+	// Let the gateway record what the assistant said
+	event := bus.NewEvent(bus.EventTranscript, textMsg.SessionID)
+	event.Source = "tts-worker"
+	event.Speaker = "assistant"
+	event.Text = textMsg.Text
+	event.IsFinal = textMsg.IsFinal
+	if err := busClient.PublishEvent(ctx, event); err != nil {
+		return err
+	}
+
 	// Stub: generate silence or beep
 	// In reality, you'd get PCM/Opus audio from TTS service
 
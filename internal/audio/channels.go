@@ -0,0 +1,50 @@
+package audio
+
+// StereoToMono averages interleaved left/right samples into a mono signal
+func StereoToMono(interleaved []float32) []float32 {
+	out := make([]float32, len(interleaved)/2)
+	for i := range out {
+		out[i] = (interleaved[i*2] + interleaved[i*2+1]) * 0.5
+	}
+	return out
+}
+
+// MonoToStereo duplicates a mono signal into interleaved left/right samples
+func MonoToStereo(mono []float32) []float32 {
+	out := make([]float32, len(mono)*2)
+	for i, s := range mono {
+		out[i*2] = s
+		out[i*2+1] = s
+	}
+	return out
+}
+
+// Remix converts interleaved audio between channel counts. Downmixing
+// averages all input channels; upmixing copies the mono mix to every output.
+func Remix(interleaved []float32, fromChannels, toChannels int) []float32 {
+	if fromChannels == toChannels {
+		return interleaved
+	}
+	if fromChannels == 2 && toChannels == 1 {
+		return StereoToMono(interleaved)
+	}
+	if fromChannels == 1 && toChannels == 2 {
+		return MonoToStereo(interleaved)
+	}
+
+	frames := len(interleaved) / fromChannels
+	out := make([]float32, frames*toChannels)
+	scale := 1 / float32(fromChannels)
+
+	for f := 0; f < frames; f++ {
+		var sum float32
+		for c := 0; c < fromChannels; c++ {
+			sum += interleaved[f*fromChannels+c]
+		}
+		for c := 0; c < toChannels; c++ {
+			out[f*toChannels+c] = sum * scale
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,72 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// BytesToInt16 decodes little-endian 16-bit PCM into samples
+func BytesToInt16(pcm []byte) []int16 {
+	samples := make([]int16, len(pcm)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(pcm[i*2:]))
+	}
+	return samples
+}
+
+// Int16ToBytes encodes samples as little-endian 16-bit PCM
+func Int16ToBytes(samples []int16) []byte {
+	pcm := make([]byte, len(samples)*2)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(s))
+	}
+	return pcm
+}
+
+// Int16ToFloat32 converts 16-bit samples to floats in [-1, 1)
+func Int16ToFloat32(samples []int16) []float32 {
+	out := make([]float32, len(samples))
+	for i, s := range samples {
+		out[i] = float32(s) / 32768.0
+	}
+	return out
+}
+
+// Float32ToInt16 converts floats to 16-bit samples, rounding and clipping
+// values outside [-1, 1)
+func Float32ToInt16(samples []float32) []int16 {
+	out := make([]int16, len(samples))
+	for i, s := range samples {
+		out[i] = floatToInt16(s)
+	}
+	return out
+}
+
+// BytesToFloat32 decodes little-endian 16-bit PCM directly into floats
+func BytesToFloat32(pcm []byte) []float32 {
+	out := make([]float32, len(pcm)/2)
+	for i := range out {
+		out[i] = float32(int16(binary.LittleEndian.Uint16(pcm[i*2:]))) / 32768.0
+	}
+	return out
+}
+
+// Float32ToBytes encodes floats as little-endian 16-bit PCM
+func Float32ToBytes(samples []float32) []byte {
+	pcm := make([]byte, len(samples)*2)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(floatToInt16(s)))
+	}
+	return pcm
+}
+
+func floatToInt16(s float32) int16 {
+	v := math.Round(float64(s) * 32768.0)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
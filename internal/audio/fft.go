@@ -0,0 +1,69 @@
+package audio
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// FFT computes an in-place radix-2 fast Fourier transform. len(x) must be a
+// power of two.
+func FFT(x []complex128) {
+	fft(x, false)
+}
+
+// IFFT computes an in-place inverse FFT, including the 1/N scaling
+func IFFT(x []complex128) {
+	fft(x, true)
+
+	scale := complex(1/float64(len(x)), 0)
+	for i := range x {
+		x[i] *= scale
+	}
+}
+
+func fft(x []complex128, inverse bool) {
+	n := len(x)
+	if n&(n-1) != 0 {
+		panic("audio: FFT length must be a power of two")
+	}
+
+	// Bit-reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	sign := -1.0
+	if inverse {
+		sign = 1.0
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a := x[start+k]
+				b := x[start+k+size/2] * w
+				x[start+k] = a + b
+				x[start+k+size/2] = a - b
+				w *= step
+			}
+		}
+	}
+}
+
+// HannWindow returns a periodic Hann window of length n
+func HannWindow(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n))
+	}
+	return w
+}
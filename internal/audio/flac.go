@@ -0,0 +1,469 @@
+package audio
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+)
+
+const (
+	// Samples per channel in each FLAC frame
+	flacBlockSize = 4096
+	// Highest fixed predictor order and residual partition order tried
+	flacMaxOrder          = 4
+	flacMaxPartitionOrder = 6
+	// Rice parameter 15 is reserved as an escape code with 4-bit parameters
+	flacMaxRiceParam = 14
+
+	flacStreamInfoSize = 34
+)
+
+// FLACEncoder encodes interleaved 16-bit PCM as a FLAC stream. Each channel
+// of each block is stored as a constant, the best of the fixed linear
+// predictors, or verbatim, whichever is smallest; silence costs a few bytes
+// per block. The STREAMINFO header is completed on Close if the output is
+// seekable; otherwise it gives only what was known at the start.
+type FLACEncoder struct {
+	out    io.Writer
+	seeker io.WriteSeeker // nil if the output can't be rewound
+	format Format
+	// Declared at the start, if known
+	frames uint64
+
+	pending []int16
+	frame   uint64
+	total   uint64
+
+	minFrame, maxFrame int
+	md5                hash.Hash
+	closed             bool
+}
+
+// NewFLACEncoder writes the FLAC stream header and returns an encoder for
+// PCM in the given format
+func NewFLACEncoder(out io.WriteSeeker, format Format) (*FLACEncoder, error) {
+	return newFLACEncoder(out, out, format, 0)
+}
+
+// NewFLACStreamEncoder is NewFLACEncoder for output that can't be rewound,
+// e.g. while it is encrypted, given how many frames will be written. The
+// header then leaves the frame sizes and MD5 signature unknown.
+func NewFLACStreamEncoder(out io.Writer, format Format, frames uint64) (*FLACEncoder, error) {
+	if frames >= 1<<36 {
+		return nil, fmt.Errorf("too many frames for FLAC: %d", frames)
+	}
+	return newFLACEncoder(out, nil, format, frames)
+}
+
+func newFLACEncoder(out io.Writer, seeker io.WriteSeeker, format Format, frames uint64) (*FLACEncoder, error) {
+	if format.Channels < 1 || format.Channels > 8 {
+		return nil, fmt.Errorf("FLAC supports 1 to 8 channels, not %d", format.Channels)
+	}
+	if format.SampleRate <= 0 || format.SampleRate >= 1<<20 {
+		return nil, fmt.Errorf("invalid FLAC sample rate %d", format.SampleRate)
+	}
+
+	e := &FLACEncoder{
+		out:     out,
+		seeker:  seeker,
+		format:  format,
+		frames:  frames,
+		pending: make([]int16, 0, flacBlockSize*format.Channels),
+		md5:     md5.New(),
+	}
+
+	// Marker and a STREAMINFO block to be completed on Close
+	header := append([]byte("fLaC"), 0x80, 0, 0, flacStreamInfoSize)
+	header = append(header, e.streamInfo()...)
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Write encodes little-endian 16-bit PCM. Data need not be a whole number
+// of frames, but the total written must be.
+func (e *FLACEncoder) Write(pcm []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("FLAC encoder closed")
+	}
+	if len(pcm)%2 != 0 {
+		return 0, errors.New("PCM data is not a whole number of samples")
+	}
+
+	e.md5.Write(pcm)
+
+	blockSamples := flacBlockSize * e.format.Channels
+	for i := 0; i+1 < len(pcm); i += 2 {
+		e.pending = append(e.pending, int16(binary.LittleEndian.Uint16(pcm[i:])))
+		if len(e.pending) == blockSamples {
+			if err := e.encodeBlock(); err != nil {
+				return i, err
+			}
+		}
+	}
+
+	return len(pcm), nil
+}
+
+// Close encodes any remaining samples and completes the stream header. It
+// does not close the underlying writer.
+func (e *FLACEncoder) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	if len(e.pending)%e.format.Channels != 0 {
+		return errors.New("PCM data ended partway through a frame")
+	}
+	if len(e.pending) > 0 {
+		if err := e.encodeBlock(); err != nil {
+			return err
+		}
+	}
+
+	if e.seeker == nil {
+		if e.total != e.frames {
+			return fmt.Errorf("FLAC stream declared %d frames but %d were written", e.frames, e.total)
+		}
+		return nil
+	}
+
+	end, err := e.seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := e.seeker.Seek(8, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := e.seeker.Write(e.streamInfo()); err != nil {
+		return err
+	}
+	_, err = e.seeker.Seek(end, io.SeekStart)
+	return err
+}
+
+// streamInfo returns the STREAMINFO block body for what has been encoded,
+// or was declared before encoding. Zero frame sizes mean unknown.
+func (e *FLACEncoder) streamInfo() []byte {
+	total := e.frames
+	if e.closed {
+		total = e.total
+	}
+
+	var w bitWriter
+	w.write(flacBlockSize, 16) // min block size
+	w.write(flacBlockSize, 16) // max block size
+	w.write(uint64(e.minFrame), 24)
+	w.write(uint64(e.maxFrame), 24)
+	w.write(uint64(e.format.SampleRate), 20)
+	w.write(uint64(e.format.Channels-1), 3)
+	w.write(15, 5) // bits per sample - 1
+	w.write(total, 36)
+
+	if e.closed {
+		// MD5 of the unencoded samples; all zeros means unknown
+		w.bytes = append(w.bytes, e.md5.Sum(nil)...)
+	} else {
+		w.bytes = append(w.bytes, make([]byte, md5.Size)...)
+	}
+	return w.bytes
+}
+
+// encodeBlock encodes the pending samples as one frame
+func (e *FLACEncoder) encodeBlock() error {
+	channels := e.format.Channels
+	blockSize := len(e.pending) / channels
+
+	var w bitWriter
+
+	// Frame header
+	w.write(0x3ffe, 14) // sync code
+	w.write(0, 1)       // reserved
+	w.write(0, 1)       // fixed block size stream
+	if blockSize == flacBlockSize {
+		w.write(12, 4) // 256 * 2^(12-8) = 4096
+	} else {
+		w.write(7, 4) // 16-bit block size - 1 after the header
+	}
+	w.write(0, 4) // sample rate from STREAMINFO
+	w.write(uint64(channels-1), 4)
+	w.write(4, 3) // 16 bits per sample
+	w.write(0, 1) // reserved
+	w.writeUTF8(e.frame)
+	if blockSize != flacBlockSize {
+		w.write(uint64(blockSize-1), 16)
+	}
+	w.write(uint64(crc8(w.bytes)), 8)
+
+	samples := make([]int32, blockSize)
+	for ch := range channels {
+		for i := range samples {
+			samples[i] = int32(e.pending[i*channels+ch])
+		}
+		writeSubframe(&w, samples)
+	}
+
+	w.align()
+	frame := binary.BigEndian.AppendUint16(w.bytes, crc16(w.bytes))
+
+	if _, err := e.out.Write(frame); err != nil {
+		return err
+	}
+
+	if e.minFrame == 0 || len(frame) < e.minFrame {
+		e.minFrame = len(frame)
+	}
+	e.maxFrame = max(e.maxFrame, len(frame))
+	e.frame++
+	e.total += uint64(blockSize)
+	e.pending = e.pending[:0]
+	return nil
+}
+
+// writeSubframe writes one channel of a frame using whichever encoding is
+// smallest
+func writeSubframe(w *bitWriter, samples []int32) {
+	constant := true
+	for _, s := range samples[1:] {
+		if s != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		w.write(0, 8) // padding bit, type CONSTANT, no wasted bits
+		w.writeSigned(samples[0], 16)
+		return
+	}
+
+	verbatimBits := 16 * len(samples)
+
+	bestOrder := -1
+	bestBits := verbatimBits
+	var bestResidual []int32
+	var bestPartitions []int
+	bestPartitionOrder := 0
+
+	for order := 0; order <= flacMaxOrder && order < len(samples); order++ {
+		residual := fixedResidual(samples, order)
+		partitionOrder, params, size := riceParameters(residual, len(samples), order)
+		size += 16 * order // warm-up samples
+		if size < bestBits {
+			bestOrder, bestBits = order, size
+			bestResidual, bestPartitions, bestPartitionOrder = residual, params, partitionOrder
+		}
+	}
+
+	if bestOrder < 0 {
+		w.write(0x02, 8) // padding bit, type VERBATIM, no wasted bits
+		for _, s := range samples {
+			w.writeSigned(s, 16)
+		}
+		return
+	}
+
+	// Padding bit, type FIXED with the predictor order, no wasted bits
+	w.write(uint64(0x08|bestOrder)<<1, 8)
+	for _, s := range samples[:bestOrder] {
+		w.writeSigned(s, 16)
+	}
+
+	// Rice-coded residual with 4-bit parameters
+	w.write(0, 2)
+	w.write(uint64(bestPartitionOrder), 4)
+	partitionSize := len(samples) >> bestPartitionOrder
+	start := 0
+	for p, param := range bestPartitions {
+		end := (p + 1) * partitionSize
+		end -= bestOrder
+		w.write(uint64(param), 4)
+		for _, r := range bestResidual[start:end] {
+			w.writeRice(zigzag(r), param)
+		}
+		start = end
+	}
+}
+
+// fixedResidual returns the prediction error of a fixed predictor for each
+// sample after the first order samples
+func fixedResidual(s []int32, order int) []int32 {
+	residual := make([]int32, 0, len(s)-order)
+	for i := order; i < len(s); i++ {
+		var r int32
+		switch order {
+		case 0:
+			r = s[i]
+		case 1:
+			r = s[i] - s[i-1]
+		case 2:
+			r = s[i] - 2*s[i-1] + s[i-2]
+		case 3:
+			r = s[i] - 3*s[i-1] + 3*s[i-2] - s[i-3]
+		case 4:
+			r = s[i] - 4*s[i-1] + 6*s[i-2] - 4*s[i-3] + s[i-4]
+		}
+		residual = append(residual, r)
+	}
+	return residual
+}
+
+// riceParameters picks the partition order and per-partition Rice
+// parameters that code the residual in the fewest bits, and returns that
+// size including the residual header
+func riceParameters(residual []int32, blockSize, order int) (partitionOrder int, params []int, size int) {
+	size = -1
+	for po := 0; po <= flacMaxPartitionOrder; po++ {
+		partitionSize := blockSize >> po
+		if blockSize%(1<<po) != 0 || partitionSize <= order {
+			break
+		}
+
+		total := 6 // coding method and partition order
+		var candidate []int
+		start := 0
+		for p := 0; p < 1<<po; p++ {
+			end := (p+1)*partitionSize - order
+			param, bits := bestRiceParameter(residual[start:end])
+			candidate = append(candidate, param)
+			total += 4 + bits
+			start = end
+		}
+
+		if size < 0 || total < size {
+			partitionOrder, params, size = po, candidate, total
+		}
+	}
+	return partitionOrder, params, size
+}
+
+// bestRiceParameter returns the Rice parameter coding values in the fewest
+// bits, and that number of bits
+func bestRiceParameter(residual []int32) (param, size int) {
+	var sum uint64
+	for _, r := range residual {
+		sum += uint64(zigzag(r))
+	}
+
+	// The optimum is near log2 of the mean; check either side of it
+	guess := 0
+	if n := uint64(len(residual)); n > 0 && sum > n {
+		guess = min(bits.Len64(sum/n)-1, flacMaxRiceParam)
+	}
+
+	size = -1
+	for k := max(guess-1, 0); k <= min(guess+1, flacMaxRiceParam); k++ {
+		total := len(residual) * (k + 1)
+		for _, r := range residual {
+			total += int(zigzag(r) >> k)
+		}
+		if size < 0 || total < size {
+			param, size = k, total
+		}
+	}
+	return param, size
+}
+
+func zigzag(v int32) uint32 {
+	return uint32(v<<1) ^ uint32(v>>31)
+}
+
+// bitWriter accumulates a big-endian bit stream
+type bitWriter struct {
+	bytes []byte
+	n     uint
+}
+
+// write appends the low n bits of v, n <= 56
+func (w *bitWriter) write(v uint64, n uint) {
+	for n > 0 {
+		take := min(n, 8-w.n%8)
+		if w.n%8 == 0 {
+			w.bytes = append(w.bytes, 0)
+		}
+		chunk := (v >> (n - take)) & (1<<take - 1)
+		w.bytes[len(w.bytes)-1] |= byte(chunk << (8 - w.n%8 - take))
+		w.n += take
+		n -= take
+	}
+}
+
+// writeSigned appends v in n-bit two's complement
+func (w *bitWriter) writeSigned(v int32, n uint) {
+	w.write(uint64(v)&(1<<n-1), n)
+}
+
+// writeRice appends v as a unary quotient and k-bit remainder
+func (w *bitWriter) writeRice(v uint32, k int) {
+	q := v >> k
+	for q >= 32 {
+		w.write(0, 32)
+		q -= 32
+	}
+	w.write(1, uint(q)+1)
+	if k > 0 {
+		w.write(uint64(v)&(1<<k-1), uint(k))
+	}
+}
+
+// writeUTF8 appends v in the extended UTF-8 coding used for frame numbers
+func (w *bitWriter) writeUTF8(v uint64) {
+	if v < 0x80 {
+		w.write(v, 8)
+		return
+	}
+
+	// Number of continuation bytes, each carrying 6 bits
+	n := 1
+	for v >= 1<<(5*n+6) && n < 6 {
+		n++
+	}
+	lead := uint64(0xff<<(7-n)) & 0xff
+	w.write(lead|v>>(6*n), 8)
+	for i := n - 1; i >= 0; i-- {
+		w.write(0x80|(v>>(6*i))&0x3f, 8)
+	}
+}
+
+// align pads with zero bits to a byte boundary
+func (w *bitWriter) align() {
+	w.n = uint(len(w.bytes)) * 8
+}
+
+// crc8 is the frame header checksum, polynomial x^8 + x^2 + x + 1
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for range 8 {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// crc16 is the frame checksum, polynomial x^16 + x^15 + x^2 + 1
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,189 @@
+package audio
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mewkiz/flac"
+)
+
+// flacSignals returns interleaved test signals of the given length that
+// exercise each subframe encoding
+func flacSignals(format Format, frames int) map[string][]int16 {
+	rng := rand.New(rand.NewPCG(1, 2))
+	signals := map[string][]int16{}
+	add := func(name string, sample func(i, ch int) float64) {
+		s := make([]int16, frames*format.Channels)
+		for i := range frames {
+			for ch := range format.Channels {
+				v := math.Round(sample(i, ch))
+				s[i*format.Channels+ch] = int16(max(math.MinInt16, min(math.MaxInt16, v)))
+			}
+		}
+		signals[name] = s
+	}
+
+	add("silence", func(int, int) float64 { return 0 })
+	add("dc", func(_, ch int) float64 { return float64(-1000 * (ch + 1)) })
+	add("sine", func(i, ch int) float64 {
+		return 12000 * math.Sin(2*math.Pi*float64(440*(ch+1))*float64(i)/float64(format.SampleRate))
+	})
+	add("noise", func(int, int) float64 { return rng.NormFloat64() * 8000 })
+	add("full scale noise", func(int, int) float64 { return float64(rng.IntN(1<<16) - 1<<15) })
+	add("square", func(i, _ int) float64 {
+		if i/37%2 == 0 {
+			return math.MaxInt16
+		}
+		return math.MinInt16
+	})
+	add("quiet speech", func(i, ch int) float64 {
+		t := float64(i) / float64(format.SampleRate)
+		envelope := 0.5 + 0.5*math.Sin(2*math.Pi*3*t)
+		return envelope * (300*math.Sin(2*math.Pi*150*t) + 120*math.Sin(2*math.Pi*450*t+float64(ch)) + rng.NormFloat64()*20)
+	})
+	return signals
+}
+
+// decodeFLAC decodes a FLAC stream with an independent decoder, checking
+// its header against what was encoded
+func decodeFLAC(t *testing.T, data []byte, format Format, frames int, complete bool) []int16 {
+	t.Helper()
+	stream, err := flac.New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse FLAC stream: %v", err)
+	}
+	defer stream.Close()
+
+	info := stream.Info
+	if int(info.SampleRate) != format.SampleRate || int(info.NChannels) != format.Channels || info.BitsPerSample != 16 {
+		t.Errorf("stream is %dHz/%dch %d bits, want %s 16 bits", info.SampleRate, info.NChannels, info.BitsPerSample, format)
+	}
+	if info.NSamples != uint64(frames) {
+		t.Errorf("stream declares %d samples, want %d", info.NSamples, frames)
+	}
+
+	var samples []int16
+	for {
+		frame, err := stream.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to decode frame after %d samples: %v", len(samples)/format.Channels, err)
+		}
+		if len(frame.Subframes) != format.Channels {
+			t.Fatalf("frame has %d subframes, want %d", len(frame.Subframes), format.Channels)
+		}
+		for i := range int(frame.BlockSize) {
+			for _, sub := range frame.Subframes {
+				samples = append(samples, int16(sub.Samples[i]))
+			}
+		}
+	}
+
+	if complete {
+		pcm := Int16ToBytes(samples)
+		if sum := md5.Sum(pcm); info.MD5sum != sum {
+			t.Errorf("stream MD5 %x, decoded audio's %x", info.MD5sum, sum)
+		}
+		if info.FrameSizeMin == 0 || info.FrameSizeMax < info.FrameSizeMin {
+			t.Errorf("frame sizes %d to %d", info.FrameSizeMin, info.FrameSizeMax)
+		}
+	}
+	return samples
+}
+
+func compareSamples(t *testing.T, got, want []int16) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sample %d decoded as %d, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFLACRoundTrip(t *testing.T) {
+	for _, format := range []Format{{16000, 1}, {8000, 1}, {48000, 2}, {44100, 3}} {
+		// Whole blocks, a short final block and a single frame
+		for _, frames := range []int{2 * flacBlockSize, 3*flacBlockSize + 1234, 1} {
+			for name, signal := range flacSignals(format, frames) {
+				t.Run(format.String()+"/"+name, func(t *testing.T) {
+					path := filepath.Join(t.TempDir(), "audio.flac")
+					file, err := os.Create(path)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer file.Close()
+
+					encoder, err := NewFLACEncoder(file, format)
+					if err != nil {
+						t.Fatal(err)
+					}
+					// Written in pieces that don't line up with blocks or frames
+					pcm := Int16ToBytes(signal)
+					for len(pcm) > 0 {
+						n := min(len(pcm), 1001*2)
+						if _, err := encoder.Write(pcm[:n]); err != nil {
+							t.Fatal(err)
+						}
+						pcm = pcm[n:]
+					}
+					if err := encoder.Close(); err != nil {
+						t.Fatal(err)
+					}
+
+					data, err := os.ReadFile(path)
+					if err != nil {
+						t.Fatal(err)
+					}
+					compareSamples(t, decodeFLAC(t, data, format, frames, true), signal)
+				})
+			}
+		}
+	}
+}
+
+func TestFLACStreamRoundTrip(t *testing.T) {
+	format := Format{16000, 2}
+	frames := 5*flacBlockSize + 17
+	for name, signal := range flacSignals(format, frames) {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			encoder, err := NewFLACStreamEncoder(&out, format, uint64(frames))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := encoder.Write(Int16ToBytes(signal)); err != nil {
+				t.Fatal(err)
+			}
+			if err := encoder.Close(); err != nil {
+				t.Fatal(err)
+			}
+			compareSamples(t, decodeFLAC(t, out.Bytes(), format, frames, false), signal)
+		})
+	}
+}
+
+func TestFLACStreamFrameCount(t *testing.T) {
+	var out bytes.Buffer
+	encoder, err := NewFLACStreamEncoder(&out, Format{16000, 1}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Write(make([]byte, 99*2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err == nil {
+		t.Error("closed with fewer frames than declared")
+	}
+}
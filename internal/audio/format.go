@@ -0,0 +1,122 @@
+package audio
+
+import (
+	"fmt"
+	"time"
+)
+
+// Format describes interleaved 16-bit PCM audio
+type Format struct {
+	SampleRate int
+	Channels   int
+}
+
+var (
+	// FormatOpus is the decoded WebRTC Opus format
+	FormatOpus = Format{SampleRate: 48000, Channels: 2}
+
+	// FormatASR is the format expected by speech recognition services
+	FormatASR = Format{SampleRate: 16000, Channels: 1}
+)
+
+// BytesPerFrame returns the size of one sample across all channels
+func (f Format) BytesPerFrame() int {
+	return f.Channels * 2
+}
+
+// Duration returns the playback duration of n bytes of PCM in this format
+func (f Format) Duration(n int) time.Duration {
+	frames := n / f.BytesPerFrame()
+	return time.Duration(frames) * time.Second / time.Duration(f.SampleRate)
+}
+
+func (f Format) String() string {
+	return fmt.Sprintf("%dHz/%dch", f.SampleRate, f.Channels)
+}
+
+// Converter converts a 16-bit PCM stream from one format to another,
+// remixing channels and resampling as needed
+type Converter struct {
+	from      Format
+	to        Format
+	resampler *Resampler
+	// Bytes of a partial frame left over from the last chunk
+	pending []byte
+}
+
+// NewConverter creates a new format converter
+func NewConverter(from, to Format) (*Converter, error) {
+	if from.Channels <= 0 || to.Channels <= 0 {
+		return nil, fmt.Errorf("invalid channel count: %s -> %s", from, to)
+	}
+
+	c := &Converter{from: from, to: to}
+
+	if from.SampleRate != to.SampleRate {
+		// Resample after downmixing or before upmixing to do the least work
+		channels := from.Channels
+		if to.Channels < channels {
+			channels = to.Channels
+		}
+
+		r, err := NewResampler(from.SampleRate, to.SampleRate, channels)
+		if err != nil {
+			return nil, err
+		}
+		c.resampler = r
+	}
+
+	return c, nil
+}
+
+// Convert converts a chunk of PCM bytes. A partial frame at the end of the
+// chunk is kept and converted with the start of the next.
+func (c *Converter) Convert(pcm []byte) []byte {
+	if len(c.pending) > 0 {
+		pcm = append(c.pending, pcm...)
+	}
+	whole := len(pcm) - len(pcm)%c.from.BytesPerFrame()
+
+	var out []byte
+	if c.from == c.to {
+		out = append([]byte(nil), pcm[:whole]...)
+	} else {
+		out = Float32ToBytes(c.ConvertFloat(BytesToFloat32(pcm[:whole])))
+	}
+	c.pending = append(c.pending[:0], pcm[whole:]...)
+	return out
+}
+
+// ConvertFloat converts a chunk of interleaved float samples, which must
+// hold whole frames
+func (c *Converter) ConvertFloat(samples []float32) []float32 {
+	if c.to.Channels < c.from.Channels {
+		samples = Remix(samples, c.from.Channels, c.to.Channels)
+	}
+
+	if c.resampler != nil {
+		samples = c.resampler.Process(samples)
+	}
+
+	if c.to.Channels > c.from.Channels {
+		samples = Remix(samples, c.from.Channels, c.to.Channels)
+	}
+
+	return samples
+}
+
+// Flush returns any samples still buffered in the resampler. A partial
+// frame left over is dropped, as it never made up a sample.
+func (c *Converter) Flush() []byte {
+	c.pending = c.pending[:0]
+	if c.resampler == nil {
+		return nil
+	}
+
+	samples := c.resampler.Flush()
+	if c.to.Channels > c.from.Channels {
+		samples = Remix(samples, c.from.Channels, c.to.Channels)
+	}
+
+	return Float32ToBytes(samples)
+}
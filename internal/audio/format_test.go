@@ -0,0 +1,55 @@
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestConverterChunking(t *testing.T) {
+	left := sweep(48000, 3000, 0.5)
+	stereo := make([]float32, len(left)*2)
+	for i, s := range left {
+		stereo[i*2] = s
+		stereo[i*2+1] = s / 2
+	}
+	pcm := Float32ToBytes(stereo)
+
+	for _, to := range []Format{FormatASR, FormatOpus, {SampleRate: 48000, Channels: 1}} {
+		t.Run(fmt.Sprint(to), func(t *testing.T) {
+			whole, err := NewConverter(FormatOpus, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append(whole.Convert(pcm), whole.Flush()...)
+
+			// Chunks splitting frames, and even samples, still convert
+			// every frame
+			for _, size := range []int{1, 2, 3, 1001, 4095} {
+				chunked, _ := NewConverter(FormatOpus, to)
+				var got []byte
+				for i := 0; i < len(pcm); i += size {
+					got = append(got, chunked.Convert(pcm[i:min(i+size, len(pcm))])...)
+				}
+				got = append(got, chunked.Flush()...)
+				if !bytes.Equal(got, want) {
+					t.Fatalf("in chunks of %d bytes converted to %d bytes, want %d the same as whole", size, len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestConverterFlushDropsPartialFrame(t *testing.T) {
+	c, err := NewConverter(FormatASR, FormatASR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := c.Convert([]byte{1, 2, 3}); !bytes.Equal(out, []byte{1, 2}) {
+		t.Errorf("converted %v, want the whole sample", out)
+	}
+	c.Flush()
+	if out := c.Convert([]byte{4, 5}); !bytes.Equal(out, []byte{4, 5}) {
+		t.Errorf("converted %v after a flush, want the new sample alone", out)
+	}
+}
@@ -0,0 +1,183 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+)
+
+const (
+	// Ogg page header flags
+	oggFirstPage = 0x02
+	oggLastPage  = 0x04
+
+	oggPageHeaderSize = 27
+	// Packets are grouped into pages of up to this many 48kHz samples,
+	// bounding how much audio an interrupted stream loses
+	oggPageSamples = 48000
+	// A page's segment table has at most 255 entries
+	oggMaxSegments = 255
+)
+
+// OggOpusWriter writes already-encoded Opus packets to an Ogg Opus stream
+// (RFC 7845) without re-encoding them. Granule positions are derived from
+// each packet's table of contents, so the stream's timeline is exactly the
+// sum of the packets written.
+type OggOpusWriter struct {
+	out    io.Writer
+	serial uint32
+	page   uint32
+
+	granule   uint64
+	pageStart uint64 // granule position at the start of the pending page
+	segments  []byte
+	data      []byte
+	closed    bool
+}
+
+// NewOggOpusWriter writes the Ogg Opus headers for a stream with the given
+// number of channels and returns a writer for its packets
+func NewOggOpusWriter(out io.Writer, channels int) (*OggOpusWriter, error) {
+	if channels < 1 || channels > 2 {
+		return nil, fmt.Errorf("Ogg Opus without a channel mapping supports 1 or 2 channels, not %d", channels)
+	}
+
+	w := &OggOpusWriter{out: out, serial: rand.Uint32()}
+
+	// Identification header. The packets are passed through rather than
+	// encoded here, so there is no encoder delay to skip.
+	head := []byte("OpusHead")
+	head = append(head, 1, byte(channels))
+	head = binary.LittleEndian.AppendUint16(head, 0)     // pre-skip
+	head = binary.LittleEndian.AppendUint32(head, 48000) // input sample rate
+	head = binary.LittleEndian.AppendUint16(head, 0)     // output gain
+	head = append(head, 0)                               // channel mapping family
+	w.addPacket(head)
+	if err := w.flush(oggFirstPage); err != nil {
+		return nil, err
+	}
+
+	// Comment header with the vendor string and no comments
+	vendor := "voice-gateway"
+	tags := []byte("OpusTags")
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(vendor)))
+	tags = append(tags, vendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0)
+	w.addPacket(tags)
+	if err := w.flush(0); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// WritePacket appends one Opus packet to the stream
+func (w *OggOpusWriter) WritePacket(packet []byte) error {
+	if w.closed {
+		return errors.New("Ogg Opus writer closed")
+	}
+
+	samples, err := OpusPacketSamples(packet)
+	if err != nil {
+		return err
+	}
+
+	// Start a new page if this packet would overflow the segment table, or
+	// the current page already holds enough audio
+	full := len(w.segments)+len(packet)/255+1 > oggMaxSegments
+	if len(w.segments) > 0 && (full || w.pageSamples() >= oggPageSamples) {
+		if err := w.flush(0); err != nil {
+			return err
+		}
+	}
+
+	w.addPacket(packet)
+	w.granule += uint64(samples)
+	return nil
+}
+
+// Granule returns the duration of the packets written so far in 48kHz
+// samples
+func (w *OggOpusWriter) Granule() uint64 {
+	return w.granule
+}
+
+// Close writes the final page, marking the end of the stream. It does not
+// close the underlying writer.
+func (w *OggOpusWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(oggLastPage)
+}
+
+// addPacket adds a packet to the pending page. Packets are laced into 255
+// byte segments, ending with a shorter one, zero-length if need be.
+func (w *OggOpusWriter) addPacket(packet []byte) {
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			w.segments = append(w.segments, byte(n))
+			break
+		}
+		w.segments = append(w.segments, 255)
+	}
+	w.data = append(w.data, packet...)
+}
+
+// pageSamples returns the duration of the packets on the pending page
+func (w *OggOpusWriter) pageSamples() uint64 {
+	return w.granule - w.pageStart
+}
+
+// flush writes the pending packets as one page
+func (w *OggOpusWriter) flush(flags byte) error {
+	page := make([]byte, oggPageHeaderSize, oggPageHeaderSize+len(w.segments)+len(w.data))
+	copy(page, "OggS")
+	page[4] = 0 // version
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], w.granule)
+	binary.LittleEndian.PutUint32(page[14:], w.serial)
+	binary.LittleEndian.PutUint32(page[18:], w.page)
+	page[26] = byte(len(w.segments))
+	page = append(page, w.segments...)
+	page = append(page, w.data...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	w.page++
+	w.pageStart = w.granule
+	w.segments = w.segments[:0]
+	w.data = w.data[:0]
+
+	_, err := w.out.Write(page)
+	return err
+}
+
+// oggCRCTable is for the CRC-32 of Ogg pages: polynomial 0x04c11db7,
+// unreflected, which hash/crc32 does not support
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for range 8 {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// oggCRC checksums a page whose checksum field is zero
+func oggCRC(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
@@ -0,0 +1,271 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+// oggPage is a parsed Ogg page
+type oggPage struct {
+	flags    byte
+	granule  uint64
+	serial   uint32
+	sequence uint32
+	// Packets completed on the page; the writer never splits a packet
+	// across pages
+	packets [][]byte
+}
+
+// parseOgg splits an Ogg stream into pages, checking each page's framing
+// and checksum
+func parseOgg(data []byte) ([]oggPage, error) {
+	var pages []oggPage
+	for len(data) > 0 {
+		if len(data) < oggPageHeaderSize || string(data[:4]) != "OggS" || data[4] != 0 {
+			return nil, fmt.Errorf("page %d: bad header", len(pages))
+		}
+		segments := int(data[26])
+		if len(data) < oggPageHeaderSize+segments {
+			return nil, fmt.Errorf("page %d: truncated segment table", len(pages))
+		}
+		table := data[oggPageHeaderSize : oggPageHeaderSize+segments]
+		size := oggPageHeaderSize + segments
+		for _, lace := range table {
+			size += int(lace)
+		}
+		if len(data) < size {
+			return nil, fmt.Errorf("page %d: truncated body", len(pages))
+		}
+
+		page := append([]byte(nil), data[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if got := oggCRC(page); got != crc {
+			return nil, fmt.Errorf("page %d: checksum %08x, computed %08x", len(pages), crc, got)
+		}
+
+		p := oggPage{
+			flags:    data[5],
+			granule:  binary.LittleEndian.Uint64(data[6:]),
+			serial:   binary.LittleEndian.Uint32(data[14:]),
+			sequence: binary.LittleEndian.Uint32(data[18:]),
+		}
+		body := data[oggPageHeaderSize+segments : size]
+		var packet []byte
+		for i, lace := range table {
+			packet = append(packet, body[:lace]...)
+			body = body[lace:]
+			if lace < 255 {
+				p.packets = append(p.packets, packet)
+				packet = nil
+			} else if i == len(table)-1 {
+				return nil, fmt.Errorf("page %d: packet continues on the next page", len(pages))
+			}
+		}
+		pages = append(pages, p)
+		data = data[size:]
+	}
+	return pages, nil
+}
+
+// opusPacket returns a packet with the given TOC byte and payload length.
+// Code 3 packets carry their frame count in the second byte.
+func opusPacket(rng *rand.Rand, toc byte, frames byte, size int) []byte {
+	packet := make([]byte, size)
+	for i := range packet {
+		packet[i] = byte(rng.Uint32())
+	}
+	packet[0] = toc
+	if toc&0x03 == 3 {
+		packet[1] = frames
+	}
+	return packet
+}
+
+func TestOggOpusRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+
+	// Packets of every mode, frame count and a range of sizes, including
+	// ones laced in whole 255-byte segments
+	kinds := []struct {
+		toc    byte
+		frames byte
+	}{
+		{0xf8, 0},     // CELT 20ms
+		{0x08, 0},     // SILK 20ms
+		{0x18, 0},     // SILK 60ms
+		{0x78, 0},     // hybrid 20ms
+		{0xe1, 0},     // CELT 2.5ms, two frames
+		{0x0b, 3},     // SILK 20ms, three frames
+		{0xfb, 6},     // CELT 20ms, six frames
+		{0x4a, 0},     // SILK 40ms, two frames
+		{0xf8 | 3, 1}, // CELT 20ms, one frame in code 3
+	}
+	sizes := []int{1, 2, 3, 60, 254, 255, 256, 510, 511, 1275, 2000}
+
+	var packets [][]byte
+	for i := range 400 {
+		kind := kinds[rng.IntN(len(kinds))]
+		size := sizes[rng.IntN(len(sizes))]
+		if kind.toc&0x03 == 3 {
+			size = max(size, 2)
+		}
+		packets = append(packets, opusPacket(rng, kind.toc, kind.frames, size))
+		// Runs of silence, as when filling gaps
+		if i%50 == 0 {
+			for range 60 {
+				packets = append(packets, OpusSilence)
+			}
+		}
+	}
+
+	for _, channels := range []int{1, 2} {
+		t.Run(fmt.Sprintf("%dch", channels), func(t *testing.T) {
+			var out bytes.Buffer
+			w, err := NewOggOpusWriter(&out, channels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var total uint64
+			for _, packet := range packets {
+				if err := w.WritePacket(packet); err != nil {
+					t.Fatal(err)
+				}
+				samples, _ := OpusPacketSamples(packet)
+				total += uint64(samples)
+				if w.Granule() != total {
+					t.Fatalf("granule %d after writing %d samples", w.Granule(), total)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.WritePacket(OpusSilence); err == nil {
+				t.Error("wrote a packet after closing")
+			}
+
+			pages, err := parseOgg(out.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pages) < 4 {
+				t.Fatalf("%d pages", len(pages))
+			}
+			checkOpusHeaders(t, pages, channels)
+
+			var got [][]byte
+			var granule uint64
+			for i, page := range pages {
+				if page.serial != pages[0].serial {
+					t.Errorf("page %d has serial %08x, want %08x", i, page.serial, pages[0].serial)
+				}
+				if page.sequence != uint32(i) {
+					t.Errorf("page %d has sequence number %d", i, page.sequence)
+				}
+				wantFlags := byte(0)
+				switch i {
+				case 0:
+					wantFlags = oggFirstPage
+				case len(pages) - 1:
+					wantFlags = oggLastPage
+				}
+				if page.flags != wantFlags {
+					t.Errorf("page %d has flags %#x, want %#x", i, page.flags, wantFlags)
+				}
+				if i < 2 {
+					continue
+				}
+
+				// A page's granule position is the end of its last packet
+				var samples uint64
+				for _, packet := range page.packets {
+					n, err := OpusPacketSamples(packet)
+					if err != nil {
+						t.Fatalf("page %d: %v", i, err)
+					}
+					samples += uint64(n)
+				}
+				granule += samples
+				if page.granule != granule {
+					t.Errorf("page %d has granule %d, want %d", i, page.granule, granule)
+				}
+				// Pages are cut after a second of audio, bounding how much
+				// a truncated file loses
+				if samples-lastPacketSamples(page) >= oggPageSamples {
+					t.Errorf("page %d holds %d samples", i, samples)
+				}
+				got = append(got, page.packets...)
+			}
+
+			if len(got) != len(packets) {
+				t.Fatalf("parsed %d packets, wrote %d", len(got), len(packets))
+			}
+			for i := range packets {
+				if !bytes.Equal(got[i], packets[i]) {
+					t.Fatalf("packet %d parsed as %d bytes, differing from the %d written", i, len(got[i]), len(packets[i]))
+				}
+			}
+			if granule != total {
+				t.Errorf("final granule %d, want %d", granule, total)
+			}
+		})
+	}
+}
+
+func lastPacketSamples(page oggPage) uint64 {
+	if len(page.packets) == 0 {
+		return 0
+	}
+	n, _ := OpusPacketSamples(page.packets[len(page.packets)-1])
+	return uint64(n)
+}
+
+// checkOpusHeaders checks the identification and comment header pages
+func checkOpusHeaders(t *testing.T, pages []oggPage, channels int) {
+	t.Helper()
+	for i, page := range pages[:2] {
+		if len(page.packets) != 1 || page.granule != 0 {
+			t.Fatalf("header page %d has %d packets and granule %d", i, len(page.packets), page.granule)
+		}
+	}
+
+	head := pages[0].packets[0]
+	if len(head) != 19 || string(head[:8]) != "OpusHead" || head[8] != 1 || int(head[9]) != channels {
+		t.Errorf("identification header %q", head)
+	} else if rate := binary.LittleEndian.Uint32(head[12:]); rate != 48000 || head[18] != 0 {
+		t.Errorf("identification header has rate %d and mapping family %d", rate, head[18])
+	}
+
+	tags := pages[1].packets[0]
+	if len(tags) < 16 || string(tags[:8]) != "OpusTags" {
+		t.Fatalf("comment header %q", tags)
+	}
+	vendor := int(binary.LittleEndian.Uint32(tags[8:]))
+	if len(tags) != 8+4+vendor+4 || binary.LittleEndian.Uint32(tags[12+vendor:]) != 0 {
+		t.Errorf("comment header %q", tags)
+	}
+}
+
+func TestOggOpusWriterErrors(t *testing.T) {
+	for _, channels := range []int{0, 3} {
+		if _, err := NewOggOpusWriter(&bytes.Buffer{}, channels); err == nil {
+			t.Errorf("created a writer for %d channels", channels)
+		}
+	}
+
+	w, err := NewOggOpusWriter(&bytes.Buffer{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range [][]byte{nil, {0x03}, {0xfb, 0x3f}} {
+		if err := w.WritePacket(packet); err == nil {
+			t.Errorf("wrote invalid packet %x", packet)
+		}
+	}
+	if w.Granule() != 0 {
+		t.Errorf("granule %d after invalid packets", w.Granule())
+	}
+}
@@ -0,0 +1,99 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pion/opus"
+)
+
+// Longest Opus packet is 120ms, i.e. 5760 samples per channel at 48kHz
+const maxOpusFrameSamples = 5760
+
+// OpusDecoder decodes Opus RTP payloads into 16-bit PCM. The decoder
+// resamples internally, so any format with a rate Opus supports (8, 12, 16,
+// 24 or 48kHz) and one or two channels can be requested.
+type OpusDecoder struct {
+	format  Format
+	decoder opus.Decoder
+	buffer  []int16
+}
+
+// NewOpusDecoder creates a decoder producing PCM in the given format
+func NewOpusDecoder(format Format) (*OpusDecoder, error) {
+	decoder, err := opus.NewDecoderWithOutput(format.SampleRate, format.Channels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Opus decoder for %s: %w", format, err)
+	}
+
+	return &OpusDecoder{
+		format:  format,
+		decoder: decoder,
+		buffer:  make([]int16, maxOpusFrameSamples*format.Channels),
+	}, nil
+}
+
+// Format returns the PCM format the decoder produces
+func (d *OpusDecoder) Format() Format {
+	return d.format
+}
+
+// Decode decodes one Opus packet into little-endian 16-bit PCM
+func (d *OpusDecoder) Decode(packet []byte) ([]byte, error) {
+	n, err := d.decoder.DecodeToInt16(packet, d.buffer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Opus packet: %w", err)
+	}
+
+	return Int16ToBytes(d.buffer[:n*d.format.Channels]), nil
+}
+
+// Frame durations in 48kHz samples of each group of Opus configurations,
+// indexed by the low two bits of the configuration (RFC 6716 section 3.1)
+var (
+	silkFrameSamples   = [4]int{480, 960, 1920, 2880}
+	hybridFrameSamples = [4]int{480, 960, 480, 960}
+	celtFrameSamples   = [4]int{120, 240, 480, 960}
+)
+
+// OpusSilence is a 20ms Opus packet with no audio data, which decoders
+// treat as discontinuous transmission
+var OpusSilence = []byte{0xf8}
+
+// OpusPacketSamples returns the duration of an Opus packet in samples at
+// 48kHz, from its table of contents
+func OpusPacketSamples(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, errors.New("empty Opus packet")
+	}
+
+	config := int(packet[0] >> 3)
+	var frameSamples int
+	switch {
+	case config < 12:
+		frameSamples = silkFrameSamples[config%4]
+	case config < 16:
+		frameSamples = hybridFrameSamples[config%4]
+	default:
+		frameSamples = celtFrameSamples[config%4]
+	}
+
+	var frames int
+	switch packet[0] & 0x03 {
+	case 0:
+		frames = 1
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, errors.New("truncated Opus packet")
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+
+	samples := frames * frameSamples
+	if samples == 0 || samples > maxOpusFrameSamples {
+		return 0, fmt.Errorf("invalid Opus packet duration of %d samples", samples)
+	}
+	return samples, nil
+}
@@ -0,0 +1,208 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// Number of sinc zero crossings on each side of the kernel centre
+	zeroCrossings = 16
+
+	// Kernel table resolution (entries per zero crossing)
+	tableResolution = 512
+
+	// Kaiser window shape; 8.6 gives roughly 80 dB stopband attenuation
+	kaiserBeta = 8.6
+
+	// Passband edge as a fraction of the lower Nyquist frequency
+	rolloff = 0.94
+)
+
+// Resampler converts interleaved audio between arbitrary sample rates using
+// a Kaiser-windowed sinc filter. It keeps filter history between calls, so a
+// stream can be fed in chunks of any size without boundary artifacts.
+type Resampler struct {
+	inRate   int
+	outRate  int
+	channels int
+
+	cutoff  float64
+	halfLen int
+	table   []float64
+
+	// Per-channel input history; history[c][0] is the oldest retained sample
+	history [][]float64
+
+	// Position of the next output sample, in units of 1/outRate input samples,
+	// relative to history[c][0]
+	pos int64
+}
+
+// NewResampler creates a streaming resampler for interleaved audio
+func NewResampler(inRate, outRate, channels int) (*Resampler, error) {
+	if inRate <= 0 || outRate <= 0 {
+		return nil, fmt.Errorf("invalid sample rates: %d -> %d", inRate, outRate)
+	}
+	if channels <= 0 {
+		return nil, fmt.Errorf("invalid channel count: %d", channels)
+	}
+
+	// Low-pass below the lower of the two Nyquist frequencies
+	cutoff := rolloff
+	if outRate < inRate {
+		cutoff = rolloff * float64(outRate) / float64(inRate)
+	}
+
+	r := &Resampler{
+		inRate:   inRate,
+		outRate:  outRate,
+		channels: channels,
+		cutoff:   cutoff,
+		halfLen:  int(math.Ceil(zeroCrossings / cutoff)),
+		table:    buildKernelTable(),
+	}
+	r.Reset()
+
+	return r, nil
+}
+
+// Reset clears the filter history
+func (r *Resampler) Reset() {
+	r.history = make([][]float64, r.channels)
+	for c := range r.history {
+		// Prime with silence so the first output sample is centred on input 0
+		r.history[c] = make([]float64, r.halfLen, r.halfLen*4)
+	}
+	r.pos = int64(r.halfLen) * int64(r.outRate)
+}
+
+// Latency returns the filter delay in input samples
+func (r *Resampler) Latency() int {
+	return r.halfLen
+}
+
+// Process resamples a chunk of interleaved samples and returns whatever
+// output is ready. Samples near the end of the chunk are held back until
+// enough look-ahead arrives or Flush is called.
+func (r *Resampler) Process(in []float32) []float32 {
+	frames := len(in) / r.channels
+	for c := 0; c < r.channels; c++ {
+		for f := 0; f < frames; f++ {
+			r.history[c] = append(r.history[c], float64(in[f*r.channels+c]))
+		}
+	}
+
+	return r.drain()
+}
+
+// ProcessInt16 resamples 16-bit samples
+func (r *Resampler) ProcessInt16(in []int16) []int16 {
+	return Float32ToInt16(r.Process(Int16ToFloat32(in)))
+}
+
+// Flush pushes silence through the filter and returns the remaining output
+func (r *Resampler) Flush() []float32 {
+	for c := 0; c < r.channels; c++ {
+		r.history[c] = append(r.history[c], make([]float64, r.halfLen)...)
+	}
+
+	out := r.drain()
+	r.Reset()
+	return out
+}
+
+// drain produces every output sample whose kernel fits in the history and
+// discards input that no future output depends on
+func (r *Resampler) drain() []float32 {
+	available := int64(len(r.history[0]))
+	outRate := int64(r.outRate)
+	inRate := int64(r.inRate)
+
+	var out []float32
+	for {
+		base := r.pos / outRate
+		if base+int64(r.halfLen) >= available {
+			break
+		}
+		frac := float64(r.pos%outRate) / float64(outRate)
+
+		for c := 0; c < r.channels; c++ {
+			out = append(out, float32(r.interpolate(r.history[c], int(base), frac)))
+		}
+		r.pos += inRate
+	}
+
+	// Keep halfLen samples of history before the next output position
+	drop := int(r.pos/outRate) - r.halfLen + 1
+	if drop > 0 {
+		for c := range r.history {
+			n := copy(r.history[c], r.history[c][drop:])
+			r.history[c] = r.history[c][:n]
+		}
+		r.pos -= int64(drop) * outRate
+	}
+
+	return out
+}
+
+// interpolate evaluates the filter at base+frac
+func (r *Resampler) interpolate(x []float64, base int, frac float64) float64 {
+	var sum float64
+	for j := -r.halfLen + 1; j <= r.halfLen; j++ {
+		sum += x[base+j] * r.kernel(frac-float64(j))
+	}
+	return sum * r.cutoff
+}
+
+// kernel looks up the windowed sinc at an offset measured in input samples
+func (r *Resampler) kernel(offset float64) float64 {
+	u := math.Abs(offset*r.cutoff) * tableResolution
+	i := int(u)
+	if i >= len(r.table)-1 {
+		return 0
+	}
+	f := u - float64(i)
+	return r.table[i] + (r.table[i+1]-r.table[i])*f
+}
+
+// buildKernelTable samples the windowed sinc from 0 to zeroCrossings
+func buildKernelTable() []float64 {
+	n := zeroCrossings*tableResolution + 1
+	table := make([]float64, n+1)
+	norm := besselI0(kaiserBeta)
+
+	for i := 0; i < n; i++ {
+		x := float64(i) / tableResolution
+		t := x / zeroCrossings
+		window := besselI0(kaiserBeta*math.Sqrt(1-t*t)) / norm
+		table[i] = sinc(x) * window
+	}
+
+	return table
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// besselI0 computes the zeroth-order modified Bessel function of the first kind
+func besselI0(x float64) float64 {
+	sum := 1.0
+	term := 1.0
+	halfX := x / 2
+
+	for k := 1; k < 50; k++ {
+		term *= halfX / float64(k)
+		sq := term * term
+		sum += sq
+		if sq < sum*1e-12 {
+			break
+		}
+	}
+
+	return sum
+}
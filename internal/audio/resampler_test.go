@@ -0,0 +1,154 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// sweep returns an exponential sine sweep from 50 Hz to f1 lasting seconds,
+// sampled at rate, at amplitude 0.5
+func sweep(rate int, f1, seconds float64) []float32 {
+	const f0 = 50.0
+	k := math.Log(f1 / f0)
+	n := int(seconds * float64(rate))
+	out := make([]float32, n)
+	for i := range out {
+		t := float64(i) / float64(rate)
+		phase := 2 * math.Pi * f0 * seconds / k * (math.Exp(t/seconds*k) - 1)
+		out[i] = float32(0.5 * math.Sin(phase))
+	}
+	return out
+}
+
+// snr returns the signal to noise ratio in dB of got against want, over
+// the samples both have away from the edges, where the filter sees silence
+func snr(t *testing.T, got, want []float32, margin int) float64 {
+	t.Helper()
+	n := min(len(got), len(want)) - margin
+	if n <= margin {
+		t.Fatalf("too little output to compare: got %d samples, want %d", len(got), len(want))
+	}
+	var signal, noise float64
+	for i := margin; i < n; i++ {
+		d := float64(got[i]) - float64(want[i])
+		signal += float64(want[i]) * float64(want[i])
+		noise += d * d
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+func TestResamplerSweepSNR(t *testing.T) {
+	rates := []int{8000, 16000, 24000, 48000}
+	const seconds = 2.0
+	// The resampler measures about 100 dB; this leaves room for platform
+	// differences without letting a broken filter through
+	const minSNR = 70.0
+
+	for _, in := range rates {
+		for _, out := range rates {
+			if in == out {
+				continue
+			}
+			t.Run(fmt.Sprintf("%d-%d", in, out), func(t *testing.T) {
+				// Stay inside the passband of the lower rate
+				f1 := 0.8 * float64(min(in, out)) / 2
+
+				r, err := NewResampler(in, out, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := append(r.Process(sweep(in, f1, seconds)), r.Flush()...)
+				want := sweep(out, f1, seconds)
+
+				if diff := len(got) - len(want); diff < -1 || diff > 1 {
+					t.Errorf("got %d samples, want %d", len(got), len(want))
+				}
+				margin := out / 20 // 50ms
+				if db := snr(t, got, want, margin); db < minSNR {
+					t.Errorf("SNR %.1f dB, want at least %.0f dB", db, minSNR)
+				}
+			})
+		}
+	}
+}
+
+func TestResamplerChunking(t *testing.T) {
+	in := sweep(16000, 6000, 1)
+
+	whole, err := NewResampler(16000, 48000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(whole.Process(in), whole.Flush()...)
+
+	chunked, _ := NewResampler(16000, 48000, 1)
+	var got []float32
+	for i := 0; i < len(in); i += 37 {
+		got = append(got, chunked.Process(in[i:min(i+37, len(in))])...)
+	}
+	got = append(got, chunked.Flush()...)
+
+	if len(got) != len(want) {
+		t.Fatalf("chunked output has %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sample %d differs: %v chunked, %v whole", i, got[i], want[i])
+		}
+	}
+}
+
+func TestResamplerStereo(t *testing.T) {
+	left := sweep(48000, 3000, 1)
+	stereo := make([]float32, len(left)*2)
+	for i, s := range left {
+		stereo[i*2] = s
+		stereo[i*2+1] = -s
+	}
+
+	r, err := NewResampler(48000, 16000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := append(r.Process(stereo), r.Flush()...)
+	if len(out)%2 != 0 {
+		t.Fatalf("odd number of interleaved samples: %d", len(out))
+	}
+
+	want := sweep(16000, 3000, 1)
+	l, rt := make([]float32, len(out)/2), make([]float32, len(out)/2)
+	for i := range l {
+		l[i], rt[i] = out[i*2], -out[i*2+1]
+	}
+	for name, channel := range map[string][]float32{"left": l, "right": rt} {
+		if db := snr(t, channel, want, 800); db < 70 {
+			t.Errorf("%s channel SNR %.1f dB, want at least 70 dB", name, db)
+		}
+	}
+}
+
+func TestInt16RoundTrip(t *testing.T) {
+	samples := []int16{0, 1, -1, 12345, -12345, math.MaxInt16, math.MinInt16}
+	if got := BytesToInt16(Int16ToBytes(samples)); fmt.Sprint(got) != fmt.Sprint(samples) {
+		t.Errorf("bytes round trip gave %v, want %v", got, samples)
+	}
+	if got := Float32ToInt16(Int16ToFloat32(samples)); fmt.Sprint(got) != fmt.Sprint(samples) {
+		t.Errorf("float round trip gave %v, want %v", got, samples)
+	}
+	if got := Float32ToInt16([]float32{2, -2}); got[0] != math.MaxInt16 || got[1] != math.MinInt16 {
+		t.Errorf("out of range floats gave %v, want clipping", got)
+	}
+}
+
+func TestRemix(t *testing.T) {
+	if got := StereoToMono([]float32{1, 0, 0.5, 0.5}); fmt.Sprint(got) != "[0.5 0.5]" {
+		t.Errorf("StereoToMono gave %v", got)
+	}
+	if got := MonoToStereo([]float32{1, -1}); fmt.Sprint(got) != "[1 1 -1 -1]" {
+		t.Errorf("MonoToStereo gave %v", got)
+	}
+	if got := Remix([]float32{0.3, 0.6, 0.9}, 3, 2); fmt.Sprintf("%.2f", got) != "[0.60 0.60]" {
+		t.Errorf("Remix 3->2 gave %v", got)
+	}
+}
@@ -0,0 +1,105 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"voice-gateway/internal/config"
+)
+
+// Bus carries audio, transcripts, synthesized speech, control commands and
+// lifecycle events between the gateway and workers. Client implements it
+// on NATS JetStream, RedisBus on Redis Streams and MemoryBus in-process.
+type Bus interface {
+	// Publishes carry the trace in ctx (see WithTrace), or start a new one
+	PublishAudio(ctx context.Context, sessionID string, chunk *AudioChunk) error
+	PublishText(ctx context.Context, sessionID string, text []byte) error
+	PublishTTS(ctx context.Context, sessionID string, chunk *AudioChunk) error
+	PublishControl(ctx context.Context, event *Event) error
+	PublishEvent(ctx context.Context, event *Event) error
+
+	SubscribeAudio(sessionID string, handler Handler) (*Subscription, error)
+	SubscribeText(sessionID string, handler Handler) (*Subscription, error)
+	SubscribeTTS(sessionID string, handler Handler) (*Subscription, error)
+	SubscribeAudioGroup(group string, handler Handler) (*Subscription, error)
+	SubscribeTextGroup(group string, handler Handler) (*Subscription, error)
+	SubscribeTTSGroup(group string, handler Handler) (*Subscription, error)
+	SubscribeControl(sessionID string, handler Handler) (*Subscription, error)
+	SubscribeEvents(sessionID string, handler Handler) (*Subscription, error)
+
+	// Subscriptions returns the active subscriptions for a session
+	Subscriptions(sessionID string) []*Subscription
+	// CloseSession drains every subscription belonging to a session
+	CloseSession(sessionID string) error
+
+	Request(ctx context.Context, service, version, method string, req, resp interface{}) error
+	ServiceInfo(ctx context.Context, service, version string) (*ServiceInfo, error)
+	NewService(name, version string) *Service
+
+	Close()
+}
+
+// Bus backends selectable with BUS_BACKEND
+const (
+	BackendNATS   = "nats"
+	BackendRedis  = "redis"
+	BackendMemory = "memory"
+)
+
+// New creates the bus backend selected in the configuration
+func New(cfg *config.Config) (Bus, error) {
+	switch strings.ToLower(cfg.Bus.Backend) {
+	case "", BackendNATS:
+		return NewClient(cfg.NATS)
+	case BackendRedis:
+		return NewRedisBus(cfg.Redis, cfg.NATS)
+	case BackendMemory:
+		log.Println("Using in-memory bus: messages stay within this process")
+		return NewMemoryBus(cfg.NATS)
+	default:
+		return nil, fmt.Errorf("unknown bus backend %q", cfg.Bus.Backend)
+	}
+}
+
+// deliverInPlace runs handler on a message until it succeeds, fails
+// terminally or has been attempted maxDeliver times, waiting out the retry
+// backoff between attempts. Messages given up on are passed to deadLetter.
+// It returns false, leaving the message unsettled, if stop is closed during
+// a backoff. Used by backends without server-side redelivery.
+func deliverInPlace(kind, sessionID string, data []byte, trace Trace, handler Handler,
+	maxDeliver int, stop <-chan struct{}, deadLetter func(attempts int, cause error)) bool {
+	for attempt := 1; ; attempt++ {
+		m, err := decodeMessage(kind, sessionID, data)
+		if err != nil {
+			err = Terminate(fmt.Errorf("malformed %s message: %w", kind, err))
+		} else {
+			m.Attempt = attempt
+			m.Trace = trace
+			err = runHandler(handler, m)
+		}
+
+		if err == nil {
+			return true
+		}
+
+		if IsTerminal(err) || attempt >= maxDeliver {
+			log.Printf("Session %s: dead-lettering %s message after %d attempt(s): %v", sessionID, kind, attempt, err)
+			deadLetter(attempt, err)
+			return true
+		}
+
+		select {
+		case <-time.After(retryDelay(err, attempt)):
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// partitionedSubject returns <prefix>.<kind>.<partition>.<sessionID>
+func partitionedSubject(prefix, kind, sessionID string, partitions int) string {
+	return fmt.Sprintf("%s.%s.%d.%s", prefix, kind, partition(sessionID, partitions), sessionID)
+}
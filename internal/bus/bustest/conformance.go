@@ -0,0 +1,627 @@
+// Package bustest checks that a bus backend delivers messages with the
+// same semantics as the others, so handlers behave the same whichever
+// backend a deployment runs.
+package bustest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"voice-gateway/internal/bus"
+)
+
+// MaxDeliver is the delivery limit buses under test must be configured with
+const MaxDeliver = 3
+
+// How long a check waits for expected messages
+const waitTimeout = 10 * time.Second
+
+// Factory creates a bus whose subjects (and any server-side streams) use
+// the given prefix, so checks cannot see each other's messages
+type Factory func(prefix string) (bus.Bus, error)
+
+// Result is the outcome of one check
+type Result struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+type check struct {
+	name string
+	run  func(b bus.Bus) error
+}
+
+var checks = []check{
+	{"ordered delivery", checkOrdering},
+	{"held until subscribed", checkHeld},
+	{"session isolation", checkIsolation},
+	{"audio envelope", checkEnvelope},
+	{"retry on error", checkRetry},
+	{"retry on panic", checkPanic},
+	{"dead-letter after max deliver", checkMaxDeliver},
+	{"terminate skips retries", checkTerminate},
+	{"group ordering", checkGroupOrdering},
+	{"group outlives members", checkGroupDurable},
+	{"close session", checkCloseSession},
+	{"broadcast", checkBroadcast},
+	{"trace propagation", checkTrace},
+	{"request reply", checkRequest},
+}
+
+// Run runs every check against buses from factory, each on a fresh bus
+func Run(factory Factory) []Result {
+	run := time.Now().UnixNano()
+	results := make([]Result, 0, len(checks))
+
+	for i, c := range checks {
+		start := time.Now()
+
+		err := func() error {
+			b, err := factory(fmt.Sprintf("conform%dc%d", run, i))
+			if err != nil {
+				return fmt.Errorf("failed to create bus: %w", err)
+			}
+			defer b.Close()
+			return c.run(b)
+		}()
+
+		results = append(results, Result{Name: c.name, Err: err, Duration: time.Since(start)})
+	}
+
+	return results
+}
+
+// collector gathers handled messages for assertions
+type collector struct {
+	mu   sync.Mutex
+	msgs []*bus.Message
+	ch   chan struct{}
+}
+
+func newCollector() *collector {
+	return &collector{ch: make(chan struct{}, 1)}
+}
+
+func (c *collector) handle(m *bus.Message) error {
+	c.mu.Lock()
+	c.msgs = append(c.msgs, m)
+	c.mu.Unlock()
+
+	select {
+	case c.ch <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// wait blocks until n messages have been collected
+func (c *collector) wait(n int) ([]*bus.Message, error) {
+	deadline := time.After(waitTimeout)
+	for {
+		c.mu.Lock()
+		got := append([]*bus.Message(nil), c.msgs...)
+		c.mu.Unlock()
+
+		if len(got) >= n {
+			return got, nil
+		}
+
+		select {
+		case <-c.ch:
+		case <-deadline:
+			return got, fmt.Errorf("got %d of %d messages", len(got), n)
+		}
+	}
+}
+
+// settle waits briefly and returns everything collected, for checking
+// that nothing more arrives
+func (c *collector) settle(d time.Duration) []*bus.Message {
+	time.Sleep(d)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*bus.Message(nil), c.msgs...)
+}
+
+func publishTexts(b bus.Bus, sessionID string, from, to int) error {
+	for i := from; i < to; i++ {
+		if err := b.PublishText(context.Background(), sessionID, []byte(fmt.Sprint(i))); err != nil {
+			return fmt.Errorf("publish %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func expectSequence(msgs []*bus.Message, from, to int) error {
+	if len(msgs) != to-from {
+		return fmt.Errorf("got %d messages, want %d", len(msgs), to-from)
+	}
+	for i, m := range msgs {
+		if want := fmt.Sprint(from + i); string(m.Data) != want {
+			return fmt.Errorf("message %d is %q, want %q", i, m.Data, want)
+		}
+	}
+	return nil
+}
+
+func checkOrdering(b bus.Bus) error {
+	c := newCollector()
+	if _, err := b.SubscribeText("order", c.handle); err != nil {
+		return err
+	}
+	if err := publishTexts(b, "order", 0, 100); err != nil {
+		return err
+	}
+
+	msgs, err := c.wait(100)
+	if err != nil {
+		return err
+	}
+	return expectSequence(msgs, 0, 100)
+}
+
+func checkHeld(b bus.Bus) error {
+	if err := publishTexts(b, "held", 0, 5); err != nil {
+		return err
+	}
+
+	c := newCollector()
+	if _, err := b.SubscribeText("held", c.handle); err != nil {
+		return err
+	}
+
+	msgs, err := c.wait(5)
+	if err != nil {
+		return err
+	}
+	return expectSequence(msgs, 0, 5)
+}
+
+func checkIsolation(b bus.Bus) error {
+	c := newCollector()
+	if _, err := b.SubscribeText("mine", c.handle); err != nil {
+		return err
+	}
+	if err := publishTexts(b, "other", 0, 5); err != nil {
+		return err
+	}
+	if err := publishTexts(b, "mine", 0, 5); err != nil {
+		return err
+	}
+
+	if _, err := c.wait(5); err != nil {
+		return err
+	}
+	msgs := c.settle(200 * time.Millisecond)
+	for _, m := range msgs {
+		if m.SessionID != "mine" {
+			return fmt.Errorf("received message for session %q", m.SessionID)
+		}
+	}
+	return expectSequence(msgs, 0, 5)
+}
+
+func checkEnvelope(b bus.Bus) error {
+	capture := time.Now().Round(time.Microsecond)
+	sent := &bus.AudioChunk{
+		Codec:          bus.CodecPCM16,
+		SampleRate:     16000,
+		Channels:       1,
+		Sequence:       42,
+		MediaTimestamp: 840 * time.Millisecond,
+		CaptureTime:    capture,
+		VAD:            bus.VADSpeech | bus.VADSpeechStart,
+		Data:           []byte{1, 2, 3, 4},
+	}
+
+	c := newCollector()
+	if _, err := b.SubscribeAudio("envelope", c.handle); err != nil {
+		return err
+	}
+	if err := b.PublishAudio(context.Background(), "envelope", sent); err != nil {
+		return err
+	}
+
+	msgs, err := c.wait(1)
+	if err != nil {
+		return err
+	}
+
+	got := msgs[0].Audio
+	if got == nil {
+		return fmt.Errorf("message has no audio envelope")
+	}
+	if got.Codec != sent.Codec || got.SampleRate != sent.SampleRate || got.Channels != sent.Channels ||
+		got.Sequence != sent.Sequence || got.MediaTimestamp != sent.MediaTimestamp ||
+		!got.CaptureTime.Equal(sent.CaptureTime) || got.VAD != sent.VAD || string(got.Data) != string(sent.Data) {
+		return fmt.Errorf("envelope changed in transit: got %+v, want %+v", got, sent)
+	}
+	return nil
+}
+
+// attemptRecorder fails until a given attempt
+type attemptRecorder struct {
+	mu       sync.Mutex
+	attempts []int
+	fail     func(attempt int) error
+	done     chan struct{}
+}
+
+func (r *attemptRecorder) handle(m *bus.Message) error {
+	r.mu.Lock()
+	r.attempts = append(r.attempts, m.Attempt)
+	r.mu.Unlock()
+
+	if err := r.fail(m.Attempt); err != nil {
+		return err
+	}
+	close(r.done)
+	return nil
+}
+
+func (r *attemptRecorder) recorded() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.attempts...)
+}
+
+func checkRetry(b bus.Bus) error {
+	r := &attemptRecorder{
+		done: make(chan struct{}),
+		fail: func(attempt int) error {
+			if attempt < 3 {
+				return errors.New("transient failure")
+			}
+			return nil
+		},
+	}
+
+	if _, err := b.SubscribeText("retry", r.handle); err != nil {
+		return err
+	}
+	if err := publishTexts(b, "retry", 0, 1); err != nil {
+		return err
+	}
+
+	select {
+	case <-r.done:
+	case <-time.After(waitTimeout):
+		return fmt.Errorf("not redelivered: attempts %v", r.recorded())
+	}
+
+	if got := r.recorded(); fmt.Sprint(got) != "[1 2 3]" {
+		return fmt.Errorf("attempts %v, want [1 2 3]", got)
+	}
+	return nil
+}
+
+func checkPanic(b bus.Bus) error {
+	done := make(chan struct{})
+	var once sync.Once
+
+	_, err := b.SubscribeText("panic", func(m *bus.Message) error {
+		if m.Attempt == 1 {
+			panic("handler bug")
+		}
+		once.Do(func() { close(done) })
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := publishTexts(b, "panic", 0, 1); err != nil {
+		return err
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(waitTimeout):
+		return fmt.Errorf("message not redelivered after panic")
+	}
+}
+
+func checkMaxDeliver(b bus.Bus) error {
+	c := newCollector()
+	_, err := b.SubscribeText("exhaust", func(m *bus.Message) error {
+		c.handle(m)
+		return errors.New("permanent failure")
+	})
+	if err != nil {
+		return err
+	}
+	if err := publishTexts(b, "exhaust", 0, 1); err != nil {
+		return err
+	}
+
+	if _, err := c.wait(MaxDeliver); err != nil {
+		return err
+	}
+	if got := c.settle(2 * time.Second); len(got) != MaxDeliver {
+		return fmt.Errorf("delivered %d times, want %d", len(got), MaxDeliver)
+	}
+	return nil
+}
+
+func checkTerminate(b bus.Bus) error {
+	c := newCollector()
+	_, err := b.SubscribeText("terminate", func(m *bus.Message) error {
+		c.handle(m)
+		return bus.Terminate(errors.New("malformed"))
+	})
+	if err != nil {
+		return err
+	}
+	if err := publishTexts(b, "terminate", 0, 2); err != nil {
+		return err
+	}
+
+	// The next message must still be delivered
+	if _, err := c.wait(2); err != nil {
+		return err
+	}
+	if got := c.settle(time.Second); len(got) != 2 {
+		return fmt.Errorf("delivered %d times, want 2", len(got))
+	}
+	return nil
+}
+
+func checkGroupOrdering(b bus.Bus) error {
+	const sessions, perSession = 10, 20
+
+	c := newCollector()
+	for i := 0; i < 2; i++ {
+		if _, err := b.SubscribeTextGroup("workers", c.handle); err != nil {
+			return err
+		}
+	}
+
+	for n := 0; n < perSession; n++ {
+		for s := 0; s < sessions; s++ {
+			if err := publishTexts(b, fmt.Sprintf("group-%d", s), n, n+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := c.wait(sessions * perSession); err != nil {
+		return err
+	}
+	msgs := c.settle(200 * time.Millisecond)
+
+	bySession := make(map[string][]*bus.Message)
+	for _, m := range msgs {
+		bySession[m.SessionID] = append(bySession[m.SessionID], m)
+	}
+	if len(bySession) != sessions {
+		return fmt.Errorf("got messages for %d sessions, want %d", len(bySession), sessions)
+	}
+
+	ids := make([]string, 0, len(bySession))
+	for id := range bySession {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if err := expectSequence(bySession[id], 0, perSession); err != nil {
+			return fmt.Errorf("session %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func checkGroupDurable(b bus.Bus) error {
+	first := newCollector()
+	sub, err := b.SubscribeTextGroup("durable", first.handle)
+	if err != nil {
+		return err
+	}
+	if err := publishTexts(b, "durable", 0, 3); err != nil {
+		return err
+	}
+	if _, err := first.wait(3); err != nil {
+		return err
+	}
+	if err := sub.Drain(); err != nil {
+		return err
+	}
+
+	// Published while the group has no members
+	if err := publishTexts(b, "durable", 3, 6); err != nil {
+		return err
+	}
+
+	second := newCollector()
+	if _, err := b.SubscribeTextGroup("durable", second.handle); err != nil {
+		return err
+	}
+
+	msgs, err := second.wait(3)
+	if err != nil {
+		return err
+	}
+	return expectSequence(msgs, 3, 6)
+}
+
+func checkCloseSession(b bus.Bus) error {
+	c := newCollector()
+	if _, err := b.SubscribeText("closing", c.handle); err != nil {
+		return err
+	}
+	if _, err := b.SubscribeControl("closing", c.handle); err != nil {
+		return err
+	}
+
+	if n := len(b.Subscriptions("closing")); n != 2 {
+		return fmt.Errorf("%d subscriptions tracked, want 2", n)
+	}
+	if err := b.CloseSession("closing"); err != nil {
+		return err
+	}
+	if n := len(b.Subscriptions("closing")); n != 0 {
+		return fmt.Errorf("%d subscriptions left after close", n)
+	}
+
+	// Work-queue messages published after closing wait for a new subscriber
+	if err := publishTexts(b, "closing", 0, 2); err != nil {
+		return err
+	}
+	if got := c.settle(200 * time.Millisecond); len(got) != 0 {
+		return fmt.Errorf("closed subscription received %d messages", len(got))
+	}
+
+	next := newCollector()
+	if _, err := b.SubscribeText("closing", next.handle); err != nil {
+		return err
+	}
+	msgs, err := next.wait(2)
+	if err != nil {
+		return err
+	}
+	return expectSequence(msgs, 0, 2)
+}
+
+func checkBroadcast(b bus.Bus) error {
+	ctx := context.Background()
+
+	all := newCollector()
+	if _, err := b.SubscribeEvents("", all.handle); err != nil {
+		return err
+	}
+	first := newCollector()
+	if _, err := b.SubscribeEvents("bcast", first.handle); err != nil {
+		return err
+	}
+	second := newCollector()
+	if _, err := b.SubscribeEvents("bcast", second.handle); err != nil {
+		return err
+	}
+
+	if err := b.PublishEvent(ctx, bus.NewEvent(bus.EventSessionStarted, "bcast")); err != nil {
+		return err
+	}
+	if err := b.PublishEvent(ctx, bus.NewEvent(bus.EventSessionStarted, "elsewhere")); err != nil {
+		return err
+	}
+
+	for name, c := range map[string]*collector{"first": first, "second": second} {
+		msgs, err := c.wait(1)
+		if err != nil {
+			return fmt.Errorf("%s subscriber: %w", name, err)
+		}
+		if msgs[0].Event == nil || msgs[0].Event.Type != bus.EventSessionStarted {
+			return fmt.Errorf("%s subscriber got %+v", name, msgs[0].Event)
+		}
+	}
+	if _, err := all.wait(2); err != nil {
+		return fmt.Errorf("all-session subscriber: %w", err)
+	}
+
+	// A late per-session subscriber sees the history
+	late := newCollector()
+	if _, err := b.SubscribeEvents("bcast", late.handle); err != nil {
+		return err
+	}
+	if _, err := late.wait(1); err != nil {
+		return fmt.Errorf("late subscriber: %w", err)
+	}
+
+	// A late all-session subscriber does not
+	lateAll := newCollector()
+	if _, err := b.SubscribeEvents("", lateAll.handle); err != nil {
+		return err
+	}
+	if got := lateAll.settle(200 * time.Millisecond); len(got) != 0 {
+		return fmt.Errorf("late all-session subscriber replayed %d events", len(got))
+	}
+	return nil
+}
+
+func checkTrace(b bus.Bus) error {
+	trace := bus.NewTrace("turn-1")
+
+	c := newCollector()
+	_, err := b.SubscribeAudio("trace", func(m *bus.Message) error {
+		return b.PublishText(m.Context(), m.SessionID, []byte("transcript"))
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := b.SubscribeText("trace", c.handle); err != nil {
+		return err
+	}
+
+	chunk := &bus.AudioChunk{Codec: bus.CodecPCM16, SampleRate: 16000, Channels: 1}
+	if err := b.PublishAudio(bus.WithTrace(context.Background(), trace), "trace", chunk); err != nil {
+		return err
+	}
+
+	msgs, err := c.wait(1)
+	if err != nil {
+		return err
+	}
+
+	got := msgs[0].Trace
+	if got.TraceID != trace.TraceID || got.TurnID != trace.TurnID || !got.OriginAt.Equal(trace.OriginAt) {
+		return fmt.Errorf("trace changed across hops: got %+v, want %+v", got, trace)
+	}
+	if got.ProducedAt.Before(trace.OriginAt) {
+		return fmt.Errorf("produced at %s before origin %s", got.ProducedAt, got.OriginAt)
+	}
+	return nil
+}
+
+func checkRequest(b bus.Bus) error {
+	ctx := context.Background()
+
+	svc := b.NewService("echo", "v1")
+	svc.Handle("echo", func(ctx context.Context, req json.RawMessage) (interface{}, error) {
+		var s string
+		if err := json.Unmarshal(req, &s); err != nil {
+			return nil, bus.NewRPCError(bus.CodeBadRequest, "%v", err)
+		}
+		return s, nil
+	})
+	svc.Handle("slow", func(ctx context.Context, req json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if err := svc.Start(); err != nil {
+		return err
+	}
+	defer svc.Stop()
+
+	var out string
+	if err := b.Request(ctx, "echo", "v1", "echo", "hello", &out); err != nil {
+		return fmt.Errorf("echo: %w", err)
+	}
+	if out != "hello" {
+		return fmt.Errorf("echo returned %q", out)
+	}
+
+	var rpcErr *bus.RPCError
+	err := b.Request(ctx, "echo", "v1", "echo", 42, nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != bus.CodeBadRequest {
+		return fmt.Errorf("bad request returned %v", err)
+	}
+
+	err = b.Request(ctx, "missing", "v1", "echo", nil, nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != bus.CodeUnimplemented {
+		return fmt.Errorf("missing service returned %v", err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	err = b.Request(short, "echo", "v1", "slow", nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("slow request returned %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package bustest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/nats-io/nats-server/v2/server"
+
+	"voice-gateway/internal/bus"
+	"voice-gateway/internal/config"
+)
+
+// busConfig returns the settings shared by every backend under test
+func busConfig(prefix string) config.NATSConfig {
+	c := config.Load().NATS
+	c.Subject = prefix + "."
+	c.DeadLetterSubject = ""
+	c.MaxDeliver = MaxDeliver
+	return c
+}
+
+// runChecks runs every check against buses from factory as subtests
+func runChecks(t *testing.T, factory Factory) {
+	for _, r := range Run(factory) {
+		t.Run(r.Name, func(t *testing.T) {
+			if r.Err != nil {
+				t.Errorf("failed after %v: %v", r.Duration.Round(time.Millisecond), r.Err)
+			}
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	runChecks(t, func(prefix string) (bus.Bus, error) {
+		return bus.NewMemoryBus(busConfig(prefix))
+	})
+}
+
+func TestRedis(t *testing.T) {
+	standin := miniredis.RunT(t)
+	rc := config.Load().Redis
+	rc.URL = "redis://" + standin.Addr()
+
+	runChecks(t, func(prefix string) (bus.Bus, error) {
+		return bus.NewRedisBus(rc, busConfig(prefix))
+	})
+}
+
+func TestNATS(t *testing.T) {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		s.Shutdown()
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(func() {
+		s.Shutdown()
+		s.WaitForShutdown()
+	})
+
+	runChecks(t, func(prefix string) (bus.Bus, error) {
+		c := busConfig(prefix)
+		c.URL = s.ClientURL()
+		c.StreamPrefix = strings.ToUpper(prefix) + "_"
+		for _, sc := range []*config.StreamConfig{&c.AudioStream, &c.TextStream, &c.TTSStream, &c.ControlStream, &c.DeadLetterStream} {
+			sc.Storage = "memory"
+		}
+		return bus.NewClient(c)
+	})
+}
@@ -0,0 +1,184 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	kindControl = "control"
+	kindEvents  = "events"
+)
+
+// EventType identifies a control command or lifecycle event
+type EventType string
+
+const (
+	// Lifecycle events, published on <prefix>.events.<sessionID>
+	EventSessionStarted EventType = "session_started"
+	EventSessionEnded   EventType = "session_ended"
+	EventStateChanged   EventType = "state_changed"
+	EventTurnComplete   EventType = "turn_complete"
+	EventBargeIn        EventType = "barge_in"
+	EventTranscript     EventType = "transcript"
+	EventToolCall       EventType = "tool_call"
+	EventError          EventType = "error"
+
+	// Commands, published on <prefix>.control.<sessionID>
+	EventCancelSynthesis EventType = "cancel_synthesis"
+	EventEndSession      EventType = "end_session"
+)
+
+// Event is a typed control or lifecycle message. Fields beyond Type,
+// SessionID and Timestamp are set as relevant to the type.
+type Event struct {
+	Type      EventType `json:"type"`
+	SessionID string    `json:"session_id"`
+	Timestamp time.Time `json:"timestamp"`
+	// Service that published the event, e.g. "gateway" or "tts-worker"
+	Source string `json:"source,omitempty"`
+	TurnID string `json:"turn_id,omitempty"`
+	// New session state for EventStateChanged
+	State  string `json:"state,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// What was said for EventTranscript: "user" for recognised caller
+	// speech, "assistant" for text sent to synthesis
+	Speaker string `json:"speaker,omitempty"`
+	Text    string `json:"text,omitempty"`
+	IsFinal bool   `json:"is_final,omitempty"`
+	// Timing of each word of Text, if the recogniser or synthesiser gives it
+	Words []Word `json:"words,omitempty"`
+
+	// The tool the assistant called for EventToolCall, with what and the
+	// outcome, or Error if it failed
+	Tool      string          `json:"tool,omitempty"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+}
+
+// Word is the timing of one word of a transcript, in seconds relative to
+// the event's Timestamp: negative for words spoken before it, as a final
+// recognition result usually is
+type Word struct {
+	Text       string  `json:"text"`
+	Start      float64 `json:"start"`
+	End        float64 `json:"end"`
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+// NewEvent creates an event stamped with the current time
+func NewEvent(eventType EventType, sessionID string) *Event {
+	return &Event{
+		Type:      eventType,
+		SessionID: sessionID,
+		Timestamp: time.Now(),
+	}
+}
+
+// PublishControl publishes a command for a session
+func (c *Client) PublishControl(ctx context.Context, event *Event) error {
+	return c.publishEvent(ctx, kindControl, event)
+}
+
+// PublishEvent publishes a lifecycle event for a session
+func (c *Client) PublishEvent(ctx context.Context, event *Event) error {
+	return c.publishEvent(ctx, kindEvents, event)
+}
+
+func (c *Client) publishEvent(ctx context.Context, kind string, event *Event) error {
+	if event.SessionID == "" {
+		return fmt.Errorf("event has no session ID")
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	return c.publish(ctx, kind, c.broadcastSubject(kind, event.SessionID), data,
+		traceHeader(outgoingTrace(ctx, event.TurnID), event.SessionID))
+}
+
+// SubscribeControl receives commands for a session, including any already
+// published. Pass an empty session ID to receive new commands for every
+// session. Unlike the audio, text and TTS streams, control and event
+// messages are broadcast: every subscriber gets every message.
+func (c *Client) SubscribeControl(sessionID string, handler Handler) (*Subscription, error) {
+	return c.subscribeBroadcast(kindControl, sessionID, handler)
+}
+
+// SubscribeEvents receives lifecycle events for a session, or for every
+// session if sessionID is empty
+func (c *Client) SubscribeEvents(sessionID string, handler Handler) (*Subscription, error) {
+	return c.subscribeBroadcast(kindEvents, sessionID, handler)
+}
+
+// subscribeBroadcast creates an ephemeral consumer on the CONTROL stream.
+// Per-session subscriptions replay the session's history so late joiners
+// see e.g. session_started; all-session subscriptions start from new
+// messages.
+func (c *Client) subscribeBroadcast(kind, sessionID string, handler Handler) (*Subscription, error) {
+	stream := c.streamName(kind)
+
+	cfg := jetstream.ConsumerConfig{
+		FilterSubject: c.broadcastSubject(kind, sessionID),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		MaxDeliver:    c.maxDeliver,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+	}
+	if sessionID == "" {
+		cfg.FilterSubject = c.broadcastSubject(kind, "*")
+		cfg.DeliverPolicy = jetstream.DeliverNewPolicy
+	}
+
+	nc := &natsConsumers{js: c.js, stream: stream}
+
+	// Core subscriptions only ever see new messages
+	if c.transports[kind] == TransportCore {
+		ns, err := c.subscribeCore(kind, cfg.FilterSubject, "", handler)
+		if err != nil {
+			return nil, err
+		}
+		nc.natsSubs = append(nc.natsSubs, ns)
+		return c.track(sessionID, nc.close), nil
+	}
+
+	cons, err := c.js.CreateOrUpdateConsumer(c.ctx, stream, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
+	}
+	nc.consumers = []string{cons.CachedInfo().Name}
+
+	cc, err := cons.Consume(c.dispatch(kind, handler))
+	if err != nil {
+		nc.deleteConsumers()
+		return nil, fmt.Errorf("failed to consume: %w", err)
+	}
+	nc.contexts = append(nc.contexts, cc)
+
+	return c.track(sessionID, nc.close), nil
+}
+
+// broadcastSubject returns <prefix>.<kind>.<sessionID>. Control and event
+// subjects are not partitioned since they are never load-balanced.
+func (c *Client) broadcastSubject(kind, sessionID string) string {
+	return fmt.Sprintf("%s.%s.%s", c.prefix, kind, sessionID)
+}
+
+// decodeEvent unmarshals a control or event payload
+func decodeEvent(data []byte) (*Event, error) {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	if event.Type == "" {
+		return nil, fmt.Errorf("event has no type")
+	}
+	return &event, nil
+}
@@ -0,0 +1,129 @@
+package bus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Audio envelope wire format (little-endian), followed by the payload:
+//
+//	0  magic "VA"
+//	2  version
+//	3  header length in bytes
+//	4  codec
+//	5  channels
+//	6  VAD flags
+//	7  reserved
+//	8  sample rate (uint32)
+//	12 sequence number (uint64)
+//	20 media timestamp in microseconds (int64)
+//	28 capture time in Unix nanoseconds (int64)
+//
+// Decoders skip header bytes beyond the fields they know, so fields can be
+// appended without bumping the version.
+const (
+	envelopeVersion    = 1
+	envelopeHeaderSize = 36
+)
+
+var envelopeMagic = [2]byte{'V', 'A'}
+
+// Codec identifies the encoding of an audio payload
+type Codec uint8
+
+const (
+	CodecPCM16 Codec = 1 // signed 16-bit little-endian PCM
+	CodecOpus  Codec = 2 // one Opus packet per envelope
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecPCM16:
+		return "pcm16"
+	case CodecOpus:
+		return "opus"
+	default:
+		return fmt.Sprintf("codec(%d)", uint8(c))
+	}
+}
+
+// VADFlags carries voice activity state for a chunk
+type VADFlags uint8
+
+const (
+	VADSpeech      VADFlags = 1 << iota // chunk contains speech
+	VADSpeechStart                      // first chunk of an utterance
+	VADSpeechEnd                        // last chunk of an utterance
+)
+
+// AudioChunk is a self-describing unit of audio on the bus
+type AudioChunk struct {
+	Codec      Codec
+	SampleRate int
+	Channels   int
+	Sequence   uint64
+	// Position of the first sample relative to the start of the stream
+	MediaTimestamp time.Duration
+	// Wall-clock time the audio was captured or produced
+	CaptureTime time.Time
+	VAD         VADFlags
+	Data        []byte
+}
+
+// Marshal encodes the chunk into the envelope wire format
+func (a *AudioChunk) Marshal() []byte {
+	buf := make([]byte, envelopeHeaderSize+len(a.Data))
+
+	buf[0] = envelopeMagic[0]
+	buf[1] = envelopeMagic[1]
+	buf[2] = envelopeVersion
+	buf[3] = envelopeHeaderSize
+	buf[4] = byte(a.Codec)
+	buf[5] = byte(a.Channels)
+	buf[6] = byte(a.VAD)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(a.SampleRate))
+	binary.LittleEndian.PutUint64(buf[12:], a.Sequence)
+	binary.LittleEndian.PutUint64(buf[20:], uint64(a.MediaTimestamp.Microseconds()))
+
+	var captured int64
+	if !a.CaptureTime.IsZero() {
+		captured = a.CaptureTime.UnixNano()
+	}
+	binary.LittleEndian.PutUint64(buf[28:], uint64(captured))
+
+	copy(buf[envelopeHeaderSize:], a.Data)
+	return buf
+}
+
+// UnmarshalAudioChunk decodes an envelope. The returned chunk's Data aliases
+// the input slice.
+func UnmarshalAudioChunk(data []byte) (*AudioChunk, error) {
+	if len(data) < 4 || data[0] != envelopeMagic[0] || data[1] != envelopeMagic[1] {
+		return nil, fmt.Errorf("not an audio envelope")
+	}
+	if data[2] != envelopeVersion {
+		return nil, fmt.Errorf("unsupported audio envelope version %d", data[2])
+	}
+
+	headerSize := int(data[3])
+	if headerSize < envelopeHeaderSize || len(data) < headerSize {
+		return nil, fmt.Errorf("truncated audio envelope header")
+	}
+
+	chunk := &AudioChunk{
+		Codec:          Codec(data[4]),
+		Channels:       int(data[5]),
+		VAD:            VADFlags(data[6]),
+		SampleRate:     int(binary.LittleEndian.Uint32(data[8:])),
+		Sequence:       binary.LittleEndian.Uint64(data[12:]),
+		MediaTimestamp: time.Duration(int64(binary.LittleEndian.Uint64(data[20:]))) * time.Microsecond,
+		Data:           data[headerSize:],
+	}
+
+	if captured := int64(binary.LittleEndian.Uint64(data[28:])); captured != 0 {
+		chunk.CaptureTime = time.Unix(0, captured)
+	}
+
+	return chunk, nil
+}
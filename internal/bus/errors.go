@@ -0,0 +1,83 @@
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// First redelivery delay for handlers that return a plain error;
+	// doubles on each attempt
+	baseRetryDelay = 500 * time.Millisecond
+
+	// Cap on the redelivery backoff
+	maxRetryDelay = 30 * time.Second
+)
+
+// Handler processes a message. Returning nil acknowledges it; returning an
+// error asks for redelivery with exponential backoff, unless the error was
+// built with Retry (explicit delay) or Terminate (no redelivery). Messages
+// that exhaust MaxDeliver attempts or are terminated are published to the
+// dead-letter subject.
+type Handler func(*Message) error
+
+// retryError requests redelivery after a specific delay
+type retryError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryError) Error() string { return e.err.Error() }
+func (e *retryError) Unwrap() error { return e.err }
+
+// Retry wraps err so the message is redelivered after delay
+func Retry(err error, delay time.Duration) error {
+	return &retryError{err: err, delay: delay}
+}
+
+// terminalError marks a message as poison
+type terminalError struct {
+	err error
+}
+
+func (e *terminalError) Error() string { return e.err.Error() }
+func (e *terminalError) Unwrap() error { return e.err }
+
+// Terminate wraps err so the message is never redelivered and goes
+// straight to the dead-letter subject
+func Terminate(err error) error {
+	return &terminalError{err: err}
+}
+
+// IsTerminal reports whether err was built with Terminate
+func IsTerminal(err error) bool {
+	var t *terminalError
+	return errors.As(err, &t)
+}
+
+// retryDelay returns the redelivery delay for a failed attempt (1-based)
+func retryDelay(err error, attempt int) time.Duration {
+	var r *retryError
+	if errors.As(err, &r) {
+		return r.delay
+	}
+
+	delay := baseRetryDelay
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// PanicError is returned in place of a handler panic
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.Value)
+}
@@ -0,0 +1,678 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"voice-gateway/internal/config"
+)
+
+const (
+	// Unconsumed work-queue messages kept per kind before the oldest are
+	// discarded
+	memMaxPending = 10000
+
+	// Dead letters kept for inspection
+	memMaxDeadLetters = 1000
+)
+
+// ErrBusClosed is returned when publishing on a closed MemoryBus
+var ErrBusClosed = errors.New("bus closed")
+
+// MemoryBus is an in-process Bus for tests and single-binary development.
+// It mirrors the NATS backend's delivery semantics:
+//
+//   - audio, text and TTS are work queues: each message goes to one
+//     matching subscriber, and is held until one appears
+//   - group subscriptions consume one partition at a time, so a session's
+//     messages are handled in order, and survive members leaving
+//   - control and events are broadcast, with per-session history replayed
+//     to per-session subscribers
+//   - handler errors are retried with the same backoff until MaxDeliver,
+//     then the message is dead-lettered
+//
+// Redelivery happens in place, so a retried message holds back the
+// messages behind it. Nothing is persisted.
+type MemoryBus struct {
+	prefix            string
+	deadLetterSubject string
+	partitions        int
+	maxDeliver        int
+	historyLimit      int
+
+	mu sync.Mutex
+	// Work-queue consumers: session subscriptions and group partitions
+	queues []*memQueue
+	groups map[string]*memGroup
+	// Work-queue messages no consumer has matched yet, by kind
+	pending map[string][]*memMsg
+	// Broadcast subscribers and retained broadcast messages by subject
+	watchers    []*memQueue
+	history     map[string][]*memMsg
+	deadLetters []DeadLetter
+	// RPC responders by subject, used round-robin
+	responders map[string][]*memResponder
+	rpcNext    map[string]int
+	closed     bool
+
+	*subscriptions
+}
+
+// DeadLetter is a message the memory bus gave up delivering
+type DeadLetter struct {
+	Subject  string
+	Data     []byte
+	Error    string
+	Attempts int
+	Time     time.Time
+}
+
+type memMsg struct {
+	subject string
+	data    []byte
+	trace   Trace
+}
+
+// memQueue is an ordered queue served by one goroutine, calling either a
+// single subscriber's handler or the members of a group in turn
+type memQueue struct {
+	kind    string
+	filter  string
+	handler Handler
+	group   *memGroup
+
+	msgs     []*memMsg
+	draining bool
+	stopped  bool
+	// Wakes the worker; guarded by MemoryBus.mu
+	cond *sync.Cond
+	// Closed on stop to interrupt retry backoff
+	quit chan struct{}
+	done chan struct{}
+}
+
+// memGroup is a durable worker group with one queue per partition
+type memGroup struct {
+	members []*memMember
+	next    int
+	queues  []*memQueue
+}
+
+type memMember struct {
+	handler Handler
+}
+
+type memResponder struct {
+	serve rpcServeFunc
+}
+
+// NewMemoryBus creates an in-memory bus using the subject prefix,
+// partitioning and delivery limits from cfg
+func NewMemoryBus(cfg config.NATSConfig) (*MemoryBus, error) {
+	if cfg.Partitions <= 0 {
+		return nil, fmt.Errorf("invalid partition count: %d", cfg.Partitions)
+	}
+	if cfg.MaxDeliver <= 0 {
+		return nil, fmt.Errorf("invalid max deliver: %d", cfg.MaxDeliver)
+	}
+
+	prefix := strings.TrimSuffix(cfg.Subject, ".")
+	if prefix == "" {
+		return nil, fmt.Errorf("subject prefix is required")
+	}
+
+	deadLetter := cfg.DeadLetterSubject
+	if deadLetter == "" {
+		deadLetter = prefix + ".dlq"
+	}
+
+	return &MemoryBus{
+		prefix:            prefix,
+		deadLetterSubject: deadLetter,
+		partitions:        cfg.Partitions,
+		maxDeliver:        cfg.MaxDeliver,
+		historyLimit:      int(cfg.ControlStream.MaxMsgsPerSubject),
+		groups:            make(map[string]*memGroup),
+		pending:           make(map[string][]*memMsg),
+		history:           make(map[string][]*memMsg),
+		responders:        make(map[string][]*memResponder),
+		rpcNext:           make(map[string]int),
+		subscriptions:     newSubscriptions(),
+	}, nil
+}
+
+// PublishAudio publishes an audio frame to the bus
+func (b *MemoryBus) PublishAudio(ctx context.Context, sessionID string, chunk *AudioChunk) error {
+	return b.publishWork(ctx, kindAudio, sessionID, chunk.Marshal())
+}
+
+// PublishText publishes a transcript to the bus
+func (b *MemoryBus) PublishText(ctx context.Context, sessionID string, text []byte) error {
+	return b.publishWork(ctx, kindText, sessionID, text)
+}
+
+// PublishTTS publishes synthesized audio to the bus
+func (b *MemoryBus) PublishTTS(ctx context.Context, sessionID string, chunk *AudioChunk) error {
+	return b.publishWork(ctx, kindTTS, sessionID, chunk.Marshal())
+}
+
+// PublishControl publishes a command for a session
+func (b *MemoryBus) PublishControl(ctx context.Context, event *Event) error {
+	return b.publishBroadcast(ctx, kindControl, event)
+}
+
+// PublishEvent publishes a lifecycle event for a session
+func (b *MemoryBus) PublishEvent(ctx context.Context, event *Event) error {
+	return b.publishBroadcast(ctx, kindEvents, event)
+}
+
+// publishWork hands a message to the first matching consumer, or holds it
+// until one subscribes
+func (b *MemoryBus) publishWork(ctx context.Context, kind, sessionID string, data []byte) error {
+	msg := &memMsg{
+		subject: partitionedSubject(b.prefix, kind, sessionID, b.partitions),
+		data:    append([]byte(nil), data...),
+		trace:   outgoingTrace(ctx, ""),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrBusClosed
+	}
+
+	for _, q := range b.queues {
+		if q.kind == kind && q.accepting() && subjectMatches(q.filter, msg.subject) {
+			q.push(msg)
+			return nil
+		}
+	}
+
+	pending := append(b.pending[kind], msg)
+	if len(pending) > memMaxPending {
+		log.Printf("Warning: in-memory %s queue full, discarding oldest message", kind)
+		pending = pending[1:]
+	}
+	b.pending[kind] = pending
+	return nil
+}
+
+// publishBroadcast delivers an event to every matching subscriber and
+// retains it for late per-session subscribers
+func (b *MemoryBus) publishBroadcast(ctx context.Context, kind string, event *Event) error {
+	if event.SessionID == "" {
+		return fmt.Errorf("event has no session ID")
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	msg := &memMsg{
+		subject: fmt.Sprintf("%s.%s.%s", b.prefix, kind, event.SessionID),
+		data:    data,
+		trace:   outgoingTrace(ctx, event.TurnID),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrBusClosed
+	}
+
+	history := append(b.history[msg.subject], msg)
+	if b.historyLimit > 0 && len(history) > b.historyLimit {
+		history = history[len(history)-b.historyLimit:]
+	}
+	b.history[msg.subject] = history
+
+	for _, q := range b.watchers {
+		if q.accepting() && subjectMatches(q.filter, msg.subject) {
+			q.push(msg)
+		}
+	}
+	return nil
+}
+
+// SubscribeAudio subscribes to audio frames for a session
+func (b *MemoryBus) SubscribeAudio(sessionID string, handler Handler) (*Subscription, error) {
+	return b.subscribeSession(kindAudio, sessionID, handler)
+}
+
+// SubscribeText subscribes to transcripts for a session
+func (b *MemoryBus) SubscribeText(sessionID string, handler Handler) (*Subscription, error) {
+	return b.subscribeSession(kindText, sessionID, handler)
+}
+
+// SubscribeTTS subscribes to synthesized audio for a session
+func (b *MemoryBus) SubscribeTTS(sessionID string, handler Handler) (*Subscription, error) {
+	return b.subscribeSession(kindTTS, sessionID, handler)
+}
+
+// SubscribeAudioGroup joins a named worker group that consumes audio for
+// every session
+func (b *MemoryBus) SubscribeAudioGroup(group string, handler Handler) (*Subscription, error) {
+	return b.subscribeGroup(kindAudio, group, handler)
+}
+
+// SubscribeTextGroup joins a named worker group that consumes transcripts
+// for every session
+func (b *MemoryBus) SubscribeTextGroup(group string, handler Handler) (*Subscription, error) {
+	return b.subscribeGroup(kindText, group, handler)
+}
+
+// SubscribeTTSGroup joins a named worker group that consumes synthesized
+// audio for every session
+func (b *MemoryBus) SubscribeTTSGroup(group string, handler Handler) (*Subscription, error) {
+	return b.subscribeGroup(kindTTS, group, handler)
+}
+
+// SubscribeControl receives commands for a session, including any already
+// published, or new commands for every session if sessionID is empty
+func (b *MemoryBus) SubscribeControl(sessionID string, handler Handler) (*Subscription, error) {
+	return b.subscribeBroadcast(kindControl, sessionID, handler)
+}
+
+// SubscribeEvents receives lifecycle events for a session, or for every
+// session if sessionID is empty
+func (b *MemoryBus) SubscribeEvents(sessionID string, handler Handler) (*Subscription, error) {
+	return b.subscribeBroadcast(kindEvents, sessionID, handler)
+}
+
+// subscribeSession consumes one session's messages of a kind. Messages
+// left unhandled when the subscription stops go back to the queue.
+func (b *MemoryBus) subscribeSession(kind, sessionID string, handler Handler) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+
+	q := b.newQueue(kind, partitionedSubject(b.prefix, kind, sessionID, b.partitions))
+	q.handler = handler
+	b.queues = append(b.queues, q)
+	b.adoptPending(q)
+	go b.work(q)
+
+	return b.track(sessionID, func(drain bool) error {
+		b.closeQueue(q, drain)
+		return nil
+	}), nil
+}
+
+// subscribeGroup adds a member to a durable group. The group's partition
+// queues keep collecting messages while it has no members.
+func (b *MemoryBus) subscribeGroup(kind, group string, handler Handler) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+
+	key := group + "-" + kind
+	g, ok := b.groups[key]
+	if !ok {
+		g = &memGroup{}
+		for p := 0; p < b.partitions; p++ {
+			q := b.newQueue(kind, fmt.Sprintf("%s.%s.%d.*", b.prefix, kind, p))
+			q.group = g
+			g.queues = append(g.queues, q)
+			b.queues = append(b.queues, q)
+			b.adoptPending(q)
+			go b.work(q)
+		}
+		b.groups[key] = g
+	}
+
+	member := &memMember{handler: handler}
+	g.members = append(g.members, member)
+	for _, q := range g.queues {
+		q.cond.Broadcast()
+	}
+
+	return b.track("", func(bool) error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, m := range g.members {
+			if m == member {
+				g.members = append(g.members[:i], g.members[i+1:]...)
+				break
+			}
+		}
+		return nil
+	}), nil
+}
+
+// subscribeBroadcast watches control or event subjects. Per-session
+// subscribers first receive the session's retained history.
+func (b *MemoryBus) subscribeBroadcast(kind, sessionID string, handler Handler) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+
+	filter := fmt.Sprintf("%s.%s.*", b.prefix, kind)
+	if sessionID != "" {
+		filter = fmt.Sprintf("%s.%s.%s", b.prefix, kind, sessionID)
+	}
+
+	q := b.newQueue(kind, filter)
+	q.handler = handler
+	if sessionID != "" {
+		q.msgs = append(q.msgs, b.history[filter]...)
+	}
+	b.watchers = append(b.watchers, q)
+	go b.work(q)
+
+	return b.track(sessionID, func(drain bool) error {
+		b.closeQueue(q, drain)
+		return nil
+	}), nil
+}
+
+func (b *MemoryBus) newQueue(kind, filter string) *memQueue {
+	return &memQueue{
+		kind:   kind,
+		filter: filter,
+		cond:   sync.NewCond(&b.mu),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// adoptPending moves held messages matching q into it, in publish order.
+// Called with b.mu held.
+func (b *MemoryBus) adoptPending(q *memQueue) {
+	var rest []*memMsg
+	for _, msg := range b.pending[q.kind] {
+		if subjectMatches(q.filter, msg.subject) {
+			q.msgs = append(q.msgs, msg)
+		} else {
+			rest = append(rest, msg)
+		}
+	}
+	b.pending[q.kind] = rest
+}
+
+// closeQueue stops routing to q. Draining waits for queued messages to be
+// handled, so it must not be called from q's own handler; stopping returns
+// immediately and requeues whatever is left.
+func (b *MemoryBus) closeQueue(q *memQueue, drain bool) {
+	b.mu.Lock()
+	b.removeQueue(q)
+	if drain {
+		q.draining = true
+	} else {
+		q.stop()
+	}
+	q.cond.Broadcast()
+	b.mu.Unlock()
+
+	if drain {
+		<-q.done
+	}
+}
+
+// removeQueue unlinks q from routing. Called with b.mu held.
+func (b *MemoryBus) removeQueue(q *memQueue) {
+	for i, other := range b.queues {
+		if other == q {
+			b.queues = append(b.queues[:i], b.queues[i+1:]...)
+			break
+		}
+	}
+	for i, other := range b.watchers {
+		if other == q {
+			b.watchers = append(b.watchers[:i], b.watchers[i+1:]...)
+			break
+		}
+	}
+}
+
+// work delivers q's messages one at a time until it is stopped or drained
+func (b *MemoryBus) work(q *memQueue) {
+	defer close(q.done)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		var handler Handler
+		for !q.stopped {
+			if len(q.msgs) > 0 {
+				if handler = q.nextHandler(); handler != nil {
+					break
+				}
+			} else if q.draining {
+				return
+			}
+			q.cond.Wait()
+		}
+		if q.stopped {
+			b.requeue(q)
+			return
+		}
+
+		msg := q.msgs[0]
+		b.mu.Unlock()
+		handled := b.deliver(q, msg, handler)
+		b.mu.Lock()
+
+		if handled {
+			q.msgs = q.msgs[1:]
+		}
+	}
+}
+
+// requeue returns a stopped work queue's messages to the pending list, or
+// discards a broadcast subscriber's. Called with b.mu held.
+func (b *MemoryBus) requeue(q *memQueue) {
+	if len(q.msgs) == 0 || q.kind == kindControl || q.kind == kindEvents {
+		return
+	}
+	b.pending[q.kind] = append(append([]*memMsg(nil), q.msgs...), b.pending[q.kind]...)
+	q.msgs = nil
+}
+
+// deliver runs handler until it succeeds, fails terminally or runs out of
+// attempts. It returns false if the queue was stopped during a backoff.
+func (b *MemoryBus) deliver(q *memQueue, msg *memMsg, handler Handler) bool {
+	sessionID := sessionFromSubject(msg.subject)
+
+	return deliverInPlace(q.kind, sessionID, msg.data, msg.trace, handler, b.maxDeliver, q.quit,
+		func(attempts int, cause error) {
+			b.deadLetter(q.kind, sessionID, msg, attempts, cause)
+		})
+}
+
+// deadLetter records a failed message for inspection
+func (b *MemoryBus) deadLetter(kind, sessionID string, msg *memMsg, attempts int, cause error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deadLetters = append(b.deadLetters, DeadLetter{
+		Subject:  fmt.Sprintf("%s.%s.%s", b.deadLetterSubject, kind, sessionID),
+		Data:     msg.data,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		Time:     time.Now(),
+	})
+	if len(b.deadLetters) > memMaxDeadLetters {
+		b.deadLetters = b.deadLetters[1:]
+	}
+}
+
+// DeadLetters returns the messages that were dead-lettered, oldest first
+func (b *MemoryBus) DeadLetters() []DeadLetter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]DeadLetter(nil), b.deadLetters...)
+}
+
+// Request calls method on a service registered on this bus
+func (b *MemoryBus) Request(ctx context.Context, service, version, method string, req, resp interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	subject := b.rpcSubject(service, version, method)
+
+	b.mu.Lock()
+	responders := b.responders[subject]
+	if len(responders) == 0 {
+		b.mu.Unlock()
+		return NewRPCError(CodeUnimplemented, "no %s %s service is running", service, version)
+	}
+	responder := responders[b.rpcNext[subject]%len(responders)]
+	b.rpcNext[subject]++
+	b.mu.Unlock()
+
+	reply := make(chan []byte, 1)
+	go func() {
+		reply <- responder.serve(ctx, data)
+	}()
+
+	select {
+	case r := <-reply:
+		return decodeReply(r, resp)
+	case <-ctx.Done():
+		return fmt.Errorf("request %s.%s failed: %w", service, method, ctx.Err())
+	}
+}
+
+// ServiceInfo asks a running service for its description
+func (b *MemoryBus) ServiceInfo(ctx context.Context, service, version string) (*ServiceInfo, error) {
+	return serviceInfo(ctx, b, service, version)
+}
+
+// NewService creates a service; register methods with Handle, then Start
+func (b *MemoryBus) NewService(name, version string) *Service {
+	return newService(b, name, version)
+}
+
+// serveRPC registers a responder for one method
+func (b *MemoryBus) serveRPC(service, version, method string, serve rpcServeFunc) (func(drain bool), error) {
+	subject := b.rpcSubject(service, version, method)
+	responder := &memResponder{serve: serve}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+	b.responders[subject] = append(b.responders[subject], responder)
+
+	return func(bool) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		responders := b.responders[subject]
+		for i, r := range responders {
+			if r == responder {
+				b.responders[subject] = append(responders[:i:i], responders[i+1:]...)
+				break
+			}
+		}
+	}, nil
+}
+
+// rpcSubject returns <prefix>.rpc.<service>.<version>.<method>
+func (b *MemoryBus) rpcSubject(service, version, method string) string {
+	return fmt.Sprintf("%s.rpc.%s.%s.%s", b.prefix, service, version, method)
+}
+
+// Close stops every subscription and worker group
+func (b *MemoryBus) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	b.stopAll()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, g := range b.groups {
+		for _, q := range g.queues {
+			q.stop()
+			q.cond.Broadcast()
+		}
+	}
+	b.queues = nil
+	b.watchers = nil
+}
+
+// accepting reports whether new messages may be routed to q
+func (q *memQueue) accepting() bool {
+	return !q.stopped && !q.draining
+}
+
+// push appends a message and wakes the worker. Called with b.mu held.
+func (q *memQueue) push(msg *memMsg) {
+	q.msgs = append(q.msgs, msg)
+	q.cond.Broadcast()
+}
+
+// stop marks q stopped and interrupts any backoff. Called with b.mu held.
+func (q *memQueue) stop() {
+	if !q.stopped {
+		q.stopped = true
+		close(q.quit)
+	}
+}
+
+// nextHandler returns the handler for the next message: the subscriber's,
+// or the next group member's in turn. Called with b.mu held.
+func (q *memQueue) nextHandler() Handler {
+	if q.group == nil {
+		return q.handler
+	}
+
+	g := q.group
+	if len(g.members) == 0 {
+		return nil
+	}
+	m := g.members[g.next%len(g.members)]
+	g.next++
+	return m.handler
+}
+
+// subjectMatches reports whether subject matches a NATS-style filter,
+// where "*" matches one token and a trailing ">" matches the rest
+func subjectMatches(filter, subject string) bool {
+	ft := strings.Split(filter, ".")
+	st := strings.Split(subject, ".")
+
+	for i, tok := range ft {
+		if tok == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) {
+			return false
+		}
+		if tok != "*" && tok != st[i] {
+			return false
+		}
+	}
+	return len(ft) == len(st)
+}
@@ -3,19 +3,52 @@ package bus
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
+
+	"voice-gateway/internal/config"
+)
+
+const (
+	kindAudio = "audio"
+	kindText  = "text"
+	kindTTS   = "tts"
 )
 
+// streamNames maps each message kind to its JetStream stream, before the
+// configured stream name prefix is applied
+var streamNames = map[string]string{
+	kindAudio:   "AUDIO",
+	kindText:    "TEXT",
+	kindTTS:     "TTS",
+	kindControl: "CONTROL",
+	kindEvents:  "CONTROL",
+}
+
 // Client wraps NATS JetStream client
 type Client struct {
-	nc     *nats.Conn
-	js     jetstream.JetStream
-	ctx    context.Context
-	cancel context.CancelFunc
+	nc *nats.Conn
+	js jetstream.JetStream
+	// Subject prefix without the trailing dot, e.g. "voice"
+	prefix     string
+	partitions int
+	maxDeliver int
+	// Subject prefix for messages that failed processing
+	deadLetterSubject string
+	// Prepended to stream names so deployments can share a server
+	streamPrefix string
+	transports   map[string]Transport
+	ctx          context.Context
+	cancel       context.CancelFunc
+
+	*subscriptions
 }
 
 // Message represents a message on the bus
@@ -23,12 +56,52 @@ type Message struct {
 	SessionID string
 	Data      []byte
 	Timestamp time.Time
+	// Audio is set for audio and TTS messages; Data holds its payload
+	Audio *AudioChunk
+	// Event is set for control and event messages
+	Event *Event
+	// Delivery attempt, starting at 1
+	Attempt int
+	// Trace context propagated from the publisher
+	Trace Trace
 }
 
 // NewClient creates a new NATS client
-func NewClient(url string) (*Client, error) {
+func NewClient(cfg config.NATSConfig) (*Client, error) {
+	if cfg.Partitions <= 0 {
+		return nil, fmt.Errorf("invalid partition count: %d", cfg.Partitions)
+	}
+	if cfg.MaxDeliver <= 0 {
+		return nil, fmt.Errorf("invalid max deliver: %d", cfg.MaxDeliver)
+	}
+
+	prefix := strings.TrimSuffix(cfg.Subject, ".")
+	if prefix == "" {
+		return nil, fmt.Errorf("subject prefix is required")
+	}
+
+	transports := make(map[string]Transport)
+	for kind, sc := range map[string]config.StreamConfig{
+		kindAudio:   cfg.AudioStream,
+		kindText:    cfg.TextStream,
+		kindTTS:     cfg.TTSStream,
+		kindControl: cfg.ControlStream,
+		kindEvents:  cfg.ControlStream,
+	} {
+		t, err := ParseTransport(sc.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s transport: %w", kind, err)
+		}
+		transports[kind] = t
+	}
+
+	deadLetter := cfg.DeadLetterSubject
+	if deadLetter == "" {
+		deadLetter = prefix + ".dlq"
+	}
+
 	// Connect to NATS
-	nc, err := nats.Connect(url,
+	nc, err := nats.Connect(cfg.URL,
 		nats.RetryOnFailedConnect(true),
 		nats.MaxReconnects(-1),
 		nats.ReconnectWait(2*time.Second),
@@ -38,7 +111,10 @@ func NewClient(url string) (*Client, error) {
 	}
 
 	// Create JetStream context
-	js, err := jetstream.New(nc)
+	js, err := jetstream.New(nc,
+		jetstream.WithPublishAsyncMaxPending(asyncMaxPending),
+		jetstream.WithPublishAsyncErrHandler(onAsyncPublishError),
+	)
 	if err != nil {
 		nc.Close()
 		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
@@ -47,14 +123,21 @@ func NewClient(url string) (*Client, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	client := &Client{
-		nc:     nc,
-		js:     js,
-		ctx:    ctx,
-		cancel: cancel,
+		nc:                nc,
+		js:                js,
+		prefix:            prefix,
+		partitions:        cfg.Partitions,
+		maxDeliver:        cfg.MaxDeliver,
+		deadLetterSubject: deadLetter,
+		streamPrefix:      cfg.StreamPrefix,
+		transports:        transports,
+		ctx:               ctx,
+		cancel:            cancel,
+		subscriptions:     newSubscriptions(),
 	}
 
 	// Initialize streams
-	if err := client.initStreams(); err != nil {
+	if err := client.initStreams(cfg); err != nil {
 		client.Close()
 		return nil, fmt.Errorf("failed to initialize streams: %w", err)
 	}
@@ -63,148 +146,287 @@ func NewClient(url string) (*Client, error) {
 	return client, nil
 }
 
-// initStreams creates the required JetStream streams
-func (c *Client) initStreams() error {
-	// Create AUDIO stream for audio frames
-	_, err := c.js.CreateOrUpdateStream(c.ctx, jetstream.StreamConfig{
-		Name:        "AUDIO",
-		Subjects:    []string{"voice.audio.>"},
-		Retention:   jetstream.WorkQueuePolicy,
-		MaxAge:      time.Hour,
-		Storage:     jetstream.MemoryStorage,
-		Replicas:    1,
-		Description: "Audio frames stream",
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create AUDIO stream: %w", err)
-	}
-
-	// Create TEXT stream for transcripts
-	_, err = c.js.CreateOrUpdateStream(c.ctx, jetstream.StreamConfig{
-		Name:        "TEXT",
-		Subjects:    []string{"voice.text.>"},
-		Retention:   jetstream.WorkQueuePolicy,
-		MaxAge:      time.Hour,
-		Storage:     jetstream.MemoryStorage,
-		Replicas:    1,
-		Description: "Transcripts stream",
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create TEXT stream: %w", err)
-	}
-
-	// Create TTS stream for synthesized audio
-	_, err = c.js.CreateOrUpdateStream(c.ctx, jetstream.StreamConfig{
-		Name:        "TTS",
-		Subjects:    []string{"voice.tts.>"},
-		Retention:   jetstream.WorkQueuePolicy,
-		MaxAge:      time.Hour,
-		Storage:     jetstream.MemoryStorage,
-		Replicas:    1,
-		Description: "TTS audio stream",
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create TTS stream: %w", err)
-	}
-
-	return nil
-}
-
 // PublishAudio publishes an audio frame to the bus
-func (c *Client) PublishAudio(sessionID string, data []byte) error {
-	subject := fmt.Sprintf("voice.audio.%s", sessionID)
-	_, err := c.js.Publish(c.ctx, subject, data)
-	return err
+func (c *Client) PublishAudio(ctx context.Context, sessionID string, chunk *AudioChunk) error {
+	return c.publish(ctx, kindAudio, c.subject(kindAudio, sessionID), chunk.Marshal(),
+		traceHeader(outgoingTrace(ctx, ""), sessionID))
 }
 
 // PublishText publishes a transcript to the bus
-func (c *Client) PublishText(sessionID string, text []byte) error {
-	subject := fmt.Sprintf("voice.text.%s", sessionID)
-	_, err := c.js.Publish(c.ctx, subject, text)
-	return err
+func (c *Client) PublishText(ctx context.Context, sessionID string, text []byte) error {
+	return c.publish(ctx, kindText, c.subject(kindText, sessionID), text,
+		traceHeader(outgoingTrace(ctx, ""), sessionID))
 }
 
 // PublishTTS publishes synthesized audio to the bus
-func (c *Client) PublishTTS(sessionID string, data []byte) error {
-	subject := fmt.Sprintf("voice.tts.%s", sessionID)
-	_, err := c.js.Publish(c.ctx, subject, data)
-	return err
+func (c *Client) PublishTTS(ctx context.Context, sessionID string, chunk *AudioChunk) error {
+	return c.publish(ctx, kindTTS, c.subject(kindTTS, sessionID), chunk.Marshal(),
+		traceHeader(outgoingTrace(ctx, ""), sessionID))
 }
 
 // SubscribeAudio subscribes to audio frames for a session
-func (c *Client) SubscribeAudio(sessionID string, handler func(*Message)) error {
-	subject := fmt.Sprintf("voice.audio.%s", sessionID)
+func (c *Client) SubscribeAudio(sessionID string, handler Handler) (*Subscription, error) {
+	return c.subscribeSession(kindAudio, sessionID, handler)
+}
 
-	cons, err := c.js.CreateOrUpdateConsumer(c.ctx, "AUDIO", jetstream.ConsumerConfig{
-		FilterSubject: subject,
-		AckPolicy:     jetstream.AckExplicitPolicy,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create consumer: %w", err)
-	}
+// SubscribeText subscribes to transcripts for a session
+func (c *Client) SubscribeText(sessionID string, handler Handler) (*Subscription, error) {
+	return c.subscribeSession(kindText, sessionID, handler)
+}
 
-	_, err = cons.Consume(func(msg jetstream.Msg) {
-		handler(&Message{
-			SessionID: sessionID,
-			Data:      msg.Data(),
-			Timestamp: time.Now(),
-		})
-		msg.Ack()
-	})
+// SubscribeTTS subscribes to synthesized audio for a session
+func (c *Client) SubscribeTTS(sessionID string, handler Handler) (*Subscription, error) {
+	return c.subscribeSession(kindTTS, sessionID, handler)
+}
 
-	return err
+// SubscribeAudioGroup joins a named worker group that consumes audio for
+// every session. See subscribeGroup for delivery guarantees.
+func (c *Client) SubscribeAudioGroup(group string, handler Handler) (*Subscription, error) {
+	return c.subscribeGroup(kindAudio, group, handler)
 }
 
-// SubscribeText subscribes to transcripts for a session
-func (c *Client) SubscribeText(sessionID string, handler func(*Message)) error {
-	subject := fmt.Sprintf("voice.text.%s", sessionID)
+// SubscribeTextGroup joins a named worker group that consumes transcripts
+// for every session
+func (c *Client) SubscribeTextGroup(group string, handler Handler) (*Subscription, error) {
+	return c.subscribeGroup(kindText, group, handler)
+}
 
-	cons, err := c.js.CreateOrUpdateConsumer(c.ctx, "TEXT", jetstream.ConsumerConfig{
-		FilterSubject: subject,
+// SubscribeTTSGroup joins a named worker group that consumes synthesized
+// audio for every session
+func (c *Client) SubscribeTTSGroup(group string, handler Handler) (*Subscription, error) {
+	return c.subscribeGroup(kindTTS, group, handler)
+}
+
+// subscribeSession creates an ephemeral consumer for one session's subject
+func (c *Client) subscribeSession(kind, sessionID string, handler Handler) (*Subscription, error) {
+	stream := c.streamName(kind)
+	nc := &natsConsumers{js: c.js, stream: stream}
+
+	if c.transports[kind] == TransportCore {
+		ns, err := c.subscribeCore(kind, c.subject(kind, sessionID), "", handler)
+		if err != nil {
+			return nil, err
+		}
+		nc.natsSubs = append(nc.natsSubs, ns)
+		return c.track(sessionID, nc.close), nil
+	}
+
+	cons, err := c.js.CreateOrUpdateConsumer(c.ctx, stream, jetstream.ConsumerConfig{
+		FilterSubject: c.subject(kind, sessionID),
 		AckPolicy:     jetstream.AckExplicitPolicy,
+		MaxDeliver:    c.maxDeliver,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to create consumer: %w", err)
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
 	}
 
-	_, err = cons.Consume(func(msg jetstream.Msg) {
-		handler(&Message{
-			SessionID: sessionID,
-			Data:      msg.Data(),
-			Timestamp: time.Now(),
+	nc.consumers = []string{cons.CachedInfo().Name}
+
+	cc, err := cons.Consume(c.dispatch(kind, handler))
+	if err != nil {
+		nc.deleteConsumers()
+		return nil, fmt.Errorf("failed to consume: %w", err)
+	}
+	nc.contexts = append(nc.contexts, cc)
+
+	return c.track(sessionID, nc.close), nil
+}
+
+// subscribeGroup binds to one durable consumer per partition, shared by
+// every member of the group. The durable consumers outlive the subscription
+// so other members and future replicas keep their position. Members
+// load-balance across partitions; each partition allows a single
+// unacknowledged message, so messages for a given session are handled
+// strictly in order, one at a time, by whichever member pulled them.
+// Throughput scales with the partition count.
+//
+// The streams use work-queue retention, so a kind is consumed either by a
+// group or by per-session subscriptions, not both. With TransportCore the
+// group is a NATS queue group per partition and ordering across members is
+// not guaranteed.
+func (c *Client) subscribeGroup(kind, group string, handler Handler) (*Subscription, error) {
+	stream := c.streamName(kind)
+	nc := &natsConsumers{js: c.js, stream: stream}
+
+	for p := 0; p < c.partitions; p++ {
+		name := fmt.Sprintf("%s-%s-p%d", group, kind, p)
+		filter := fmt.Sprintf("%s.%s.%d.*", c.prefix, kind, p)
+
+		if c.transports[kind] == TransportCore {
+			ns, err := c.subscribeCore(kind, filter, name, handler)
+			if err != nil {
+				nc.close(false)
+				return nil, err
+			}
+			nc.natsSubs = append(nc.natsSubs, ns)
+			continue
+		}
+
+		cons, err := c.js.CreateOrUpdateConsumer(c.ctx, stream, jetstream.ConsumerConfig{
+			Durable:       name,
+			FilterSubject: filter,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			MaxAckPending: 1,
+			MaxDeliver:    c.maxDeliver,
 		})
-		msg.Ack()
-	})
+		if err != nil {
+			nc.close(false)
+			return nil, fmt.Errorf("failed to create consumer for partition %d: %w", p, err)
+		}
 
-	return err
+		cc, err := cons.Consume(c.dispatch(kind, handler))
+		if err != nil {
+			nc.close(false)
+			return nil, fmt.Errorf("failed to consume partition %d: %w", p, err)
+		}
+		nc.contexts = append(nc.contexts, cc)
+	}
+
+	return c.track("", nc.close), nil
 }
 
-// SubscribeTTS subscribes to synthesized audio for a session
-func (c *Client) SubscribeTTS(sessionID string, handler func(*Message)) error {
-	subject := fmt.Sprintf("voice.tts.%s", sessionID)
+// dispatch decodes messages of the given kind, runs handler and settles
+// each message according to the result
+func (c *Client) dispatch(kind string, handler Handler) jetstream.MessageHandler {
+	return func(msg jetstream.Msg) {
+		sessionID := sessionFromSubject(msg.Subject())
 
-	cons, err := c.js.CreateOrUpdateConsumer(c.ctx, "TTS", jetstream.ConsumerConfig{
-		FilterSubject: subject,
-		AckPolicy:     jetstream.AckExplicitPolicy,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create consumer: %w", err)
+		attempt := 1
+		if meta, err := msg.Metadata(); err == nil {
+			attempt = int(meta.NumDelivered)
+		}
+
+		m, err := decodeMessage(kind, sessionID, msg.Data())
+		if err != nil {
+			err = Terminate(fmt.Errorf("malformed %s message: %w", kind, err))
+		} else {
+			m.Attempt = attempt
+			m.Trace = traceFromHeader(msg.Headers())
+			err = runHandler(handler, m)
+		}
+
+		if err == nil {
+			msg.Ack()
+			return
+		}
+
+		if IsTerminal(err) || attempt >= c.maxDeliver {
+			log.Printf("Session %s: dead-lettering %s message after %d attempt(s): %v", sessionID, kind, attempt, err)
+			if dlqErr := c.deadLetter(kind, sessionID, msg, attempt, err); dlqErr != nil {
+				// Leave it to be redelivered rather than lose it
+				log.Printf("Session %s: failed to dead-letter message: %v", sessionID, dlqErr)
+				msg.NakWithDelay(maxRetryDelay)
+				return
+			}
+			msg.TermWithReason(err.Error())
+			return
+		}
+
+		msg.NakWithDelay(retryDelay(err, attempt))
 	}
+}
 
-	_, err = cons.Consume(func(msg jetstream.Msg) {
-		handler(&Message{
+// decodeMessage builds a Message from a raw payload of the given kind
+func decodeMessage(kind, sessionID string, data []byte) (*Message, error) {
+	switch kind {
+	case kindText:
+		return &Message{
 			SessionID: sessionID,
-			Data:      msg.Data(),
+			Data:      data,
 			Timestamp: time.Now(),
-		})
-		msg.Ack()
-	})
+		}, nil
 
+	case kindControl, kindEvents:
+		event, err := decodeEvent(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Message{
+			SessionID: sessionID,
+			Data:      data,
+			Timestamp: event.Timestamp,
+			Event:     event,
+		}, nil
+	}
+
+	audio, err := UnmarshalAudioChunk(data)
+	if err != nil {
+		return nil, err
+	}
+	return audioMessage(sessionID, audio), nil
+}
+
+// runHandler calls handler, converting a panic into a PanicError
+func runHandler(handler Handler, m *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Session %s: handler panic: %v\n%s", m.SessionID, r, debug.Stack())
+			err = &PanicError{Value: r}
+		}
+	}()
+
+	return handler(m)
+}
+
+// deadLetter republishes a failed message to <dead-letter>.<kind>.<sessionID>
+// with its trace headers and headers describing the failure
+func (c *Client) deadLetter(kind, sessionID string, msg jetstream.Msg, attempts int, cause error) error {
+	dlq := nats.NewMsg(fmt.Sprintf("%s.%s.%s", c.deadLetterSubject, kind, sessionID))
+	dlq.Data = msg.Data()
+	for key, values := range msg.Headers() {
+		dlq.Header[key] = values
+	}
+	dlq.Header.Set("Voice-Original-Subject", msg.Subject())
+	dlq.Header.Set("Voice-Error", cause.Error())
+	dlq.Header.Set("Voice-Attempts", strconv.Itoa(attempts))
+
+	_, err := c.js.PublishMsg(c.ctx, dlq)
 	return err
 }
 
-// Close closes the NATS connection
+// streamName returns the JetStream stream holding messages of kind
+func (c *Client) streamName(kind string) string {
+	return c.streamPrefix + streamNames[kind]
+}
+
+// subject returns the partitioned subject for a session:
+// <prefix>.<kind>.<partition>.<sessionID>
+func (c *Client) subject(kind, sessionID string) string {
+	return partitionedSubject(c.prefix, kind, sessionID, c.partitions)
+}
+
+// partition maps a session to a stable partition number
+func partition(sessionID string, partitions int) int {
+	h := fnv.New32a()
+	h.Write([]byte(sessionID))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// sessionFromSubject extracts the session ID from the last subject token
+func sessionFromSubject(subject string) string {
+	return subject[strings.LastIndexByte(subject, '.')+1:]
+}
+
+// audioMessage builds a Message from a decoded audio envelope
+func audioMessage(sessionID string, audio *AudioChunk) *Message {
+	timestamp := audio.CaptureTime
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	return &Message{
+		SessionID: sessionID,
+		Data:      audio.Data,
+		Timestamp: timestamp,
+		Audio:     audio,
+	}
+}
+
+// Close stops all subscriptions, waits for pending async publishes and
+// closes the NATS connection
 func (c *Client) Close() {
+	c.stopAll()
+	c.flushAsync()
 	c.cancel()
 	if c.nc != nil {
 		c.nc.Close()
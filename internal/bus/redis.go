@@ -0,0 +1,849 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+
+	"voice-gateway/internal/config"
+)
+
+const (
+	// How long blocking reads wait before checking for shutdown
+	redisBlock = time.Second
+
+	// Entries fetched per stream read
+	redisBatch = 100
+
+	// Wait after a failed Redis call before trying again
+	redisErrorBackoff = time.Second
+
+	// Stream entry field holding the payload; the rest are trace headers
+	redisDataField = "data"
+)
+
+// Extends a lease only if we still own it
+var renewLease = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// Deletes a lease only if we still own it
+var releaseLease = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// RedisBus implements Bus on Redis Streams, for deployments that run Redis
+// but not NATS. Keys mirror the NATS subjects:
+//
+//   - audio, text and TTS go to one stream per partition,
+//     <prefix>.<kind>.<partition>, and entries are deleted once handled so
+//     the streams behave as work queues
+//   - worker groups are Redis consumer groups; each partition is owned by
+//     one member at a time through a lease, so a session's messages are
+//     handled in order, and a new owner claims entries a failed member left
+//     unacknowledged
+//   - control and events are appended to <prefix>.<kind>.<sessionID>,
+//     replayed to per-session subscribers, and to <prefix>.<kind> for
+//     all-session subscribers
+//   - failed messages are retried in place with the usual backoff, then
+//     added to the <dead-letter>.<kind> stream
+//   - requests go through a list per method, with replies on a per-request
+//     list
+type RedisBus struct {
+	rdb               *redis.Client
+	prefix            string
+	deadLetterSubject string
+	partitions        int
+	maxDeliver        int
+	maxLen            int64
+	leaseTTL          time.Duration
+	// Retention of per-session control and event history
+	historyLen int64
+	historyAge time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
+
+	*subscriptions
+}
+
+// NewRedisBus connects to Redis, taking the subject prefix, partitioning,
+// delivery limits and control history retention from bus
+func NewRedisBus(cfg config.RedisConfig, bus config.NATSConfig) (*RedisBus, error) {
+	if bus.Partitions <= 0 {
+		return nil, fmt.Errorf("invalid partition count: %d", bus.Partitions)
+	}
+	if bus.MaxDeliver <= 0 {
+		return nil, fmt.Errorf("invalid max deliver: %d", bus.MaxDeliver)
+	}
+	if cfg.LeaseTTL <= 0 {
+		return nil, fmt.Errorf("invalid lease TTL: %s", cfg.LeaseTTL)
+	}
+
+	prefix := strings.TrimSuffix(bus.Subject, ".")
+	if prefix == "" {
+		return nil, fmt.Errorf("subject prefix is required")
+	}
+
+	deadLetter := bus.DeadLetterSubject
+	if deadLetter == "" {
+		deadLetter = prefix + ".dlq"
+	}
+
+	opts, err := redis.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	// Let cancellation and request deadlines interrupt blocking reads
+	opts.ContextTimeoutEnabled = true
+	rdb := redis.NewClient(opts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pingCtx, pingCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer pingCancel()
+	if err := rdb.Ping(pingCtx).Err(); err != nil {
+		cancel()
+		rdb.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	historyLen := bus.ControlStream.MaxMsgsPerSubject
+	if historyLen <= 0 {
+		historyLen = cfg.MaxLen
+	}
+
+	log.Println("Connected to Redis Streams")
+	return &RedisBus{
+		rdb:               rdb,
+		prefix:            prefix,
+		deadLetterSubject: deadLetter,
+		partitions:        bus.Partitions,
+		maxDeliver:        bus.MaxDeliver,
+		maxLen:            cfg.MaxLen,
+		leaseTTL:          cfg.LeaseTTL,
+		historyLen:        historyLen,
+		historyAge:        bus.ControlStream.MaxAge,
+		ctx:               ctx,
+		cancel:            cancel,
+		subscriptions:     newSubscriptions(),
+	}, nil
+}
+
+// PublishAudio publishes an audio frame to the bus
+func (b *RedisBus) PublishAudio(ctx context.Context, sessionID string, chunk *AudioChunk) error {
+	return b.publishWork(ctx, kindAudio, sessionID, chunk.Marshal())
+}
+
+// PublishText publishes a transcript to the bus
+func (b *RedisBus) PublishText(ctx context.Context, sessionID string, text []byte) error {
+	return b.publishWork(ctx, kindText, sessionID, text)
+}
+
+// PublishTTS publishes synthesized audio to the bus
+func (b *RedisBus) PublishTTS(ctx context.Context, sessionID string, chunk *AudioChunk) error {
+	return b.publishWork(ctx, kindTTS, sessionID, chunk.Marshal())
+}
+
+// PublishControl publishes a command for a session
+func (b *RedisBus) PublishControl(ctx context.Context, event *Event) error {
+	return b.publishBroadcast(ctx, kindControl, event)
+}
+
+// PublishEvent publishes a lifecycle event for a session
+func (b *RedisBus) PublishEvent(ctx context.Context, event *Event) error {
+	return b.publishBroadcast(ctx, kindEvents, event)
+}
+
+// publishWork appends a message to its session's partition stream
+func (b *RedisBus) publishWork(ctx context.Context, kind, sessionID string, data []byte) error {
+	return b.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: b.partitionKey(kind, partition(sessionID, b.partitions)),
+		MaxLen: b.maxLen,
+		Approx: true,
+		Values: entryValues(traceHeader(outgoingTrace(ctx, ""), sessionID), data),
+	}).Err()
+}
+
+// publishBroadcast appends an event to the session's history and to the
+// all-session stream
+func (b *RedisBus) publishBroadcast(ctx context.Context, kind string, event *Event) error {
+	if event.SessionID == "" {
+		return fmt.Errorf("event has no session ID")
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	values := entryValues(traceHeader(outgoingTrace(ctx, event.TurnID), event.SessionID), data)
+	history := b.broadcastKey(kind, event.SessionID)
+
+	_, err = b.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: history, MaxLen: b.historyLen, Approx: true, Values: values})
+		if b.historyAge > 0 {
+			pipe.Expire(ctx, history, b.historyAge)
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: b.broadcastKey(kind, ""), MaxLen: b.maxLen, Approx: true, Values: values})
+		return nil
+	})
+	return err
+}
+
+// SubscribeAudio subscribes to audio frames for a session
+func (b *RedisBus) SubscribeAudio(sessionID string, handler Handler) (*Subscription, error) {
+	return b.subscribeSession(kindAudio, sessionID, handler)
+}
+
+// SubscribeText subscribes to transcripts for a session
+func (b *RedisBus) SubscribeText(sessionID string, handler Handler) (*Subscription, error) {
+	return b.subscribeSession(kindText, sessionID, handler)
+}
+
+// SubscribeTTS subscribes to synthesized audio for a session
+func (b *RedisBus) SubscribeTTS(sessionID string, handler Handler) (*Subscription, error) {
+	return b.subscribeSession(kindTTS, sessionID, handler)
+}
+
+// SubscribeAudioGroup joins a named worker group that consumes audio for
+// every session
+func (b *RedisBus) SubscribeAudioGroup(group string, handler Handler) (*Subscription, error) {
+	return b.subscribeGroup(kindAudio, group, handler)
+}
+
+// SubscribeTextGroup joins a named worker group that consumes transcripts
+// for every session
+func (b *RedisBus) SubscribeTextGroup(group string, handler Handler) (*Subscription, error) {
+	return b.subscribeGroup(kindText, group, handler)
+}
+
+// SubscribeTTSGroup joins a named worker group that consumes synthesized
+// audio for every session
+func (b *RedisBus) SubscribeTTSGroup(group string, handler Handler) (*Subscription, error) {
+	return b.subscribeGroup(kindTTS, group, handler)
+}
+
+// SubscribeControl receives commands for a session, including any already
+// published, or new commands for every session if sessionID is empty
+func (b *RedisBus) SubscribeControl(sessionID string, handler Handler) (*Subscription, error) {
+	return b.subscribeBroadcast(kindControl, sessionID, handler)
+}
+
+// SubscribeEvents receives lifecycle events for a session, or for every
+// session if sessionID is empty
+func (b *RedisBus) SubscribeEvents(sessionID string, handler Handler) (*Subscription, error) {
+	return b.subscribeBroadcast(kindEvents, sessionID, handler)
+}
+
+// subscribeSession reads the session's partition stream from the start,
+// handling and deleting the session's entries and skipping the rest
+func (b *RedisBus) subscribeSession(kind, sessionID string, handler Handler) (*Subscription, error) {
+	key := b.partitionKey(kind, partition(sessionID, b.partitions))
+
+	l := b.startLoop(func(l *redisLoop) {
+		b.readStream(l, key, "0-0", func(entry redis.XMessage) bool {
+			sid, data, trace := entryFields(entry.Values)
+			if sid != sessionID {
+				return true
+			}
+			if !b.deliver(l, kind, key, sid, data, trace, handler) {
+				return false
+			}
+			if err := b.rdb.XDel(b.ctx, key, entry.ID).Err(); err != nil {
+				log.Printf("Session %s: failed to delete handled %s entry: %v", sid, kind, err)
+			}
+			return true
+		})
+	})
+
+	return b.track(sessionID, func(drain bool) error {
+		l.close(drain)
+		return nil
+	}), nil
+}
+
+// subscribeBroadcast reads a session's event history from the start, or the
+// all-session stream from its current end
+func (b *RedisBus) subscribeBroadcast(kind, sessionID string, handler Handler) (*Subscription, error) {
+	key := b.broadcastKey(kind, sessionID)
+	start := "0-0"
+
+	if sessionID == "" {
+		last, err := b.rdb.XRevRangeN(b.ctx, key, "+", "-", 1).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		if len(last) > 0 {
+			start = last[0].ID
+		}
+	}
+
+	l := b.startLoop(func(l *redisLoop) {
+		b.readStream(l, key, start, func(entry redis.XMessage) bool {
+			sid, data, trace := entryFields(entry.Values)
+			return b.deliver(l, kind, key, sid, data, trace, handler)
+		})
+	})
+
+	return b.track(sessionID, func(drain bool) error {
+		l.close(drain)
+		return nil
+	}), nil
+}
+
+// subscribeGroup joins a consumer group on every partition stream. Each
+// partition is consumed by whichever member holds its lease, one entry at a
+// time, so a session's messages are handled in order. The consumer groups
+// outlive the subscription so members and future replicas keep their
+// position.
+func (b *RedisBus) subscribeGroup(kind, group string, handler Handler) (*Subscription, error) {
+	name := fmt.Sprintf("%s-%s", group, kind)
+	consumer := uuid.NewString()
+
+	for p := 0; p < b.partitions; p++ {
+		err := b.rdb.XGroupCreateMkStream(b.ctx, b.partitionKey(kind, p), name, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, fmt.Errorf("failed to create consumer group for partition %d: %w", p, err)
+		}
+	}
+
+	var loops []*redisLoop
+	for p := 0; p < b.partitions; p++ {
+		p := p
+		loops = append(loops, b.startLoop(func(l *redisLoop) {
+			b.consumePartition(l, kind, name, consumer, p, handler)
+		}))
+	}
+
+	return b.track("", func(drain bool) error {
+		for _, l := range loops {
+			l.signal(drain)
+		}
+		for _, l := range loops {
+			<-l.done
+		}
+		return nil
+	}), nil
+}
+
+// consumePartition consumes one partition for a group member while it
+// holds the partition's lease
+func (b *RedisBus) consumePartition(l *redisLoop, kind, group, consumer string, p int, handler Handler) {
+	key := b.partitionKey(kind, p)
+	lease := &redisLease{
+		rdb:   b.rdb,
+		key:   fmt.Sprintf("%s.lease.%s.%d", b.prefix, group, p),
+		owner: consumer,
+		ttl:   b.leaseTTL,
+	}
+	defer b.removeConsumer(key, group, consumer)
+	defer lease.release()
+
+	handle := func(entry redis.XMessage) bool {
+		sid, data, trace := entryFields(entry.Values)
+		if !b.deliver(l, kind, key, sid, data, trace, handler) {
+			return false
+		}
+
+		_, err := b.rdb.Pipelined(b.ctx, func(pipe redis.Pipeliner) error {
+			pipe.XAck(b.ctx, key, group, entry.ID)
+			pipe.XDel(b.ctx, key, entry.ID)
+			return nil
+		})
+		if err != nil {
+			log.Printf("Session %s: failed to acknowledge %s entry: %v", sid, kind, err)
+		}
+		return true
+	}
+
+	for l.ctx.Err() == nil {
+		if !lease.acquire(l.ctx) {
+			l.sleep(b.leaseTTL / 3)
+			continue
+		}
+
+		// Take over entries a previous owner left unacknowledged
+		if !b.claimPending(l, lease, key, group, consumer, handle) {
+			return
+		}
+
+		for l.ctx.Err() == nil && lease.held.Load() {
+			streams, err := b.rdb.XReadGroup(l.ctx, &redis.XReadGroupArgs{
+				Group:    group,
+				Consumer: consumer,
+				Streams:  []string{key, ">"},
+				Count:    1,
+				Block:    redisBlock,
+			}).Result()
+			if err != nil {
+				if !b.readFailed(l, key, err) {
+					return
+				}
+				continue
+			}
+
+			for _, entry := range streams[0].Messages {
+				if !handle(entry) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// claimPending handles the group's unacknowledged entries in order after
+// taking over a partition. It returns false if the loop was stopped.
+func (b *RedisBus) claimPending(l *redisLoop, lease *redisLease, key, group, consumer string,
+	handle func(redis.XMessage) bool) bool {
+	start := "0-0"
+	for lease.held.Load() {
+		entries, next, err := b.rdb.XAutoClaim(l.ctx, &redis.XAutoClaimArgs{
+			Stream:   key,
+			Group:    group,
+			Consumer: consumer,
+			Start:    start,
+			Count:    redisBatch,
+		}).Result()
+		if err != nil {
+			return b.readFailed(l, key, err)
+		}
+
+		for _, entry := range entries {
+			if l.stopped() || !handle(entry) {
+				return false
+			}
+		}
+
+		if next == "0-0" || len(entries) == 0 {
+			return true
+		}
+		start = next
+	}
+	return true
+}
+
+// removeConsumer deletes a group member's consumer if it has no
+// unacknowledged entries left for another member to claim
+func (b *RedisBus) removeConsumer(key, group, consumer string) {
+	ctx, cancel := context.WithTimeout(context.Background(), consumerDeleteTimeout)
+	defer cancel()
+
+	pending, err := b.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   key,
+		Group:    group,
+		Start:    "-",
+		End:      "+",
+		Count:    1,
+		Consumer: consumer,
+	}).Result()
+	if err != nil || len(pending) > 0 {
+		return
+	}
+
+	b.rdb.XGroupDelConsumer(ctx, key, group, consumer)
+}
+
+// readStream reads key from after start, calling handle for each entry
+// until the loop ends or handle returns false
+func (b *RedisBus) readStream(l *redisLoop, key, start string, handle func(redis.XMessage) bool) {
+	cursor := start
+	for l.ctx.Err() == nil {
+		streams, err := b.rdb.XRead(l.ctx, &redis.XReadArgs{
+			Streams: []string{key, cursor},
+			Count:   redisBatch,
+			Block:   redisBlock,
+		}).Result()
+		if err != nil {
+			if !b.readFailed(l, key, err) {
+				return
+			}
+			continue
+		}
+
+		for _, entry := range streams[0].Messages {
+			if l.stopped() || !handle(entry) {
+				return
+			}
+			cursor = entry.ID
+		}
+	}
+}
+
+// readFailed handles a read error, returning false if the loop is ending
+func (b *RedisBus) readFailed(l *redisLoop, key string, err error) bool {
+	if errors.Is(err, redis.Nil) {
+		return true
+	}
+	if l.ctx.Err() != nil {
+		return false
+	}
+
+	log.Printf("Failed to read %s: %v", key, err)
+	l.sleep(redisErrorBackoff)
+	return true
+}
+
+// deliver runs handler with retries, dead-lettering messages given up on
+func (b *RedisBus) deliver(l *redisLoop, kind, key, sessionID string, data []byte, trace Trace, handler Handler) bool {
+	return deliverInPlace(kind, sessionID, data, trace, handler, b.maxDeliver, l.stop,
+		func(attempts int, cause error) {
+			if err := b.deadLetter(kind, key, sessionID, data, trace, attempts, cause); err != nil {
+				log.Printf("Session %s: failed to dead-letter message: %v", sessionID, err)
+			}
+		})
+}
+
+// deadLetter appends a failed message to <dead-letter>.<kind> with its
+// trace and fields describing the failure
+func (b *RedisBus) deadLetter(kind, key, sessionID string, data []byte, trace Trace, attempts int, cause error) error {
+	header := traceHeader(trace, sessionID)
+	header.Set("Voice-Original-Subject", key)
+	header.Set("Voice-Error", cause.Error())
+	header.Set("Voice-Attempts", strconv.Itoa(attempts))
+
+	return b.rdb.XAdd(b.ctx, &redis.XAddArgs{
+		Stream: fmt.Sprintf("%s.%s", b.deadLetterSubject, kind),
+		MaxLen: b.maxLen,
+		Approx: true,
+		Values: entryValues(header, data),
+	}).Err()
+}
+
+// redisRequest is the wire format of a request pushed to a method's list
+type redisRequest struct {
+	Reply    string          `json:"reply"`
+	Deadline int64           `json:"deadline"`
+	Header   nats.Header     `json:"header,omitempty"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Request calls method on a service and decodes the result into resp
+func (b *RedisBus) Request(ctx context.Context, service, version, method string, req, resp interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	queue := b.rpcSubject(service, version, method)
+
+	replicas, err := b.rdb.ZCount(ctx, queue+".replicas", strconv.FormatInt(time.Now().UnixMilli(), 10), "+inf").Result()
+	if err != nil {
+		return fmt.Errorf("request %s.%s failed: %w", service, method, err)
+	}
+	if replicas == 0 {
+		return NewRPCError(CodeUnimplemented, "no %s %s service is running", service, version)
+	}
+
+	r := redisRequest{
+		Reply:    fmt.Sprintf("%s.rpc.reply.%s", b.prefix, uuid.NewString()),
+		Deadline: deadline.UnixNano(),
+		Data:     data,
+	}
+	if _, ok := TraceFromContext(ctx); ok {
+		r.Header = traceHeader(outgoingTrace(ctx, ""), "")
+		r.Header.Del(sessionIDHeader)
+	}
+
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	if err := b.rdb.LPush(ctx, queue, payload).Err(); err != nil {
+		return fmt.Errorf("request %s.%s failed: %w", service, method, err)
+	}
+
+	// BLPOP timeouts have one-second resolution; ctx enforces the deadline
+	wait := time.Until(deadline).Truncate(time.Second) + time.Second
+	reply, err := b.rdb.BLPop(ctx, wait, r.Reply).Result()
+	if err != nil {
+		var netErr net.Error
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if errors.Is(err, redis.Nil) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			err = context.DeadlineExceeded
+		}
+		return fmt.Errorf("request %s.%s failed: %w", service, method, err)
+	}
+
+	return decodeReply([]byte(reply[1]), resp)
+}
+
+// ServiceInfo asks a running service for its description
+func (b *RedisBus) ServiceInfo(ctx context.Context, service, version string) (*ServiceInfo, error) {
+	return serviceInfo(ctx, b, service, version)
+}
+
+// NewService creates a service; register methods with Handle, then Start
+func (b *RedisBus) NewService(name, version string) *Service {
+	return newService(b, name, version)
+}
+
+// serveRPC pops requests for one method. Replicas register in a sorted set
+// scored by heartbeat expiry so callers can tell when none are running.
+func (b *RedisBus) serveRPC(service, version, method string, serve rpcServeFunc) (func(drain bool), error) {
+	queue := b.rpcSubject(service, version, method)
+	replicas := queue + ".replicas"
+	replica := uuid.NewString()
+
+	heartbeat := func(ctx context.Context) error {
+		expiry := float64(time.Now().Add(b.leaseTTL).UnixMilli())
+		return b.rdb.ZAdd(ctx, replicas, redis.Z{Score: expiry, Member: replica}).Err()
+	}
+	if err := heartbeat(b.ctx); err != nil {
+		return nil, fmt.Errorf("failed to register %s: %w", queue, err)
+	}
+
+	l := b.startLoop(func(l *redisLoop) {
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), consumerDeleteTimeout)
+			defer cancel()
+			b.rdb.ZRem(ctx, replicas, replica)
+		}()
+
+		lastBeat := time.Now()
+		for l.ctx.Err() == nil {
+			if time.Since(lastBeat) > b.leaseTTL/3 {
+				if err := heartbeat(l.ctx); err != nil && l.ctx.Err() == nil {
+					log.Printf("Service %s: heartbeat failed: %v", service, err)
+				}
+				lastBeat = time.Now()
+			}
+
+			res, err := b.rdb.BRPop(l.ctx, redisBlock, queue).Result()
+			if err != nil {
+				if !b.readFailed(l, queue, err) {
+					return
+				}
+				continue
+			}
+
+			var r redisRequest
+			if err := json.Unmarshal([]byte(res[1]), &r); err != nil {
+				log.Printf("Service %s: discarding malformed request: %v", service, err)
+				continue
+			}
+
+			// The caller has given up
+			deadline := time.Unix(0, r.Deadline)
+			if time.Now().After(deadline) {
+				continue
+			}
+
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			if trace := traceFromHeader(r.Header); trace.TraceID != "" {
+				ctx = WithTrace(ctx, trace)
+			}
+			reply := serve(ctx, r.Data)
+			cancel()
+
+			_, err = b.rdb.Pipelined(b.ctx, func(pipe redis.Pipeliner) error {
+				pipe.RPush(b.ctx, r.Reply, reply)
+				pipe.PExpire(b.ctx, r.Reply, time.Until(deadline)+time.Second)
+				return nil
+			})
+			if err != nil {
+				log.Printf("Service %s: failed to respond on %s: %v", service, r.Reply, err)
+			}
+		}
+	})
+
+	return l.close, nil
+}
+
+// rpcSubject returns <prefix>.rpc.<service>.<version>.<method>
+func (b *RedisBus) rpcSubject(service, version, method string) string {
+	return fmt.Sprintf("%s.rpc.%s.%s.%s", b.prefix, service, version, method)
+}
+
+// partitionKey returns the stream for one partition of a kind
+func (b *RedisBus) partitionKey(kind string, p int) string {
+	return fmt.Sprintf("%s.%s.%d", b.prefix, kind, p)
+}
+
+// broadcastKey returns <prefix>.<kind>.<sessionID>, or <prefix>.<kind> for
+// the all-session stream
+func (b *RedisBus) broadcastKey(kind, sessionID string) string {
+	if sessionID == "" {
+		return fmt.Sprintf("%s.%s", b.prefix, kind)
+	}
+	return fmt.Sprintf("%s.%s.%s", b.prefix, kind, sessionID)
+}
+
+// Close stops all subscriptions and services and closes the connection
+func (b *RedisBus) Close() {
+	b.stopAll()
+	b.cancel()
+	b.loops.Wait()
+	b.rdb.Close()
+}
+
+// entryValues flattens headers and payload into stream entry fields
+func entryValues(header nats.Header, data []byte) map[string]interface{} {
+	values := map[string]interface{}{redisDataField: data}
+	for key := range header {
+		values[key] = header.Get(key)
+	}
+	return values
+}
+
+// entryFields extracts the session, payload and trace from a stream entry
+func entryFields(values map[string]interface{}) (string, []byte, Trace) {
+	header := nats.Header{}
+	var data []byte
+
+	for key, value := range values {
+		s, _ := value.(string)
+		if key == redisDataField {
+			data = []byte(s)
+		} else {
+			header.Set(key, s)
+		}
+	}
+
+	return header.Get(sessionIDHeader), data, traceFromHeader(header)
+}
+
+// redisLoop is a background reader owned by a subscription or service
+type redisLoop struct {
+	// Cancelled to stop reading new entries
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Closed to abandon the entry being retried
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// startLoop runs fn until its loop is closed or the bus is
+func (b *RedisBus) startLoop(fn func(l *redisLoop)) *redisLoop {
+	ctx, cancel := context.WithCancel(b.ctx)
+	l := &redisLoop{
+		ctx:    ctx,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	b.loops.Add(1)
+	go func() {
+		defer b.loops.Done()
+		defer close(l.done)
+		fn(l)
+	}()
+
+	return l
+}
+
+// signal asks the loop to end; draining finishes the entries already read
+func (l *redisLoop) signal(drain bool) {
+	if !drain {
+		l.stopOnce.Do(func() { close(l.stop) })
+	}
+	l.cancel()
+}
+
+// close ends the loop and waits for it
+func (l *redisLoop) close(drain bool) {
+	l.signal(drain)
+	<-l.done
+}
+
+func (l *redisLoop) stopped() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d or until the loop ends
+func (l *redisLoop) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-l.ctx.Done():
+	}
+}
+
+// redisLease gives one group member exclusive ownership of a partition.
+// It is renewed in the background while held; if renewal fails the member
+// stops reading the partition after the entry in hand.
+type redisLease struct {
+	rdb   *redis.Client
+	key   string
+	owner string
+	ttl   time.Duration
+
+	held      atomic.Bool
+	stopRenew chan struct{}
+}
+
+// acquire takes the lease if it is free
+func (le *redisLease) acquire(ctx context.Context) bool {
+	ok, err := le.rdb.SetNX(ctx, le.key, le.owner, le.ttl).Result()
+	if err != nil || !ok {
+		return false
+	}
+
+	le.held.Store(true)
+	le.stopRenew = make(chan struct{})
+	go le.renew(le.stopRenew)
+	return true
+}
+
+func (le *redisLease) renew(stop chan struct{}) {
+	ticker := time.NewTicker(le.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), le.ttl/3)
+			n, err := renewLease.Run(ctx, le.rdb, []string{le.key}, le.owner, le.ttl.Milliseconds()).Int()
+			cancel()
+			if err != nil || n == 0 {
+				log.Printf("Lost lease %s: %v", le.key, err)
+				le.held.Store(false)
+				return
+			}
+		}
+	}
+}
+
+// release gives the lease up so another member can take over at once
+func (le *redisLease) release() {
+	if le.stopRenew == nil {
+		return
+	}
+	close(le.stopRenew)
+	le.stopRenew = nil
+	le.held.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), consumerDeleteTimeout)
+	defer cancel()
+	releaseLease.Run(ctx, le.rdb, []string{le.key}, le.owner)
+}
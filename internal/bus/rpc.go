@@ -0,0 +1,309 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Timeout applied to requests whose context has no deadline
+	defaultRequestTimeout = 5 * time.Second
+
+	// Header carrying the caller's deadline in Unix nanoseconds
+	deadlineHeader = "Voice-Deadline"
+
+	// Method every service answers with its name, version and methods
+	infoMethod = "_info"
+)
+
+// RPCError is an error returned by a remote handler
+type RPCError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Common RPC error codes
+const (
+	CodeNotFound      = "not_found"
+	CodeBadRequest    = "bad_request"
+	CodeInternal      = "internal"
+	CodeUnimplemented = "unimplemented"
+)
+
+// NewRPCError creates an error that is passed to the caller with its code
+func NewRPCError(code, format string, args ...interface{}) *RPCError {
+	return &RPCError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// rpcReply is the wire format of every response
+type rpcReply struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+}
+
+// ServiceInfo describes a running service, returned by its _info method
+type ServiceInfo struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Methods []string `json:"methods"`
+}
+
+// Request calls method on a service and decodes the result into resp
+// (which may be nil). req is JSON-encoded. The call fails when ctx is done,
+// or after defaultRequestTimeout if ctx has no deadline.
+func (c *Client) Request(ctx context.Context, service, version, method string, req, resp interface{}) error {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	msg := nats.NewMsg(c.rpcSubject(service, version, method))
+	msg.Data = data
+	if _, ok := TraceFromContext(ctx); ok {
+		msg.Header = traceHeader(outgoingTrace(ctx, ""), "")
+		msg.Header.Del(sessionIDHeader)
+	}
+	msg.Header.Set(deadlineHeader, strconv.FormatInt(deadline.UnixNano(), 10))
+
+	reply, err := c.nc.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		if errors.Is(err, nats.ErrNoResponders) {
+			return NewRPCError(CodeUnimplemented, "no %s %s service is running", service, version)
+		}
+		return fmt.Errorf("request %s.%s failed: %w", service, method, err)
+	}
+
+	return decodeReply(reply.Data, resp)
+}
+
+// requestContext applies defaultRequestTimeout if ctx has no deadline
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, defaultRequestTimeout)
+}
+
+// decodeReply unpacks a reply into resp, or returns the remote error
+func decodeReply(data []byte, resp interface{}) error {
+	var r rpcReply
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("failed to decode reply: %w", err)
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+
+	if resp != nil && len(r.Result) > 0 {
+		if err := json.Unmarshal(r.Result, resp); err != nil {
+			return fmt.Errorf("failed to decode result: %w", err)
+		}
+	}
+	return nil
+}
+
+// ServiceInfo asks a running service for its description
+func (c *Client) ServiceInfo(ctx context.Context, service, version string) (*ServiceInfo, error) {
+	return serviceInfo(ctx, c, service, version)
+}
+
+func serviceInfo(ctx context.Context, b Bus, service, version string) (*ServiceInfo, error) {
+	var info ServiceInfo
+	if err := b.Request(ctx, service, version, infoMethod, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// rpcSubject returns <prefix>.rpc.<service>.<version>.<method>
+func (c *Client) rpcSubject(service, version, method string) string {
+	return fmt.Sprintf("%s.rpc.%s.%s.%s", c.prefix, service, version, method)
+}
+
+// serveRPC answers requests for one method through a NATS queue group
+func (c *Client) serveRPC(service, version, method string, serve rpcServeFunc) (func(drain bool), error) {
+	subject := c.rpcSubject(service, version, method)
+	queue := fmt.Sprintf("%s-%s", service, version)
+
+	sub, err := c.nc.QueueSubscribe(subject, queue, func(msg *nats.Msg) {
+		ctx := context.Background()
+		if ns, err := strconv.ParseInt(msg.Header.Get(deadlineHeader), 10, 64); err == nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, time.Unix(0, ns))
+			defer cancel()
+		}
+		if trace := traceFromHeader(msg.Header); trace.TraceID != "" {
+			ctx = WithTrace(ctx, trace)
+		}
+
+		if err := msg.Respond(serve(ctx, msg.Data)); err != nil {
+			log.Printf("Service %s: failed to respond on %s: %v", service, msg.Subject, err)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe %s: %w", subject, err)
+	}
+
+	return func(drain bool) { closeCore([]*nats.Subscription{sub}, drain) }, nil
+}
+
+// rpcServeFunc handles one encoded request and returns the encoded reply
+type rpcServeFunc func(ctx context.Context, data []byte) []byte
+
+// rpcServer is implemented by each backend to deliver requests for a
+// method to one replica of a service
+type rpcServer interface {
+	serveRPC(service, version, method string, serve rpcServeFunc) (stop func(drain bool), err error)
+}
+
+// RPCHandler handles a request. The context carries the caller's deadline.
+// Returning an *RPCError passes its code to the caller; other errors are
+// reported as internal errors.
+type RPCHandler func(ctx context.Context, req json.RawMessage) (interface{}, error)
+
+// Service answers requests for a named, versioned set of methods. Replicas
+// of the same service share requests through a queue group, so each
+// request is answered once.
+type Service struct {
+	server   rpcServer
+	name     string
+	version  string
+	handlers map[string]RPCHandler
+	stops    []func(drain bool)
+	mu       sync.Mutex
+}
+
+// NewService creates a service; register methods with Handle, then Start
+func (c *Client) NewService(name, version string) *Service {
+	return newService(c, name, version)
+}
+
+func newService(server rpcServer, name, version string) *Service {
+	return &Service{
+		server:   server,
+		name:     name,
+		version:  version,
+		handlers: make(map[string]RPCHandler),
+	}
+}
+
+// Handle registers a method handler
+func (s *Service) Handle(method string, handler RPCHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if method == infoMethod {
+		return fmt.Errorf("method %s is reserved", method)
+	}
+	if _, exists := s.handlers[method]; exists {
+		return fmt.Errorf("method %s already registered", method)
+	}
+	if len(s.stops) > 0 {
+		return fmt.Errorf("service %s already started", s.name)
+	}
+
+	s.handlers[method] = handler
+	return nil
+}
+
+// Start subscribes every registered method
+func (s *Service) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	methods := map[string]RPCHandler{infoMethod: s.info}
+	for method, handler := range s.handlers {
+		methods[method] = handler
+	}
+
+	for method, handler := range methods {
+		stop, err := s.server.serveRPC(s.name, s.version, method, s.serve(handler))
+		if err != nil {
+			s.unsubscribe(false)
+			return err
+		}
+		s.stops = append(s.stops, stop)
+	}
+
+	log.Printf("Service %s %s listening (%d methods)", s.name, s.version, len(s.handlers))
+	return nil
+}
+
+// Stop drains in-flight requests and unsubscribes
+func (s *Service) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unsubscribe(true)
+}
+
+func (s *Service) unsubscribe(drain bool) {
+	for _, stop := range s.stops {
+		stop(drain)
+	}
+	s.stops = nil
+}
+
+// info describes the service
+func (s *Service) info(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	methods := make([]string, 0, len(s.handlers))
+	for method := range s.handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	return ServiceInfo{Name: s.name, Version: s.version, Methods: methods}, nil
+}
+
+// serve adapts a handler to encoded requests and replies
+func (s *Service) serve(handler RPCHandler) rpcServeFunc {
+	return func(ctx context.Context, data []byte) []byte {
+		result, err := callRPC(ctx, handler, data)
+
+		var reply rpcReply
+		if err != nil {
+			var rpcErr *RPCError
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &RPCError{Code: CodeInternal, Message: err.Error()}
+			}
+			reply.Error = rpcErr
+		} else if reply.Result, err = json.Marshal(result); err != nil {
+			reply.Error = &RPCError{Code: CodeInternal, Message: fmt.Sprintf("failed to marshal result: %v", err)}
+		}
+
+		data, _ = json.Marshal(reply)
+		return data
+	}
+}
+
+// callRPC runs handler, converting a panic into an internal error
+func callRPC(ctx context.Context, handler RPCHandler, data []byte) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("RPC handler panic: %v\n%s", r, debug.Stack())
+			err = &RPCError{Code: CodeInternal, Message: fmt.Sprintf("handler panic: %v", r)}
+		}
+	}()
+
+	return handler(ctx, json.RawMessage(data))
+}
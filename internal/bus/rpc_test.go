@@ -0,0 +1,296 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+
+	"voice-gateway/internal/config"
+)
+
+// startNATS runs an in-process NATS server with JetStream for the test
+func startNATS(t *testing.T) string {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		s.Shutdown()
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(func() {
+		s.Shutdown()
+		s.WaitForShutdown()
+	})
+	return s.ClientURL()
+}
+
+// newTestClient connects a client to the server at url
+func newTestClient(t *testing.T, url string) *Client {
+	t.Helper()
+	cfg := config.Load().NATS
+	cfg.URL = url
+	cfg.Subject = "test."
+	cfg.StreamPrefix = "TEST_"
+	cfg.DeadLetterSubject = ""
+	for _, sc := range []*config.StreamConfig{&cfg.AudioStream, &cfg.TextStream, &cfg.TTSStream, &cfg.ControlStream, &cfg.DeadLetterStream} {
+		sc.Storage = "memory"
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// startService registers handlers on a new service and starts it
+func startService(t *testing.T, c *Client, name string, handlers map[string]RPCHandler) *Service {
+	t.Helper()
+	svc := c.NewService(name, "v1")
+	for method, handler := range handlers {
+		if err := svc.Handle(method, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := svc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(svc.Stop)
+	return svc
+}
+
+func rpcCode(err error) string {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Code
+	}
+	return ""
+}
+
+func TestRPCDeadline(t *testing.T) {
+	c := newTestClient(t, startNATS(t))
+	startService(t, c, "clock", map[string]RPCHandler{
+		"deadline": func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				return nil, NewRPCError(CodeBadRequest, "no deadline")
+			}
+			return deadline.UnixNano(), nil
+		},
+		"wait": func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+
+	t.Run("caller's", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		want, _ := ctx.Deadline()
+
+		var got int64
+		if err := c.Request(ctx, "clock", "v1", "deadline", nil, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want.UnixNano() {
+			t.Errorf("handler deadline %v, caller's %v", time.Unix(0, got), want)
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		start := time.Now()
+		var got int64
+		if err := c.Request(context.Background(), "clock", "v1", "deadline", nil, &got); err != nil {
+			t.Fatal(err)
+		}
+		remaining := time.Unix(0, got).Sub(start)
+		if remaining < defaultRequestTimeout-time.Second || remaining > defaultRequestTimeout+time.Second {
+			t.Errorf("handler deadline %v after the request, want about %v", remaining, defaultRequestTimeout)
+		}
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := c.Request(ctx, "clock", "v1", "wait", nil, nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("request returned %v, want deadline exceeded", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("request took %v to expire", elapsed)
+		}
+	})
+}
+
+func TestRPCErrors(t *testing.T) {
+	c := newTestClient(t, startNATS(t))
+	startService(t, c, "errors", map[string]RPCHandler{
+		"not_found": func(context.Context, json.RawMessage) (interface{}, error) {
+			return nil, NewRPCError(CodeNotFound, "no call %d", 7)
+		},
+		"wrapped": func(context.Context, json.RawMessage) (interface{}, error) {
+			return nil, fmt.Errorf("lookup: %w", NewRPCError(CodeBadRequest, "bad id"))
+		},
+		"plain": func(context.Context, json.RawMessage) (interface{}, error) {
+			return nil, errors.New("disk full")
+		},
+		"unmarshalable": func(context.Context, json.RawMessage) (interface{}, error) {
+			return make(chan int), nil
+		},
+		"panic": func(context.Context, json.RawMessage) (interface{}, error) {
+			panic("boom")
+		},
+		"ok": func(context.Context, json.RawMessage) (interface{}, error) {
+			return "fine", nil
+		},
+	})
+
+	tests := []struct {
+		method  string
+		code    string
+		message string
+	}{
+		{"not_found", CodeNotFound, "no call 7"},
+		{"wrapped", CodeBadRequest, "bad id"},
+		{"plain", CodeInternal, "disk full"},
+		{"unmarshalable", CodeInternal, "failed to marshal result"},
+		{"panic", CodeInternal, "handler panic: boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			err := c.Request(context.Background(), "errors", "v1", tt.method, nil, nil)
+			var rpcErr *RPCError
+			if !errors.As(err, &rpcErr) {
+				t.Fatalf("request returned %v, want an RPC error", err)
+			}
+			if rpcErr.Code != tt.code || !strings.HasPrefix(rpcErr.Message, tt.message) {
+				t.Errorf("request returned %v, want %s: %s", rpcErr, tt.code, tt.message)
+			}
+		})
+	}
+
+	// The service keeps answering after a handler panics
+	var out string
+	if err := c.Request(context.Background(), "errors", "v1", "ok", nil, &out); err != nil || out != "fine" {
+		t.Errorf("request after panic returned %q, %v", out, err)
+	}
+}
+
+func TestRPCNoResponders(t *testing.T) {
+	c := newTestClient(t, startNATS(t))
+
+	start := time.Now()
+	err := c.Request(context.Background(), "missing", "v1", "anything", nil, nil)
+	if code := rpcCode(err); code != CodeUnimplemented {
+		t.Fatalf("request returned %v, want %s", err, CodeUnimplemented)
+	}
+	// Reported straight away rather than after the request times out
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v to fail", elapsed)
+	}
+
+	// A stopped service no longer responds, nor does another version
+	svc := c.NewService("stopped", "v1")
+	if err := svc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ServiceInfo(context.Background(), "stopped", "v1"); err != nil {
+		t.Fatalf("running service: %v", err)
+	}
+	if _, err := c.ServiceInfo(context.Background(), "stopped", "v2"); rpcCode(err) != CodeUnimplemented {
+		t.Errorf("other version returned %v, want %s", err, CodeUnimplemented)
+	}
+	svc.Stop()
+	if _, err := c.ServiceInfo(context.Background(), "stopped", "v1"); rpcCode(err) != CodeUnimplemented {
+		t.Errorf("stopped service returned %v, want %s", err, CodeUnimplemented)
+	}
+}
+
+func TestRPCQueueGroup(t *testing.T) {
+	url := startNATS(t)
+	caller := newTestClient(t, url)
+
+	const replicas, requests = 3, 60
+	var mu sync.Mutex
+	served := make(map[int][]int) // request -> replicas that handled it
+	for replica := range replicas {
+		startService(t, newTestClient(t, url), "counter", map[string]RPCHandler{
+			"serve": func(_ context.Context, req json.RawMessage) (interface{}, error) {
+				var n int
+				if err := json.Unmarshal(req, &n); err != nil {
+					return nil, NewRPCError(CodeBadRequest, "%v", err)
+				}
+				mu.Lock()
+				served[n] = append(served[n], replica)
+				mu.Unlock()
+				return replica, nil
+			},
+		})
+	}
+
+	// Every replica answers _info, and only one does for each call
+	info, err := caller.ServiceInfo(context.Background(), "counter", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "counter" || info.Version != "v1" || len(info.Methods) != 1 || info.Methods[0] != "serve" {
+		t.Errorf("info returned %+v", info)
+	}
+
+	var wg sync.WaitGroup
+	answers := make([]int, requests)
+	errs := make(chan error, requests)
+	for n := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := caller.Request(context.Background(), "counter", "v1", "serve", n, &answers[n]); err != nil {
+				errs <- fmt.Errorf("request %d: %w", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	perReplica := make([]int, replicas)
+	for n := range requests {
+		handled := served[n]
+		if len(handled) != 1 {
+			t.Errorf("request %d handled by replicas %v, want exactly one", n, handled)
+			continue
+		}
+		if answers[n] != handled[0] {
+			t.Errorf("request %d answered by replica %d, handled by %d", n, answers[n], handled[0])
+		}
+		perReplica[handled[0]]++
+	}
+	for replica, count := range perReplica {
+		if count == 0 {
+			t.Errorf("replica %d handled no requests: %v", replica, perReplica)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package bus
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"voice-gateway/internal/config"
+)
+
+// initStreams creates or updates the JetStream streams described by the
+// configuration
+func (c *Client) initStreams(cfg config.NATSConfig) error {
+	streams := []struct {
+		kind        string
+		name        string
+		subjects    []string
+		description string
+		config      config.StreamConfig
+	}{
+		{kindAudio, c.streamName(kindAudio), []string{c.prefix + ".audio.>"}, "Audio frames stream", cfg.AudioStream},
+		{kindText, c.streamName(kindText), []string{c.prefix + ".text.>"}, "Transcripts stream", cfg.TextStream},
+		{kindTTS, c.streamName(kindTTS), []string{c.prefix + ".tts.>"}, "TTS audio stream", cfg.TTSStream},
+		{kindControl, c.streamName(kindControl), []string{c.prefix + ".control.>", c.prefix + ".events.>"}, "Control commands and lifecycle events", cfg.ControlStream},
+		{"", c.streamPrefix + "DLQ", []string{c.deadLetterSubject + ".>"}, "Dead-lettered messages", cfg.DeadLetterStream},
+	}
+
+	for _, s := range streams {
+		// Core kinds bypass JetStream entirely
+		if s.kind != "" && c.transports[s.kind] == TransportCore {
+			continue
+		}
+
+		sc, err := streamConfig(s.name, s.subjects, s.description, s.config)
+		if err != nil {
+			return fmt.Errorf("invalid %s stream config: %w", s.name, err)
+		}
+
+		if _, err := c.js.CreateOrUpdateStream(c.ctx, sc); err != nil {
+			return fmt.Errorf("failed to create %s stream: %w", s.name, err)
+		}
+	}
+
+	return nil
+}
+
+// streamConfig converts a stream definition to its JetStream form
+func streamConfig(name string, subjects []string, description string, cfg config.StreamConfig) (jetstream.StreamConfig, error) {
+	sc := jetstream.StreamConfig{
+		Name:              name,
+		Subjects:          subjects,
+		Description:       description,
+		Replicas:          cfg.Replicas,
+		MaxAge:            cfg.MaxAge,
+		MaxBytes:          cfg.MaxBytes,
+		MaxMsgsPerSubject: cfg.MaxMsgsPerSubject,
+	}
+
+	if sc.Replicas < 1 {
+		return sc, fmt.Errorf("replicas must be at least 1")
+	}
+
+	switch strings.ToLower(cfg.Storage) {
+	case "memory":
+		sc.Storage = jetstream.MemoryStorage
+	case "file":
+		sc.Storage = jetstream.FileStorage
+	default:
+		return sc, fmt.Errorf("unknown storage type %q", cfg.Storage)
+	}
+
+	switch strings.ToLower(cfg.Retention) {
+	case "limits":
+		sc.Retention = jetstream.LimitsPolicy
+	case "workqueue", "work-queue":
+		sc.Retention = jetstream.WorkQueuePolicy
+	case "interest":
+		sc.Retention = jetstream.InterestPolicy
+	default:
+		return sc, fmt.Errorf("unknown retention policy %q", cfg.Retention)
+	}
+
+	switch strings.ToLower(cfg.Discard) {
+	case "old":
+		sc.Discard = jetstream.DiscardOld
+	case "new":
+		sc.Discard = jetstream.DiscardNew
+	default:
+		return sc, fmt.Errorf("unknown discard policy %q", cfg.Discard)
+	}
+
+	return sc, nil
+}
@@ -0,0 +1,196 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Timeout for deleting a consumer on the server after unsubscribing
+const consumerDeleteTimeout = 5 * time.Second
+
+// Subscription is an active consumer created by one of the Subscribe
+// methods. Session subscriptions own their consumer and delete it when
+// stopped; group subscriptions share durable consumers with other group
+// members and only stop consuming.
+type Subscription struct {
+	sessionID string
+	// Backend-specific teardown
+	closer   func(drain bool) error
+	registry *subscriptions
+
+	once sync.Once
+	err  error
+}
+
+// SessionID returns the session the subscription belongs to, or "" for
+// group and all-session subscriptions
+func (s *Subscription) SessionID() string {
+	return s.sessionID
+}
+
+// Stop stops consuming immediately, discarding buffered messages, and
+// deletes any consumer owned by the subscription
+func (s *Subscription) Stop() error {
+	return s.close(false)
+}
+
+// Drain finishes handling buffered messages before unsubscribing and
+// deleting any consumer owned by the subscription
+func (s *Subscription) Drain() error {
+	return s.close(true)
+}
+
+func (s *Subscription) close(drain bool) error {
+	s.once.Do(func() {
+		s.err = s.closer(drain)
+		s.registry.untrack(s)
+	})
+
+	return s.err
+}
+
+// subscriptions tracks active subscriptions by session ID ("" for group
+// and all-session subscriptions) so they can be cleaned up together. Each
+// backend embeds one.
+type subscriptions struct {
+	subs map[string][]*Subscription
+	mu   sync.Mutex
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		subs: make(map[string][]*Subscription),
+	}
+}
+
+// track wraps a backend teardown function in a tracked Subscription
+func (r *subscriptions) track(sessionID string, closer func(drain bool) error) *Subscription {
+	sub := &Subscription{
+		sessionID: sessionID,
+		closer:    closer,
+		registry:  r,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subs[sessionID] = append(r.subs[sessionID], sub)
+	return sub
+}
+
+// untrack forgets a subscription once it has been stopped
+func (r *subscriptions) untrack(sub *Subscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	subs := r.subs[sub.sessionID]
+	for i, s := range subs {
+		if s == sub {
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+
+	if len(subs) == 0 {
+		delete(r.subs, sub.sessionID)
+	} else {
+		r.subs[sub.sessionID] = subs
+	}
+}
+
+// Subscriptions returns the active subscriptions for a session
+func (r *subscriptions) Subscriptions(sessionID string) []*Subscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Subscription(nil), r.subs[sessionID]...)
+}
+
+// CloseSession drains every subscription belonging to a session and deletes
+// their consumers. It is meant to be called on session teardown, e.g. from
+// a session.Manager OnDelete hook.
+func (r *subscriptions) CloseSession(sessionID string) error {
+	return closeAll(r.Subscriptions(sessionID), true)
+}
+
+// stopAll stops every tracked subscription
+func (r *subscriptions) stopAll() {
+	r.mu.Lock()
+	var all []*Subscription
+	for _, subs := range r.subs {
+		all = append(all, subs...)
+	}
+	r.mu.Unlock()
+
+	closeAll(all, false)
+}
+
+// closeAll closes subscriptions in parallel, since backends may take a
+// moment to interrupt a blocked read
+func closeAll(subs []*Subscription, drain bool) error {
+	errs := make([]error, len(subs))
+
+	var wg sync.WaitGroup
+	for i, sub := range subs {
+		wg.Add(1)
+		go func(i int, sub *Subscription) {
+			defer wg.Done()
+			errs[i] = sub.close(drain)
+		}(i, sub)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// natsConsumers holds the NATS resources behind one Subscription
+type natsConsumers struct {
+	js     jetstream.JetStream
+	stream string
+
+	// Consumers owned by the subscription, deleted on close
+	consumers []string
+	contexts  []jetstream.ConsumeContext
+
+	// Plain NATS subscriptions for TransportCore kinds
+	natsSubs []*nats.Subscription
+}
+
+func (n *natsConsumers) close(drain bool) error {
+	for _, cc := range n.contexts {
+		if drain {
+			cc.Drain()
+		} else {
+			cc.Stop()
+		}
+	}
+	for _, cc := range n.contexts {
+		<-cc.Closed()
+	}
+	closeCore(n.natsSubs, drain)
+
+	return n.deleteConsumers()
+}
+
+func (n *natsConsumers) deleteConsumers() error {
+	if len(n.consumers) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), consumerDeleteTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, name := range n.consumers {
+		err := n.js.DeleteConsumer(ctx, n.stream, name)
+		if err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+			errs = append(errs, fmt.Errorf("failed to delete consumer %s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
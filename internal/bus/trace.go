@@ -0,0 +1,137 @@
+package bus
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// Headers carrying trace context on every published message
+const (
+	traceIDHeader    = "Voice-Trace-Id"
+	sessionIDHeader  = "Voice-Session-Id"
+	turnIDHeader     = "Voice-Turn-Id"
+	originAtHeader   = "Voice-Origin-At"
+	producedAtHeader = "Voice-Produced-At"
+)
+
+// Trace follows one utterance from RTP ingest through ASR, LLM and TTS.
+// Workers pass the trace of the message they are handling to everything
+// they publish in response, so every hop shares the trace ID and origin
+// time.
+type Trace struct {
+	TraceID string
+	TurnID  string
+	// When the first message of the trace was published
+	OriginAt time.Time
+	// When this message was published; set by the bus
+	ProducedAt time.Time
+}
+
+// NewTrace starts a trace for a turn
+func NewTrace(turnID string) Trace {
+	return Trace{
+		TraceID:  newTraceID(),
+		TurnID:   turnID,
+		OriginAt: time.Now(),
+	}
+}
+
+// Latency returns the time since the trace started
+func (t Trace) Latency() time.Duration {
+	if t.OriginAt.IsZero() {
+		return 0
+	}
+	return time.Since(t.OriginAt)
+}
+
+// HopLatency returns the time since this message was published
+func (t Trace) HopLatency() time.Duration {
+	if t.ProducedAt.IsZero() {
+		return 0
+	}
+	return time.Since(t.ProducedAt)
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context carrying trace, used by publishes and
+// requests made with it
+func WithTrace(ctx context.Context, trace Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// TraceFromContext returns the trace carried by ctx, if any
+func TraceFromContext(ctx context.Context) (Trace, bool) {
+	trace, ok := ctx.Value(traceKey{}).(Trace)
+	return trace, ok
+}
+
+// Context returns a context carrying the message's trace, for publishing
+// results and making requests on its behalf
+func (m *Message) Context() context.Context {
+	return WithTrace(context.Background(), m.Trace)
+}
+
+// outgoingTrace returns the trace to publish with: the one carried by ctx,
+// or a new one, stamped with the current time. turnID fills in a missing
+// turn, e.g. from an event.
+func outgoingTrace(ctx context.Context, turnID string) Trace {
+	trace, ok := TraceFromContext(ctx)
+	if !ok || trace.TraceID == "" {
+		trace = NewTrace(turnID)
+	}
+	if trace.TurnID == "" {
+		trace.TurnID = turnID
+	}
+	if trace.OriginAt.IsZero() {
+		trace.OriginAt = time.Now()
+	}
+	trace.ProducedAt = time.Now()
+	return trace
+}
+
+// traceHeader builds the NATS headers for a message
+func traceHeader(trace Trace, sessionID string) nats.Header {
+	h := nats.Header{}
+	h.Set(traceIDHeader, trace.TraceID)
+	h.Set(sessionIDHeader, sessionID)
+	if trace.TurnID != "" {
+		h.Set(turnIDHeader, trace.TurnID)
+	}
+	h.Set(originAtHeader, strconv.FormatInt(trace.OriginAt.UnixNano(), 10))
+	h.Set(producedAtHeader, strconv.FormatInt(trace.ProducedAt.UnixNano(), 10))
+	return h
+}
+
+// traceFromHeader extracts trace context from NATS headers. Messages from
+// publishers without trace support get an empty trace.
+func traceFromHeader(h nats.Header) Trace {
+	if h == nil {
+		return Trace{}
+	}
+
+	return Trace{
+		TraceID:    h.Get(traceIDHeader),
+		TurnID:     h.Get(turnIDHeader),
+		OriginAt:   parseUnixNano(h.Get(originAtHeader)),
+		ProducedAt: parseUnixNano(h.Get(producedAtHeader)),
+	}
+}
+
+func parseUnixNano(s string) time.Time {
+	ns, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// newTraceID returns a 32-hex-digit ID, the same shape as a W3C trace ID
+func newTraceID() string {
+	return strings.ReplaceAll(uuid.NewString(), "-", "")
+}
@@ -0,0 +1,167 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Transport selects how messages of a kind travel over NATS
+type Transport int
+
+const (
+	// TransportJetStream persists every message and waits for the server
+	// ack on each publish. Messages are redelivered until handled.
+	TransportJetStream Transport = iota
+
+	// TransportAsync persists messages but publishes without waiting for
+	// each ack; acks are collected in the background and failures logged.
+	TransportAsync
+
+	// TransportCore uses plain NATS publish/subscribe: lowest latency, no
+	// persistence, no acks and no redelivery. Suited to live audio frames
+	// where a late frame is as useless as a lost one. No stream is created
+	// for core kinds.
+	TransportCore
+)
+
+const (
+	// Outstanding async publishes before PublishAsync blocks
+	asyncMaxPending = 1024
+
+	// How long Close waits for outstanding async publish acks
+	asyncFlushTimeout = 5 * time.Second
+
+	// How long Drain waits for core subscriptions to finish
+	coreDrainTimeout = 5 * time.Second
+)
+
+// ParseTransport parses a transport name: "jetstream", "async" or "core"
+func ParseTransport(name string) (Transport, error) {
+	switch strings.ToLower(name) {
+	case "", "jetstream":
+		return TransportJetStream, nil
+	case "async":
+		return TransportAsync, nil
+	case "core":
+		return TransportCore, nil
+	default:
+		return 0, fmt.Errorf("unknown transport %q", name)
+	}
+}
+
+func (t Transport) String() string {
+	switch t {
+	case TransportJetStream:
+		return "jetstream"
+	case TransportAsync:
+		return "async"
+	case TransportCore:
+		return "core"
+	default:
+		return fmt.Sprintf("transport(%d)", int(t))
+	}
+}
+
+// publish sends data using the transport configured for kind
+func (c *Client) publish(ctx context.Context, kind, subject string, data []byte, header nats.Header) error {
+	msg := &nats.Msg{
+		Subject: subject,
+		Data:    data,
+		Header:  header,
+	}
+
+	switch c.transports[kind] {
+	case TransportCore:
+		return c.nc.PublishMsg(msg)
+	case TransportAsync:
+		_, err := c.js.PublishMsgAsync(msg)
+		return err
+	default:
+		_, err := c.js.PublishMsg(ctx, msg)
+		return err
+	}
+}
+
+// flushAsync waits for outstanding async publishes to be acknowledged
+func (c *Client) flushAsync() {
+	if c.js.PublishAsyncPending() == 0 {
+		return
+	}
+
+	select {
+	case <-c.js.PublishAsyncComplete():
+	case <-time.After(asyncFlushTimeout):
+		log.Printf("Warning: %d async publishes unacknowledged at close", c.js.PublishAsyncPending())
+	}
+}
+
+// onAsyncPublishError logs publishes that the server failed to ack
+func onAsyncPublishError(_ jetstream.JetStream, msg *nats.Msg, err error) {
+	log.Printf("Async publish to %s failed: %v", msg.Subject, err)
+}
+
+// subscribeCore subscribes with plain NATS. With a queue group, members
+// share messages but NATS picks a member per message, so per-session
+// ordering is only guaranteed with a single member.
+func (c *Client) subscribeCore(kind, subject, queue string, handler Handler) (*nats.Subscription, error) {
+	cb := func(msg *nats.Msg) {
+		sid := sessionFromSubject(msg.Subject)
+
+		m, err := decodeMessage(kind, sid, msg.Data)
+		if err != nil {
+			log.Printf("Session %s: discarding malformed %s message: %v", sid, kind, err)
+			return
+		}
+		m.Attempt = 1
+		m.Trace = traceFromHeader(msg.Header)
+
+		// Nothing to redeliver from; report and move on
+		if err := runHandler(handler, m); err != nil {
+			log.Printf("Session %s: %s handler failed: %v", sid, kind, err)
+		}
+	}
+
+	var (
+		ns  *nats.Subscription
+		err error
+	)
+	if queue != "" {
+		ns, err = c.nc.QueueSubscribe(subject, queue, cb)
+	} else {
+		ns, err = c.nc.Subscribe(subject, cb)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+	}
+
+	return ns, nil
+}
+
+// closeCore unsubscribes core subscriptions, optionally letting pending
+// messages be handled first
+func closeCore(subs []*nats.Subscription, drain bool) {
+	for _, ns := range subs {
+		if drain {
+			ns.Drain()
+		} else {
+			ns.Unsubscribe()
+		}
+	}
+
+	if !drain {
+		return
+	}
+
+	deadline := time.Now().Add(coreDrainTimeout)
+	for _, ns := range subs {
+		for ns.IsValid() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
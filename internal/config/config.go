@@ -3,19 +3,29 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds all application configuration
 type Config struct {
-	Server   ServerConfig
-	WebRTC   WebRTCConfig
-	NATS     NATSConfig
-	Services ServicesConfig
+	Server    ServerConfig
+	WebRTC    WebRTCConfig
+	Bus       BusConfig
+	NATS      NATSConfig
+	Redis     RedisConfig
+	Services  ServicesConfig
+	Recording RecordingConfig
+	Audio     AudioConfig
 }
 
 type ServerConfig struct {
 	Host string
 	Port int
+	// Bearer tokens identifying the tenant making an offer, as
+	// "tenant=token" pairs. Tenants named by the client without one are
+	// recorded in the session but not trusted, e.g. to opt out of recording.
+	TenantTokens []string
 }
 
 type WebRTCConfig struct {
@@ -24,9 +34,164 @@ type WebRTCConfig struct {
 	UDPPortMax int
 }
 
+type BusConfig struct {
+	// "nats", "redis", or "memory" to run the whole pipeline in one process
+	// without external services. The redis and memory backends use the
+	// subject, partition and delivery settings from NATSConfig.
+	Backend string
+}
+
+// RedisConfig configures the Redis Streams bus backend
+type RedisConfig struct {
+	// e.g. redis://:password@localhost:6379/0
+	URL string
+	// Approximate cap on entries per stream; older entries are trimmed
+	MaxLen int64
+	// How long a worker group member owns a partition without renewing
+	LeaseTTL time.Duration
+}
+
 type NATSConfig struct {
-	URL     string
+	URL string
+	// Subject prefix for every bus subject, e.g. "voice." gives
+	// voice.audio.>, voice.text.> and voice.tts.>
 	Subject string
+	// Number of subject partitions sessions are hashed into; must be the
+	// same for every publisher and consumer
+	Partitions int
+	// Delivery attempts before a message is dead-lettered
+	MaxDeliver int
+	// Subject prefix failed messages are republished under; defaults to
+	// <Subject>dlq
+	DeadLetterSubject string
+
+	// Prepended to JetStream stream names (AUDIO, TEXT, ...) so several
+	// deployments or test runs can share a server
+	StreamPrefix string
+
+	// JetStream stream definitions
+	AudioStream      StreamConfig
+	TextStream       StreamConfig
+	TTSStream        StreamConfig
+	ControlStream    StreamConfig
+	DeadLetterStream StreamConfig
+}
+
+// StreamConfig describes a JetStream stream
+type StreamConfig struct {
+	Storage   string // "memory" or "file"
+	Replicas  int
+	Retention string // "limits", "workqueue" or "interest"
+	MaxAge    time.Duration
+	MaxBytes  int64 // -1 for unlimited
+	// Messages kept per subject, i.e. per session (-1 for unlimited)
+	MaxMsgsPerSubject int64
+	Discard           string // "old" or "new"
+	// "jetstream" (durable, acked publish), "async" (durable, batched acks)
+	// or "core" (plain NATS, no persistence)
+	Transport string
+}
+
+// RecordingConfig controls call recording
+type RecordingConfig struct {
+	Enabled bool
+	// Each session is recorded into <Dir>/<sessionID>/
+	Dir string
+	// Tenants whose calls are never recorded
+	OptOutTenants []string
+	// How the audio is stored: "wav", "flac" or "ogg" (the call's own Opus
+	// packets, one file per party)
+	Format string
+	// Where finished recordings are kept: "local" (Dir) or "s3". With s3,
+	// Dir only holds calls in progress.
+	Storage    string
+	S3         S3Config
+	Encryption EncryptionConfig
+	Retention  RetentionConfig
+	// Bearer token required by the recording HTTP API, which is disabled
+	// if it is empty
+	APIToken string
+}
+
+// EncryptionConfig controls encryption of recordings at rest. Each
+// recording is encrypted with its own data key, stored wrapped by the key
+// encryption key (KEK) configured here.
+type EncryptionConfig struct {
+	Enabled bool
+	// The KEK, 32 bytes base64 or hex encoded. KEKFile takes precedence and
+	// may also hold the bytes raw.
+	KEK     string
+	KEKFile string
+	// Recorded with each wrapped data key; defaults to a fingerprint of the
+	// KEK
+	KEKID string
+}
+
+// RetentionConfig controls how long recordings are kept. Recordings under
+// legal hold are never deleted.
+type RetentionConfig struct {
+	// Recordings older than this are deleted; 0 keeps them forever
+	MaxAge time.Duration
+	// Per-tenant overrides of MaxAge as "tenant=duration", e.g.
+	// "acme=2160h"; a duration of 0 keeps the tenant's recordings forever.
+	// Only applied to calls that authenticated as the tenant.
+	TenantMaxAge []string
+	// While all recordings together take more bytes than this, the oldest
+	// are deleted; 0 for no limit
+	MaxBytes int64
+	// How often the gateway applies the rules; 0 disables the purge job
+	Interval time.Duration
+	// JSON Lines file every deletion and legal hold change is appended to,
+	// besides being kept in recording storage; empty for no local copy
+	AuditLog string
+}
+
+// S3Config configures recording storage on S3 or a compatible object store
+// such as MinIO
+type S3Config struct {
+	// e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prepended to every object key, e.g. "recordings/"
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	// Only for temporary credentials
+	SessionToken string
+
+	// Address the bucket as <Endpoint>/<Bucket> rather than as a subdomain
+	// of the endpoint, as MinIO usually requires
+	PathStyle bool
+
+	// Server-side encryption: "" (the bucket default), "AES256" or
+	// "aws:kms", optionally with a KMS key other than the account default
+	SSE      string
+	KMSKeyID string
+
+	// Audio is uploaded during the call in parts of this many bytes; S3
+	// requires at least 5MiB
+	PartSize int64
+	// Attempts after the first for a request failing with a network error,
+	// throttling or a server error
+	MaxRetries int
+}
+
+// AudioConfig controls how each caller's audio is cleaned up before voice
+// activity detection and speech recognition
+type AudioConfig struct {
+	// High-pass cutoff in Hz removing DC offset and rumble; 0 disables it
+	HighPassCutoff float64
+	// Spectral-subtraction noise suppression, pulling noise down by at most
+	// NoiseSuppressionDB
+	NoiseSuppression   bool
+	NoiseSuppressionDB float64
+	// Automatic gain control towards AGCTargetDBFS RMS, boosting by at most
+	// AGCMaxGainDB
+	AGC           bool
+	AGCTargetDBFS float64
+	AGCMaxGainDB  float64
 }
 
 type ServicesConfig struct {
@@ -39,8 +204,9 @@ type ServicesConfig struct {
 func Load() *Config {
 	return &Config{
 		Server: ServerConfig{
-			Host: getEnv("SERVER_HOST", "localhost"),
-			Port: getEnvInt("SERVER_PORT", 8080),
+			Host:         getEnv("SERVER_HOST", "localhost"),
+			Port:         getEnvInt("SERVER_PORT", 8080),
+			TenantTokens: getEnvList("TENANT_TOKENS"),
 		},
 		WebRTC: WebRTCConfig{
 			ICEServers: []string{
@@ -49,15 +215,140 @@ func Load() *Config {
 			UDPPortMin: getEnvInt("UDP_PORT_MIN", 10000),
 			UDPPortMax: getEnvInt("UDP_PORT_MAX", 20000),
 		},
+		Bus: BusConfig{
+			Backend: getEnv("BUS_BACKEND", "nats"),
+		},
 		NATS: NATSConfig{
-			URL:     getEnv("NATS_URL", "nats://localhost:4222"),
-			Subject: getEnv("NATS_SUBJECT", "voice."),
+			URL:               getEnv("NATS_URL", "nats://localhost:4222"),
+			Subject:           getEnv("NATS_SUBJECT", "voice."),
+			Partitions:        getEnvInt("NATS_PARTITIONS", 8),
+			MaxDeliver:        getEnvInt("NATS_MAX_DELIVER", 5),
+			DeadLetterSubject: getEnv("NATS_DEAD_LETTER_SUBJECT", ""),
+			StreamPrefix:      getEnv("NATS_STREAM_NAME_PREFIX", ""),
+			AudioStream:       loadStreamConfig("NATS_AUDIO_", workQueueStream),
+			TextStream:        loadStreamConfig("NATS_TEXT_", workQueueStream),
+			TTSStream:         loadStreamConfig("NATS_TTS_", workQueueStream),
+			ControlStream:     loadStreamConfig("NATS_CONTROL_", broadcastStream),
+			DeadLetterStream:  loadStreamConfig("NATS_DLQ_", deadLetterStream),
+		},
+		Redis: RedisConfig{
+			URL:      getEnv("REDIS_URL", "redis://localhost:6379/0"),
+			MaxLen:   getEnvInt64("REDIS_STREAM_MAX_LEN", 100000),
+			LeaseTTL: getEnvDuration("REDIS_LEASE_TTL", 10*time.Second),
 		},
 		Services: ServicesConfig{
 			ASRURL: getEnv("ASR_URL", "localhost:50051"),
 			TTSURL: getEnv("TTS_URL", "localhost:50052"),
 			LLMURL: getEnv("LLM_URL", ""),
 		},
+		Recording: RecordingConfig{
+			Enabled:       getEnvBool("RECORDING_ENABLED", false),
+			Dir:           getEnv("RECORDING_DIR", "./recordings"),
+			OptOutTenants: getEnvList("RECORDING_OPT_OUT_TENANTS"),
+			Format:        getEnv("RECORDING_FORMAT", "wav"),
+			Storage:       getEnv("RECORDING_STORAGE", "local"),
+			S3: S3Config{
+				Endpoint:        getEnv("RECORDING_S3_ENDPOINT", "https://s3.amazonaws.com"),
+				Region:          getEnv("RECORDING_S3_REGION", "us-east-1"),
+				Bucket:          getEnv("RECORDING_S3_BUCKET", ""),
+				Prefix:          getEnv("RECORDING_S3_PREFIX", ""),
+				AccessKeyID:     getEnv("RECORDING_S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")),
+				SecretAccessKey: getEnv("RECORDING_S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+				SessionToken:    getEnv("RECORDING_S3_SESSION_TOKEN", os.Getenv("AWS_SESSION_TOKEN")),
+				PathStyle:       getEnvBool("RECORDING_S3_PATH_STYLE", false),
+				SSE:             getEnv("RECORDING_S3_SSE", ""),
+				KMSKeyID:        getEnv("RECORDING_S3_SSE_KMS_KEY_ID", ""),
+				PartSize:        getEnvInt64("RECORDING_S3_PART_SIZE", 5<<20),
+				MaxRetries:      getEnvInt("RECORDING_S3_MAX_RETRIES", 3),
+			},
+			Retention: RetentionConfig{
+				MaxAge:       getEnvDuration("RECORDING_RETENTION_MAX_AGE", 0),
+				TenantMaxAge: getEnvList("RECORDING_RETENTION_TENANT_MAX_AGE"),
+				MaxBytes:     getEnvInt64("RECORDING_RETENTION_MAX_BYTES", 0),
+				Interval:     getEnvDuration("RECORDING_RETENTION_INTERVAL", time.Hour),
+				AuditLog:     getEnv("RECORDING_AUDIT_LOG", "./recording-audit.jsonl"),
+			},
+			APIToken: getEnv("RECORDING_API_TOKEN", ""),
+			Encryption: EncryptionConfig{
+				Enabled: getEnvBool("RECORDING_ENCRYPTION_ENABLED", false),
+				KEK:     getEnv("RECORDING_KEK", ""),
+				KEKFile: getEnv("RECORDING_KEK_FILE", ""),
+				KEKID:   getEnv("RECORDING_KEK_ID", ""),
+			},
+		},
+		Audio: AudioConfig{
+			HighPassCutoff:     getEnvFloat("AUDIO_HIGH_PASS_HZ", 80),
+			NoiseSuppression:   getEnvBool("AUDIO_NOISE_SUPPRESSION", true),
+			NoiseSuppressionDB: getEnvFloat("AUDIO_NOISE_SUPPRESSION_DB", 18),
+			AGC:                getEnvBool("AUDIO_AGC", true),
+			AGCTargetDBFS:      getEnvFloat("AUDIO_AGC_TARGET_DBFS", -20),
+			AGCMaxGainDB:       getEnvFloat("AUDIO_AGC_MAX_GAIN_DB", 24),
+		},
+	}
+}
+
+// Default topology for the live audio, text and TTS streams
+var workQueueStream = StreamConfig{
+	Storage:           "memory",
+	Replicas:          1,
+	Retention:         "workqueue",
+	MaxAge:            time.Hour,
+	MaxBytes:          -1,
+	MaxMsgsPerSubject: -1,
+	Discard:           "old",
+	Transport:         "jetstream",
+}
+
+// Default topology for control commands and lifecycle events, which every
+// subscriber receives rather than sharing as a work queue
+var broadcastStream = StreamConfig{
+	Storage:           "memory",
+	Replicas:          1,
+	Retention:         "limits",
+	MaxAge:            time.Hour,
+	MaxBytes:          -1,
+	MaxMsgsPerSubject: 1000,
+	Discard:           "old",
+	Transport:         "jetstream",
+}
+
+// Default topology for dead-lettered messages, kept for inspection
+var deadLetterStream = StreamConfig{
+	Storage:           "file",
+	Replicas:          1,
+	Retention:         "limits",
+	MaxAge:            7 * 24 * time.Hour,
+	MaxBytes:          -1,
+	MaxMsgsPerSubject: -1,
+	Discard:           "old",
+	Transport:         "jetstream",
+}
+
+// loadStreamConfig reads <prefix>STORAGE, <prefix>REPLICAS, etc., falling
+// back to the NATS_STREAM_* values and then to defaults
+func loadStreamConfig(prefix string, defaults StreamConfig) StreamConfig {
+	get := func(name, def string) string {
+		return getEnv(prefix+name, getEnv("NATS_STREAM_"+name, def))
+	}
+	getInt := func(name string, def int) int {
+		return getEnvInt(prefix+name, getEnvInt("NATS_STREAM_"+name, def))
+	}
+	getInt64 := func(name string, def int64) int64 {
+		return getEnvInt64(prefix+name, getEnvInt64("NATS_STREAM_"+name, def))
+	}
+	getDuration := func(name string, def time.Duration) time.Duration {
+		return getEnvDuration(prefix+name, getEnvDuration("NATS_STREAM_"+name, def))
+	}
+
+	return StreamConfig{
+		Storage:           get("STORAGE", defaults.Storage),
+		Replicas:          getInt("REPLICAS", defaults.Replicas),
+		Retention:         get("RETENTION", defaults.Retention),
+		MaxAge:            getDuration("MAX_AGE", defaults.MaxAge),
+		MaxBytes:          getInt64("MAX_BYTES", defaults.MaxBytes),
+		MaxMsgsPerSubject: getInt64("MAX_MSGS_PER_SUBJECT", defaults.MaxMsgsPerSubject),
+		Discard:           get("DISCARD", defaults.Discard),
+		Transport:         get("TRANSPORT", defaults.Transport),
 	}
 }
 
@@ -76,3 +367,50 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolVal, err := strconv.ParseBool(value); err == nil {
+			return boolVal
+		}
+	}
+	return defaultValue
+}
+
+// getEnvList splits a comma-separated value, ignoring empty entries
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvInt64(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if intVal, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return intVal
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
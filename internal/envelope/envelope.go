@@ -0,0 +1,172 @@
+// Package envelope encrypts files at rest with envelope encryption: each
+// set of files gets its own random data key, which is stored alongside them
+// wrapped (encrypted) by a long-lived key encryption key (KEK) kept
+// elsewhere. Rotating the KEK only means rewrapping data keys.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"voice-gateway/internal/config"
+)
+
+// Algorithm used both to wrap data keys and to encrypt with them
+const Algorithm = "AES-256-GCM"
+
+const keySize = 32
+
+// KEK is a key encryption key, which wraps data keys
+type KEK struct {
+	// Recorded with each wrapped key, to tell which KEK unwraps it
+	ID   string
+	aead cipher.AEAD
+}
+
+// NewKEK creates a KEK from 32 bytes of key material. An empty id is
+// replaced by a fingerprint of the key.
+func NewKEK(id string, key []byte) (*KEK, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key encryption key: %w", err)
+	}
+	if id == "" {
+		sum := sha256.Sum256(key)
+		id = "sha256:" + hex.EncodeToString(sum[:8])
+	}
+	return &KEK{ID: id, aead: aead}, nil
+}
+
+// LoadKEK reads the configured KEK, from a file if one is set, otherwise
+// from the environment. The key is 32 bytes, given base64 or hex encoded; a
+// file may also hold them raw. A raw key in the environment isn't accepted,
+// as a mistyped encoded key of the same length would be taken for one.
+func LoadKEK(cfg config.EncryptionConfig) (*KEK, error) {
+	var key []byte
+	var err error
+	switch {
+	case cfg.KEKFile != "":
+		data, readErr := os.ReadFile(cfg.KEKFile)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read key encryption key: %w", readErr)
+		}
+		key, err = decodeKey(data, true)
+	case cfg.KEK != "":
+		key, err = decodeKey([]byte(cfg.KEK), false)
+	default:
+		return nil, errors.New("no key encryption key configured")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewKEK(cfg.KEKID, key)
+}
+
+// decodeKey accepts a key as base64 or hex text, or as raw bytes if raw is
+// set
+func decodeKey(material []byte, raw bool) ([]byte, error) {
+	if raw && len(material) == keySize {
+		return material, nil
+	}
+
+	text := strings.TrimSpace(string(material))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	if raw {
+		return nil, fmt.Errorf("key encryption key must be %d bytes, raw or base64 or hex encoded", keySize)
+	}
+	return nil, fmt.Errorf("key encryption key must be %d bytes, base64 or hex encoded", keySize)
+}
+
+// WrappedKey is a data key encrypted by a KEK, as stored with the files it
+// encrypts
+type WrappedKey struct {
+	KEKID      string `json:"kek_id"`
+	Algorithm  string `json:"algorithm"`
+	Nonce      []byte `json:"nonce"`
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// DataKey encrypts one set of files
+type DataKey struct {
+	aead    cipher.AEAD
+	wrapped WrappedKey
+}
+
+// NewDataKey generates a random data key wrapped by the KEK
+func (k *KEK) NewDataKey() (*DataKey, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &DataKey{
+		aead: aead,
+		wrapped: WrappedKey{
+			KEKID:      k.ID,
+			Algorithm:  Algorithm,
+			Nonce:      nonce,
+			WrappedKey: k.aead.Seal(nil, nonce, key, []byte(k.ID)),
+		},
+	}, nil
+}
+
+// Unwrap decrypts a data key wrapped by this KEK
+func (k *KEK) Unwrap(wrapped WrappedKey) (*DataKey, error) {
+	if wrapped.Algorithm != Algorithm {
+		return nil, fmt.Errorf("unsupported key algorithm %q", wrapped.Algorithm)
+	}
+	if wrapped.KEKID != k.ID {
+		return nil, fmt.Errorf("data key was wrapped by key encryption key %q, not %q", wrapped.KEKID, k.ID)
+	}
+	if len(wrapped.Nonce) != k.aead.NonceSize() {
+		return nil, errors.New("invalid wrapped key nonce")
+	}
+
+	key, err := k.aead.Open(nil, wrapped.Nonce, wrapped.WrappedKey, []byte(wrapped.KEKID))
+	if err != nil {
+		return nil, errors.New("failed to unwrap data key: wrong key encryption key or corrupt key")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{aead: aead, wrapped: wrapped}, nil
+}
+
+// Wrapped returns the data key as encrypted by its KEK
+func (d *DataKey) Wrapped() WrappedKey {
+	return d.wrapped
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("key must be %d bytes, not %d", keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
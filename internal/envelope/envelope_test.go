@@ -0,0 +1,72 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"voice-gateway/internal/config"
+)
+
+func TestLoadKEK(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a, 0x01, 0xfe, 0x80}, keySize/4)
+	// Text of the right length to be taken for a raw key
+	text := strings.Repeat("k", keySize)
+
+	tests := []struct {
+		name string
+		env  string
+		file []byte
+		want []byte // nil if rejected
+	}{
+		{"hex", hex.EncodeToString(key), nil, key},
+		{"base64", base64.StdEncoding.EncodeToString(key), nil, key},
+		{"base64 with newline", base64.StdEncoding.EncodeToString(key) + "\n", nil, key},
+		{"raw in the environment", text, nil, nil},
+		{"short", hex.EncodeToString(key[:16]), nil, nil},
+		{"long", base64.StdEncoding.EncodeToString(append(key, 0)), nil, nil},
+		{"raw file", "", key, key},
+		{"raw text file", "", []byte(text), []byte(text)},
+		{"hex file", "", []byte(hex.EncodeToString(key) + "\n"), key},
+		{"base64 file", "", []byte(base64.StdEncoding.EncodeToString(key) + "\n"), key},
+		{"short file", "", key[:31], nil},
+		{"file over the environment", hex.EncodeToString(make([]byte, keySize)), key, key},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.EncryptionConfig{KEK: tt.env}
+			if tt.file != nil {
+				cfg.KEKFile = filepath.Join(t.TempDir(), "kek")
+				if err := os.WriteFile(cfg.KEKFile, tt.file, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			kek, err := LoadKEK(cfg)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatal("key accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := NewKEK("", tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kek.ID != want.ID {
+				t.Errorf("loaded key %s, want %s", kek.ID, want.ID)
+			}
+		})
+	}
+
+	if _, err := LoadKEK(config.EncryptionConfig{}); err == nil {
+		t.Error("loaded a key with none configured")
+	}
+}
@@ -0,0 +1,348 @@
+package envelope
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// An encrypted stream is a header, the magic and a random nonce prefix,
+// followed by chunks of at most ChunkSize bytes of plaintext, each stored as
+// its ciphertext length and the ciphertext. A chunk's nonce is the prefix,
+// its index and whether it is the last, so chunks cannot be reordered,
+// dropped or truncated unnoticed. Chunks may be shorter than ChunkSize,
+// letting a writer make what it has written durable at any point.
+const (
+	Magic      = "VGE1"
+	ChunkSize  = 64 << 10
+	prefixSize = 7
+	headerSize = len(Magic) + prefixSize
+	tagSize    = 16
+)
+
+// ErrTruncated is returned after the last complete chunk of a stream that
+// was never closed, e.g. by a crash
+var ErrTruncated = errors.New("encrypted stream truncated")
+
+// IsEncrypted reports whether data starts like an encrypted stream
+func IsEncrypted(data []byte) bool {
+	return len(data) >= len(Magic) && string(data[:len(Magic)]) == Magic
+}
+
+func (d *DataKey) nonce(header []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, d.aead.NonceSize())
+	copy(nonce, header[len(Magic):])
+	binary.BigEndian.PutUint32(nonce[prefixSize:], index)
+	if final {
+		nonce[prefixSize+4] = 1
+	}
+	return nonce
+}
+
+// Writer encrypts a stream. Nothing written reaches the underlying writer
+// until a chunk fills or Flush is called.
+type Writer struct {
+	key    *DataKey
+	out    io.Writer
+	header []byte
+	buf    []byte
+	index  uint32
+	closed bool
+	err    error
+}
+
+// NewWriter starts an encrypted stream on out
+func (d *DataKey) NewWriter(out io.Writer) (*Writer, error) {
+	header := make([]byte, headerSize)
+	copy(header, Magic)
+	if _, err := rand.Read(header[len(Magic):]); err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{key: d, out: out, header: header, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("encrypted stream closed")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		take := min(len(p), ChunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+
+		if len(w.buf) == ChunkSize {
+			if err := w.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes out what is buffered as a chunk of its own
+func (w *Writer) Flush() error {
+	if w.closed || w.err != nil || len(w.buf) == 0 {
+		return w.err
+	}
+	return w.seal(false)
+}
+
+// Close writes the last chunk, marking the stream complete. It does not
+// close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	if w.err != nil {
+		w.closed = true
+		return w.err
+	}
+	err := w.seal(true)
+	w.closed = true
+	return err
+}
+
+func (w *Writer) seal(final bool) error {
+	if w.index == ^uint32(0) {
+		w.err = errors.New("encrypted stream too long")
+		return w.err
+	}
+
+	chunk := make([]byte, 4, 4+len(w.buf)+tagSize)
+	chunk = w.key.aead.Seal(chunk, w.key.nonce(w.header, w.index, final), w.buf, w.header)
+	binary.BigEndian.PutUint32(chunk, uint32(len(chunk)-4))
+
+	if _, err := w.out.Write(chunk); err != nil {
+		w.err = err
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Reader decrypts a stream, failing on any chunk that was altered
+type Reader struct {
+	key    *DataKey
+	in     *bufio.Reader
+	header []byte
+	buf    []byte
+	index  uint32
+	final  bool
+	err    error
+}
+
+// NewReader decrypts the stream read from in
+func (d *DataKey) NewReader(in io.Reader) *Reader {
+	return &Reader{key: d, in: bufio.NewReaderSize(in, ChunkSize+tagSize+4)}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into buf, or returns why there is none
+func (r *Reader) next() error {
+	if r.header == nil {
+		header := make([]byte, headerSize)
+		if _, err := io.ReadFull(r.in, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return ErrTruncated
+			}
+			return err
+		}
+		if !IsEncrypted(header) {
+			return errors.New("not an encrypted stream")
+		}
+		r.header = header
+	}
+
+	if r.final {
+		if _, err := r.in.ReadByte(); err != io.EOF {
+			if err == nil {
+				return errors.New("data after end of encrypted stream")
+			}
+			return err
+		}
+		return io.EOF
+	}
+
+	plaintext, final, err := r.key.readChunk(r.in, r.header, r.index)
+	if err != nil {
+		return err
+	}
+	r.buf = plaintext
+	r.final = final
+	r.index++
+	return nil
+}
+
+// fullChunkSize is the stored size of a full chunk
+const fullChunkSize = 4 + ChunkSize + tagSize
+
+// PlaintextSize returns the size of the plaintext of a complete stream of
+// the given size whose chunks are all full but the last, as written
+// without Flush
+func PlaintextSize(size int64) int64 {
+	chunks := (size - int64(headerSize) + fullChunkSize - 1) / fullChunkSize
+	return size - int64(headerSize) - chunks*(4+tagSize)
+}
+
+// OpenAt decrypts a stream from a plaintext offset on, reading it from the
+// chunk holding that offset, where open opens the stream at a byte offset.
+// The stream's chunks must all be full but the last, as written without
+// Flush; reading one that isn't fails.
+func (d *DataKey) OpenAt(open func(offset int64) (io.ReadCloser, error), offset int64) (io.ReadCloser, error) {
+	in, err := open(0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	_, err = io.ReadFull(in, header)
+	in.Close()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(header) {
+		return nil, errors.New("not an encrypted stream")
+	}
+
+	index := offset / ChunkSize
+	if offset < 0 || index > int64(^uint32(0)) {
+		return nil, fmt.Errorf("invalid offset %d in encrypted stream", offset)
+	}
+	if in, err = open(int64(headerSize) + index*fullChunkSize); err != nil {
+		return nil, err
+	}
+
+	r := d.NewReader(in)
+	r.header, r.index = header, uint32(index)
+	if _, err := io.CopyN(io.Discard, r, offset%ChunkSize); err != nil {
+		in.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, in}, nil
+}
+
+// readChunk reads and decrypts the chunk at index, which may be the last
+func (d *DataKey) readChunk(in io.Reader, header []byte, index uint32) ([]byte, bool, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(in, length[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, false, ErrTruncated
+		}
+		return nil, false, err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size < tagSize || size > ChunkSize+tagSize {
+		return nil, false, fmt.Errorf("invalid encrypted chunk %d", index)
+	}
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(in, chunk); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, false, ErrTruncated
+		}
+		return nil, false, err
+	}
+
+	for _, final := range []bool{false, true} {
+		if plaintext, err := d.aead.Open(chunk[:0:0], d.nonce(header, index, final), chunk, header); err == nil {
+			return plaintext, final, nil
+		}
+	}
+	return nil, false, fmt.Errorf("encrypted chunk %d failed authentication: wrong key or corrupt data", index)
+}
+
+// Finish completes a stream left unclosed by a crash: a torn chunk at the
+// end is cut off and a last chunk is added after the complete ones. It
+// returns the size of the plaintext, and does nothing more to a stream that
+// was closed.
+func (d *DataKey) Finish(file *os.File) (int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	in := bufio.NewReaderSize(file, ChunkSize+tagSize+4)
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(in, header); err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		// Torn in the header: nothing was ever written to it
+		return 0, d.restart(file)
+	}
+	if !IsEncrypted(header) {
+		return 0, errors.New("not an encrypted stream")
+	}
+
+	end := int64(headerSize)
+	var size int64
+	var index uint32
+	for {
+		plaintext, final, err := d.readChunk(in, header, index)
+		if err == ErrTruncated {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += int64(len(plaintext))
+		end += int64(4 + len(plaintext) + tagSize)
+		if final {
+			return size, nil
+		}
+		index++
+	}
+
+	if err := file.Truncate(end); err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(end, io.SeekStart); err != nil {
+		return 0, err
+	}
+	w := &Writer{key: d, out: file, header: header, index: index}
+	return size, w.Close()
+}
+
+// restart replaces the content of file with an empty stream
+func (d *DataKey) restart(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w, err := d.NewWriter(file)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,318 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeys(t *testing.T) (*KEK, *DataKey) {
+	t.Helper()
+	kek, err := NewKEK("test", bytes.Repeat([]byte{3}, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := kek.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kek, key
+}
+
+func plaintext(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+// seal encrypts data written in writes of the given size, flushing after
+// each if flush is set, and closes the stream unless open is set
+func seal(t *testing.T, key *DataKey, data []byte, write int, flush, open bool) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	w, err := key.NewWriter(&sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(data) > 0 {
+		n := min(write, len(data))
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+		if flush {
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !open {
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sealed.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	_, key := testKeys(t)
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 5} {
+		data := plaintext(size)
+		for _, write := range []int{1000, ChunkSize + 3} {
+			sealed := seal(t, key, data, write, false, false)
+			got, err := io.ReadAll(key.NewReader(bytes.NewReader(sealed)))
+			if err != nil {
+				t.Fatalf("%d bytes in writes of %d: %v", size, write, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%d bytes in writes of %d read back as %d differing bytes", size, write, len(got))
+			}
+			if n := PlaintextSize(int64(len(sealed))); n != int64(size) {
+				t.Errorf("%d bytes in writes of %d: plaintext size %d", size, write, n)
+			}
+		}
+
+		// Flushed chunks are shorter but read the same
+		sealed := seal(t, key, data, 1000, true, false)
+		got, err := io.ReadAll(key.NewReader(bytes.NewReader(sealed)))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes flushed in writes of 1000 read back as %d bytes: %v", size, len(got), err)
+		}
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	_, key := testKeys(t)
+	sealed := seal(t, key, plaintext(3*ChunkSize+5), ChunkSize, false, false)
+	chunk := func(i int) (int, int) {
+		start := headerSize + i*fullChunkSize
+		return start, min(start+fullChunkSize, len(sealed))
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(s []byte) []byte
+	}{
+		{"flipped ciphertext", func(s []byte) []byte {
+			start, _ := chunk(1)
+			s[start+100] ^= 1
+			return s
+		}},
+		{"flipped header", func(s []byte) []byte {
+			s[len(Magic)] ^= 1
+			return s
+		}},
+		{"reordered chunks", func(s []byte) []byte {
+			start0, end0 := chunk(0)
+			start1, end1 := chunk(1)
+			out := append([]byte{}, s[:start0]...)
+			out = append(out, s[start1:end1]...)
+			out = append(out, s[start0:end0]...)
+			return append(out, s[end1:]...)
+		}},
+		{"dropped chunk", func(s []byte) []byte {
+			start, end := chunk(1)
+			return append(s[:start:start], s[end:]...)
+		}},
+		{"duplicated chunk", func(s []byte) []byte {
+			start, end := chunk(1)
+			out := append([]byte{}, s[:end]...)
+			out = append(out, s[start:end]...)
+			return append(out, s[end:]...)
+		}},
+		{"data after the end", func(s []byte) []byte {
+			return append(s, 0)
+		}},
+		{"other key", func(s []byte) []byte {
+			_, other := testKeys(t)
+			return seal(t, other, plaintext(10), 10, false, false)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.tamper(bytes.Clone(sealed))
+			_, err := io.ReadAll(key.NewReader(bytes.NewReader(s)))
+			if err == nil || errors.Is(err, ErrTruncated) {
+				t.Errorf("read with %v", err)
+			}
+		})
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	_, key := testKeys(t)
+	data := plaintext(2*ChunkSize + 5)
+	sealed := seal(t, key, data, 1000, false, false)
+	unclosed := seal(t, key, data, 1000, false, true)
+
+	tests := []struct {
+		name   string
+		stream []byte
+		want   int // plaintext bytes read before the error
+	}{
+		{"empty", nil, 0},
+		{"in the header", sealed[:headerSize-1], 0},
+		{"after the header", sealed[:headerSize], 0},
+		{"in a chunk length", sealed[:headerSize+2], 0},
+		{"in the first chunk", sealed[:headerSize+fullChunkSize/2], 0},
+		{"after the first chunk", sealed[:headerSize+fullChunkSize], ChunkSize},
+		{"in the last chunk", sealed[:len(sealed)-1], 2 * ChunkSize},
+		{"never closed", unclosed, 2 * ChunkSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(key.NewReader(bytes.NewReader(tt.stream)))
+			if !errors.Is(err, ErrTruncated) {
+				t.Errorf("read with %v", err)
+			}
+			if !bytes.Equal(got, data[:tt.want]) {
+				t.Errorf("read %d bytes before the error, want %d", len(got), tt.want)
+			}
+
+			// Finish makes what was complete a closed stream
+			path := filepath.Join(t.TempDir(), "stream")
+			if err := os.WriteFile(path, tt.stream, 0600); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			size, err := key.Finish(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != int64(tt.want) {
+				t.Errorf("finished with %d bytes, want %d", size, tt.want)
+			}
+			finished, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = io.ReadAll(key.NewReader(bytes.NewReader(finished)))
+			if err != nil || !bytes.Equal(got, data[:tt.want]) {
+				t.Errorf("finished stream read %d bytes with %v", len(got), err)
+			}
+		})
+	}
+}
+
+func TestFinishClosed(t *testing.T) {
+	_, key := testKeys(t)
+	data := plaintext(ChunkSize + 5)
+	sealed := seal(t, key, data, 1000, true, false)
+	path := filepath.Join(t.TempDir(), "stream")
+	if err := os.WriteFile(path, sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	size, err := key.Finish(file)
+	if err != nil || size != int64(len(data)) {
+		t.Fatalf("finished with %d bytes and %v", size, err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(after, sealed) {
+		t.Error("closed stream changed")
+	}
+}
+
+func TestOpenAt(t *testing.T) {
+	_, key := testKeys(t)
+	data := plaintext(3*ChunkSize + 5)
+	sealed := seal(t, key, data, 777, false, false)
+	open := func(offset int64) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(sealed[offset:])), nil
+	}
+
+	for _, offset := range []int64{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 2*ChunkSize + 12345, int64(len(data)) - 1, int64(len(data))} {
+		r, err := key.OpenAt(open, offset)
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+		if !bytes.Equal(got, data[offset:]) {
+			t.Errorf("offset %d read %d differing bytes", offset, len(got))
+		}
+		r.Close()
+	}
+
+	if _, err := key.OpenAt(open, -1); err == nil {
+		t.Error("opened at a negative offset")
+	}
+	if _, err := key.OpenAt(open, int64(len(data))+1); err == nil {
+		t.Error("opened past the end")
+	}
+
+	// A flushed stream's chunks aren't where OpenAt looks for them
+	flushed := seal(t, key, data, 777, true, false)
+	r, err := key.OpenAt(func(offset int64) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(flushed[offset:])), nil
+	}, ChunkSize+1)
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	if err == nil {
+		t.Error("read a flushed stream at an offset")
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	kek, key := testKeys(t)
+	data := plaintext(1000)
+	sealed := seal(t, key, data, 100, false, false)
+
+	unwrapped, err := kek.Unwrap(key.Wrapped())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(unwrapped.NewReader(bytes.NewReader(sealed)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("unwrapped key read %d bytes with %v", len(got), err)
+	}
+
+	wrongKey, err := NewKEK("test", bytes.Repeat([]byte{4}, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, err := NewKEK("other", bytes.Repeat([]byte{3}, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed := key.Wrapped()
+	renamed.KEKID = "other"
+	tampered := key.Wrapped()
+	tampered.WrappedKey = bytes.Clone(tampered.WrappedKey)
+	tampered.WrappedKey[0] ^= 1
+	algorithm := key.Wrapped()
+	algorithm.Algorithm = "ROT13"
+
+	tests := []struct {
+		name    string
+		kek     *KEK
+		wrapped WrappedKey
+	}{
+		{"wrong key", wrongKey, key.Wrapped()},
+		{"other key ID", otherID, key.Wrapped()},
+		{"relabelled key ID", otherID, renamed},
+		{"tampered key", kek, tampered},
+		{"unknown algorithm", kek, algorithm},
+	}
+	for _, tt := range tests {
+		if _, err := tt.kek.Unwrap(tt.wrapped); err == nil {
+			t.Errorf("%s: unwrapped", tt.name)
+		}
+	}
+}
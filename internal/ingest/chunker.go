@@ -3,7 +3,6 @@ package ingest
 import (
 	"encoding/binary"
 	"io"
-	"log"
 	"math"
 	"time"
 
@@ -29,6 +28,7 @@ type Chunker struct {
 	samplesPerFrame int
 	buffer        []byte
 	onChunk       func([]byte)
+	preprocessor  *Preprocessor
 }
 
 // NewChunker creates a new audio chunker
@@ -44,10 +44,23 @@ func NewChunker(sampleRate int, frameDuration time.Duration, onChunk func([]byte
 	}
 }
 
+// SetPreprocessor installs a preprocessing chain applied to every chunk
+// before it is delivered
+func (c *Chunker) SetPreprocessor(p *Preprocessor) {
+	c.preprocessor = p
+}
+
 // ProcessRTP processes an RTP packet and chunks the audio
 func (c *Chunker) ProcessRTP(packet *rtp.Packet) error {
+	c.Write(packet.Payload)
+	return nil
+}
+
+// Write adds 16-bit PCM, such as decoded audio, and delivers every frame
+// completed by it
+func (c *Chunker) Write(pcm []byte) {
 	// Add payload to buffer
-	c.buffer = append(c.buffer, packet.Payload...)
+	c.buffer = append(c.buffer, pcm...)
 
 	// Calculate bytes per frame (16-bit samples = 2 bytes per sample)
 	bytesPerFrame := c.samplesPerFrame * 2
@@ -57,12 +70,14 @@ func (c *Chunker) ProcessRTP(packet *rtp.Packet) error {
 		chunk := c.buffer[:bytesPerFrame]
 		c.buffer = c.buffer[bytesPerFrame:]
 
+		if c.preprocessor != nil {
+			chunk = c.preprocessor.Process(chunk)
+		}
+
 		if c.onChunk != nil {
 			c.onChunk(chunk)
 		}
 	}
-
-	return nil
 }
 
 // VAD implements simple Voice Activity Detection
@@ -176,21 +191,3 @@ func (fr *FrameReader) ReadFrame() ([]byte, error) {
 	copy(frame, fr.buffer[:n])
 	return frame, nil
 }
-
-// FanOut duplicates audio chunks to multiple channels
-func FanOut(in <-chan []byte, outs ...chan<- []byte) {
-	for chunk := range in {
-		for _, out := range outs {
-			select {
-			case out <- chunk:
-			default:
-				log.Printf("Warning: dropping audio chunk (channel full)")
-			}
-		}
-	}
-
-	// Close all output channels when input closes
-	for _, out := range outs {
-		close(out)
-	}
-}
@@ -0,0 +1,56 @@
+package ingest
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunkerWrite(t *testing.T) {
+	var chunks [][]byte
+	c := NewChunker(PCMSampleRate, FrameDuration20ms, func(chunk []byte) {
+		chunks = append(chunks, bytes.Clone(chunk))
+	})
+
+	// 50ms of audio, in writes that don't line up with frames
+	pcm := make([]byte, PCMSampleRate/20*2)
+	for i := range pcm {
+		pcm[i] = byte(i)
+	}
+	c.Write(pcm[:300])
+	c.Write(pcm[300:1300])
+	c.Write(pcm[1300:])
+
+	if len(chunks) != 2 {
+		t.Fatalf("got %d chunks, want 2 whole 20ms frames", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if want := pcm[i*640 : (i+1)*640]; !bytes.Equal(chunk, want) {
+			t.Errorf("chunk %d differs from the audio written", i)
+		}
+	}
+}
+
+func TestChunkerPreprocessor(t *testing.T) {
+	var got []byte
+	c := NewChunker(PCMSampleRate, FrameDuration20ms, func(chunk []byte) {
+		got = append(got, chunk...)
+	})
+	c.SetPreprocessor(NewPreprocessor(PCMSampleRate, PreprocessConfig{HighPassCutoff: 80}))
+
+	// A DC offset is removed by the high-pass filter
+	in := make([]float64, PCMSampleRate)
+	for i := range in {
+		in[i] = 0.25
+	}
+	c.Write(pcm(in))
+
+	if len(got) != len(in)*2 {
+		t.Fatalf("got %d bytes, want %d", len(got), len(in)*2)
+	}
+	tail := got[len(got)-640:]
+	for i := 0; i < len(tail); i += 2 {
+		if s := int16(tail[i]) | int16(tail[i+1])<<8; s > 100 || s < -100 {
+			t.Fatalf("sample %d after a second of DC is %d, want about 0", i/2, s)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package ingest
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"voice-gateway/internal/audio"
+)
+
+const (
+	// Default NLMS adaptation step size (0 < mu < 2)
+	defaultEchoStepSize = 0.3
+
+	// Geigel threshold: near-end speech is declared when the mic level
+	// exceeds this fraction of the recent far-end peak (0.5 = 6 dB ERL)
+	defaultDoubleTalkThreshold = 0.5
+
+	// How long adaptation stays frozen after double-talk ends
+	defaultDoubleTalkHangover = 60 * time.Millisecond
+
+	// Far-end level below which the filter is not adapted
+	farEndSilence = 1e-4
+
+	// Upper bound on queued reference audio before the oldest is discarded
+	maxReferenceBacklog = 2 * time.Second
+)
+
+// EchoCanceller removes the agent's own outbound audio from the microphone
+// signal. The reference (far-end) signal is the PCM being written to the
+// WebRTC local track; an NLMS adaptive filter models the speaker-to-mic echo
+// path and subtracts its estimate from the near-end signal before VAD/ASR.
+type EchoCanceller struct {
+	sampleRate int
+	taps       int
+	stepSize   float64
+
+	// Far-end history as a doubled circular buffer so the filter window is
+	// always the contiguous slice history[pos:pos+taps], newest first
+	history []float64
+	pos     int
+	energy  float64
+	weights []float64
+
+	// Reference samples written but not yet consumed by Process
+	pending  []float64
+	maxQueue int
+
+	dtd *DoubleTalkDetector
+	mu  sync.Mutex
+}
+
+// NewEchoCanceller creates an echo canceller for 16-bit mono PCM.
+// tailLength is the longest echo path to model (typically 100-250ms).
+func NewEchoCanceller(sampleRate int, tailLength time.Duration) *EchoCanceller {
+	taps := int(float64(sampleRate) * tailLength.Seconds())
+	if taps < 1 {
+		taps = 1
+	}
+
+	return &EchoCanceller{
+		sampleRate: sampleRate,
+		taps:       taps,
+		stepSize:   defaultEchoStepSize,
+		history:    make([]float64, taps*2),
+		weights:    make([]float64, taps),
+		maxQueue:   int(float64(sampleRate) * maxReferenceBacklog.Seconds()),
+		dtd:        NewDoubleTalkDetector(defaultDoubleTalkThreshold, sampleRate, defaultDoubleTalkHangover),
+	}
+}
+
+// SetStepSize sets the NLMS adaptation rate
+func (e *EchoCanceller) SetStepSize(mu float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stepSize = mu
+}
+
+// SetDelay sets the bulk delay between writing a reference sample and its
+// echo reaching the microphone (playout buffer plus network round trip).
+// The delay is inserted as silence at the head of the reference queue; a
+// negative delay is taken as none.
+func (e *EchoCanceller) SetDelay(delay time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := max(int(float64(e.sampleRate)*delay.Seconds()), 0)
+	e.pending = append(make([]float64, n), e.pending...)
+}
+
+// DoubleTalkDetector returns the detector guarding filter adaptation
+func (e *EchoCanceller) DoubleTalkDetector() *DoubleTalkDetector {
+	return e.dtd
+}
+
+// WriteReference queues far-end PCM as it is sent to the local track
+func (e *EchoCanceller) WriteReference(pcm []byte) {
+	samples := audio.BytesToFloat32(pcm)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, s := range samples {
+		e.pending = append(e.pending, float64(s))
+	}
+
+	// If nobody is consuming mic audio, don't grow without bound
+	if over := len(e.pending) - e.maxQueue; over > 0 {
+		e.pending = e.pending[over:]
+	}
+}
+
+// Process removes echo from a chunk of near-end PCM and returns the cleaned
+// chunk. One queued reference sample is consumed per mic sample; when no
+// reference is queued the far end is treated as silent.
+func (e *EchoCanceller) Process(mic []byte) []byte {
+	near := audio.BytesToFloat32(mic)
+	out := make([]float32, len(near))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, d := range near {
+		var x float64
+		if len(e.pending) > 0 {
+			x = e.pending[0]
+			e.pending = e.pending[1:]
+		}
+		e.push(x)
+
+		window := e.history[e.pos : e.pos+e.taps]
+
+		var y float64
+		for k, w := range e.weights {
+			y += w * window[k]
+		}
+		residual := float64(d) - y
+
+		doubleTalk := e.dtd.update(float64(d), window)
+		if !doubleTalk && e.energy > farEndSilence*float64(e.taps) {
+			g := e.stepSize * residual / (e.energy + 1e-6)
+			for k := range e.weights {
+				e.weights[k] += g * window[k]
+			}
+		}
+
+		out[i] = float32(residual)
+	}
+
+	return audio.Float32ToBytes(out)
+}
+
+// Reset clears the adaptive filter and any queued reference audio
+func (e *EchoCanceller) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i := range e.history {
+		e.history[i] = 0
+	}
+	for i := range e.weights {
+		e.weights[i] = 0
+	}
+	e.pos = 0
+	e.energy = 0
+	e.pending = nil
+	e.dtd.reset()
+}
+
+// push adds the newest far-end sample to the filter window
+func (e *EchoCanceller) push(x float64) {
+	oldest := e.history[e.pos+e.taps-1]
+	e.energy += x*x - oldest*oldest
+	if e.energy < 0 {
+		e.energy = 0
+	}
+
+	e.pos--
+	if e.pos < 0 {
+		e.pos = e.taps - 1
+	}
+	e.history[e.pos] = x
+	e.history[e.pos+e.taps] = x
+}
+
+// DoubleTalkDetector implements the Geigel algorithm: near-end speech is
+// declared when the mic sample exceeds a fraction of the far-end peak over
+// the echo tail. While double-talk is active (plus a hangover) the echo
+// canceller freezes adaptation so the user's voice doesn't corrupt the
+// echo path estimate.
+type DoubleTalkDetector struct {
+	threshold float64
+	hangover  int
+	remaining int
+	active    bool
+
+	// Running far-end peak, recomputed when the peak sample leaves the window
+	peak    float64
+	peakAge int
+}
+
+// NewDoubleTalkDetector creates a new Geigel double-talk detector
+func NewDoubleTalkDetector(threshold float64, sampleRate int, hangover time.Duration) *DoubleTalkDetector {
+	return &DoubleTalkDetector{
+		threshold: threshold,
+		hangover:  int(float64(sampleRate) * hangover.Seconds()),
+	}
+}
+
+// IsActive returns whether near-end and far-end are currently talking at once
+func (d *DoubleTalkDetector) IsActive() bool {
+	return d.active
+}
+
+// update processes one near-end sample against the far-end window
+// (newest first) and reports whether adaptation should be frozen
+func (d *DoubleTalkDetector) update(near float64, window []float64) bool {
+	newest := math.Abs(window[0])
+	d.peakAge++
+	if newest >= d.peak {
+		d.peak = newest
+		d.peakAge = 0
+	} else if d.peakAge >= len(window) {
+		d.peak, d.peakAge = 0, 0
+		for k, x := range window {
+			if a := math.Abs(x); a > d.peak {
+				d.peak, d.peakAge = a, k
+			}
+		}
+	}
+
+	if d.peak > farEndSilence && math.Abs(near) > d.threshold*d.peak {
+		d.remaining = d.hangover
+	} else if d.remaining > 0 {
+		d.remaining--
+	}
+
+	d.active = d.remaining > 0
+	return d.active
+}
+
+func (d *DoubleTalkDetector) reset() {
+	d.remaining = 0
+	d.active = false
+	d.peak = 0
+	d.peakAge = 0
+}
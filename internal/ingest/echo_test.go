@@ -0,0 +1,206 @@
+package ingest
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"voice-gateway/internal/audio"
+)
+
+const (
+	echoTestRate = 16000
+	// 20ms chunks, as the gateway processes them
+	echoTestChunk = echoTestRate / 50
+)
+
+// speechLike returns seconds of noise shaped like speech: low-pass filtered
+// and amplitude modulated at a syllable rate
+func speechLike(seed int64, seconds float64, level float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	out := make([]float64, int(seconds*echoTestRate))
+	var lp float64
+	for i := range out {
+		lp = 0.7*lp + 0.3*rng.NormFloat64()
+		envelope := 0.6 + 0.4*math.Sin(2*math.Pi*4*float64(i)/echoTestRate+float64(seed))
+		out[i] = level * envelope * lp
+	}
+	return out
+}
+
+// echoPath convolves the far end with a room-like impulse response: a
+// bulk delay followed by decaying, alternating taps, 6 dB down overall
+func echoPath(far []float64, delay int) []float64 {
+	ir := make([]float64, delay+400)
+	for k := delay; k < len(ir); k++ {
+		ir[k] = 0.08 * math.Exp(-float64(k-delay)/60) * math.Cos(float64(k-delay)*0.9)
+	}
+	out := make([]float64, len(far))
+	for i := range out {
+		for k, h := range ir {
+			if i >= k && h != 0 {
+				out[i] += h * far[i-k]
+			}
+		}
+	}
+	return out
+}
+
+func pcm(samples []float64) []byte {
+	f := make([]float32, len(samples))
+	for i, s := range samples {
+		f[i] = float32(s)
+	}
+	return audio.Float32ToBytes(f)
+}
+
+// runEcho feeds far and mic through the canceller in chunks and returns the
+// cleaned mic signal
+func runEcho(ec *EchoCanceller, far, mic []float64) []float64 {
+	var out []float64
+	for i := 0; i < len(mic); i += echoTestChunk {
+		end := min(i+echoTestChunk, len(mic))
+		ec.WriteReference(pcm(far[i:end]))
+		for _, s := range audio.BytesToFloat32(ec.Process(pcm(mic[i:end]))) {
+			out = append(out, float64(s))
+		}
+	}
+	return out
+}
+
+func energy(samples []float64) float64 {
+	var sum float64
+	for _, s := range samples {
+		sum += s * s
+	}
+	return sum
+}
+
+// erle returns the echo return loss enhancement over the last seconds
+func erle(mic, out []float64, seconds float64) float64 {
+	from := len(mic) - int(seconds*echoTestRate)
+	return 10 * math.Log10(energy(mic[from:])/energy(out[from:]))
+}
+
+func TestEchoCancellerERLE(t *testing.T) {
+	far := speechLike(1, 8, 0.3)
+	mic := echoPath(far, 160) // 10ms
+
+	ec := NewEchoCanceller(echoTestRate, 64*time.Millisecond)
+	out := runEcho(ec, far, mic)
+
+	// Measures about 47 dB
+	if db := erle(mic, out, 2); db < 30 {
+		t.Errorf("ERLE %.1f dB after convergence, want at least 30 dB", db)
+	}
+}
+
+func TestEchoCancellerDelay(t *testing.T) {
+	// Longer than the tail, so only found with the bulk delay set
+	const delay = 100 * time.Millisecond
+	far := speechLike(2, 8, 0.3)
+	mic := echoPath(far, int(delay.Seconds()*echoTestRate))
+
+	ec := NewEchoCanceller(echoTestRate, 64*time.Millisecond)
+	ec.SetDelay(delay)
+	out := runEcho(ec, far, mic)
+
+	if db := erle(mic, out, 2); db < 30 {
+		t.Errorf("ERLE %.1f dB with a %v bulk delay, want at least 30 dB", db, delay)
+	}
+}
+
+func TestEchoCancellerNegativeDelay(t *testing.T) {
+	ec := NewEchoCanceller(echoTestRate, 64*time.Millisecond)
+	ec.WriteReference(pcm(make([]float64, echoTestChunk)))
+	ec.SetDelay(-time.Second)
+
+	if len(ec.pending) != echoTestChunk {
+		t.Errorf("%d reference samples queued after a negative delay, want %d", len(ec.pending), echoTestChunk)
+	}
+}
+
+func TestEchoCancellerDoubleTalk(t *testing.T) {
+	const seconds = 10
+	far := speechLike(3, seconds, 0.3)
+	echo := echoPath(far, 160)
+
+	// The caller talks over the agent from 6s to 8s
+	near := make([]float64, len(far))
+	copy(near[6*echoTestRate:], speechLike(4, 2, 0.6))
+
+	mic := make([]float64, len(far))
+	for i := range mic {
+		mic[i] = echo[i] + near[i]
+	}
+
+	// run returns the echo left in the output during double-talk, relative
+	// to the echo in the mic signal, the ERLE over the last second, once the
+	// caller has stopped, and in how many chunks double-talk was detected
+	from, to := 6*echoTestRate, 8*echoTestRate
+	run := func(ec *EchoCanceller) (float64, float64, int) {
+		var out []float64
+		var detected int
+		for i := 0; i < len(mic); i += echoTestChunk {
+			ec.WriteReference(pcm(far[i : i+echoTestChunk]))
+			for _, s := range audio.BytesToFloat32(ec.Process(pcm(mic[i : i+echoTestChunk]))) {
+				out = append(out, float64(s))
+			}
+			if i >= from && i < to && ec.DoubleTalkDetector().IsActive() {
+				detected++
+			}
+		}
+
+		var residual []float64
+		for i := from; i < to; i++ {
+			residual = append(residual, out[i]-near[i])
+		}
+		return 10 * math.Log10(energy(residual)/energy(echo[from:to])), erle(mic, out, 1), detected
+	}
+
+	frozen, after, detected := run(NewEchoCanceller(echoTestRate, 64*time.Millisecond))
+	if chunks := (to - from) / echoTestChunk; detected < chunks*3/4 {
+		t.Errorf("double-talk detected in %d of %d chunks, want at least three quarters", detected, chunks)
+	}
+
+	// Without the detector the filter adapts to the caller's voice
+	adapting := NewEchoCanceller(echoTestRate, 64*time.Millisecond)
+	adapting.dtd.threshold = math.Inf(1)
+	diverged, _, _ := run(adapting)
+
+	// Measures about 0 dB against 15 dB
+	if frozen > 3 {
+		t.Errorf("residual echo %.1f dB above the echo during double-talk, want at most 3 dB", frozen)
+	}
+	if frozen > diverged-10 {
+		t.Errorf("residual echo %.1f dB with the detector, %.1f dB without, want at least 10 dB less", frozen, diverged)
+	}
+	if after < 30 {
+		t.Errorf("ERLE %.1f dB a second after double-talk, want at least 30 dB", after)
+	}
+}
+
+func TestEchoCancellerReferenceBacklog(t *testing.T) {
+	ec := NewEchoCanceller(echoTestRate, 64*time.Millisecond)
+	ec.WriteReference(pcm(speechLike(5, 5, 0.3)))
+
+	if max := int(maxReferenceBacklog.Seconds() * echoTestRate); len(ec.pending) > max {
+		t.Errorf("%d reference samples queued, want at most %d", len(ec.pending), max)
+	}
+}
+
+func TestEchoCancellerSilentFarEnd(t *testing.T) {
+	near := speechLike(6, 1, 0.3)
+	ec := NewEchoCanceller(echoTestRate, 64*time.Millisecond)
+	out := runEcho(ec, make([]float64, len(near)), near)
+
+	// Nothing to cancel, so the mic passes through up to quantization
+	var residual []float64
+	for i := range near {
+		residual = append(residual, out[i]-near[i])
+	}
+	if snr := 10 * math.Log10(energy(near)/energy(residual)); snr < 60 {
+		t.Errorf("near-end altered with a silent far end: %.1f dB SNR, want at least 60 dB", snr)
+	}
+}
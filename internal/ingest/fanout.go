@@ -0,0 +1,346 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policy controls what FanOut does when a consumer's buffer is full
+type Policy int
+
+const (
+	// PolicyBlock waits for the consumer, stalling every other consumer
+	// too. Use for sinks that must never lose audio, such as the recorder.
+	PolicyBlock Policy = iota
+
+	// PolicyDropOldest discards the oldest queued chunk to make room.
+	// Suits live consumers like the ASR feed that care most about recency.
+	PolicyDropOldest
+
+	// PolicyDropNewest discards the incoming chunk
+	PolicyDropNewest
+
+	// PolicyCoalesce merges chunks that don't fit into a single larger
+	// chunk delivered once the consumer catches up. Audio is only dropped
+	// if the backlog exceeds maxCoalescedChunks.
+	PolicyCoalesce
+)
+
+const (
+	// Upper bound on chunks merged by PolicyCoalesce before the oldest
+	// coalesced audio is discarded
+	maxCoalescedChunks = 50
+
+	// Minimum interval between drop warnings for a single consumer
+	dropLogInterval = 5 * time.Second
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyBlock:
+		return "block"
+	case PolicyDropOldest:
+		return "drop-oldest"
+	case PolicyDropNewest:
+		return "drop-newest"
+	case PolicyCoalesce:
+		return "coalesce"
+	default:
+		return fmt.Sprintf("policy(%d)", int(p))
+	}
+}
+
+// Consumer is one output of a FanOut
+type Consumer struct {
+	name   string
+	policy Policy
+	ch     chan []byte
+	done   chan struct{}
+
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+
+	// Guards sends and close of ch, plus the fields below
+	sendMu    sync.Mutex
+	closed    bool
+	coalesced []byte
+	merged    int
+	lastWarn  time.Time
+	warnDrops uint64
+}
+
+// C returns the channel chunks are delivered on. It is closed when the
+// consumer is removed or the FanOut stops.
+func (c *Consumer) C() <-chan []byte {
+	return c.ch
+}
+
+// Name returns the consumer name
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// Policy returns the consumer's backpressure policy
+func (c *Consumer) Policy() Policy {
+	return c.policy
+}
+
+// Delivered returns the number of chunks delivered to the consumer
+func (c *Consumer) Delivered() uint64 {
+	return c.delivered.Load()
+}
+
+// Dropped returns the number of chunks discarded for the consumer
+func (c *Consumer) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// ConsumerStats is a snapshot of a consumer's counters
+type ConsumerStats struct {
+	Policy    Policy
+	Delivered uint64
+	Dropped   uint64
+	Queued    int
+}
+
+// FanOut duplicates audio chunks to multiple consumers, each with its own
+// buffer and backpressure policy. Consumers may be added and removed while
+// it is running.
+type FanOut struct {
+	consumers map[string]*Consumer
+	closed    bool
+	mu        sync.RWMutex
+}
+
+// NewFanOut creates a new fan-out with no consumers
+func NewFanOut() *FanOut {
+	return &FanOut{
+		consumers: make(map[string]*Consumer),
+	}
+}
+
+// Add registers a consumer with the given buffer size and policy
+func (f *FanOut) Add(name string, buffer int, policy Policy) (*Consumer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, fmt.Errorf("fan-out is closed")
+	}
+	if _, exists := f.consumers[name]; exists {
+		return nil, fmt.Errorf("consumer %s already registered", name)
+	}
+
+	c := &Consumer{
+		name:   name,
+		policy: policy,
+		ch:     make(chan []byte, buffer),
+		done:   make(chan struct{}),
+	}
+	f.consumers[name] = c
+	return c, nil
+}
+
+// Remove unregisters a consumer and closes its channel
+func (f *FanOut) Remove(name string) {
+	f.mu.Lock()
+	c, ok := f.consumers[name]
+	delete(f.consumers, name)
+	f.mu.Unlock()
+
+	if ok {
+		c.close()
+	}
+}
+
+// Stats returns a snapshot of every consumer's counters
+func (f *FanOut) Stats() map[string]ConsumerStats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	stats := make(map[string]ConsumerStats, len(f.consumers))
+	for name, c := range f.consumers {
+		stats[name] = ConsumerStats{
+			Policy:    c.policy,
+			Delivered: c.Delivered(),
+			Dropped:   c.Dropped(),
+			Queued:    len(c.ch),
+		}
+	}
+	return stats
+}
+
+// Run distributes chunks from in until it is closed or ctx is cancelled,
+// then closes every consumer
+func (f *FanOut) Run(ctx context.Context, in <-chan []byte) error {
+	defer f.close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case chunk, ok := <-in:
+			if !ok {
+				f.flush(ctx)
+				return nil
+			}
+			f.dispatch(ctx, chunk)
+		}
+	}
+}
+
+func (f *FanOut) snapshot() []*Consumer {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	consumers := make([]*Consumer, 0, len(f.consumers))
+	for _, c := range f.consumers {
+		consumers = append(consumers, c)
+	}
+	return consumers
+}
+
+func (f *FanOut) dispatch(ctx context.Context, chunk []byte) {
+	for _, c := range f.snapshot() {
+		c.send(ctx, chunk)
+	}
+}
+
+// flush hands any coalesced audio to consumers before shutdown
+func (f *FanOut) flush(ctx context.Context) {
+	for _, c := range f.snapshot() {
+		c.flushCoalesced(ctx)
+	}
+}
+
+func (f *FanOut) close() {
+	f.mu.Lock()
+	consumers := f.consumers
+	f.consumers = make(map[string]*Consumer)
+	f.closed = true
+	f.mu.Unlock()
+
+	for _, c := range consumers {
+		c.close()
+	}
+}
+
+func (c *Consumer) close() {
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.ch)
+	}
+}
+
+func (c *Consumer) send(ctx context.Context, chunk []byte) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	switch c.policy {
+	case PolicyBlock:
+		select {
+		case c.ch <- chunk:
+			c.delivered.Add(1)
+		case <-c.done:
+		case <-ctx.Done():
+		}
+
+	case PolicyDropOldest:
+		for {
+			select {
+			case c.ch <- chunk:
+				c.delivered.Add(1)
+				return
+			default:
+			}
+			// Make room; the consumer may have drained it concurrently
+			select {
+			case <-c.ch:
+				c.drop(1)
+			default:
+			}
+		}
+
+	case PolicyDropNewest:
+		select {
+		case c.ch <- chunk:
+			c.delivered.Add(1)
+		default:
+			c.drop(1)
+		}
+
+	case PolicyCoalesce:
+		if c.merged == 0 {
+			select {
+			case c.ch <- chunk:
+				c.delivered.Add(1)
+				return
+			default:
+			}
+		}
+
+		if c.merged == maxCoalescedChunks {
+			// Discard the oldest chunk's worth of merged audio
+			c.coalesced = c.coalesced[len(c.coalesced)/c.merged:]
+			c.merged--
+			c.drop(1)
+		}
+		c.coalesced = append(c.coalesced, chunk...)
+		c.merged++
+
+		select {
+		case c.ch <- c.coalesced:
+			c.delivered.Add(1)
+			c.coalesced = nil
+			c.merged = 0
+		default:
+		}
+	}
+}
+
+func (c *Consumer) flushCoalesced(ctx context.Context) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.closed || c.merged == 0 {
+		return
+	}
+
+	select {
+	case c.ch <- c.coalesced:
+		c.delivered.Add(1)
+	case <-c.done:
+	case <-ctx.Done():
+	}
+	c.coalesced = nil
+	c.merged = 0
+}
+
+// drop counts discarded chunks and logs at most once per dropLogInterval
+func (c *Consumer) drop(n uint64) {
+	c.dropped.Add(n)
+	c.warnDrops += n
+
+	if time.Since(c.lastWarn) >= dropLogInterval {
+		log.Printf("Warning: consumer %s (%s) dropped %d audio chunks", c.name, c.policy, c.warnDrops)
+		c.lastWarn = time.Now()
+		c.warnDrops = 0
+	}
+}
@@ -0,0 +1,255 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// runFanOut starts f on a new input channel and returns it with a function
+// closing it and waiting for Run to return
+func runFanOut(ctx context.Context, f *FanOut) (chan<- []byte, func() error) {
+	in := make(chan []byte)
+	done := make(chan error, 1)
+	go func() { done <- f.Run(ctx, in) }()
+	return in, func() error {
+		close(in)
+		return <-done
+	}
+}
+
+// drain reads a consumer until it is closed
+func drain(c *Consumer) []string {
+	var got []string
+	for chunk := range c.C() {
+		got = append(got, string(chunk))
+	}
+	return got
+}
+
+func send(in chan<- []byte, chunks ...string) {
+	for _, chunk := range chunks {
+		in <- []byte(chunk)
+	}
+}
+
+// waitDelivered waits for a chunk sent to be dispatched to a consumer
+func waitDelivered(t *testing.T, c *Consumer, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for c.Delivered()+c.Dropped() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %d chunks dispatched, want %d", c.Name(), c.Delivered()+c.Dropped(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func checkCounts(t *testing.T, c *Consumer, delivered, dropped uint64) {
+	t.Helper()
+	if c.Delivered() != delivered || c.Dropped() != dropped {
+		t.Errorf("%s: %d delivered and %d dropped, want %d and %d", c.Name(), c.Delivered(), c.Dropped(), delivered, dropped)
+	}
+}
+
+func TestFanOutBlock(t *testing.T) {
+	f := NewFanOut()
+	c, _ := f.Add("recorder", 1, PolicyBlock)
+	in, stop := runFanOut(context.Background(), f)
+
+	result := make(chan []string)
+	go func() {
+		// Slower than the input, which has to wait
+		var got []string
+		for chunk := range c.C() {
+			time.Sleep(time.Millisecond)
+			got = append(got, string(chunk))
+		}
+		result <- got
+	}()
+
+	send(in, "a", "b", "c", "d", "e")
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(<-result); got != "[a b c d e]" {
+		t.Errorf("got %s, want every chunk in order", got)
+	}
+	checkCounts(t, c, 5, 0)
+}
+
+func TestFanOutDropOldest(t *testing.T) {
+	f := NewFanOut()
+	c, _ := f.Add("recognition", 2, PolicyDropOldest)
+	in, stop := runFanOut(context.Background(), f)
+
+	send(in, "a", "b", "c", "d", "e")
+	stop()
+	if got := fmt.Sprint(drain(c)); got != "[d e]" {
+		t.Errorf("got %s, want the latest chunks", got)
+	}
+	checkCounts(t, c, 5, 3)
+}
+
+func TestFanOutDropNewest(t *testing.T) {
+	f := NewFanOut()
+	c, _ := f.Add("monitor", 2, PolicyDropNewest)
+	in, stop := runFanOut(context.Background(), f)
+
+	send(in, "a", "b", "c", "d", "e")
+	stop()
+	if got := fmt.Sprint(drain(c)); got != "[a b]" {
+		t.Errorf("got %s, want the first chunks", got)
+	}
+	checkCounts(t, c, 2, 3)
+}
+
+func TestFanOutCoalesce(t *testing.T) {
+	f := NewFanOut()
+	c, _ := f.Add("recognition", 1, PolicyCoalesce)
+	in, stop := runFanOut(context.Background(), f)
+
+	send(in, "a", "b", "c", "d", "e")
+	result := make(chan []string)
+	go func() { result <- drain(c) }()
+	stop()
+
+	// What didn't fit is merged and delivered when the input ends
+	if got := fmt.Sprint(<-result); got != "[a bcde]" {
+		t.Errorf("got %s, want the chunks that didn't fit merged", got)
+	}
+	checkCounts(t, c, 2, 0)
+}
+
+func TestFanOutCoalesceLimit(t *testing.T) {
+	f := NewFanOut()
+	c, _ := f.Add("recognition", 1, PolicyCoalesce)
+	in, stop := runFanOut(context.Background(), f)
+
+	send(in, "-")
+	var want string
+	for i := range maxCoalescedChunks + 10 {
+		chunk := string(rune('A' + i%26))
+		send(in, chunk)
+		if i >= 10 {
+			want += chunk
+		}
+	}
+	result := make(chan []string)
+	go func() { result <- drain(c) }()
+	stop()
+
+	got := <-result
+	if len(got) != 2 || got[0] != "-" || got[1] != want {
+		t.Errorf("got %q, want the first chunk and the latest %d merged", got, maxCoalescedChunks)
+	}
+	checkCounts(t, c, 2, 10)
+}
+
+func TestFanOutSlowConsumer(t *testing.T) {
+	f := NewFanOut()
+	recorder, _ := f.Add("recorder", 1, PolicyBlock)
+	recognition, _ := f.Add("recognition", 1, PolicyDropOldest)
+	in, stop := runFanOut(context.Background(), f)
+
+	// Nothing reads recognition; the recorder still gets everything
+	result := make(chan []string)
+	go func() { result <- drain(recorder) }()
+	send(in, "a", "b", "c", "d")
+	stop()
+
+	if got := fmt.Sprint(<-result); got != "[a b c d]" {
+		t.Errorf("recorder got %s, want every chunk", got)
+	}
+	checkCounts(t, recorder, 4, 0)
+	checkCounts(t, recognition, 4, 3)
+
+	stats := f.Stats()
+	if len(stats) != 0 {
+		t.Errorf("stats after stopping list %d consumers, want none", len(stats))
+	}
+}
+
+func TestFanOutAddRemove(t *testing.T) {
+	f := NewFanOut()
+	first, err := f.Add("first", 10, PolicyDropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Add("first", 10, PolicyBlock); err == nil {
+		t.Error("adding a consumer twice succeeded")
+	}
+	in, stop := runFanOut(context.Background(), f)
+
+	send(in, "a")
+	waitDelivered(t, first, 1)
+	second, _ := f.Add("second", 10, PolicyDropNewest)
+	send(in, "b")
+	waitDelivered(t, second, 1)
+	waitDelivered(t, first, 2)
+
+	stats := f.Stats()
+	if s := stats["second"]; s.Policy != PolicyDropNewest || s.Queued != 1 {
+		t.Errorf("stats of the second consumer %+v, want 1 queued", s)
+	}
+
+	// Removing closes the consumer, and it gets nothing more
+	f.Remove("first")
+	if got := fmt.Sprint(drain(first)); got != "[a b]" {
+		t.Errorf("removed consumer got %s, want what was sent before", got)
+	}
+	send(in, "c")
+	stop()
+
+	if got := fmt.Sprint(drain(second)); got != "[b c]" {
+		t.Errorf("added consumer got %s, want what was sent after", got)
+	}
+	if _, err := f.Add("third", 10, PolicyBlock); err == nil {
+		t.Error("adding a consumer to a stopped fan-out succeeded")
+	}
+	// Removing an unknown consumer does nothing
+	f.Remove("first")
+}
+
+func TestFanOutCancel(t *testing.T) {
+	f := NewFanOut()
+	c, _ := f.Add("recorder", 1, PolicyBlock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan []byte, 10)
+	done := make(chan error, 1)
+	go func() { done <- f.Run(ctx, in) }()
+
+	// The second chunk blocks on the full consumer until cancelled
+	send(in, "a", "b", "c")
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return when cancelled")
+	}
+	if got := drain(c); len(got) == 0 || got[0] != "a" {
+		t.Errorf("got %v, want the chunk queued before cancelling", got)
+	}
+}
+
+func TestPolicyString(t *testing.T) {
+	for policy, want := range map[Policy]string{
+		PolicyBlock:      "block",
+		PolicyDropOldest: "drop-oldest",
+		PolicyDropNewest: "drop-newest",
+		PolicyCoalesce:   "coalesce",
+		Policy(9):        "policy(9)",
+	} {
+		if got := policy.String(); got != want {
+			t.Errorf("%d: got %q, want %q", int(policy), got, want)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package ingest
+
+import (
+	"math"
+	"math/cmplx"
+	"sync"
+
+	"voice-gateway/internal/audio"
+)
+
+// Processor is a stage in the audio preprocessing chain. Stages operate in
+// place on mono float samples and keep their own state between chunks.
+type Processor interface {
+	Process(samples []float32)
+	Reset()
+}
+
+// PreprocessConfig selects and tunes the preprocessing stages for a session
+type PreprocessConfig struct {
+	// High-pass cutoff in Hz for DC and rumble removal (0 disables)
+	HighPassCutoff float64
+
+	// Spectral-subtraction noise suppression
+	NoiseSuppression bool
+	// Maximum attenuation applied to noise-only bins, in dB
+	NoiseSuppressionDB float64
+
+	// Automatic gain control
+	AGC bool
+	// Target speech level in dBFS RMS
+	AGCTargetDBFS float64
+	// Maximum gain the AGC may apply, in dB
+	AGCMaxGainDB float64
+}
+
+// DefaultPreprocessConfig returns settings suited to telephony-style speech
+func DefaultPreprocessConfig() PreprocessConfig {
+	return PreprocessConfig{
+		HighPassCutoff:     80,
+		NoiseSuppression:   true,
+		NoiseSuppressionDB: 18,
+		AGC:                true,
+		AGCTargetDBFS:      -20,
+		AGCMaxGainDB:       24,
+	}
+}
+
+// Preprocessor runs a chain of processing stages over 16-bit mono PCM
+type Preprocessor struct {
+	stages []Processor
+	mu     sync.Mutex
+}
+
+// NewPreprocessor creates a preprocessing chain from the given config.
+// Stages run in the order high-pass, noise suppression, AGC.
+func NewPreprocessor(sampleRate int, cfg PreprocessConfig) *Preprocessor {
+	p := &Preprocessor{}
+
+	if cfg.HighPassCutoff > 0 {
+		p.Add(NewHighPassFilter(sampleRate, cfg.HighPassCutoff))
+	}
+	if cfg.NoiseSuppression {
+		p.Add(NewNoiseSuppressor(sampleRate, cfg.NoiseSuppressionDB))
+	}
+	if cfg.AGC {
+		p.Add(NewAGC(sampleRate, cfg.AGCTargetDBFS, cfg.AGCMaxGainDB))
+	}
+
+	return p
+}
+
+// Add appends a stage to the end of the chain
+func (p *Preprocessor) Add(stage Processor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stages = append(p.stages, stage)
+}
+
+// Process runs a PCM chunk through every stage and returns the result
+func (p *Preprocessor) Process(pcm []byte) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.stages) == 0 {
+		return pcm
+	}
+
+	samples := audio.BytesToFloat32(pcm)
+	for _, stage := range p.stages {
+		stage.Process(samples)
+	}
+
+	return audio.Float32ToBytes(samples)
+}
+
+// Reset clears the state of every stage
+func (p *Preprocessor) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, stage := range p.stages {
+		stage.Reset()
+	}
+}
+
+// HighPassFilter is a second-order Butterworth high-pass that removes DC
+// offset and low-frequency rumble (RBJ biquad)
+type HighPassFilter struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	x1, x2     float64
+	y1, y2     float64
+}
+
+// NewHighPassFilter creates a high-pass filter with the given cutoff
+func NewHighPassFilter(sampleRate int, cutoff float64) *HighPassFilter {
+	w0 := 2 * math.Pi * cutoff / float64(sampleRate)
+	q := math.Sqrt2 / 2
+	alpha := math.Sin(w0) / (2 * q)
+	cosW0 := math.Cos(w0)
+	a0 := 1 + alpha
+
+	return &HighPassFilter{
+		b0: (1 + cosW0) / 2 / a0,
+		b1: -(1 + cosW0) / a0,
+		b2: (1 + cosW0) / 2 / a0,
+		a1: -2 * cosW0 / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+// Process filters samples in place
+func (f *HighPassFilter) Process(samples []float32) {
+	for i, s := range samples {
+		x := float64(s)
+		y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+		f.x2, f.x1 = f.x1, x
+		f.y2, f.y1 = f.y1, y
+		samples[i] = float32(y)
+	}
+}
+
+// Reset clears the filter state
+func (f *HighPassFilter) Reset() {
+	f.x1, f.x2, f.y1, f.y2 = 0, 0, 0, 0
+}
+
+const (
+	// Noise suppressor analysis frame (~32ms at 16kHz)
+	nsFrameSize = 512
+
+	// Over-subtraction factor for the noise estimate
+	nsOverSubtraction = 2.0
+
+	// Per-frame upward drift of the noise floor estimate (~2.5 dB/s at 16kHz)
+	nsNoiseRise = 1.01
+
+	// Lowest noise power tracked, so the estimate can recover from digital
+	// silence
+	nsMinNoise = 1e-10
+
+	// Smoothing of the power spectrum and of the gains across frames
+	nsPowerSmoothing = 0.7
+	nsGainSmoothing  = 0.5
+)
+
+// NoiseSuppressor attenuates stationary background noise by spectral
+// subtraction. The noise floor is tracked per frequency bin from the minimum
+// of the smoothed power spectrum, so no external VAD is needed. Processing
+// uses 50% overlapped sqrt-Hann frames and adds one frame of latency.
+type NoiseSuppressor struct {
+	frameSize int
+	hop       int
+	window    []float64
+	floor     float64
+
+	frame  []float64
+	input  []float32
+	output []float32
+	ola    []float64
+
+	power []float64
+	noise []float64
+	gains []float64
+	hops  int
+
+	spectrum []complex128
+}
+
+// NewNoiseSuppressor creates a noise suppressor. maxAttenuationDB bounds how
+// far noise-only bins are pulled down.
+func NewNoiseSuppressor(sampleRate int, maxAttenuationDB float64) *NoiseSuppressor {
+	frameSize := nsFrameSize * sampleRate / PCMSampleRate
+	// Round up to a power of two for the FFT
+	size := 1
+	for size < frameSize {
+		size <<= 1
+	}
+
+	window := audio.HannWindow(size)
+	for i := range window {
+		window[i] = math.Sqrt(window[i])
+	}
+
+	ns := &NoiseSuppressor{
+		frameSize: size,
+		hop:       size / 2,
+		window:    window,
+		floor:     math.Pow(10, -maxAttenuationDB/20),
+		spectrum:  make([]complex128, size),
+	}
+	ns.Reset()
+
+	return ns
+}
+
+// Process suppresses noise in place. Output is delayed by one frame.
+func (ns *NoiseSuppressor) Process(samples []float32) {
+	ns.input = append(ns.input, samples...)
+
+	for len(ns.input) >= ns.hop {
+		ns.processHop(ns.input[:ns.hop])
+		ns.input = ns.input[ns.hop:]
+	}
+
+	n := copy(samples, ns.output)
+	ns.output = ns.output[n:]
+}
+
+// Reset clears the noise estimate and buffered audio
+func (ns *NoiseSuppressor) Reset() {
+	ns.frame = make([]float64, ns.frameSize)
+	ns.ola = make([]float64, ns.frameSize)
+	ns.input = nil
+	// One hop of silence keeps output available for chunk sizes that
+	// aren't a multiple of the hop
+	ns.output = make([]float32, ns.hop)
+
+	bins := ns.frameSize/2 + 1
+	ns.power = make([]float64, bins)
+	ns.noise = make([]float64, bins)
+	ns.gains = make([]float64, bins)
+	for k := range ns.gains {
+		ns.gains[k] = 1
+	}
+	ns.hops = 0
+}
+
+// processHop shifts in one hop of input, filters the frame and emits one hop
+// of output
+func (ns *NoiseSuppressor) processHop(hop []float32) {
+	copy(ns.frame, ns.frame[ns.hop:])
+	for i, s := range hop {
+		ns.frame[ns.frameSize-ns.hop+i] = float64(s)
+	}
+
+	for i, s := range ns.frame {
+		ns.spectrum[i] = complex(s*ns.window[i], 0)
+	}
+	audio.FFT(ns.spectrum)
+
+	bins := len(ns.power)
+	for k := 0; k < bins; k++ {
+		mag := cmplx.Abs(ns.spectrum[k])
+		p := mag * mag
+
+		// Seed the estimates from the first full frame
+		if ns.hops < ns.frameSize/ns.hop {
+			ns.power[k] = p
+			ns.noise[k] = p
+		} else {
+			ns.power[k] = nsPowerSmoothing*ns.power[k] + (1-nsPowerSmoothing)*p
+		}
+
+		// Minimum tracking with slow upward drift
+		if ns.power[k] < ns.noise[k] {
+			ns.noise[k] = ns.power[k]
+		} else {
+			ns.noise[k] = math.Max(ns.noise[k]*nsNoiseRise, nsMinNoise)
+		}
+
+		gain := ns.floor
+		if p > 0 {
+			gain = math.Sqrt(math.Max(1-nsOverSubtraction*ns.noise[k]/p, 0))
+		}
+		gain = nsGainSmoothing*ns.gains[k] + (1-nsGainSmoothing)*gain
+		if gain < ns.floor {
+			gain = ns.floor
+		}
+		ns.gains[k] = gain
+
+		g := complex(gain, 0)
+		ns.spectrum[k] *= g
+		if k > 0 && k < ns.frameSize-k {
+			ns.spectrum[ns.frameSize-k] *= g
+		}
+	}
+	ns.hops++
+
+	audio.IFFT(ns.spectrum)
+
+	for i := range ns.ola {
+		ns.ola[i] += real(ns.spectrum[i]) * ns.window[i]
+	}
+	for i := 0; i < ns.hop; i++ {
+		ns.output = append(ns.output, float32(ns.ola[i]))
+	}
+	copy(ns.ola, ns.ola[ns.hop:])
+	for i := ns.frameSize - ns.hop; i < ns.frameSize; i++ {
+		ns.ola[i] = 0
+	}
+}
+
+const (
+	// Signals below this RMS level are treated as silence and not boosted
+	agcGateDBFS = -55
+
+	// Gain smoothing time constants
+	agcAttack  = 10 * 1e-3
+	agcRelease = 400 * 1e-3
+)
+
+// AGC normalizes speech towards a target RMS level. Gain falls quickly on
+// loud input and recovers slowly, and is held during silence so background
+// noise isn't pumped up between words.
+type AGC struct {
+	sampleRate int
+	target     float64
+	maxGain    float64
+	gate       float64
+	gain       float64
+}
+
+// NewAGC creates an automatic gain control stage
+func NewAGC(sampleRate int, targetDBFS, maxGainDB float64) *AGC {
+	return &AGC{
+		sampleRate: sampleRate,
+		target:     dbToLinear(targetDBFS),
+		maxGain:    dbToLinear(maxGainDB),
+		gate:       dbToLinear(agcGateDBFS),
+		gain:       1,
+	}
+}
+
+// Gain returns the currently applied linear gain
+func (a *AGC) Gain() float64 {
+	return a.gain
+}
+
+// Process applies gain in place, ramping from the previous chunk's gain to
+// avoid zipper noise
+func (a *AGC) Process(samples []float32) {
+	if len(samples) == 0 {
+		return
+	}
+
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	rms := math.Sqrt(sum / float64(len(samples)))
+
+	next := a.gain
+	if rms > a.gate {
+		desired := math.Min(a.target/rms, a.maxGain)
+
+		tc := agcRelease
+		if desired < a.gain {
+			tc = agcAttack
+		}
+		dt := float64(len(samples)) / float64(a.sampleRate)
+		coeff := 1 - math.Exp(-dt/tc)
+		next = a.gain + (desired-a.gain)*coeff
+	}
+
+	step := (next - a.gain) / float64(len(samples))
+	g := a.gain
+	for i, s := range samples {
+		g += step
+		samples[i] = float32(float64(s) * g)
+	}
+	a.gain = next
+}
+
+// Reset restores unity gain
+func (a *AGC) Reset() {
+	a.gain = 1
+}
+
+func dbToLinear(db float64) float64 {
+	return math.Pow(10, db/20)
+}
@@ -0,0 +1,178 @@
+package ingest
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"voice-gateway/internal/audio"
+)
+
+// voiced returns seconds of a vowel-like harmonic tone at the given RMS
+// level, spoken in alternate seconds with pauses between
+func voiced(seconds float64, rms float64) []float64 {
+	out := make([]float64, int(seconds*PCMSampleRate))
+	for i := range out {
+		t := float64(i) / PCMSampleRate
+		if int(t)%2 == 1 {
+			continue
+		}
+		var s float64
+		for h := 1; h*150 < 3400; h++ {
+			s += math.Sin(2*math.Pi*150*float64(h)*t+float64(h)) / float64(h)
+		}
+		out[i] = s * (0.7 + 0.3*math.Sin(2*math.Pi*4*t))
+	}
+	scale := rms / math.Sqrt(2*energy(out)/float64(len(out)))
+	for i := range out {
+		out[i] *= scale
+	}
+	return out
+}
+
+// whiteNoise returns seconds of Gaussian noise at the given RMS level
+func whiteNoise(seed int64, seconds float64, rms float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	out := make([]float64, int(seconds*PCMSampleRate))
+	for i := range out {
+		out[i] = rms * rng.NormFloat64()
+	}
+	return out
+}
+
+func mix(signals ...[]float64) []float64 {
+	out := make([]float64, len(signals[0]))
+	for _, s := range signals {
+		for i := range out {
+			out[i] += s[i]
+		}
+	}
+	return out
+}
+
+// preprocess runs samples through p in 20ms chunks of 16-bit PCM, as the
+// gateway does
+func preprocess(p *Preprocessor, samples []float64) []float64 {
+	var out []float64
+	chunk := PCMSampleRate / 50
+	for i := 0; i < len(samples); i += chunk {
+		for _, s := range audio.BytesToFloat32(p.Process(pcm(samples[i:min(i+chunk, len(samples))]))) {
+			out = append(out, float64(s))
+		}
+	}
+	return out
+}
+
+// speechSNR estimates the SNR of audio made by voiced from the power in its
+// speech and in its pauses, after the first two seconds and away from the
+// edges of each second
+func speechSNR(samples []float64) float64 {
+	var speech, pause float64
+	var speechN, pauseN int
+	for i := 2 * PCMSampleRate; i < len(samples); i++ {
+		second, within := i/PCMSampleRate, i%PCMSampleRate
+		if within < PCMSampleRate/10 || within > PCMSampleRate*9/10 {
+			continue
+		}
+		if second%2 == 0 {
+			speech += samples[i] * samples[i]
+			speechN++
+		} else {
+			pause += samples[i] * samples[i]
+			pauseN++
+		}
+	}
+	noise := pause / float64(pauseN)
+	return 10 * math.Log10((speech/float64(speechN)-noise)/noise)
+}
+
+// goertzel returns the power of samples at one frequency
+func goertzel(samples []float64, freq float64) float64 {
+	w := 2 * math.Pi * freq / PCMSampleRate
+	var s1, s2 float64
+	for _, x := range samples {
+		s1, s2 = x+2*math.Cos(w)*s1-s2, s1
+	}
+	return (s1*s1 + s2*s2 - 2*math.Cos(w)*s1*s2) / float64(len(samples)*len(samples))
+}
+
+func TestHighPassFilter(t *testing.T) {
+	n := 2 * PCMSampleRate
+	tone, rumble := make([]float64, n), make([]float64, n)
+	for i := range tone {
+		tone[i] = 0.3 * math.Sin(2*math.Pi*1000*float64(i)/PCMSampleRate)
+		rumble[i] = 0.2 + 0.2*math.Sin(2*math.Pi*20*float64(i)/PCMSampleRate)
+	}
+	in := mix(tone, rumble)
+
+	// snr compares the tone with DC and rumble over the last second
+	snr := func(samples []float64) float64 {
+		last := samples[len(samples)-PCMSampleRate:]
+		return 10 * math.Log10(goertzel(last, 1000)/(goertzel(last, 0)+goertzel(last, 20)))
+	}
+
+	p := NewPreprocessor(PCMSampleRate, PreprocessConfig{HighPassCutoff: 80})
+	before, after := snr(in), snr(preprocess(p, in))
+	t.Logf("tone to DC and rumble: %.1f dB before, %.1f dB after", before, after)
+	if after-before < 20 {
+		t.Errorf("high-pass filter improved the SNR by %.1f dB, want at least 20 dB", after-before)
+	}
+}
+
+func TestNoiseSuppression(t *testing.T) {
+	in := mix(voiced(10, 0.1), whiteNoise(1, 10, 0.02))
+
+	p := NewPreprocessor(PCMSampleRate, PreprocessConfig{NoiseSuppression: true, NoiseSuppressionDB: 18})
+	before, after := speechSNR(in), speechSNR(preprocess(p, in))
+	t.Logf("SNR %.1f dB before, %.1f dB after", before, after)
+	if after-before < 6 {
+		t.Errorf("noise suppression improved the SNR by %.1f dB, want at least 6 dB", after-before)
+	}
+}
+
+func TestAGC(t *testing.T) {
+	const target = -20
+	// Quiet speech over a faint noise floor, below the AGC's gate
+	in := mix(voiced(10, 0.003), whiteNoise(2, 10, 0.0003))
+
+	agc := NewAGC(PCMSampleRate, target, 30)
+	p := &Preprocessor{}
+	p.Add(agc)
+	out := preprocess(p, in)
+
+	// Speech in the last second spoken
+	from, to := 8*PCMSampleRate+PCMSampleRate/10, 9*PCMSampleRate
+	level := 10 * math.Log10(energy(out[from:to])/float64(to-from))
+	if math.Abs(level-target) > 3 {
+		t.Errorf("speech brought to %.1f dBFS, want %d dBFS within 3 dB", level, target)
+	}
+
+	// The gain is held through pauses, so noise isn't pumped up
+	gain := agc.Gain()
+	preprocess(p, whiteNoise(3, 1, 0.0003))
+	if agc.Gain() > gain*1.01 {
+		t.Errorf("gain rose from %.1f to %.1f over a pause", gain, agc.Gain())
+	}
+
+	if before, after := speechSNR(in), speechSNR(out); math.Abs(after-before) > 1 {
+		t.Errorf("AGC changed the SNR from %.1f dB to %.1f dB", before, after)
+	}
+}
+
+func TestPreprocessorDefaults(t *testing.T) {
+	clean := mix(voiced(10, 0.05), whiteNoise(4, 10, 0.003))
+	in := make([]float64, len(clean))
+	for i, s := range clean {
+		in[i] = s + 0.05 // DC offset from a cheap microphone
+	}
+
+	p := NewPreprocessor(PCMSampleRate, DefaultPreprocessConfig())
+	out := preprocess(p, in)
+
+	// The offset counts as noise too
+	before, noise, after := speechSNR(in), speechSNR(clean), speechSNR(out)
+	t.Logf("SNR %.1f dB before, %.1f dB without the offset, %.1f dB after", before, noise, after)
+	if after-noise < 3 {
+		t.Errorf("preprocessing improved the SNR by %.1f dB over the noise alone, want at least 3 dB", after-noise)
+	}
+}
@@ -0,0 +1,158 @@
+package retention
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"voice-gateway/internal/storage"
+)
+
+// AuditPrefix is where audit entries are kept in recording storage, one
+// object per entry named after its time. Keys starting with a dot are not
+// recordings.
+const AuditPrefix = ".audit/"
+
+// Audited actions
+const (
+	// Recorded before a deletion is attempted, so one that is cut short
+	// still leaves a trace
+	ActionDeleteIntent = "delete_intent"
+	ActionDelete       = "delete"
+	ActionLegalHold    = "legal_hold"
+	ActionReleaseHold  = "legal_hold_released"
+)
+
+// ActorRetention is the actor of deletions made by the purge job
+const ActorRetention = "retention"
+
+// AuditEntry records one action on a recording, or an attempt at one
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	SessionID string    `json:"session_id"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	// Who acted: ActorRetention or whoever made the request
+	Actor string `json:"actor"`
+	// The retention rule applied, or the reason given with the request
+	Reason string `json:"reason,omitempty"`
+	// What was deleted
+	Objects int   `json:"objects,omitempty"`
+	Bytes   int64 `json:"bytes,omitempty"`
+	// Set if the action failed or was refused
+	Error string `json:"error,omitempty"`
+}
+
+// AuditLog stores each entry in recording storage, where it outlives the
+// gateway as the recordings do, and appends it to a local JSON Lines file
+// if one is configured. Both are durable before Record returns.
+type AuditLog struct {
+	store storage.Storage
+
+	mu   sync.Mutex
+	file *os.File // nil without a local copy
+	last time.Time
+}
+
+// OpenAuditLog creates an audit log kept in store and, unless path is
+// empty, also appended to the file at path, created if need be
+func OpenAuditLog(store storage.Storage, path string) (*AuditLog, error) {
+	a := &AuditLog{store: store}
+	if path == "" {
+		return a, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	a.file = file
+	return a, nil
+}
+
+// Record stores an entry, timestamped now if it has no time
+func (a *AuditLog) Record(ctx context.Context, entry AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+		// Entries are keyed by time, so each gets one of its own
+		if !entry.Time.After(a.last) {
+			entry.Time = a.last.Add(time.Nanosecond)
+		}
+		a.last = entry.Time
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	outcome := "done"
+	if entry.Error != "" {
+		outcome = "failed: " + entry.Error
+	}
+	log.Printf("Session %s: %s by %s (%s) %s", entry.SessionID, entry.Action, entry.Actor, entry.Reason, outcome)
+
+	// The entry is stored even if the request that caused it is cancelled
+	ctx = context.WithoutCancel(ctx)
+	if err := storage.Upload(ctx, a.store, auditKey(entry), bytes.NewReader(append(line, '\n'))); err != nil {
+		return fmt.Errorf("failed to store audit entry: %w", err)
+	}
+	if a.file == nil {
+		return nil
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+	return nil
+}
+
+// auditKey names an entry's object so that entries list in time order
+func auditKey(entry AuditEntry) string {
+	return fmt.Sprintf("%s%s-%s-%s.json", AuditPrefix, entry.Time.UTC().Format("20060102T150405.000000000Z"), entry.SessionID, entry.Action)
+}
+
+// ReadAudit returns the entries in store, in time order
+func ReadAudit(ctx context.Context, store storage.Storage) ([]AuditEntry, error) {
+	objects, err := store.List(ctx, AuditPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit entries: %w", err)
+	}
+
+	var entries []AuditEntry
+	for _, object := range objects {
+		r, err := store.Open(ctx, object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit entry %s: %w", object.Key, err)
+		}
+		var entry AuditEntry
+		err = json.NewDecoder(r).Decode(&entry)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit entry %s: %w", object.Key, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
@@ -0,0 +1,122 @@
+// Package retention deletes recordings once they are no longer to be kept,
+// and keeps an audit log of every deletion and legal hold.
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/session"
+)
+
+// Policy decides which recordings are deleted
+type Policy struct {
+	// Recordings older than this are deleted; 0 keeps them forever
+	MaxAge time.Duration
+	// Overrides MaxAge for a tenant's recordings
+	TenantMaxAge map[string]time.Duration
+	// While all recordings together take more bytes than this, the oldest
+	// are deleted; 0 for no limit
+	MaxBytes int64
+}
+
+// NewPolicy creates the configured policy
+func NewPolicy(cfg config.RetentionConfig) (Policy, error) {
+	policy := Policy{
+		MaxAge:       cfg.MaxAge,
+		TenantMaxAge: make(map[string]time.Duration),
+		MaxBytes:     cfg.MaxBytes,
+	}
+	if policy.MaxAge < 0 || policy.MaxBytes < 0 {
+		return Policy{}, fmt.Errorf("retention limits must not be negative")
+	}
+
+	for _, rule := range cfg.TenantMaxAge {
+		tenant, value, found := strings.Cut(rule, "=")
+		if !found || strings.TrimSpace(tenant) == "" {
+			return Policy{}, fmt.Errorf("invalid tenant retention %q, expected tenant=duration", rule)
+		}
+		maxAge, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || maxAge < 0 {
+			return Policy{}, fmt.Errorf("invalid retention for tenant %s: %q", tenant, value)
+		}
+		policy.TenantMaxAge[strings.TrimSpace(tenant)] = maxAge
+	}
+	return policy, nil
+}
+
+// Enabled reports whether the policy ever deletes anything
+func (p Policy) Enabled() bool {
+	if p.MaxAge > 0 || p.MaxBytes > 0 {
+		return true
+	}
+	for _, maxAge := range p.TenantMaxAge {
+		if maxAge > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAge returns how long a tenant's recordings are kept, 0 for forever.
+// Tenant rules only apply to authenticated tenants, so a caller can't have
+// a recording purged early by claiming a tenant kept briefly.
+func (p Policy) maxAge(tenantID string) time.Duration {
+	if maxAge, ok := p.TenantMaxAge[tenantID]; ok && tenantID != "" {
+		return maxAge
+	}
+	return p.MaxAge
+}
+
+// Deletion is a recording the policy deletes, and why
+type Deletion struct {
+	Recording session.RecordingInfo
+	Reason    string
+}
+
+// Select returns the recordings to delete, oldest first. Recordings under
+// legal hold or in progress are never selected, though they count towards
+// the size limit.
+func (p Policy) Select(recordings []session.RecordingInfo, now time.Time) []Deletion {
+	recordings = append([]session.RecordingInfo(nil), recordings...)
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].StartTime().Before(recordings[j].StartTime())
+	})
+
+	var total int64
+	for _, r := range recordings {
+		total += r.Size
+	}
+
+	var deletions []Deletion
+	var kept []session.RecordingInfo
+	for _, r := range recordings {
+		if r.Held() || r.InProgress(now) {
+			continue
+		}
+		if maxAge := p.maxAge(r.AuthenticatedTenantID()); maxAge > 0 && now.Sub(r.StartTime()) > maxAge {
+			deletions = append(deletions, Deletion{Recording: r, Reason: fmt.Sprintf("older than %s", maxAge)})
+			total -= r.Size
+			continue
+		}
+		kept = append(kept, r)
+	}
+
+	if p.MaxBytes > 0 {
+		for _, r := range kept {
+			if total <= p.MaxBytes {
+				break
+			}
+			deletions = append(deletions, Deletion{Recording: r, Reason: fmt.Sprintf("recordings exceed %d bytes", p.MaxBytes)})
+			total -= r.Size
+		}
+	}
+
+	sort.SliceStable(deletions, func(i, j int) bool {
+		return deletions[i].Recording.StartTime().Before(deletions[j].Recording.StartTime())
+	})
+	return deletions
+}
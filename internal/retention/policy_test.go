@@ -0,0 +1,155 @@
+package retention
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"voice-gateway/internal/session"
+)
+
+// recording returns a completed recording of a tenant that started age
+// before now
+func recording(id, tenant string, authenticated bool, age time.Duration, size int64, now time.Time) session.RecordingInfo {
+	return session.RecordingInfo{
+		SessionID: id,
+		Metadata: &session.RecordingMetadata{
+			SessionID:           id,
+			TenantID:            tenant,
+			TenantAuthenticated: authenticated,
+			Status:              session.StatusComplete,
+			StartTime:           now.Add(-age),
+		},
+		Size: size,
+	}
+}
+
+func selectedIDs(deletions []Deletion) []string {
+	var ids []string
+	for _, d := range deletions {
+		ids = append(ids, d.Recording.SessionID)
+	}
+	return ids
+}
+
+func TestSelectClaimedTenant(t *testing.T) {
+	now := time.Now()
+	policy := Policy{MaxAge: 30 * 24 * time.Hour, TenantMaxAge: map[string]time.Duration{"brief": time.Hour}}
+	recordings := []session.RecordingInfo{
+		recording("verified", "brief", true, 2*time.Hour, 1, now),
+		// A caller claiming the tenant without its token gets the default
+		recording("claimed", "brief", false, 2*time.Hour, 1, now),
+	}
+
+	got := selectedIDs(policy.Select(recordings, now))
+	if len(got) != 1 || got[0] != "verified" {
+		t.Errorf("selected %v, want [verified]", got)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	held := func(r session.RecordingInfo) session.RecordingInfo {
+		r.Metadata.LegalHold = &session.LegalHold{Reason: "litigation", SetAt: now}
+		return r
+	}
+	recordingNow := func(r session.RecordingInfo) session.RecordingInfo {
+		r.Metadata.Status = session.StatusRecording
+		return r
+	}
+
+	tests := []struct {
+		name       string
+		policy     Policy
+		recordings []session.RecordingInfo
+		want       []string
+	}{
+		{
+			name:   "no limits",
+			policy: Policy{},
+			recordings: []session.RecordingInfo{
+				recording("old", "", false, 1000*day, 1<<30, now),
+			},
+		},
+		{
+			name:   "age cutoff",
+			policy: Policy{MaxAge: 30 * day},
+			recordings: []session.RecordingInfo{
+				recording("new", "", false, 29*day, 1, now),
+				recording("older", "", false, 40*day, 1, now),
+				recording("old", "", false, 31*day, 1, now),
+			},
+			want: []string{"older", "old"},
+		},
+		{
+			name:   "tenant override",
+			policy: Policy{MaxAge: 30 * day, TenantMaxAge: map[string]time.Duration{"brief": day, "long": 90 * day}},
+			recordings: []session.RecordingInfo{
+				recording("brief", "brief", true, 2*day, 1, now),
+				recording("long", "long", true, 60*day, 1, now),
+				recording("longer", "long", true, 91*day, 1, now),
+				recording("default", "other", true, 31*day, 1, now),
+			},
+			want: []string{"longer", "default", "brief"},
+		},
+		{
+			name:   "tenant kept forever",
+			policy: Policy{MaxAge: 30 * day, TenantMaxAge: map[string]time.Duration{"forever": 0}},
+			recordings: []session.RecordingInfo{
+				recording("forever", "forever", true, 1000*day, 1, now),
+				recording("claimed", "forever", false, 1000*day, 1, now),
+			},
+			want: []string{"claimed"},
+		},
+		{
+			name:   "size cap oldest first",
+			policy: Policy{MaxBytes: 250},
+			recordings: []session.RecordingInfo{
+				recording("c", "", false, 1*day, 100, now),
+				recording("a", "", false, 3*day, 100, now),
+				recording("b", "", false, 2*day, 100, now),
+				recording("d", "", false, 0, 100, now),
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name:   "size cap after age",
+			policy: Policy{MaxAge: 10 * day, MaxBytes: 150},
+			recordings: []session.RecordingInfo{
+				recording("expired", "", false, 20*day, 100, now),
+				recording("a", "", false, 5*day, 100, now),
+				recording("b", "", false, 4*day, 100, now),
+			},
+			want: []string{"expired", "a"},
+		},
+		{
+			name:   "held and in progress exempt",
+			policy: Policy{MaxAge: day, MaxBytes: 150},
+			recordings: []session.RecordingInfo{
+				held(recording("held", "", false, 100*day, 100, now)),
+				recordingNow(recording("recording", "", false, 2*time.Hour, 100, now)),
+				recording("old", "", false, 2*day, 100, now),
+			},
+			// The exempt recordings still count towards the cap, which
+			// deleting everything else can't reach
+			want: []string{"old"},
+		},
+		{
+			name:   "abandoned recording",
+			policy: Policy{MaxAge: day},
+			recordings: []session.RecordingInfo{
+				recordingNow(recording("abandoned", "", false, 2*day, 100, now)),
+			},
+			want: []string{"abandoned"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectedIDs(tt.policy.Select(tt.recordings, now))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selected %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
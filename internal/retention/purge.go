@@ -0,0 +1,118 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"voice-gateway/internal/session"
+	"voice-gateway/internal/storage"
+)
+
+// ErrNotAudited is returned for a deletion that couldn't be recorded in
+// the audit log
+var ErrNotAudited = errors.New("deletion not audited")
+
+// Purger applies a retention policy to the recordings in storage
+type Purger struct {
+	store  storage.Storage
+	policy Policy
+	audit  *AuditLog
+}
+
+// NewPurger creates a purger recording its deletions in audit
+func NewPurger(store storage.Storage, policy Policy, audit *AuditLog) *Purger {
+	return &Purger{store: store, policy: policy, audit: audit}
+}
+
+// Purge deletes the recordings the policy selects and returns them. A
+// recording placed under legal hold or found in progress since it was
+// selected is skipped. With dryRun nothing is deleted or audited.
+func (p *Purger) Purge(ctx context.Context, dryRun bool) ([]Deletion, error) {
+	recordings, err := session.ListRecordings(ctx, p.store)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := p.policy.Select(recordings, time.Now())
+	if dryRun {
+		return selected, nil
+	}
+
+	var deleted []Deletion
+	var errs []error
+	for _, d := range selected {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+
+		_, err := DeleteRecording(ctx, p.store, p.audit, AuditEntry{
+			SessionID: d.Recording.SessionID,
+			TenantID:  d.Recording.TenantID(),
+			Actor:     ActorRetention,
+			Reason:    d.Reason,
+		})
+		switch {
+		case errors.Is(err, ErrNotAudited):
+			// Nothing more is deleted without a record of it
+			return deleted, errors.Join(append(errs, fmt.Errorf("session %s: %w", d.Recording.SessionID, err))...)
+		case errors.Is(err, session.ErrLegalHold) || errors.Is(err, session.ErrInProgress) || errors.Is(err, storage.ErrNotFound):
+		case err != nil:
+			errs = append(errs, fmt.Errorf("session %s: %w", d.Recording.SessionID, err))
+		default:
+			deleted = append(deleted, d)
+		}
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// DeleteRecording deletes a recording with session.DeleteRecording,
+// auditing the intent before and the result after. entry names the
+// recording and who deletes it and why. Nothing is deleted if the intent
+// can't be recorded. A failure to record either entry is returned as
+// ErrNotAudited, joined with any error deleting.
+func DeleteRecording(ctx context.Context, store storage.Storage, audit *AuditLog, entry AuditEntry) (session.RecordingInfo, error) {
+	entry.Action = ActionDeleteIntent
+	if err := audit.Record(ctx, entry); err != nil {
+		return session.RecordingInfo{}, fmt.Errorf("%w: %w", ErrNotAudited, err)
+	}
+
+	info, err := session.DeleteRecording(ctx, store, entry.SessionID)
+	entry.Action, entry.Time = ActionDelete, time.Time{}
+	if entry.TenantID == "" {
+		entry.TenantID = info.TenantID()
+	}
+	if err == nil {
+		entry.Objects, entry.Bytes = len(info.Objects), info.Size
+	} else {
+		entry.Error = err.Error()
+	}
+	if auditErr := audit.Record(ctx, entry); auditErr != nil {
+		err = errors.Join(err, fmt.Errorf("%w: %w", ErrNotAudited, auditErr))
+	}
+	return info, err
+}
+
+// Run purges every interval until ctx is done
+func (p *Purger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := p.Purge(ctx, false)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Recording purge failed: %v", err)
+		}
+		if len(deleted) > 0 {
+			log.Printf("Recording purge deleted %d recordings", len(deleted))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
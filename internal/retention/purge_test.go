@@ -0,0 +1,142 @@
+package retention
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/session"
+	"voice-gateway/internal/storage"
+)
+
+// auditFailingStore refuses to store audit entries
+type auditFailingStore struct {
+	storage.Storage
+}
+
+func (s *auditFailingStore) Create(ctx context.Context, key string) (storage.Writer, error) {
+	if strings.HasPrefix(key, AuditPrefix) {
+		return nil, errors.New("store unavailable")
+	}
+	return s.Storage.Create(ctx, key)
+}
+
+// storeRecording stores a completed recording of a session that started
+// age ago
+func storeRecording(t *testing.T, store storage.Storage, sessionID string, age time.Duration) {
+	t.Helper()
+	ctx := context.Background()
+	metadata := session.RecordingMetadata{SessionID: sessionID, TenantID: "acme", Status: session.StatusComplete, StartTime: time.Now().Add(-age)}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{session.MetadataFile: data, "audio.wav": make([]byte, 100)} {
+		if err := storage.Upload(ctx, store, sessionID+"/"+name, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestPurger(t *testing.T, store storage.Storage, logPath string) *Purger {
+	t.Helper()
+	policy, err := NewPolicy(config.RetentionConfig{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := OpenAuditLog(store, logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+	return NewPurger(store, policy, audit)
+}
+
+func TestPurgeAudit(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeRecording(t, store, "expired", 48*time.Hour)
+	storeRecording(t, store, "recent", time.Hour)
+	logPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	ctx := context.Background()
+
+	deleted, err := newTestPurger(t, store, logPath).Purge(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].Recording.SessionID != "expired" {
+		t.Fatalf("deleted %v", deleted)
+	}
+
+	entries, err := ReadAudit(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d audit entries in storage, want 2", len(entries))
+	}
+	intent, result := entries[0], entries[1]
+	if intent.Action != ActionDeleteIntent || intent.SessionID != "expired" || intent.Actor != ActorRetention || intent.Objects != 0 {
+		t.Errorf("intent entry %+v", intent)
+	}
+	if result.Action != ActionDelete || result.SessionID != "expired" || result.TenantID != "acme" || result.Objects != 2 || result.Error != "" {
+		t.Errorf("result entry %+v", result)
+	}
+	if !result.Time.After(intent.Time) {
+		t.Errorf("result at %v, intent at %v", result.Time, intent.Time)
+	}
+
+	// The local copy holds the same entries
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Errorf("%d lines in the local audit log, want 2", len(lines))
+	}
+
+	// Audit entries aren't taken for a recording
+	recordings, err := session.ListRecordings(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) != 1 || recordings[0].SessionID != "recent" {
+		t.Errorf("listed %v", recordings)
+	}
+	if session.ValidSessionID(strings.TrimSuffix(AuditPrefix, "/")) {
+		t.Error("the audit log can be named as a recording")
+	}
+}
+
+func TestPurgeStopsWithoutAudit(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeRecording(t, local, "expired-1", 48*time.Hour)
+	storeRecording(t, local, "expired-2", 48*time.Hour)
+	store := &auditFailingStore{local}
+	ctx := context.Background()
+
+	deleted, err := newTestPurger(t, store, "").Purge(ctx, false)
+	if !errors.Is(err, ErrNotAudited) {
+		t.Fatalf("purge returned %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("deleted %d recordings without auditing", len(deleted))
+	}
+	for _, id := range []string{"expired-1", "expired-2"} {
+		if _, err := session.StatRecording(ctx, local, id); err != nil {
+			t.Errorf("session %s: %v", id, err)
+		}
+	}
+}
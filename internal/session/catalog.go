@@ -0,0 +1,266 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+
+	"voice-gateway/internal/storage"
+)
+
+// A recording still marked as being recorded this long after it started
+// was abandoned by a crash; no call lasts this long
+const abandonedAfter = 24 * time.Hour
+
+var (
+	// ErrLegalHold is returned for a change to a recording under legal hold
+	ErrLegalHold = errors.New("recording is under legal hold")
+	// ErrInProgress is returned for a change to a recording still being
+	// recorded
+	ErrInProgress = errors.New("recording is in progress")
+)
+
+// recordingLocks serializes changes to a recording's legal hold with its
+// deletion, so a recording is never deleted after the hold check while a
+// hold is placed on it. The locks only cover this process: storage has no
+// conditional writes to serialize changes made by others.
+var recordingLocks = struct {
+	sync.Mutex
+	locks map[string]*recordingLock
+}{locks: map[string]*recordingLock{}}
+
+type recordingLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockRecording waits for any other change to a recording to finish and
+// returns a function releasing it
+func lockRecording(sessionID string) (unlock func()) {
+	recordingLocks.Lock()
+	lock := recordingLocks.locks[sessionID]
+	if lock == nil {
+		lock = &recordingLock{}
+		recordingLocks.locks[sessionID] = lock
+	}
+	lock.users++
+	recordingLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		recordingLocks.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(recordingLocks.locks, sessionID)
+		}
+		recordingLocks.Unlock()
+	}
+}
+
+// RecordingInfo describes a recording in storage
+type RecordingInfo struct {
+	SessionID string
+	// nil if the recording has no readable metadata
+	Metadata *RecordingMetadata
+	Objects  []storage.ObjectInfo
+	// Of all its objects
+	Size int64
+	// When any of its objects was last written
+	ModTime time.Time
+}
+
+// StartTime returns when the recording started, or when it was last
+// written if its metadata is missing
+func (i RecordingInfo) StartTime() time.Time {
+	if i.Metadata != nil && !i.Metadata.StartTime.IsZero() {
+		return i.Metadata.StartTime
+	}
+	return i.ModTime
+}
+
+// TenantID returns the tenant whose call was recorded, if known
+func (i RecordingInfo) TenantID() string {
+	if i.Metadata == nil {
+		return ""
+	}
+	return i.Metadata.TenantID
+}
+
+// AuthenticatedTenantID returns the tenant whose call was recorded if the
+// caller authenticated as it, and "" for a tenant only claimed
+func (i RecordingInfo) AuthenticatedTenantID() string {
+	if i.Metadata == nil || !i.Metadata.TenantAuthenticated {
+		return ""
+	}
+	return i.Metadata.TenantID
+}
+
+// Held reports whether the recording is under legal hold
+func (i RecordingInfo) Held() bool {
+	return i.Metadata != nil && i.Metadata.LegalHold != nil
+}
+
+// InProgress reports whether the recording may still be being recorded
+func (i RecordingInfo) InProgress(now time.Time) bool {
+	return i.Metadata != nil && i.Metadata.Status == StatusRecording && now.Sub(i.StartTime()) < abandonedAfter
+}
+
+// ValidSessionID reports whether id can name a recording in storage. Names
+// starting with a dot are kept for other objects, such as the audit log.
+func ValidSessionID(id string) bool {
+	return id != "" && fs.ValidPath(id) && !strings.Contains(id, "/") && !strings.HasPrefix(id, ".")
+}
+
+// ListRecordings describes every recording in storage, in session ID order
+func ListRecordings(ctx context.Context, store storage.Storage) ([]RecordingInfo, error) {
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recordings: %w", err)
+	}
+
+	var recordings []RecordingInfo
+	for _, object := range objects {
+		sessionID, _, found := strings.Cut(object.Key, "/")
+		if !found || !ValidSessionID(sessionID) {
+			continue // not part of a recording
+		}
+		if len(recordings) == 0 || recordings[len(recordings)-1].SessionID != sessionID {
+			recordings = append(recordings, RecordingInfo{SessionID: sessionID})
+		}
+		addObject(&recordings[len(recordings)-1], object)
+	}
+
+	for i := range recordings {
+		recordings[i].Metadata, err = readStoredMetadata(ctx, store, recordings[i].SessionID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+	}
+	return recordings, nil
+}
+
+// StatRecording describes one recording in storage, returning
+// storage.ErrNotFound if there is none
+func StatRecording(ctx context.Context, store storage.Storage, sessionID string) (RecordingInfo, error) {
+	if !ValidSessionID(sessionID) {
+		return RecordingInfo{}, fmt.Errorf("invalid session ID %q", sessionID)
+	}
+
+	objects, err := store.List(ctx, sessionID+"/")
+	if err != nil {
+		return RecordingInfo{}, fmt.Errorf("failed to list recording: %w", err)
+	}
+	if len(objects) == 0 {
+		return RecordingInfo{}, fmt.Errorf("no recording of session %s: %w", sessionID, storage.ErrNotFound)
+	}
+
+	info := RecordingInfo{SessionID: sessionID}
+	for _, object := range objects {
+		addObject(&info, object)
+	}
+	info.Metadata, err = readStoredMetadata(ctx, store, sessionID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return RecordingInfo{}, err
+	}
+	return info, nil
+}
+
+func addObject(info *RecordingInfo, object storage.ObjectInfo) {
+	info.Objects = append(info.Objects, object)
+	info.Size += object.Size
+	if object.ModTime.After(info.ModTime) {
+		info.ModTime = object.ModTime
+	}
+}
+
+// readStoredMetadata reads a recording's metadata from storage
+func readStoredMetadata(ctx context.Context, store storage.Storage, sessionID string) (*RecordingMetadata, error) {
+	data, err := readObject(ctx, store, recordingKey(sessionID, MetadataFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata RecordingMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		// Unreadable metadata is treated as missing rather than failing
+		// every listing
+		return nil, nil
+	}
+	return &metadata, nil
+}
+
+// DeleteRecording removes every object of a recording from storage, unless
+// it is under legal hold or in progress. The key file goes first, leaving
+// an encrypted recording unreadable even if the rest can't be deleted, and
+// the metadata last, so a recording only partly deleted is still listed.
+// The hold is checked and the objects deleted with the recording locked
+// against SetLegalHold in this process only; a hold placed by another
+// process sharing the storage may be lost to a deletion already under way.
+func DeleteRecording(ctx context.Context, store storage.Storage, sessionID string) (RecordingInfo, error) {
+	unlock := lockRecording(sessionID)
+	defer unlock()
+
+	info, err := StatRecording(ctx, store, sessionID)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	if info.Held() {
+		return info, ErrLegalHold
+	}
+	if info.InProgress(time.Now()) {
+		return info, ErrInProgress
+	}
+
+	first, last := recordingKey(sessionID, KeyFile), recordingKey(sessionID, MetadataFile)
+	order := []string{first}
+	for _, object := range info.Objects {
+		if object.Key != first && object.Key != last {
+			order = append(order, object.Key)
+		}
+	}
+	order = append(order, last)
+
+	for _, key := range order {
+		if err := store.Delete(ctx, key); err != nil {
+			return info, fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+	}
+	return info, nil
+}
+
+// SetLegalHold places a recording under legal hold, or releases it if hold
+// is nil, by updating its metadata in storage. A recording being deleted
+// by this process is waited for, and then found gone; a deletion by another
+// process isn't seen, and can remove the recording despite the hold.
+func SetLegalHold(ctx context.Context, store storage.Storage, sessionID string, hold *LegalHold) (RecordingInfo, error) {
+	unlock := lockRecording(sessionID)
+	defer unlock()
+
+	info, err := StatRecording(ctx, store, sessionID)
+	if err != nil {
+		return RecordingInfo{}, err
+	}
+	if info.Metadata == nil {
+		return info, fmt.Errorf("recording of session %s has no metadata", sessionID)
+	}
+	// Completing the recording would replace the metadata
+	if info.InProgress(time.Now()) {
+		return info, ErrInProgress
+	}
+
+	info.Metadata.LegalHold = hold
+	data, err := json.MarshalIndent(info.Metadata, "", "  ")
+	if err != nil {
+		return info, err
+	}
+	if err := storage.Upload(ctx, store, recordingKey(sessionID, MetadataFile), bytes.NewReader(append(data, '\n'))); err != nil {
+		return info, fmt.Errorf("failed to update metadata: %w", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,118 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"voice-gateway/internal/storage"
+)
+
+// stallingStore holds up the first deletion of a key until released
+type stallingStore struct {
+	storage.Storage
+	key      string
+	once     sync.Once
+	stalled  chan struct{}
+	released chan struct{}
+}
+
+func (s *stallingStore) Delete(ctx context.Context, key string) error {
+	if key == s.key {
+		s.once.Do(func() {
+			close(s.stalled)
+			<-s.released
+		})
+	}
+	return s.Storage.Delete(ctx, key)
+}
+
+// storeRecording stores a completed recording of a session
+func storeRecording(t *testing.T, store storage.Storage, sessionID string) {
+	t.Helper()
+	ctx := context.Background()
+	metadata := RecordingMetadata{SessionID: sessionID, Status: StatusComplete, StartTime: time.Now().Add(-time.Hour)}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{MetadataFile: data, "audio.wav": make([]byte, 100)} {
+		if err := storage.Upload(ctx, store, recordingKey(sessionID, name), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLegalHoldDuringDeletion(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeRecording(t, local, "held")
+	store := &stallingStore{
+		Storage:  local,
+		key:      recordingKey("held", "audio.wav"),
+		stalled:  make(chan struct{}),
+		released: make(chan struct{}),
+	}
+	ctx := context.Background()
+
+	// The deletion has passed its hold check when the hold is placed
+	deleted := make(chan error, 1)
+	go func() {
+		_, err := DeleteRecording(ctx, store, "held")
+		deleted <- err
+	}()
+	<-store.stalled
+
+	held := make(chan error, 1)
+	go func() {
+		_, err := SetLegalHold(ctx, store, "held", &LegalHold{Reason: "litigation", SetBy: "alice", SetAt: time.Now()})
+		held <- err
+	}()
+	select {
+	case err := <-held:
+		t.Fatalf("hold placed during deletion: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(store.released)
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-held; !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("hold on deleted recording returned %v", err)
+	}
+	if objects, err := local.List(ctx, "held/"); err != nil || len(objects) > 0 {
+		t.Errorf("%d objects left, %v", len(objects), err)
+	}
+}
+
+func TestDeleteHeldRecording(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeRecording(t, store, "held")
+	ctx := context.Background()
+
+	if _, err := SetLegalHold(ctx, store, "held", &LegalHold{Reason: "litigation", SetBy: "alice", SetAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteRecording(ctx, store, "held"); !errors.Is(err, ErrLegalHold) {
+		t.Fatalf("deleting held recording returned %v", err)
+	}
+	if _, err := SetLegalHold(ctx, store, "held", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteRecording(ctx, store, "held"); err != nil {
+		t.Fatal(err)
+	}
+	if len(recordingLocks.locks) != 0 {
+		t.Errorf("%d recording locks left", len(recordingLocks.locks))
+	}
+}
@@ -0,0 +1,187 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"voice-gateway/internal/envelope"
+	"voice-gateway/internal/storage"
+)
+
+// ExportRecording writes a plaintext copy of a session's recording in store
+// to outputDir, decrypting it with a data key unwrapped by kek if it is
+// encrypted. The copy is laid out like an unencrypted recording: channel
+// WAV files get their lengths filled in and the metadata gets back its
+// transcripts. A recording whose files were never completed must be
+// repaired with RecoverRecording first.
+func ExportRecording(ctx context.Context, store storage.Storage, sessionID, outputDir string, kek *envelope.KEK) (*RecordingMetadata, error) {
+	objects, err := store.List(ctx, sessionID+"/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recording: %w", err)
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("no recording of session %s: %w", sessionID, storage.ErrNotFound)
+	}
+
+	var dataKey *envelope.DataKey
+	if keyFile, err := readObject(ctx, store, recordingKey(sessionID, KeyFile)); err == nil {
+		if dataKey, err = UnwrapKey(keyFile, kek); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	data, err := readObject(ctx, store, recordingKey(sessionID, MetadataFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	var metadata RecordingMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, sessionID+"/")
+		if name == KeyFile || name == MetadataFile || !filepath.IsLocal(name) || strings.Contains(name, "/") {
+			continue
+		}
+		if err := exportFile(ctx, store, object.Key, filepath.Join(outputDir, name), dataKey); err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", name, err)
+		}
+	}
+
+	if metadata.Encrypted {
+		transcripts, toolCalls, err := readJournal(filepath.Join(outputDir, TranscriptsFile), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read transcript journal: %w", err)
+		}
+		metadata.Transcripts, metadata.ToolCalls = transcripts, toolCalls
+		metadata.Encrypted = false
+	}
+	if err := writeMetadataFile(outputDir, metadata); err != nil {
+		return nil, fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	return &metadata, nil
+}
+
+// ReadTranscripts returns the metadata of a session's recording in store
+// with its transcripts and tool calls, which for an encrypted recording are
+// read from its journal, decrypted with a data key unwrapped by kek
+func ReadTranscripts(ctx context.Context, store storage.Storage, sessionID string, kek *envelope.KEK) (*RecordingMetadata, error) {
+	metadata, err := readStoredMetadata(ctx, store, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	if metadata == nil {
+		return nil, fmt.Errorf("recording of session %s has unreadable metadata", sessionID)
+	}
+	if !metadata.Encrypted {
+		return metadata, nil
+	}
+
+	keyFile, err := readObject(ctx, store, recordingKey(sessionID, KeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	dataKey, err := UnwrapKey(keyFile, kek)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := store.Open(ctx, recordingKey(sessionID, TranscriptsFile))
+	if errors.Is(err, storage.ErrNotFound) {
+		return metadata, nil // nothing was said
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transcript journal: %w", err)
+	}
+	defer r.Close()
+
+	metadata.Transcripts, metadata.ToolCalls, err = parseJournal(dataKey.NewReader(bufio.NewReader(r)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transcript journal: %w", err)
+	}
+	return metadata, nil
+}
+
+// readObject reads a whole object from storage
+func readObject(ctx context.Context, store storage.Storage, key string) ([]byte, error) {
+	r, err := store.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// exportFile writes the plaintext of an object to outputPath
+func exportFile(ctx context.Context, store storage.Storage, key, outputPath string, dataKey *envelope.DataKey) error {
+	r, err := store.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var in io.Reader = bufio.NewReader(r)
+	if magic, _ := in.(*bufio.Reader).Peek(len(envelope.Magic)); envelope.IsEncrypted(magic) {
+		if dataKey == nil {
+			return errors.New("file is encrypted but the recording has no key file")
+		}
+		in = dataKey.NewReader(in)
+	}
+
+	out, err := os.OpenFile(outputPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	size, err := io.Copy(out, in)
+	if errors.Is(err, envelope.ErrTruncated) {
+		return errors.New("file is incomplete; repair the recording with recover-recordings first")
+	}
+	if err != nil {
+		return err
+	}
+
+	if filepath.Ext(outputPath) == ".wav" {
+		if err := completeWAVHeader(out, size); err != nil {
+			return fmt.Errorf("failed to update WAV header: %w", err)
+		}
+	}
+	return out.Close()
+}
+
+// completeWAVHeader fills in the length of a WAV file written with unknown
+// size, such as an encrypted or streamed channel file
+func completeWAVHeader(file *os.File, size int64) error {
+	header := make([]byte, wavHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil // too short to be a WAV file; left as is
+	}
+	if string(header[0:4]) != "RIFF" || binary.LittleEndian.Uint32(header[wavHeaderSize-4:]) != wavUnknownSize {
+		return nil
+	}
+
+	info, err := readWAVHeader(bytes.NewReader(header))
+	if err != nil {
+		return err
+	}
+	frameSize := int64(info.channels * bytesPerSample)
+	return patchWAVSizes(file, (size-wavHeaderSize)/frameSize*frameSize)
+}
@@ -0,0 +1,146 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"voice-gateway/internal/envelope"
+)
+
+// KeyFile holds the wrapped data key of an encrypted recording. Every other
+// file of the recording except the metadata is encrypted with it.
+const KeyFile = "key.json"
+
+// sealedFile is a file written through a recording's data key, or as is if
+// the recording isn't encrypted
+type sealedFile struct {
+	file *os.File
+	enc  *envelope.Writer // nil if not encrypted
+	// Seal each write as a chunk of its own, for files written a record at
+	// a time that must reach the disk as they are written
+	flushWrites bool
+}
+
+// newSealedFile writes to an open file, encrypting with dataKey unless it
+// is nil
+func newSealedFile(file *os.File, dataKey *envelope.DataKey) (*sealedFile, error) {
+	f := &sealedFile{file: file}
+	if dataKey != nil {
+		enc, err := dataKey.NewWriter(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start encryption: %w", err)
+		}
+		f.enc = enc
+	}
+	return f, nil
+}
+
+// createSealedFile creates a file written through dataKey
+func createSealedFile(path string, dataKey *envelope.DataKey) (*sealedFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := newSealedFile(file, dataKey)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *sealedFile) Write(p []byte) (int, error) {
+	if f.enc == nil {
+		return f.file.Write(p)
+	}
+	n, err := f.enc.Write(p)
+	if err == nil && f.flushWrites {
+		err = f.enc.Flush()
+	}
+	return n, err
+}
+
+// Flush writes out anything held back for encryption
+func (f *sealedFile) Flush() error {
+	if f.enc == nil {
+		return nil
+	}
+	return f.enc.Flush()
+}
+
+// Close completes the encrypted stream and closes the file
+func (f *sealedFile) Close() error {
+	if f.enc == nil {
+		return f.file.Close()
+	}
+	err := f.enc.Close()
+	return errors.Join(err, f.file.Close())
+}
+
+// openSealedFile opens a file for reading, decrypting it with dataKey
+// unless that is nil
+func openSealedFile(path string, dataKey *envelope.DataKey) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil || dataKey == nil {
+		return file, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{dataKey.NewReader(file), file}, nil
+}
+
+// finishSealedFile completes an encrypted file left unclosed by a crash,
+// returning the size of its plaintext
+func finishSealedFile(path string, dataKey *envelope.DataKey) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	size, err := dataKey.Finish(file)
+	if err != nil {
+		return 0, err
+	}
+	return size, file.Close()
+}
+
+// writeKeyFile stores a recording's wrapped data key
+func writeKeyFile(sessionDir string, dataKey *envelope.DataKey) error {
+	data, err := json.MarshalIndent(dataKey.Wrapped(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(sessionDir, KeyFile), append(data, '\n'), 0600)
+}
+
+// readKeyFile unwraps the data key of the recording in a session
+// directory, returning nil if the recording isn't encrypted
+func readKeyFile(sessionDir string, kek *envelope.KEK) (*envelope.DataKey, error) {
+	data, err := os.ReadFile(filepath.Join(sessionDir, KeyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return UnwrapKey(data, kek)
+}
+
+// UnwrapKey decrypts the contents of a recording's key file with the KEK
+func UnwrapKey(keyFile []byte, kek *envelope.KEK) (*envelope.DataKey, error) {
+	if kek == nil {
+		return nil, errors.New("recording is encrypted but no key encryption key is configured")
+	}
+
+	var wrapped envelope.WrappedKey
+	if err := json.Unmarshal(keyFile, &wrapped); err != nil {
+		return nil, fmt.Errorf("failed to parse key file: %w", err)
+	}
+	return kek.Unwrap(wrapped)
+}
@@ -0,0 +1,135 @@
+package session
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"voice-gateway/internal/audio"
+	"voice-gateway/internal/envelope"
+)
+
+// Formats a recording's audio can be stored in
+const (
+	// A stereo audio.wav, keeping the channel WAV files
+	FormatWAV = "wav"
+	// A stereo audio.flac
+	FormatFLAC = "flac"
+	// Each channel's Opus packets as received, in <channel>.ogg. A channel
+	// for which no Opus was written is kept as <channel>.wav.
+	FormatOgg = "ogg"
+)
+
+// ValidateFormat checks that a recording format is supported
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatWAV, FormatFLAC, FormatOgg:
+		return nil
+	}
+	return fmt.Errorf("unsupported recording format %q, expected %s, %s or %s", format, FormatWAV, FormatFLAC, FormatOgg)
+}
+
+// channelPath returns where a channel's PCM is streamed during recording
+func channelPath(sessionDir string, channel Channel) string {
+	return filepath.Join(sessionDir, channel.String()+".wav")
+}
+
+// oggPath returns where a channel's Opus is written when recording to Ogg
+func oggPath(sessionDir string, channel Channel) string {
+	return filepath.Join(sessionDir, channel.String()+".ogg")
+}
+
+// storeAudio turns the closed channel WAV files of a recording into its
+// final audio files in the given format, removing the channel files the
+// format replaces, and returns the names of the files holding the audio.
+// samples gives how many samples of each channel to use. The channels of an
+// encrypted recording are decrypted with dataKey and what is stored is
+// encrypted with it.
+func storeAudio(sessionDir, format string, samples []int64, sampleRate int, dataKey *envelope.DataKey) ([]string, error) {
+	paths := make([]string, len(samples))
+	for i := range samples {
+		paths[i] = channelPath(sessionDir, Channel(i))
+	}
+
+	switch format {
+	case FormatWAV:
+		if err := writeStereoWAV(filepath.Join(sessionDir, AudioFile), paths, samples, sampleRate, dataKey, dataKey); err != nil {
+			return nil, err
+		}
+		return []string{AudioFile}, nil
+
+	case FormatFLAC:
+		if err := writeStereoFLAC(filepath.Join(sessionDir, FLACFile), paths, samples, sampleRate, dataKey, dataKey); err != nil {
+			return nil, err
+		}
+		if err := removeAll(paths); err != nil {
+			return nil, fmt.Errorf("failed to remove channel audio: %w", err)
+		}
+		return []string{FLACFile}, nil
+
+	case FormatOgg:
+		var files []string
+		for i, path := range paths {
+			ogg := oggPath(sessionDir, Channel(i))
+			if _, err := os.Stat(ogg); err != nil {
+				// Nothing to pass through, e.g. a codec other than Opus
+				files = append(files, filepath.Base(path))
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to remove channel audio: %w", err)
+			}
+			files = append(files, filepath.Base(ogg))
+		}
+		return files, nil
+	}
+
+	return nil, ValidateFormat(format)
+}
+
+// writeStereoFLAC is writeStereoWAV for FLAC
+func writeStereoFLAC(outputPath string, inputPaths []string, samples []int64, sampleRate int, inputKey, outputKey *envelope.DataKey) error {
+	flacFile, err := createSealedFile(outputPath, outputKey)
+	if err != nil {
+		return fmt.Errorf("failed to create FLAC file: %w", err)
+	}
+	defer flacFile.Close()
+
+	format := audio.Format{SampleRate: sampleRate, Channels: len(inputPaths)}
+	var encoder *audio.FLACEncoder
+	if outputKey != nil {
+		// Encrypted output can't be rewound to complete the header
+		encoder, err = audio.NewFLACStreamEncoder(flacFile, format, uint64(longest(samples)))
+	} else {
+		encoder, err = audio.NewFLACEncoder(flacFile.file, format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start FLAC stream: %w", err)
+	}
+
+	// The encoder buffers a block at a time, so a small buffer in front of
+	// it just batches the per-sample writes
+	out := bufio.NewWriter(encoder)
+	if err := interleaveWAVs(out, inputPaths, samples, inputKey); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("failed to encode audio data: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed to finish FLAC stream: %w", err)
+	}
+
+	return flacFile.Close()
+}
+
+// removeAll removes files, carrying on past failures
+func removeAll(paths []string) error {
+	var errs []error
+	for _, path := range paths {
+		errs = append(errs, os.Remove(path))
+	}
+	return errors.Join(errs...)
+}
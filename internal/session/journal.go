@@ -0,0 +1,120 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"voice-gateway/internal/envelope"
+)
+
+// transcriptJournal appends transcript entries and tool calls to a JSON
+// Lines file as they arrive, so they survive a crash without being held in
+// memory. When encrypted, each line is sealed as it is written.
+type transcriptJournal struct {
+	file  *sealedFile
+	count int
+}
+
+func newTranscriptJournal(path string, dataKey *envelope.DataKey) (*transcriptJournal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := newSealedFile(file, dataKey)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	sealed.flushWrites = true
+	return &transcriptJournal{file: sealed}, nil
+}
+
+// journalLine is a line of the journal other than a transcript entry,
+// which is written as it is
+type journalLine struct {
+	ToolCall *ToolCall `json:"tool_call,omitempty"`
+}
+
+// append writes one entry as a single line
+func (j *transcriptJournal) append(entry TranscriptEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal transcript: %w", err)
+	}
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write transcript: %w", err)
+	}
+	j.count++
+	return nil
+}
+
+// appendToolCall writes one tool call as a single line
+func (j *transcriptJournal) appendToolCall(call ToolCall) error {
+	line, err := json.Marshal(journalLine{ToolCall: &call})
+	if err != nil {
+		return fmt.Errorf("failed to marshal tool call: %w", err)
+	}
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write tool call: %w", err)
+	}
+	return nil
+}
+
+func (j *transcriptJournal) Close() error {
+	return j.file.Close()
+}
+
+// readJournal reads the transcript entries and tool calls of a journal. A
+// truncated final line, as left by a crash mid-write, is ignored. An
+// encrypted journal is decrypted with dataKey, and must have been
+// completed.
+func readJournal(path string, dataKey *envelope.DataKey) ([]TranscriptEntry, []ToolCall, error) {
+	file, err := openSealedFile(path, dataKey)
+	if errors.Is(err, os.ErrNotExist) {
+		return []TranscriptEntry{}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	return parseJournal(file)
+}
+
+// parseJournal reads the transcript entries and tool calls of a plaintext
+// journal
+func parseJournal(r io.Reader) ([]TranscriptEntry, []ToolCall, error) {
+	entries := []TranscriptEntry{}
+	var toolCalls []ToolCall
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything after the last newline was never completely written
+			return entries, toolCalls, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var other journalLine
+		if err := json.Unmarshal(line, &other); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse journal: %w", err)
+		}
+		if other.ToolCall != nil {
+			toolCalls = append(toolCalls, *other.ToolCall)
+			continue
+		}
+
+		var entry TranscriptEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse transcript: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+}
@@ -0,0 +1,260 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"voice-gateway/internal/envelope"
+	"voice-gateway/internal/storage"
+)
+
+// ErrNotPlayable is returned for a recording without the audio asked for,
+// e.g. a channel not kept as Ogg or a recording not yet completed
+var ErrNotPlayable = errors.New("recording has no playable audio")
+
+// Playback reads a recording's audio, decrypted if need be, from any
+// point, as http.ServeContent wants. A WAV recording is served as WAV
+// built from its PCM with a header of its own, and a FLAC one, or a
+// channel of one kept as Ogg, as it is stored. Reads are made with the
+// context it was opened with.
+type Playback struct {
+	ctx     context.Context
+	store   storage.Storage
+	key     string
+	dataKey *envelope.DataKey
+
+	// Media type of the audio
+	ContentType string
+	// When the audio file was written
+	ModTime time.Time
+
+	// Served ahead of the stored file from dataOffset on, if set
+	header     []byte
+	dataOffset int64
+	size       int64
+
+	// Decrypted copy of a stored file that can't be read from any point,
+	// read instead of it if set
+	file *os.File
+
+	pos int64
+	// Reading the stored file from rpos, if open
+	r    io.ReadCloser
+	rpos int64
+}
+
+// OpenPlayback opens the audio of a session's recording in store,
+// decrypting it with a data key unwrapped by kek if it is encrypted. A
+// recording kept as Ogg has a file per channel: channel names the one to
+// play, one of the ChannelLayout, or is empty for the first.
+func OpenPlayback(ctx context.Context, store storage.Storage, sessionID, channel string, kek *envelope.KEK) (*Playback, error) {
+	info, err := StatRecording(ctx, store, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	metadata := info.Metadata
+	if metadata == nil {
+		return nil, fmt.Errorf("recording of session %s has no metadata", sessionID)
+	}
+	if info.InProgress(time.Now()) {
+		return nil, ErrInProgress
+	}
+
+	name, err := playbackFile(metadata, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Playback{ctx: ctx, store: store, key: recordingKey(sessionID, name)}
+	object, err := store.Stat(ctx, p.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", name, err)
+	}
+	p.ModTime, p.size = object.ModTime, object.Size
+
+	if metadata.Encrypted {
+		keyFile, err := readObject(ctx, store, recordingKey(sessionID, KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		if p.dataKey, err = UnwrapKey(keyFile, kek); err != nil {
+			return nil, err
+		}
+		// The stereo file is written in one go, so its chunks can be
+		// found without reading them
+		p.size = envelope.PlaintextSize(object.Size)
+	}
+
+	switch path.Ext(name) {
+	case ".flac":
+		p.ContentType = "audio/flac"
+		return p, nil
+	case ".ogg":
+		p.ContentType = "audio/ogg"
+		if p.dataKey != nil {
+			if err := p.decrypt(); err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s: %w", name, err)
+			}
+		}
+		return p, nil
+	}
+
+	p.ContentType = "audio/wav"
+	frameSize := int64(metadata.Channels * bytesPerSample)
+	if frameSize <= 0 || p.size < wavHeaderSize {
+		return nil, fmt.Errorf("invalid WAV recording of session %s", sessionID)
+	}
+	dataSize := (p.size - wavHeaderSize) / frameSize * frameSize
+	var header bytes.Buffer
+	if err := writeWAVHeader(&header, uint32(metadata.SampleRate), bytesPerSample*8, uint16(metadata.Channels), uint32(dataSize)); err != nil {
+		return nil, err
+	}
+	p.header, p.dataOffset = header.Bytes(), wavHeaderSize
+	p.size = int64(len(p.header)) + dataSize
+	return p, nil
+}
+
+// playbackFile returns the name of the file holding the audio to play: the
+// stereo file, or the Ogg file of a channel
+func playbackFile(metadata *RecordingMetadata, channel string) (string, error) {
+	if channel == "" {
+		for _, name := range []string{AudioFile, FLACFile} {
+			if slices.Contains(metadata.AudioFiles, name) {
+				return name, nil
+			}
+		}
+		for _, name := range metadata.ChannelLayout {
+			if slices.Contains(metadata.AudioFiles, name+".ogg") {
+				return name + ".ogg", nil
+			}
+		}
+		return "", ErrNotPlayable
+	}
+
+	if !slices.Contains(metadata.ChannelLayout, channel) || !slices.Contains(metadata.AudioFiles, channel+".ogg") {
+		return "", fmt.Errorf("%w: no Ogg file of channel %q", ErrNotPlayable, channel)
+	}
+	return channel + ".ogg", nil
+}
+
+// decrypt copies the plaintext of the stored file to a temporary one. Ogg
+// pages are sealed as they are written, so the chunks of an Ogg file
+// can't be found without reading them all.
+func (p *Playback) decrypt() error {
+	in, err := p.store.Open(p.ctx, p.key)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	file, err := os.CreateTemp("", "playback-*")
+	if err != nil {
+		return err
+	}
+	p.file = file
+	size, err := io.Copy(file, p.dataKey.NewReader(bufio.NewReader(in)))
+	if err != nil {
+		p.Close()
+		return err
+	}
+	p.size = size
+	return nil
+}
+
+// Size returns the length of the audio served
+func (p *Playback) Size() int64 {
+	return p.size
+}
+
+func (p *Playback) Read(b []byte) (int, error) {
+	if p.pos >= p.size {
+		return 0, io.EOF
+	}
+	b = b[:min(int64(len(b)), p.size-p.pos)]
+
+	if p.pos < int64(len(p.header)) {
+		n := copy(b, p.header[p.pos:])
+		p.pos += int64(n)
+		return n, nil
+	}
+
+	offset := p.pos - int64(len(p.header)) + p.dataOffset
+	if p.r == nil || p.rpos != offset {
+		if err := p.open(offset); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := p.r.Read(b)
+	p.pos += int64(n)
+	p.rpos += int64(n)
+	if err == io.EOF && p.pos < p.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// open starts reading the plaintext of the stored file from offset
+func (p *Playback) open(offset int64) error {
+	if p.r != nil {
+		p.r.Close()
+		p.r = nil
+	}
+
+	if p.file != nil {
+		p.r, p.rpos = io.NopCloser(io.NewSectionReader(p.file, offset, p.size-offset)), offset
+		return nil
+	}
+
+	openAt := func(offset int64) (io.ReadCloser, error) {
+		return p.store.OpenAt(p.ctx, p.key, offset)
+	}
+	var r io.ReadCloser
+	var err error
+	if p.dataKey != nil {
+		r, err = p.dataKey.OpenAt(openAt, offset)
+	} else {
+		r, err = openAt(offset)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read audio: %w", err)
+	}
+	p.r, p.rpos = r, offset
+	return nil
+}
+
+func (p *Playback) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += p.pos
+	case io.SeekEnd:
+		offset += p.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of audio")
+	}
+	p.pos = offset
+	return offset, nil
+}
+
+func (p *Playback) Close() error {
+	var err error
+	if p.r != nil {
+		err = p.r.Close()
+		p.r = nil
+	}
+	if p.file != nil {
+		p.file.Close()
+		os.Remove(p.file.Name())
+		p.file = nil
+	}
+	return err
+}
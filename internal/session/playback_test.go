@@ -0,0 +1,142 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"voice-gateway/internal/envelope"
+	"voice-gateway/internal/storage"
+)
+
+// storeOggRecording stores a recording kept as Ogg, with the caller's audio
+// in caller.ogg and the agent's in agent.wav, sealed with dataKey if set
+func storeOggRecording(t *testing.T, store storage.Storage, sessionID string, callerOgg []byte, dataKey *envelope.DataKey) {
+	t.Helper()
+	ctx := context.Background()
+	metadata := RecordingMetadata{
+		SessionID:     sessionID,
+		Status:        StatusComplete,
+		StartTime:     time.Now().Add(-time.Hour),
+		Format:        FormatOgg,
+		AudioFiles:    []string{"caller.ogg", "agent.wav"},
+		Channels:      2,
+		ChannelLayout: channelNames,
+		Encrypted:     dataKey != nil,
+	}
+	objects := map[string][]byte{"caller.ogg": callerOgg, "agent.wav": make([]byte, 100)}
+
+	if dataKey != nil {
+		// Sealed a page at a time, as the recorder does
+		var sealed bytes.Buffer
+		w, err := dataKey.NewWriter(&sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for page := range slices.Chunk(callerOgg, 1000) {
+			if _, err := w.Write(page); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		objects["caller.ogg"] = sealed.Bytes()
+
+		keyFile, err := json.Marshal(dataKey.Wrapped())
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects[KeyFile] = keyFile
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects[MetadataFile] = data
+	for name, data := range objects {
+		if err := storage.Upload(ctx, store, recordingKey(sessionID, name), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOggPlayback(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	store, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek, err := envelope.NewKEK("test", bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := kek.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ogg := make([]byte, 3*envelope.ChunkSize+555)
+	for i := range ogg {
+		ogg[i] = byte(i * 13)
+	}
+	storeOggRecording(t, store, "plain", ogg, nil)
+	storeOggRecording(t, store, "sealed", ogg, dataKey)
+	ctx := context.Background()
+
+	for _, sessionID := range []string{"plain", "sealed"} {
+		t.Run(sessionID, func(t *testing.T) {
+			for _, channel := range []string{"", "caller"} {
+				p, err := OpenPlayback(ctx, store, sessionID, channel, kek)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.ContentType != "audio/ogg" || p.Size() != int64(len(ogg)) {
+					t.Errorf("channel %q served as %s of %d bytes", channel, p.ContentType, p.Size())
+				}
+
+				// Read from a point, as for a range request
+				offset := int64(envelope.ChunkSize + 100)
+				if _, err := p.Seek(offset, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, ogg[offset:]) {
+					t.Errorf("channel %q read %d bytes differing from those stored", channel, len(got))
+				}
+				if err := p.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The agent's channel has no Ogg file, and the others don't exist
+			for _, channel := range []string{"agent", "../caller", "nobody"} {
+				if _, err := OpenPlayback(ctx, store, sessionID, channel, kek); !errors.Is(err, ErrNotPlayable) {
+					t.Errorf("channel %q opened with %v", channel, err)
+				}
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d temporary files left", len(entries))
+	}
+}
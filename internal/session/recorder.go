@@ -1,54 +1,272 @@
 package session
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
+
+	"voice-gateway/internal/audio"
+	"voice-gateway/internal/envelope"
+	"voice-gateway/internal/storage"
+)
+
+// Channel identifies one party's audio in a recording
+type Channel int
+
+const (
+	// ChannelCaller is the caller's microphone, the left channel of the
+	// stereo export
+	ChannelCaller Channel = iota
+	// ChannelAgent is the audio played to the caller, e.g. synthesized
+	// speech, the right channel of the stereo export
+	ChannelAgent
 )
 
-// Recorder handles recording of audio and transcripts
+var (
+	channelNames = []string{"caller", "agent"}
+	// Transcript speaker whose voice is on each channel
+	channelSpeakers = []string{SpeakerUser, SpeakerAssistant}
+)
+
+func (c Channel) String() string {
+	if c < 0 || int(c) >= len(channelNames) {
+		return fmt.Sprintf("channel(%d)", int(c))
+	}
+	return channelNames[c]
+}
+
+const (
+	// Each channel is recorded as 16-bit mono PCM
+	bytesPerSample = 2
+
+	// Writes starting within this much of the end of a channel are treated
+	// as contiguous, absorbing rounding in media timestamps
+	alignTolerance = time.Millisecond
+
+	// Longest gap in a channel filled with silence. A write further from
+	// the end of the channel, e.g. after its RTP timestamps jumped, is taken
+	// as a discontinuity: the channel resyncs to it, carrying on where it
+	// left off.
+	maxGapFill = 3 * time.Second
+
+	// Opus timestamps are always in 48kHz samples
+	opusSampleRate = 48000
+)
+
+// Files in a session's recording directory. Each channel is also recorded
+// to <channel>.wav, e.g. caller.wav, and to <channel>.ogg when recording
+// to Ogg.
+const (
+	MetadataFile    = "metadata.json"
+	TranscriptsFile = "transcripts.jsonl"
+	AudioFile       = "audio.wav"
+	FLACFile        = "audio.flac"
+)
+
+// Recording statuses reported in metadata
+const (
+	// Being recorded, or abandoned by a crash if no gateway is recording it
+	StatusRecording = "recording"
+	StatusComplete  = "complete"
+	// Repaired by RecoverRecording after a crash
+	StatusRecovered = "recovered"
+)
+
+// Recorder handles recording of audio and transcripts. Everything is
+// written as it arrives so a crash loses at most the last moment of a
+// call: each party is streamed to its own mono WAV file, kept aligned to
+// the time since the recording started, and transcripts are appended to a
+// journal. Close stores the channels in the recording's format and
+// completes the metadata; RecoverRecording does the same for a recording
+// that was never closed. With remote storage the channels are also
+// uploaded as they are recorded, and Close uploads the finished recording
+// and removes the local copy. An encrypted recording has every file but the
+// metadata encrypted with a data key of its own, kept wrapped by the KEK in
+// KeyFile; its metadata then leaves out the transcripts.
 type Recorder struct {
 	sessionID    string
+	tenantID     string
+	tenantAuth   bool
 	recordingDir string
-	audioFile    *os.File
-	metaFile     *os.File
-	transcripts  []TranscriptEntry
+	sampleRate   int
+	format       string
+	store        storage.Storage   // nil to keep recordings in recordingDir
+	dataKey      *envelope.DataKey // nil if not encrypted
+	startTime    time.Time
+	tracks       []*track // indexed by Channel
+	journal      *transcriptJournal
+	closed       bool
+	closeErr     error // returned by Close after the first time
 	mu           sync.Mutex
 }
 
+// track is one channel's WAV file, and Ogg file if recording to Ogg
+type track struct {
+	path    string
+	wav     *wavWriter
+	samples int64
+	// How far the channel's writes are placed from the recording timeline
+	// by resyncs, in samples and in Opus samples
+	skew    int64
+	oggSkew int64
+	oggFile *sealedFile
+	ogg     *audio.OggOpusWriter
+	upload  *channelUpload
+	// What the audio was decoded from, e.g. "audio/opus 48000Hz"
+	source string
+	speech *speechTracker
+}
+
+// Transcript speakers
+const (
+	SpeakerUser      = "user"
+	SpeakerAssistant = "assistant"
+)
+
 // TranscriptEntry represents a transcript with timing
 type TranscriptEntry struct {
 	Timestamp time.Time `json:"timestamp"`
-	Text      string    `json:"text"`
-	IsFinal   bool      `json:"is_final"`
-	Speaker   string    `json:"speaker"` // "user" or "assistant"
+	// Seconds from the start of the audio
+	Offset  float64 `json:"offset_seconds"`
+	Text    string  `json:"text"`
+	IsFinal bool    `json:"is_final"`
+	Speaker string  `json:"speaker"` // "user" or "assistant"
+	// Timing of each word, when the transcript came with it
+	Words []WordTiming `json:"words,omitempty"`
+}
+
+// WordTiming is when one word of a transcript was spoken
+type WordTiming struct {
+	Text string `json:"text"`
+	// Seconds from the start of the audio
+	Start      float64 `json:"start_seconds"`
+	End        float64 `json:"end_seconds"`
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+// ToolCall records a tool the assistant called during the session
+type ToolCall struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Seconds from the start of the audio
+	Offset    float64         `json:"offset_seconds"`
+	Tool      string          `json:"tool"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// BargeIn is a party starting to speak while the other was speaking
+type BargeIn struct {
+	// Seconds from the start of the audio
+	Offset float64 `json:"offset_seconds"`
+	// Who started speaking, "user" or "assistant"
+	Speaker string `json:"speaker"`
 }
 
 // RecordingMetadata contains session metadata
 type RecordingMetadata struct {
-	SessionID   string            `json:"session_id"`
-	StartTime   time.Time         `json:"start_time"`
-	EndTime     time.Time         `json:"end_time"`
-	Duration    float64           `json:"duration_seconds"`
-	SampleRate  int               `json:"sample_rate"`
-	Channels    int               `json:"channels"`
+	SessionID string `json:"session_id"`
+	TenantID  string `json:"tenant_id,omitempty"`
+	// Whether the caller proved it acts for the tenant; a tenant only
+	// claimed gets no per-tenant treatment
+	TenantAuthenticated bool   `json:"tenant_authenticated,omitempty"`
+	Status              string `json:"status"`
+	// When the recording started, the zero point of the audio and of
+	// transcript offsets
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time,omitzero"`
+	Duration  float64   `json:"duration_seconds"`
+	// FormatWAV, FormatFLAC or FormatOgg
+	Format string `json:"format"`
+	// Files in the session directory holding the audio, once the recording
+	// is completed
+	AudioFiles []string `json:"audio_files,omitempty"`
+	// The recorded PCM; Ogg files keep the call's Opus at 48kHz
+	SampleRate    int `json:"sample_rate"`
+	BitsPerSample int `json:"bits_per_sample"`
+	Channels      int `json:"channels"`
+	// Party recorded on each channel of a stereo file, in order
+	ChannelLayout []string `json:"channel_layout"`
+	// Whether the other files are encrypted, with the data key in KeyFile
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Copied from the transcript journal when the recording is completed,
+	// unless it is encrypted
 	Transcripts []TranscriptEntry `json:"transcripts"`
-	Stats       RecordingStats    `json:"stats"`
+	// Copied from the journal like the transcripts
+	ToolCalls []ToolCall     `json:"tool_calls,omitempty"`
+	Stats     RecordingStats `json:"stats"`
+	// Detected in the audio, in order
+	BargeIns []BargeIn `json:"barge_ins,omitempty"`
+	// Set to exempt the recording from deletion
+	LegalHold *LegalHold `json:"legal_hold,omitempty"`
+}
+
+// LegalHold records why and by whom a recording must be kept
+type LegalHold struct {
+	Reason string    `json:"reason"`
+	SetBy  string    `json:"set_by"`
+	SetAt  time.Time `json:"set_at"`
 }
 
 // RecordingStats contains statistics about the recording
 type RecordingStats struct {
-	TotalAudioBytes  int64 `json:"total_audio_bytes"`
-	TranscriptCount  int   `json:"transcript_count"`
-	SpeechDuration   float64 `json:"speech_duration_seconds"`
+	TotalAudioBytes int64 `json:"total_audio_bytes"`
+	TranscriptCount int   `json:"transcript_count"`
+	// Time anyone was speaking, and time nobody was
+	SpeechDuration  float64 `json:"speech_duration_seconds"`
+	SilenceDuration float64 `json:"silence_duration_seconds"`
+	// Times either party started speaking over the other
+	Interruptions int `json:"interruptions"`
+	// Keyed by transcript speaker, "user" or "assistant"
+	Speakers map[string]SpeakerStats `json:"speakers"`
 }
 
-// NewRecorder creates a new session recorder
-func NewRecorder(sessionID string, recordingDir string) (*Recorder, error) {
+// SpeakerStats describes one party's side of the call
+type SpeakerStats struct {
+	Channel string `json:"channel"`
+	// What the channel was decoded from, if known
+	Source   string  `json:"source,omitempty"`
+	TalkTime float64 `json:"talk_time_seconds"`
+	// Separate stretches of speech
+	Turns int `json:"turns"`
+	// Times this party started speaking while the other was
+	Interruptions int `json:"interruptions"`
+}
+
+// RecorderOptions configures a Recorder
+type RecorderOptions struct {
+	// Tenant whose call is recorded, for the metadata
+	TenantID string
+	// Whether the tenant was authenticated rather than only claimed
+	TenantAuthenticated bool
+	// Of the PCM passed to WriteAudio
+	SampleRate int
+	// FormatWAV, FormatFLAC or FormatOgg
+	Format string
+	// If set, the recording is uploaded here, the recording directory only
+	// holding it until then
+	Store storage.Storage
+	// If set, the recording is encrypted with a new data key wrapped by it
+	KEK *envelope.KEK
+}
+
+// NewRecorder creates a new session recorder in <recordingDir>/<sessionID>
+func NewRecorder(sessionID string, recordingDir string, opts RecorderOptions) (*Recorder, error) {
+	sampleRate, format, store, kek := opts.SampleRate, opts.Format, opts.Store, opts.KEK
+	if sampleRate <= 0 {
+		return nil, fmt.Errorf("invalid sample rate %d", sampleRate)
+	}
+	if err := ValidateFormat(format); err != nil {
+		return nil, err
+	}
+
 	// Create recording directory if it doesn't exist
 	if err := os.MkdirAll(recordingDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create recording directory: %w", err)
@@ -59,225 +277,591 @@ func NewRecorder(sessionID string, recordingDir string) (*Recorder, error) {
 		return nil, fmt.Errorf("failed to create session directory: %w", err)
 	}
 
-	// Create audio file (PCM format)
-	audioPath := filepath.Join(sessionDir, "audio.pcm")
-	audioFile, err := os.Create(audioPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create audio file: %w", err)
+	r := &Recorder{
+		sessionID:    sessionID,
+		tenantID:     opts.TenantID,
+		tenantAuth:   opts.TenantAuthenticated,
+		recordingDir: sessionDir,
+		sampleRate:   sampleRate,
+		format:       format,
+		store:        store,
+		startTime:    time.Now(),
+	}
+
+	if kek != nil {
+		dataKey, err := kek.NewDataKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create data key: %w", err)
+		}
+		// Written first, as nothing written after it can be read without it
+		if err := writeKeyFile(sessionDir, dataKey); err != nil {
+			return nil, fmt.Errorf("failed to write key file: %w", err)
+		}
+		r.dataKey = dataKey
+	}
+
+	// Create one WAV file per channel
+	for i, name := range channelNames {
+		path := channelPath(sessionDir, Channel(i))
+		wav, err := newWAVWriter(path, sampleRate, 1, r.dataKey)
+		if err != nil {
+			r.closeFiles()
+			return nil, fmt.Errorf("failed to create %s audio file: %w", name, err)
+		}
+		r.tracks = append(r.tracks, &track{
+			path:   path,
+			wav:    wav,
+			speech: newSpeechTracker(sampleRate),
+		})
 	}
 
-	// Create metadata file
-	metaPath := filepath.Join(sessionDir, "metadata.json")
-	metaFile, err := os.Create(metaPath)
+	journal, err := newTranscriptJournal(filepath.Join(sessionDir, TranscriptsFile), r.dataKey)
 	if err != nil {
-		audioFile.Close()
-		return nil, fmt.Errorf("failed to create metadata file: %w", err)
+		r.closeFiles()
+		return nil, fmt.Errorf("failed to create transcript journal: %w", err)
+	}
+	r.journal = journal
+
+	// Written now so a crashed recording can still be identified
+	metadata := r.metadata()
+	metadata.Status = StatusRecording
+	if err := writeMetadataFile(sessionDir, metadata); err != nil {
+		r.closeFiles()
+		return nil, fmt.Errorf("failed to write metadata: %w", err)
 	}
 
-	return &Recorder{
-		sessionID:    sessionID,
-		recordingDir: sessionDir,
-		audioFile:    audioFile,
-		metaFile:     metaFile,
-		transcripts:  []TranscriptEntry{},
-	}, nil
+	if store != nil {
+		if err := r.startUploads(); err != nil {
+			r.closeFiles()
+			return nil, err
+		}
+	}
+
+	return r, nil
 }
 
-// WriteAudio writes audio data to the recording
-func (r *Recorder) WriteAudio(data []byte) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// startUploads puts the key file and initial metadata in storage and starts
+// streaming each channel there
+func (r *Recorder) startUploads() error {
+	ctx := context.Background()
+	if r.dataKey != nil {
+		if err := uploadFile(ctx, r.store, recordingKey(r.sessionID, KeyFile), filepath.Join(r.recordingDir, KeyFile)); err != nil {
+			return fmt.Errorf("failed to upload key file: %w", err)
+		}
+	}
+	if err := uploadMetadata(ctx, r.store, r.recordingDir); err != nil {
+		return fmt.Errorf("failed to upload metadata: %w", err)
+	}
 
-	if r.audioFile == nil {
-		return fmt.Errorf("audio file not open")
+	for _, t := range r.tracks {
+		upload, err := newChannelUpload(ctx, r.store, recordingKey(r.sessionID, filepath.Base(t.path)), r.sampleRate, r.dataKey)
+		if err != nil {
+			for _, t := range r.tracks {
+				if t.upload != nil {
+					t.upload.finish(false)
+				}
+			}
+			return fmt.Errorf("failed to start uploading audio: %w", err)
+		}
+		t.upload = upload
 	}
+	return nil
+}
 
-	_, err := r.audioFile.Write(data)
-	return err
+// Elapsed returns the time since the recording started, the timeline
+// WriteAudio positions audio on
+func (r *Recorder) Elapsed() time.Duration {
+	return time.Since(r.startTime)
 }
 
-// AddTranscript adds a transcript entry
-func (r *Recorder) AddTranscript(text string, isFinal bool, speaker string) {
+// SetSource records what a channel's audio is decoded from, e.g. the codec
+// and clock rate of the RTP stream, for the metadata
+func (r *Recorder) SetSource(channel Channel, source string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.transcripts = append(r.transcripts, TranscriptEntry{
-		Timestamp: time.Now(),
-		Text:      text,
-		IsFinal:   isFinal,
-		Speaker:   speaker,
-	})
+	if channel >= 0 && int(channel) < len(r.tracks) {
+		r.tracks[channel].source = source
+	}
 }
 
-// Close finalizes the recording and writes metadata
-func (r *Recorder) Close() error {
+// WriteAudio writes mono PCM at the recorder's sample rate to a channel,
+// starting at the given offset from the start of the recording. A gap since
+// the channel's last write is filled with silence, up to maxGapFill; audio
+// overlapping what the channel already holds, e.g. from a late packet, is
+// dropped. A write further away than maxGapFill resyncs the channel.
+func (r *Recorder) WriteAudio(channel Channel, data []byte, at time.Duration) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// Close audio file
-	if r.audioFile != nil {
-		if err := r.audioFile.Close(); err != nil {
-			return fmt.Errorf("failed to close audio file: %w", err)
+	if channel < 0 || int(channel) >= len(r.tracks) {
+		return fmt.Errorf("unknown recording channel %d", int(channel))
+	}
+	t := r.tracks[channel]
+	if r.closed {
+		return fmt.Errorf("audio file not open")
+	}
+
+	start := int64(at)*int64(r.sampleRate)/int64(time.Second) - t.skew
+	tolerance := int64(alignTolerance) * int64(r.sampleRate) / int64(time.Second)
+	limit := int64(maxGapFill) * int64(r.sampleRate) / int64(time.Second)
+
+	switch gap := start - t.samples; {
+	case gap > limit || gap < -limit:
+		t.skew += gap
+		log.Printf("Session %s: %s recording discontinuity of %v, resyncing", r.sessionID, channel, samplesDuration(gap, r.sampleRate))
+	case gap > tolerance:
+		if err := t.writeSilence(gap); err != nil {
+			return err
 		}
+	case gap < -tolerance:
+		overlap := int(-gap) * bytesPerSample
+		if overlap >= len(data) {
+			return nil
+		}
+		data = data[overlap:]
 	}
 
-	// Write metadata
-	if err := r.writeMetadata(); err != nil {
-		return fmt.Errorf("failed to write metadata: %w", err)
+	if err := t.write(data); err != nil {
+		return err
 	}
 
-	// Close metadata file
-	if r.metaFile != nil {
-		if err := r.metaFile.Close(); err != nil {
-			return fmt.Errorf("failed to close metadata file: %w", err)
+	// Keep every channel's header current, including quiet ones
+	for _, t := range r.tracks {
+		if err := t.wav.patchIfDue(); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// write appends PCM to the track
+func (t *track) write(data []byte) error {
+	data = data[:len(data)/bytesPerSample*bytesPerSample]
+	n, err := t.wav.Write(data)
+	n = n / bytesPerSample * bytesPerSample
+	t.samples += int64(n / bytesPerSample)
+	t.speech.write(data[:n])
+	if err != nil {
+		return err
+	}
+	return t.uploadAudio(data[:n])
+}
+
+// uploadAudio streams audio written to the track to storage, if it is
+// being uploaded
+func (t *track) uploadAudio(data []byte) error {
+	if t.upload == nil {
+		return nil
+	}
+	return t.upload.Write(data)
+}
+
+// samplesDuration returns how long a number of samples lasts
+func samplesDuration(samples int64, sampleRate int) time.Duration {
+	return time.Duration(samples) * time.Second / time.Duration(sampleRate)
+}
 
+// Reused to pad gaps; zero bytes are silence in signed PCM
+var silence = make([]byte, 4096)
+
+// writeSilence appends the given number of silent samples to the track
+func (t *track) writeSilence(samples int64) error {
+	remaining := samples * bytesPerSample
+	for remaining > 0 {
+		chunk := silence
+		if remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := t.wav.Write(chunk)
+		t.samples += int64(n / bytesPerSample)
+		t.speech.silence(int64(n / bytesPerSample))
+		if err != nil {
+			return err
+		}
+		if err := t.uploadAudio(chunk[:n]); err != nil {
+			return err
+		}
+		remaining -= int64(len(chunk))
+	}
 	return nil
 }
 
-// writeMetadata writes session metadata to file
-func (r *Recorder) writeMetadata() error {
-	if r.metaFile == nil {
-		return fmt.Errorf("metadata file not open")
+// WriteOpus writes an encoded Opus packet to a channel's Ogg file as is,
+// placed on the recording timeline like WriteAudio: gaps up to maxGapFill
+// are filled with silent packets, longer ones resync the channel, and a
+// late packet mostly overlapping what the channel already holds is
+// dropped. It does nothing unless recording to Ogg. The
+// decoded audio must still be passed to WriteAudio, as the statistics and
+// crash recovery are based on it.
+func (r *Recorder) WriteOpus(channel Channel, packet []byte, at time.Duration) error {
+	if r.format != FormatOgg {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if channel < 0 || int(channel) >= len(r.tracks) {
+		return fmt.Errorf("unknown recording channel %d", int(channel))
+	}
+	t := r.tracks[channel]
+	if r.closed {
+		return fmt.Errorf("audio file not open")
 	}
 
-	// Get audio file size
-	audioInfo, err := os.Stat(filepath.Join(r.recordingDir, "audio.pcm"))
+	samples, err := audio.OpusPacketSamples(packet)
 	if err != nil {
-		return fmt.Errorf("failed to stat audio file: %w", err)
+		return err
 	}
 
-	// Calculate duration (assuming 16kHz, 16-bit, mono)
-	sampleRate := 16000
-	bytesPerSample := 2
-	totalSamples := audioInfo.Size() / int64(bytesPerSample)
-	duration := float64(totalSamples) / float64(sampleRate)
+	// Created on the first packet, so a channel that never carries Opus
+	// has no Ogg file
+	if t.ogg == nil {
+		file, err := createSealedFile(oggPath(r.recordingDir, channel), r.dataKey)
+		if err != nil {
+			return fmt.Errorf("failed to create %s Ogg file: %w", channel, err)
+		}
+		// Pages are written whole, so seal each as it comes
+		file.flushWrites = true
+		ogg, err := audio.NewOggOpusWriter(file, 1)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write %s Ogg headers: %w", channel, err)
+		}
+		t.oggFile, t.ogg = file, ogg
+	}
 
-	metadata := RecordingMetadata{
-		SessionID:   r.sessionID,
-		StartTime:   time.Now().Add(-time.Duration(duration) * time.Second),
-		EndTime:     time.Now(),
-		Duration:    duration,
-		SampleRate:  sampleRate,
-		Channels:    1,
-		Transcripts: r.transcripts,
-		Stats: RecordingStats{
-			TotalAudioBytes: audioInfo.Size(),
-			TranscriptCount: len(r.transcripts),
-			SpeechDuration:  duration,
-		},
+	start := int64(at)*opusSampleRate/int64(time.Second) - t.oggSkew
+	silent, _ := audio.OpusPacketSamples(audio.OpusSilence)
+	limit := int64(maxGapFill) * opusSampleRate / int64(time.Second)
+
+	gap := start - int64(t.ogg.Granule())
+	if gap > limit || gap < -limit {
+		t.oggSkew += gap
+		log.Printf("Session %s: %s Ogg recording discontinuity of %v, resyncing", r.sessionID, channel, samplesDuration(gap, opusSampleRate))
+		gap = 0
+	}
+	for ; gap >= int64(silent); gap -= int64(silent) {
+		if err := t.ogg.WritePacket(audio.OpusSilence); err != nil {
+			return err
+		}
+	}
+	if gap < -int64(samples)/2 {
+		return nil
 	}
 
-	encoder := json.NewEncoder(r.metaFile)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(metadata)
+	return t.ogg.WritePacket(packet)
 }
 
-// ExportToWAV converts the PCM recording to WAV format
-func (r *Recorder) ExportToWAV(outputPath string) error {
+// AddTranscript journals a transcript entry for speech at the given time,
+// or now if it is zero. The timing of its words, if known, is given in
+// seconds relative to that time.
+func (r *Recorder) AddTranscript(text string, isFinal bool, speaker string, at time.Time, words []WordTiming) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	pcmPath := filepath.Join(r.recordingDir, "audio.pcm")
-	pcmFile, err := os.Open(pcmPath)
-	if err != nil {
-		return fmt.Errorf("failed to open PCM file: %w", err)
+	if r.closed {
+		return fmt.Errorf("transcript journal not open")
 	}
-	defer pcmFile.Close()
 
-	wavFile, err := os.Create(outputPath)
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	entry := TranscriptEntry{
+		Timestamp: at,
+		Offset:    at.Sub(r.startTime).Seconds(),
+		Text:      text,
+		IsFinal:   isFinal,
+		Speaker:   speaker,
+	}
+	for _, w := range words {
+		w.Start += entry.Offset
+		w.End += entry.Offset
+		entry.Words = append(entry.Words, w)
+	}
+	return r.journal.append(entry)
+}
+
+// AddToolCall journals a tool call made at the given time, or now if it is
+// zero
+func (r *Recorder) AddToolCall(call ToolCall) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return fmt.Errorf("transcript journal not open")
+	}
+
+	if call.Timestamp.IsZero() {
+		call.Timestamp = time.Now()
+	}
+	call.Offset = call.Timestamp.Sub(r.startTime).Seconds()
+	return r.journal.appendToolCall(call)
+}
+
+// Close finalizes the recording, storing the audio in the recording's
+// format and completing the metadata. Closing again returns the same
+// error.
+func (r *Recorder) Close() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return r.closeErr
+	}
+	r.closed = true
+	defer func() { r.closeErr = err }()
+	// Channel uploads not completed by then are discarded, whatever
+	// stopped the recording getting that far
+	defer r.abortUploads()
+
+	// Close audio files and the journal
+	if err := r.closeFiles(); err != nil {
+		return fmt.Errorf("failed to close recording files: %w", err)
+	}
+
+	_, samples, err := r.channels()
+	if err != nil {
+		return err
+	}
+	audioFiles, err := storeAudio(r.recordingDir, r.format, samples, r.sampleRate, r.dataKey)
 	if err != nil {
-		return fmt.Errorf("failed to create WAV file: %w", err)
+		return fmt.Errorf("failed to export recording: %w", err)
 	}
-	defer wavFile.Close()
 
-	// Get PCM file size
-	pcmInfo, err := pcmFile.Stat()
+	transcripts, toolCalls, err := readJournal(filepath.Join(r.recordingDir, TranscriptsFile), r.dataKey)
 	if err != nil {
-		return fmt.Errorf("failed to stat PCM file: %w", err)
+		return fmt.Errorf("failed to read transcript journal: %w", err)
+	}
+
+	segments := make([][]segment, len(r.tracks))
+	sources := make([]string, len(r.tracks))
+	for i, t := range r.tracks {
+		segments[i] = t.speech.finish()
+		sources[i] = t.source
 	}
 
-	// WAV header parameters
-	sampleRate := uint32(16000)
-	bitsPerSample := uint16(16)
-	numChannels := uint16(1)
-	dataSize := uint32(pcmInfo.Size())
+	metadata := r.metadata()
+	metadata.Status = StatusComplete
+	metadata.EndTime = time.Now()
+	metadata.Transcripts = transcripts
+	metadata.ToolCalls = toolCalls
+	metadata.AudioFiles = audioFiles
+	summarize(&metadata, r.frames(), segments, sources)
+	if metadata.Encrypted {
+		withholdTranscripts(&metadata)
+	}
 
-	// Write WAV header
-	if err := writeWAVHeader(wavFile, sampleRate, bitsPerSample, numChannels, dataSize); err != nil {
-		return fmt.Errorf("failed to write WAV header: %w", err)
+	if err := writeMetadataFile(r.recordingDir, metadata); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
 	}
 
-	// Copy PCM data
-	if _, err := io.Copy(wavFile, pcmFile); err != nil {
-		return fmt.Errorf("failed to copy audio data: %w", err)
+	if r.store != nil {
+		if err := r.upload(); err != nil {
+			return fmt.Errorf("failed to upload recording, kept in %s: %w", r.recordingDir, err)
+		}
 	}
 
 	return nil
 }
 
-// writeWAVHeader writes a WAV file header
-func writeWAVHeader(w io.Writer, sampleRate uint32, bitsPerSample, numChannels uint16, dataSize uint32) error {
-	byteRate := sampleRate * uint32(numChannels) * uint32(bitsPerSample/8)
-	blockAlign := numChannels * (bitsPerSample / 8)
+// upload completes the channel uploads still wanted and uploads the rest
+// of the recording. Streamed channel files keep a header without the
+// length, which wasn't known when it was sent.
+func (r *Recorder) upload() error {
+	uploaded := make(map[string]bool)
+	for _, t := range r.tracks {
+		name := filepath.Base(t.path)
+		// Only channel files the format keeps are wanted; a channel whose
+		// upload failed is sent again from the local copy
+		_, err := os.Stat(t.path)
+		keep := err == nil
+		if t.upload.finish(keep) == nil && keep {
+			uploaded[name] = true
+		}
+	}
+
+	return uploadRecording(context.Background(), r.store, r.recordingDir, uploaded)
+}
 
-	// RIFF header
-	if _, err := w.Write([]byte("RIFF")); err != nil {
-		return err
+// abortUploads discards the channel uploads still in progress
+func (r *Recorder) abortUploads() {
+	for _, t := range r.tracks {
+		if t.upload != nil {
+			t.upload.finish(false)
+		}
 	}
-	if err := writeUint32(w, dataSize+36); err != nil {
-		return err
+}
+
+// closeFiles closes every channel's audio file and the transcript journal
+func (r *Recorder) closeFiles() error {
+	var errs []error
+	for _, t := range r.tracks {
+		if t.wav != nil {
+			errs = append(errs, t.wav.Close())
+		}
+		if t.ogg != nil {
+			errs = append(errs, t.ogg.Close(), t.oggFile.Close())
+		}
 	}
-	if _, err := w.Write([]byte("WAVE")); err != nil {
-		return err
+	if r.journal != nil {
+		errs = append(errs, r.journal.Close())
 	}
+	return errors.Join(errs...)
+}
 
-	// fmt chunk
-	if _, err := w.Write([]byte("fmt ")); err != nil {
-		return err
+// frames returns the length of the recording in samples per channel, i.e.
+// the length of the longest channel
+func (r *Recorder) frames() int64 {
+	var frames int64
+	for _, t := range r.tracks {
+		frames = max(frames, t.samples)
 	}
-	if err := writeUint32(w, 16); err != nil { // chunk size
-		return err
+	return frames
+}
+
+// metadata returns what is known about the recording from the start
+func (r *Recorder) metadata() RecordingMetadata {
+	return RecordingMetadata{
+		SessionID:           r.sessionID,
+		TenantID:            r.tenantID,
+		TenantAuthenticated: r.tenantAuth,
+		StartTime:           r.startTime,
+		Format:              r.format,
+		SampleRate:          r.sampleRate,
+		BitsPerSample:       bytesPerSample * 8,
+		Channels:            len(r.tracks),
+		ChannelLayout:       channelNames,
+		Encrypted:           r.dataKey != nil,
+		Transcripts:         []TranscriptEntry{},
 	}
-	if err := writeUint16(w, 1); err != nil { // audio format (PCM)
-		return err
+}
+
+// withholdTranscripts leaves the transcripts and tool calls of an encrypted
+// recording out of its metadata, which isn't encrypted; they stay in the
+// encrypted journal
+func withholdTranscripts(metadata *RecordingMetadata) {
+	metadata.Transcripts = []TranscriptEntry{}
+	metadata.ToolCalls = nil
+}
+
+// summarize fills in the duration and statistics of a recording from its
+// length in samples per channel and the speech segments of each channel
+func summarize(metadata *RecordingMetadata, frames int64, segments [][]segment, sources []string) {
+	seconds := func(samples int64) float64 {
+		return float64(samples) / float64(metadata.SampleRate)
 	}
-	if err := writeUint16(w, numChannels); err != nil {
-		return err
+
+	caller, agent := segments[ChannelCaller], segments[ChannelAgent]
+	speech := unionSamples(caller, agent)
+
+	speakers := make(map[string]SpeakerStats, len(segments))
+	var bargeIns []BargeIn
+	for i := range segments {
+		other := agent
+		if Channel(i) == ChannelAgent {
+			other = caller
+		}
+		starts := interruptions(segments[i], other)
+		for _, start := range starts {
+			bargeIns = append(bargeIns, BargeIn{Offset: seconds(start), Speaker: channelSpeakers[i]})
+		}
+
+		speakers[channelSpeakers[i]] = SpeakerStats{
+			Channel:       channelNames[i],
+			Source:        sources[i],
+			TalkTime:      seconds(speechSamples(segments[i])),
+			Turns:         len(segments[i]),
+			Interruptions: len(starts),
+		}
 	}
-	if err := writeUint32(w, sampleRate); err != nil {
-		return err
+
+	sort.Slice(bargeIns, func(i, j int) bool { return bargeIns[i].Offset < bargeIns[j].Offset })
+
+	metadata.Duration = seconds(frames)
+	metadata.BargeIns = bargeIns
+	metadata.Stats = RecordingStats{
+		TotalAudioBytes: frames * int64(len(segments)*bytesPerSample),
+		TranscriptCount: len(metadata.Transcripts),
+		SpeechDuration:  seconds(speech),
+		SilenceDuration: seconds(frames - speech),
+		Interruptions:   len(bargeIns),
+		Speakers:        speakers,
 	}
-	if err := writeUint32(w, byteRate); err != nil {
+}
+
+// writeMetadataFile replaces a session's metadata file, writing it to a
+// temporary file first so it is never left half-written
+func writeMetadataFile(sessionDir string, metadata RecordingMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
 		return err
 	}
-	if err := writeUint16(w, blockAlign); err != nil {
+
+	tmp, err := os.CreateTemp(sessionDir, MetadataFile+".*.tmp")
+	if err != nil {
 		return err
 	}
-	if err := writeUint16(w, bitsPerSample); err != nil {
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
 		return err
 	}
-
-	// data chunk
-	if _, err := w.Write([]byte("data")); err != nil {
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
 		return err
 	}
-	if err := writeUint32(w, dataSize); err != nil {
+	if err := tmp.Close(); err != nil {
 		return err
 	}
 
-	return nil
+	return os.Rename(tmp.Name(), filepath.Join(sessionDir, MetadataFile))
+}
+
+// ExportToWAV writes the recording so far as a stereo WAV file with the
+// caller on the left channel and the agent on the right. Once a FLAC or Ogg
+// recording is closed the channel WAV files it reads are gone. The export
+// is not encrypted, even if the recording is.
+func (r *Recorder) ExportToWAV(outputPath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	paths, samples, err := r.channels()
+	if err != nil {
+		return err
+	}
+	return writeStereoWAV(outputPath, paths, samples, r.sampleRate, r.dataKey, nil)
 }
 
-func writeUint16(w io.Writer, val uint16) error {
-	bytes := []byte{byte(val), byte(val >> 8)}
-	_, err := w.Write(bytes)
-	return err
+// ExportToFLAC is ExportToWAV for FLAC
+func (r *Recorder) ExportToFLAC(outputPath string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	paths, samples, err := r.channels()
+	if err != nil {
+		return err
+	}
+	return writeStereoFLAC(outputPath, paths, samples, r.sampleRate, r.dataKey, nil)
 }
 
-func writeUint32(w io.Writer, val uint32) error {
-	bytes := []byte{byte(val), byte(val >> 8), byte(val >> 16), byte(val >> 24)}
-	_, err := w.Write(bytes)
-	return err
+// channels returns each channel's WAV file and its length in samples. Audio
+// of an open recording held back for encryption is written out first, so
+// the files hold every sample.
+func (r *Recorder) channels() ([]string, []int64, error) {
+	paths := make([]string, len(r.tracks))
+	samples := make([]int64, len(r.tracks))
+	for i, t := range r.tracks {
+		if !r.closed {
+			if err := t.wav.out.Flush(); err != nil {
+				return nil, nil, fmt.Errorf("failed to write %s audio: %w", Channel(i), err)
+			}
+		}
+		paths[i] = t.path
+		samples[i] = t.samples
+	}
+	return paths, samples, nil
 }
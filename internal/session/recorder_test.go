@@ -0,0 +1,193 @@
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"voice-gateway/internal/audio"
+	"voice-gateway/internal/storage"
+)
+
+const testSampleRate = 16000
+
+func newTestRecorder(t *testing.T, format string) *Recorder {
+	t.Helper()
+	r, err := NewRecorder("test-session", t.TempDir(), RecorderOptions{SampleRate: testSampleRate, Format: format})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// frame returns 20ms of non-silent PCM
+func frame() []byte {
+	pcm := make([]byte, testSampleRate/50*bytesPerSample)
+	for i := range pcm {
+		pcm[i] = 1
+	}
+	return pcm
+}
+
+func TestWriteAudioGaps(t *testing.T) {
+	const frameSamples = testSampleRate / 50
+	seconds := func(d time.Duration) int64 { return int64(d) * testSampleRate / int64(time.Second) }
+
+	tests := []struct {
+		name string
+		// Offsets of the writes after one at 0
+		at []time.Duration
+		// Samples in the channel afterwards
+		samples int64
+	}{
+		{"contiguous", []time.Duration{20 * time.Millisecond, 40 * time.Millisecond}, 3 * frameSamples},
+		{"gap filled", []time.Duration{time.Second}, seconds(time.Second) + frameSamples},
+		{"longest gap filled", []time.Duration{maxGapFill + 20*time.Millisecond}, seconds(maxGapFill+20*time.Millisecond) + frameSamples},
+		{"late write dropped", []time.Duration{20 * time.Millisecond, 0}, 2 * frameSamples},
+		// Jumps, e.g. from RTP timestamps that wrapped, are resynced to
+		// rather than filled, and later writes follow on from them
+		{"jump ahead", []time.Duration{12 * time.Hour, 12*time.Hour + 20*time.Millisecond}, 3 * frameSamples},
+		{"jump back", []time.Duration{20 * time.Millisecond, -time.Hour, -time.Hour + 20*time.Millisecond}, 4 * frameSamples},
+		{"gap after jump", []time.Duration{time.Hour, time.Hour + time.Second}, seconds(time.Second) + 2*frameSamples},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRecorder(t, FormatWAV)
+			start := time.Now()
+			for _, at := range append([]time.Duration{0}, tt.at...) {
+				if err := r.WriteAudio(ChannelCaller, frame(), at); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("writes took %v", elapsed)
+			}
+			if got := r.tracks[ChannelCaller].samples; got != tt.samples {
+				t.Errorf("channel has %d samples, want %d", got, tt.samples)
+			}
+			if got := r.tracks[ChannelAgent].samples; got != 0 {
+				t.Errorf("other channel has %d samples", got)
+			}
+		})
+	}
+}
+
+func TestWriteOpusGaps(t *testing.T) {
+	silent, err := audio.OpusPacketSamples(audio.OpusSilence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	granules := func(d time.Duration) uint64 { return uint64(int64(d) * opusSampleRate / int64(time.Second)) }
+
+	tests := []struct {
+		name    string
+		at      []time.Duration
+		granule uint64
+	}{
+		{"contiguous", []time.Duration{20 * time.Millisecond}, 2 * uint64(silent)},
+		{"gap filled", []time.Duration{time.Second}, granules(time.Second) + uint64(silent)},
+		{"jump ahead", []time.Duration{12 * time.Hour, 12*time.Hour + 20*time.Millisecond}, 3 * uint64(silent)},
+		{"jump back", []time.Duration{-time.Hour}, 2 * uint64(silent)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRecorder(t, FormatOgg)
+			for _, at := range append([]time.Duration{0}, tt.at...) {
+				if err := r.WriteOpus(ChannelCaller, audio.OpusSilence, at); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := r.tracks[ChannelCaller].ogg.Granule(); got != tt.granule {
+				t.Errorf("granule %d, want %d", got, tt.granule)
+			}
+		})
+	}
+}
+
+// trackingStore counts the objects being written to it
+type trackingStore struct {
+	storage.Storage
+	mu      sync.Mutex
+	writing int
+}
+
+func (s *trackingStore) Create(ctx context.Context, key string) (storage.Writer, error) {
+	w, err := s.Storage.Create(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.writing++
+	s.mu.Unlock()
+	return &trackedWriter{Writer: w, store: s}, nil
+}
+
+func (s *trackingStore) open() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writing
+}
+
+type trackedWriter struct {
+	storage.Writer
+	store *trackingStore
+	once  sync.Once
+}
+
+func (w *trackedWriter) done() {
+	w.once.Do(func() {
+		w.store.mu.Lock()
+		w.store.writing--
+		w.store.mu.Unlock()
+	})
+}
+
+func (w *trackedWriter) Close() error {
+	defer w.done()
+	return w.Writer.Close()
+}
+
+func (w *trackedWriter) Abort() error {
+	defer w.done()
+	return w.Writer.Abort()
+}
+
+func TestCloseFailureAbortsUploads(t *testing.T) {
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &trackingStore{Storage: local}
+	dir := t.TempDir()
+	r, err := NewRecorder("test-session", dir, RecorderOptions{SampleRate: testSampleRate, Format: FormatWAV, Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := store.open(); n != len(channelNames) {
+		t.Fatalf("%d uploads in progress, want one per channel", n)
+	}
+	for i := range 10 {
+		if err := r.WriteAudio(ChannelCaller, frame(), time.Duration(i)*20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The stereo file can't be built without the caller's channel
+	if err := os.Remove(filepath.Join(dir, "test-session", ChannelCaller.String()+".wav")); err != nil {
+		t.Fatal(err)
+	}
+	err = r.Close()
+	if err == nil {
+		t.Fatal("closed without the caller's audio")
+	}
+	if n := store.open(); n != 0 {
+		t.Errorf("%d uploads left in progress", n)
+	}
+	if again := r.Close(); again != err {
+		t.Errorf("closing again returned %v, want %v", again, err)
+	}
+}
@@ -0,0 +1,167 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"voice-gateway/internal/envelope"
+)
+
+// ReadMetadata reads the metadata of the recording in a session directory
+func ReadMetadata(sessionDir string) (*RecordingMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(sessionDir, MetadataFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata RecordingMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	return &metadata, nil
+}
+
+// RecoverRecording repairs a recording that was never closed, e.g. because
+// the gateway crashed: it fixes the channel WAV headers, recomputes the
+// speech statistics from the audio, stores the audio in the recording's
+// format and completes the metadata with the transcript journal and status
+// "recovered". Ogg files are kept as they are, less at most the last page.
+// An encrypted recording needs the KEK its data key was wrapped by; its
+// files are completed as encrypted streams, less any chunk being written.
+// It must not be run on a recording that is still in progress.
+func RecoverRecording(sessionDir string, kek *envelope.KEK) (*RecordingMetadata, error) {
+	dataKey, err := readKeyFile(sessionDir, kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data key: %w", err)
+	}
+
+	metadata, err := ReadMetadata(sessionDir)
+	if err != nil {
+		// Rebuild what we can from the audio
+		metadata = &RecordingMetadata{SessionID: filepath.Base(sessionDir)}
+	}
+	metadata.Encrypted = dataKey != nil
+	if metadata.Format == "" {
+		// Recorded before formats were configurable
+		metadata.Format = FormatWAV
+	}
+	metadata.BitsPerSample = bytesPerSample * 8
+	metadata.Channels = len(channelNames)
+	metadata.ChannelLayout = channelNames
+
+	paths := make([]string, len(channelNames))
+	samples := make([]int64, len(channelNames))
+	segments := make([][]segment, len(channelNames))
+	sources := make([]string, len(channelNames))
+	var lastWrite time.Time
+
+	for i, name := range channelNames {
+		paths[i] = channelPath(sessionDir, Channel(i))
+
+		// Before the repair touches the file
+		if stat, err := os.Stat(paths[i]); err == nil && stat.ModTime().After(lastWrite) {
+			lastWrite = stat.ModTime()
+		}
+
+		info, err := repairChannel(paths[i], dataKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to repair %s audio: %w", name, err)
+		}
+		if info.channels != 1 {
+			return nil, fmt.Errorf("%s audio has %d channels, expected 1", name, info.channels)
+		}
+		if metadata.SampleRate == 0 {
+			metadata.SampleRate = info.sampleRate
+		} else if info.sampleRate != metadata.SampleRate {
+			return nil, fmt.Errorf("%s audio is %dHz, expected %dHz", name, info.sampleRate, metadata.SampleRate)
+		}
+		samples[i] = info.dataSize / bytesPerSample
+
+		segments[i], err = detectSpeech(paths[i], info.sampleRate, dataKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to analyse %s audio: %w", name, err)
+		}
+
+		sources[i] = metadata.Stats.Speakers[channelSpeakers[i]].Source
+
+		if dataKey != nil {
+			if err := finishIfExists(oggPath(sessionDir, Channel(i)), dataKey); err != nil {
+				return nil, fmt.Errorf("failed to repair %s Ogg file: %w", name, err)
+			}
+		}
+	}
+
+	frames := max(samples[ChannelCaller], samples[ChannelAgent])
+	if metadata.StartTime.IsZero() {
+		metadata.StartTime = lastWrite.Add(-time.Duration(frames) * time.Second / time.Duration(metadata.SampleRate))
+	}
+
+	journalPath := filepath.Join(sessionDir, TranscriptsFile)
+	if dataKey != nil {
+		if err := finishIfExists(journalPath, dataKey); err != nil {
+			return nil, fmt.Errorf("failed to repair transcript journal: %w", err)
+		}
+	}
+	metadata.Transcripts, metadata.ToolCalls, err = readJournal(journalPath, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transcript journal: %w", err)
+	}
+
+	// The call ended no earlier than the last audio written
+	metadata.Status = StatusRecovered
+	metadata.EndTime = lastWrite
+	summarize(metadata, frames, segments, sources)
+	if metadata.Encrypted {
+		withholdTranscripts(metadata)
+	}
+
+	metadata.AudioFiles, err = storeAudio(sessionDir, metadata.Format, samples, metadata.SampleRate, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export recording: %w", err)
+	}
+
+	if err := writeMetadataFile(sessionDir, *metadata); err != nil {
+		return nil, fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	return metadata, nil
+}
+
+// finishIfExists completes an encrypted file left unclosed, if there is one
+func finishIfExists(path string, dataKey *envelope.DataKey) error {
+	_, err := finishSealedFile(path, dataKey)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// detectSpeech finds the speech segments in a mono WAV file written by
+// wavWriter
+func detectSpeech(path string, sampleRate int, dataKey *envelope.DataKey) ([]segment, error) {
+	file, err := openChannel(path, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tracker := newSpeechTracker(sampleRate)
+	reader := bufio.NewReader(file)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := reader.Read(buf)
+		tracker.write(buf[:n])
+		if err == io.EOF {
+			return tracker.finish(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
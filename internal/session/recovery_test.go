@@ -0,0 +1,214 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crashedChannel writes a channel WAV file as a crash leaves it: its header
+// claims headerSamples and it holds the given samples, then half of one more
+func crashedChannel(t *testing.T, path string, samples []int16, headerSamples int) {
+	t.Helper()
+	var file bytes.Buffer
+	if err := writeWAVHeader(&file, testSampleRate, bytesPerSample*8, 1, uint32(headerSamples*bytesPerSample)); err != nil {
+		t.Fatal(err)
+	}
+	binary.Write(&file, binary.LittleEndian, samples)
+	file.WriteByte(0x7f)
+	if err := os.WriteFile(path, file.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tone returns n samples of a loud square wave, detected as speech
+func tone(n int, level int16) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		if i/20%2 == 0 {
+			samples[i] = level
+		} else {
+			samples[i] = -level
+		}
+	}
+	return samples
+}
+
+// journalLines returns the journal lines of the given transcripts and a
+// tool call
+func journalLines(t *testing.T, texts ...string) []byte {
+	t.Helper()
+	var journal bytes.Buffer
+	for i, text := range texts {
+		line, err := json.Marshal(TranscriptEntry{Offset: float64(i), Text: text, IsFinal: true, Speaker: SpeakerUser})
+		if err != nil {
+			t.Fatal(err)
+		}
+		journal.Write(append(line, '\n'))
+	}
+	line, err := json.Marshal(journalLine{ToolCall: &ToolCall{Offset: 1.5, Tool: "lookup"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Write(append(line, '\n'))
+	return journal.Bytes()
+}
+
+func TestRepairWAV(t *testing.T) {
+	tests := []struct {
+		name          string
+		headerSamples int
+	}{
+		{"header never patched", 0},
+		{"stale header", 100},
+		{"header past the data", 1 << 20},
+	}
+	samples := tone(1600, 3000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "caller.wav")
+			crashedChannel(t, path, samples, tt.headerSamples)
+
+			info, err := repairWAV(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.channels != 1 || info.sampleRate != testSampleRate || info.dataSize != int64(len(samples)*bytesPerSample) {
+				t.Errorf("repaired as %dHz/%dch with %d bytes", info.sampleRate, info.channels, info.dataSize)
+			}
+			checkWAV(t, path, 1, samples)
+		})
+	}
+}
+
+// checkWAV checks that a WAV file's header matches its length and that it
+// holds the given interleaved samples
+func checkWAV(t *testing.T, path string, channels int, samples []int16) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < wavHeaderSize || string(data[:4]) != "RIFF" || string(data[36:40]) != "data" {
+		t.Fatalf("%s is not a WAV file", path)
+	}
+	if riff := binary.LittleEndian.Uint32(data[4:]); int(riff) != len(data)-8 {
+		t.Errorf("RIFF size %d in a file of %d bytes", riff, len(data))
+	}
+	if size := binary.LittleEndian.Uint32(data[40:]); int(size) != len(data)-wavHeaderSize {
+		t.Errorf("data size %d, file holds %d bytes", size, len(data)-wavHeaderSize)
+	}
+	if n := binary.LittleEndian.Uint16(data[22:]); int(n) != channels {
+		t.Errorf("%d channels, want %d", n, channels)
+	}
+
+	got := make([]int16, (len(data)-wavHeaderSize)/bytesPerSample)
+	binary.Read(bytes.NewReader(data[wavHeaderSize:]), binary.LittleEndian, got)
+	if len(got) != len(samples) {
+		t.Fatalf("%d samples, want %d", len(got), len(samples))
+	}
+	for i := range samples {
+		if got[i] != samples[i] {
+			t.Fatalf("sample %d is %d, want %d", i, got[i], samples[i])
+		}
+	}
+}
+
+func TestParseJournalCutShort(t *testing.T) {
+	journal := journalLines(t, "first", "second", "third")
+	partial, err := json.Marshal(TranscriptEntry{Offset: 4, Text: "cut off", IsFinal: true, Speaker: SpeakerUser})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut anywhere in the last line, even just before its newline
+	for _, cut := range []int{0, 1, len(partial) / 2, len(partial)} {
+		entries, toolCalls, err := parseJournal(bytes.NewReader(append(journal, partial[:cut]...)))
+		if err != nil {
+			t.Fatalf("cut at %d: %v", cut, err)
+		}
+		var texts []string
+		for _, entry := range entries {
+			texts = append(texts, entry.Text)
+		}
+		if strings.Join(texts, ",") != "first,second,third" || len(toolCalls) != 1 {
+			t.Errorf("cut at %d: read %q and %d tool calls", cut, texts, len(toolCalls))
+		}
+	}
+
+	// A damaged complete line is an error, not silently dropped
+	if _, _, err := parseJournal(strings.NewReader("{\"text\":\n")); err == nil {
+		t.Error("parsed a damaged line")
+	}
+}
+
+func TestRecoverRecording(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "crashed")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	if err := writeMetadataFile(dir, RecordingMetadata{
+		SessionID:  "crashed",
+		TenantID:   "acme",
+		Status:     StatusRecording,
+		StartTime:  start,
+		Format:     FormatWAV,
+		SampleRate: testSampleRate,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The caller's header was last patched early on; the agent's never was
+	caller := tone(testSampleRate, 4000)
+	agent := append(make([]int16, testSampleRate/2), tone(testSampleRate, 5000)...)
+	crashedChannel(t, channelPath(dir, ChannelCaller), caller, 160)
+	crashedChannel(t, channelPath(dir, ChannelAgent), agent, 0)
+
+	journal := append(journalLines(t, "hello", "I need help"), `{"offset_seconds":2,"text":"cut o`...)
+	if err := os.WriteFile(filepath.Join(dir, TranscriptsFile), journal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := RecoverRecording(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Status != StatusRecovered || metadata.TenantID != "acme" || !metadata.StartTime.Equal(start) {
+		t.Errorf("recovered as %s of %q started %v", metadata.Status, metadata.TenantID, metadata.StartTime)
+	}
+	if len(metadata.Transcripts) != 2 || metadata.Transcripts[1].Text != "I need help" || len(metadata.ToolCalls) != 1 {
+		t.Errorf("recovered transcripts %+v and %d tool calls", metadata.Transcripts, len(metadata.ToolCalls))
+	}
+	if len(metadata.AudioFiles) != 1 || metadata.AudioFiles[0] != AudioFile {
+		t.Fatalf("audio files %v", metadata.AudioFiles)
+	}
+	if want := 1.5; metadata.Duration != want {
+		t.Errorf("duration %vs, want %vs", metadata.Duration, want)
+	}
+
+	// The stereo file holds every complete sample, the caller's padded
+	// with silence to the agent's length
+	var stereo []int16
+	for i := range agent {
+		var left int16
+		if i < len(caller) {
+			left = caller[i]
+		}
+		stereo = append(stereo, left, agent[i])
+	}
+	checkWAV(t, filepath.Join(dir, AudioFile), 2, stereo)
+
+	stored, err := ReadMetadata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != StatusRecovered || len(stored.Transcripts) != 2 {
+		t.Errorf("stored metadata has status %s and %d transcripts", stored.Status, len(stored.Transcripts))
+	}
+}
@@ -10,25 +10,28 @@ import (
 // Session represents an active voice call session
 type Session struct {
 	ID        string
+	TenantID  string // "" if the caller did not identify a tenant
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	State     State
+	onClose   []func()
 	mu        sync.RWMutex
 }
 
 type State string
 
 const (
-	StateNew        State = "new"
-	StateConnected  State = "connected"
-	StateListening  State = "listening"
-	StateSpeaking   State = "speaking"
+	StateNew          State = "new"
+	StateConnected    State = "connected"
+	StateListening    State = "listening"
+	StateSpeaking     State = "speaking"
 	StateDisconnected State = "disconnected"
 )
 
 // Manager handles session lifecycle
 type Manager struct {
 	sessions map[string]*Session
+	onDelete []func(*Session)
 	mu       sync.RWMutex
 }
 
@@ -39,13 +42,14 @@ func NewManager() *Manager {
 	}
 }
 
-// Create creates a new session
-func (m *Manager) Create() *Session {
+// Create creates a new session for a tenant
+func (m *Manager) Create(tenantID string) *Session {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	session := &Session{
 		ID:        uuid.New().String(),
+		TenantID:  tenantID,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 		State:     StateNew,
@@ -63,11 +67,50 @@ func (m *Manager) Get(id string) (*Session, bool) {
 	return session, ok
 }
 
-// Delete removes a session
+// Delete removes a session and runs its teardown hooks
 func (m *Manager) Delete(id string) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
 	delete(m.sessions, id)
+	hooks := m.onDelete
+	m.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	session.close()
+	for _, fn := range hooks {
+		fn(session)
+	}
+}
+
+// OnDelete registers a function to run for every session when it is
+// deleted, after the session's own OnClose hooks
+func (m *Manager) OnDelete(fn func(*Session)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onDelete = append(m.onDelete, fn)
+}
+
+// OnClose registers a function to run when the session is deleted, such as
+// stopping its bus subscriptions. Hooks run in reverse registration order.
+func (s *Session) OnClose(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onClose = append(s.onClose, fn)
+}
+
+// close runs and clears the teardown hooks
+func (s *Session) close() {
+	s.mu.Lock()
+	hooks := s.onClose
+	s.onClose = nil
+	s.mu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
 }
 
 // UpdateState updates the session state
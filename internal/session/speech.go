@@ -0,0 +1,155 @@
+package session
+
+import (
+	"time"
+
+	"voice-gateway/internal/ingest"
+)
+
+const (
+	// RMS level above which a frame counts as speech (about -40 dBFS)
+	speechThreshold = 0.01
+	// Frame size speech is detected over
+	speechFrame = 20 * time.Millisecond
+	// Silence shorter than this doesn't end a speech segment, so pauses
+	// between words are counted as talk time
+	speechHangover = 300 * time.Millisecond
+)
+
+// segment is a span of a channel, in samples from the start of the
+// recording
+type segment struct {
+	start, end int64
+}
+
+func (s segment) contains(pos int64) bool {
+	return s.start < pos && pos < s.end
+}
+
+// speechTracker finds the segments of a channel containing speech as audio
+// is written. It works in media time, so silence padded in for a gap is
+// measured the same as silence that was actually received.
+type speechTracker struct {
+	vad       *ingest.VAD
+	frameSize int   // bytes
+	hangover  int64 // samples
+	pending   []byte
+	pos       int64
+	speaking  bool
+	start     int64
+	speechEnd int64
+	segments  []segment
+}
+
+func newSpeechTracker(sampleRate int) *speechTracker {
+	return &speechTracker{
+		vad:       ingest.NewVAD(speechThreshold, 0),
+		frameSize: int(int64(sampleRate)*int64(speechFrame)/int64(time.Second)) * bytesPerSample,
+		hangover:  int64(sampleRate) * int64(speechHangover) / int64(time.Second),
+	}
+}
+
+// write analyses PCM appended to the channel
+func (t *speechTracker) write(data []byte) {
+	t.pending = append(t.pending, data...)
+
+	for len(t.pending) >= t.frameSize {
+		frame := t.pending[:t.frameSize]
+		samples := int64(t.frameSize / bytesPerSample)
+
+		if t.vad.Process(frame) {
+			if !t.speaking {
+				t.speaking = true
+				t.start = t.pos
+			}
+			t.speechEnd = t.pos + samples
+		}
+		t.pos += samples
+		t.endAfterHangover()
+
+		t.pending = t.pending[t.frameSize:]
+	}
+}
+
+// silence accounts for silence appended to the channel
+func (t *speechTracker) silence(samples int64) {
+	// A partial frame before a gap is too short to judge; count it as silence
+	t.pos += int64(len(t.pending)/bytesPerSample) + samples
+	t.pending = t.pending[:0]
+	t.endAfterHangover()
+}
+
+func (t *speechTracker) endAfterHangover() {
+	if t.speaking && t.pos-t.speechEnd >= t.hangover {
+		t.endSegment()
+	}
+}
+
+func (t *speechTracker) endSegment() {
+	t.segments = append(t.segments, segment{start: t.start, end: t.speechEnd})
+	t.speaking = false
+}
+
+// finish closes any open segment and returns every speech segment
+func (t *speechTracker) finish() []segment {
+	if t.speaking {
+		t.endSegment()
+	}
+	return t.segments
+}
+
+// speechSamples returns the total length of the segments
+func speechSamples(segments []segment) int64 {
+	var total int64
+	for _, s := range segments {
+		total += s.end - s.start
+	}
+	return total
+}
+
+// unionSamples returns how many samples fall in at least one segment
+func unionSamples(a, b []segment) int64 {
+	var total int64
+	var current segment
+	open := false
+
+	// Both lists are ordered, so merge them in start order
+	for len(a) > 0 || len(b) > 0 {
+		var next segment
+		if len(b) == 0 || (len(a) > 0 && a[0].start <= b[0].start) {
+			next, a = a[0], a[1:]
+		} else {
+			next, b = b[0], b[1:]
+		}
+
+		switch {
+		case !open:
+			current, open = next, true
+		case next.start <= current.end:
+			current.end = max(current.end, next.end)
+		default:
+			total += current.end - current.start
+			current = next
+		}
+	}
+	if open {
+		total += current.end - current.start
+	}
+
+	return total
+}
+
+// interruptions returns where the segments of one channel that start while
+// the other channel is speaking start
+func interruptions(segments, other []segment) []int64 {
+	var starts []int64
+	for _, s := range segments {
+		for _, o := range other {
+			if o.contains(s.start) {
+				starts = append(starts, s.start)
+				break
+			}
+		}
+	}
+	return starts
+}
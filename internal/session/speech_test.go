@@ -0,0 +1,156 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+	"time"
+)
+
+// span is a stretch of speech in a synthetic channel
+type span struct {
+	start, end time.Duration
+}
+
+func samplesAt(d time.Duration) int64 {
+	return int64(d) * testSampleRate / int64(time.Second)
+}
+
+// channelPCM returns length of PCM that is loud within the spans and
+// silent elsewhere
+func channelPCM(length time.Duration, spans ...span) []byte {
+	samples := make([]int16, samplesAt(length))
+	for _, s := range spans {
+		copy(samples[samplesAt(s.start):], tone(int(samplesAt(s.end)-samplesAt(s.start)), 3000))
+	}
+	var pcm bytes.Buffer
+	binary.Write(&pcm, binary.LittleEndian, samples)
+	return pcm.Bytes()
+}
+
+// trackPCM runs pcm through a speech tracker in writes that don't line up
+// with its frames
+func trackPCM(pcm []byte) []segment {
+	tracker := newSpeechTracker(testSampleRate)
+	for part := range slices.Chunk(pcm, 1234) {
+		tracker.write(part)
+	}
+	return tracker.finish()
+}
+
+func segmentsAt(spans ...span) []segment {
+	var segments []segment
+	for _, s := range spans {
+		segments = append(segments, segment{start: samplesAt(s.start), end: samplesAt(s.end)})
+	}
+	return segments
+}
+
+func TestSpeechTracker(t *testing.T) {
+	s := time.Second
+	ms := time.Millisecond
+	tests := []struct {
+		name   string
+		length time.Duration
+		spans  []span
+		want   []span
+	}{
+		{"silence", 2 * s, nil, nil},
+		{"speech", 2 * s, []span{{0, s}}, []span{{0, s}}},
+		{"speech to the end", 2 * s, []span{{s, 2 * s}}, []span{{s, 2 * s}}},
+		{"trailing pause", 1200 * ms, []span{{0, s}}, []span{{0, s}}},
+		{"pause within speech", 3 * s, []span{{0, s}, {s + 200*ms, 2 * s}}, []span{{0, 2 * s}}},
+		{"pause ending speech", 3 * s, []span{{0, s}, {s + speechHangover, 2 * s}}, []span{{0, s}, {s + speechHangover, 2 * s}}},
+		{"turns", 5 * s, []span{{100 * ms, s}, {2 * s, 3 * s}, {4 * s, 4500 * ms}}, []span{{100 * ms, s}, {2 * s, 3 * s}, {4 * s, 4500 * ms}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := trackPCM(channelPCM(tt.length, tt.spans...))
+			if want := segmentsAt(tt.want...); !slices.Equal(got, want) {
+				t.Errorf("segments %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSpeechTrackerGap(t *testing.T) {
+	tracker := newSpeechTracker(testSampleRate)
+	speech := channelPCM(time.Second, span{0, time.Second})
+
+	// Speech, then half a frame, then a gap filled with silence
+	tracker.write(speech)
+	tracker.write(speech[:320])
+	tracker.silence(samplesAt(time.Second))
+	tracker.write(speech)
+
+	got := tracker.finish()
+	want := []segment{{0, samplesAt(time.Second)}, {samplesAt(time.Second) + 160 + samplesAt(time.Second), 160 + samplesAt(3*time.Second)}}
+	if !slices.Equal(got, want) {
+		t.Errorf("segments %v, want %v", got, want)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	s := time.Second
+	ms := time.Millisecond
+	length := 10 * s
+	// The agent talks over the caller at 1s and 5.5s, the caller over the
+	// agent at 3s; both start together at 8s, which is no barge-in
+	caller := trackPCM(channelPCM(length, span{0, 2 * s}, span{3 * s, 3500 * ms}, span{5 * s, 6 * s}, span{8 * s, 8500 * ms}))
+	agent := trackPCM(channelPCM(length, span{s, 4 * s}, span{5500 * ms, 7 * s}, span{8 * s, 9 * s}))
+
+	metadata := RecordingMetadata{SampleRate: testSampleRate, Transcripts: make([]TranscriptEntry, 3)}
+	summarize(&metadata, samplesAt(length), [][]segment{caller, agent}, []string{"opus", "tts"})
+
+	if metadata.Duration != 10 {
+		t.Errorf("duration %v", metadata.Duration)
+	}
+	stats := metadata.Stats
+	// Someone speaks during 0-4s, 5-7s and 8-9s
+	if stats.SpeechDuration != 7 || stats.SilenceDuration != 3 {
+		t.Errorf("speech %vs and silence %vs, want 7s and 3s", stats.SpeechDuration, stats.SilenceDuration)
+	}
+	if stats.TotalAudioBytes != samplesAt(length)*2*bytesPerSample || stats.TranscriptCount != 3 {
+		t.Errorf("%d audio bytes and %d transcripts", stats.TotalAudioBytes, stats.TranscriptCount)
+	}
+
+	want := map[string]SpeakerStats{
+		SpeakerUser:      {Channel: "caller", Source: "opus", TalkTime: 4, Turns: 4, Interruptions: 1},
+		SpeakerAssistant: {Channel: "agent", Source: "tts", TalkTime: 5.5, Turns: 3, Interruptions: 2},
+	}
+	for speaker, want := range want {
+		if got := stats.Speakers[speaker]; got != want {
+			t.Errorf("%s stats %+v, want %+v", speaker, got, want)
+		}
+	}
+
+	wantBargeIns := []BargeIn{{Offset: 1, Speaker: SpeakerAssistant}, {Offset: 3, Speaker: SpeakerUser}, {Offset: 5.5, Speaker: SpeakerAssistant}}
+	if stats.Interruptions != 3 || !slices.Equal(metadata.BargeIns, wantBargeIns) {
+		t.Errorf("%d interruptions at %v, want %v", stats.Interruptions, metadata.BargeIns, wantBargeIns)
+	}
+}
+
+func TestUnionSamples(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []segment
+		want int64
+	}{
+		{"none", nil, nil, 0},
+		{"one side", []segment{{0, 10}, {20, 25}}, nil, 15},
+		{"disjoint", []segment{{0, 10}}, []segment{{20, 30}}, 20},
+		{"overlapping", []segment{{0, 10}}, []segment{{5, 15}}, 15},
+		{"contained", []segment{{0, 100}}, []segment{{10, 20}, {30, 40}}, 100},
+		{"touching", []segment{{0, 10}}, []segment{{10, 20}}, 20},
+		{"bridged", []segment{{0, 10}, {20, 30}}, []segment{{5, 25}}, 30},
+	}
+	for _, tt := range tests {
+		if got := unionSamples(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: %d samples, want %d", tt.name, got, tt.want)
+		}
+		if got := unionSamples(tt.b, tt.a); got != tt.want {
+			t.Errorf("%s reversed: %d samples, want %d", tt.name, got, tt.want)
+		}
+	}
+}
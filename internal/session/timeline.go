@@ -0,0 +1,227 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Formats a recording's transcript can be exported in
+const (
+	// WebVTT subtitles, with each cue's speaker as its voice
+	TranscriptVTT = "vtt"
+	// SubRip subtitles, each cue's text prefixed with its speaker
+	TranscriptSRT = "srt"
+	// The Timeline as JSON
+	TranscriptJSON = "json"
+)
+
+const (
+	// Speaking time assumed per word of an utterance without word timings
+	secondsPerWord = 0.4
+	// Shortest time an utterance without word timings is shown for
+	minUtterance = time.Second
+)
+
+// ValidateTranscriptFormat checks that a transcript format is supported
+func ValidateTranscriptFormat(format string) error {
+	switch format {
+	case TranscriptVTT, TranscriptSRT, TranscriptJSON:
+		return nil
+	}
+	return fmt.Errorf("unsupported transcript format %q, expected %s, %s or %s", format, TranscriptVTT, TranscriptSRT, TranscriptJSON)
+}
+
+// TranscriptContentType returns the media type of a transcript format
+func TranscriptContentType(format string) string {
+	switch format {
+	case TranscriptVTT:
+		return "text/vtt; charset=utf-8"
+	case TranscriptSRT:
+		return "application/x-subrip; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// Timeline is a normalized account of a recorded conversation. All times
+// are in seconds from the start of the audio.
+type Timeline struct {
+	SessionID string    `json:"session_id"`
+	StartTime time.Time `json:"start_time"`
+	Duration  float64   `json:"duration_seconds"`
+	// Each party's turns, in order
+	Turns     []Turn     `json:"turns"`
+	ToolCalls []ToolCall `json:"tool_calls"`
+	BargeIns  []BargeIn  `json:"barge_ins"`
+}
+
+// Turn is what one party said before the other spoke
+type Turn struct {
+	Speaker    string      `json:"speaker"`
+	Start      float64     `json:"start_seconds"`
+	End        float64     `json:"end_seconds"`
+	Text       string      `json:"text"`
+	Utterances []Utterance `json:"utterances"`
+}
+
+// Utterance is one final transcript of a turn. Without word timings its
+// end is estimated from its length.
+type Utterance struct {
+	Start float64      `json:"start_seconds"`
+	End   float64      `json:"end_seconds"`
+	Text  string       `json:"text"`
+	Words []WordTiming `json:"words,omitempty"`
+}
+
+// NewTimeline builds the timeline of a recording from its metadata, which
+// must include its transcripts. Interim transcripts are left out.
+func NewTimeline(metadata *RecordingMetadata) *Timeline {
+	timeline := &Timeline{
+		SessionID: metadata.SessionID,
+		StartTime: metadata.StartTime,
+		Duration:  metadata.Duration,
+		Turns:     []Turn{},
+		ToolCalls: append([]ToolCall{}, metadata.ToolCalls...),
+		BargeIns:  append([]BargeIn{}, metadata.BargeIns...),
+	}
+
+	// Placed by their word timings where they have them, which may put
+	// them before transcripts delivered earlier
+	var spoken []spokenUtterance
+	for _, entry := range metadata.Transcripts {
+		if !entry.IsFinal || strings.TrimSpace(entry.Text) == "" {
+			continue
+		}
+		u := Utterance{Start: entry.Offset, Text: strings.TrimSpace(entry.Text), Words: entry.Words}
+		if len(u.Words) > 0 {
+			u.Start, u.End = u.Words[0].Start, u.Words[len(u.Words)-1].End
+		}
+		spoken = append(spoken, spokenUtterance{Utterance: u, speaker: entry.Speaker})
+	}
+	sort.SliceStable(spoken, func(i, j int) bool { return spoken[i].Start < spoken[j].Start })
+
+	for i, s := range spoken {
+		u := s.Utterance
+		if len(u.Words) == 0 {
+			estimate := max(minUtterance.Seconds(), float64(len(strings.Fields(u.Text)))*secondsPerWord)
+			u.End = u.Start + estimate
+			// Cut short by whatever is said next
+			if i+1 < len(spoken) && spoken[i+1].Start > u.Start {
+				u.End = min(u.End, spoken[i+1].Start)
+			}
+			if timeline.Duration > u.Start {
+				u.End = min(u.End, timeline.Duration)
+			}
+		}
+
+		turns := timeline.Turns
+		if len(turns) > 0 && turns[len(turns)-1].Speaker == s.speaker {
+			turn := &turns[len(turns)-1]
+			turn.End = max(turn.End, u.End)
+			turn.Text += " " + u.Text
+			turn.Utterances = append(turn.Utterances, u)
+			continue
+		}
+		timeline.Turns = append(turns, Turn{
+			Speaker:    s.speaker,
+			Start:      u.Start,
+			End:        u.End,
+			Text:       u.Text,
+			Utterances: []Utterance{u},
+		})
+	}
+
+	sort.SliceStable(timeline.ToolCalls, func(i, j int) bool {
+		return timeline.ToolCalls[i].Offset < timeline.ToolCalls[j].Offset
+	})
+	return timeline
+}
+
+// Write writes the timeline in a transcript format
+func (t *Timeline) Write(w io.Writer, format string) error {
+	switch format {
+	case TranscriptVTT:
+		return t.WriteWebVTT(w)
+	case TranscriptSRT:
+		return t.WriteSRT(w)
+	case TranscriptJSON:
+		return t.WriteJSON(w)
+	}
+	return ValidateTranscriptFormat(format)
+}
+
+// WriteWebVTT writes a cue for each utterance, voiced by its speaker
+func (t *Timeline) WriteWebVTT(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "WEBVTT - %s\n\n", vttEscape(t.SessionID))
+	for i, u := range t.utterances() {
+		fmt.Fprintf(out, "%d\n%s --> %s\n<v %s>%s\n\n", i+1,
+			cueTime(u.Start, '.'), cueTime(u.End, '.'), vttEscape(u.speaker), vttEscape(u.Text))
+	}
+	return out.Flush()
+}
+
+// WriteSRT writes a cue for each utterance, prefixed with its speaker
+func (t *Timeline) WriteSRT(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	for i, u := range t.utterances() {
+		// A blank line would end the cue, and an arrow be taken for timing
+		text := srtEscape(strings.Join(strings.Fields(u.Text), " "))
+		fmt.Fprintf(out, "%d\n%s --> %s\n%s: %s\n\n", i+1,
+			cueTime(u.Start, ','), cueTime(u.End, ','), u.speaker, text)
+	}
+	return out.Flush()
+}
+
+// WriteJSON writes the timeline as indented JSON
+func (t *Timeline) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(t)
+}
+
+type spokenUtterance struct {
+	Utterance
+	speaker string
+}
+
+// utterances returns every utterance of the timeline in order of their
+// start, even if the turns were put together out of order
+func (t *Timeline) utterances() []spokenUtterance {
+	var utterances []spokenUtterance
+	for _, turn := range t.Turns {
+		for _, u := range turn.Utterances {
+			utterances = append(utterances, spokenUtterance{Utterance: u, speaker: turn.Speaker})
+		}
+	}
+	sort.SliceStable(utterances, func(i, j int) bool { return utterances[i].Start < utterances[j].Start })
+	return utterances
+}
+
+// cueTime formats seconds as a subtitle timestamp, HH:MM:SS followed by
+// the separator and milliseconds
+func cueTime(seconds float64, separator byte) string {
+	ms := int64(max(seconds, 0)*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
+
+// srtEscape shortens arrows in SRT cue text, where they would be taken for
+// a cue's timing; "--->" only becomes one once shortened
+func srtEscape(text string) string {
+	for strings.Contains(text, "-->") {
+		text = strings.ReplaceAll(text, "-->", "->")
+	}
+	return text
+}
+
+var vttReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\n", " ", "\r", " ")
+
+// vttEscape makes text safe for a WebVTT cue
+func vttEscape(text string) string {
+	return vttReplacer.Replace(text)
+}
@@ -0,0 +1,120 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// timelineCases are recordings whose transcripts are exported and compared
+// with testdata/timeline/<name>.<format>
+var timelineCases = map[string]*RecordingMetadata{
+	"escaping": {
+		SessionID: "a<b>&c",
+		Duration:  20,
+		Transcripts: []TranscriptEntry{
+			{Offset: 1, Text: "if a --> b & c < d", IsFinal: true, Speaker: SpeakerUser},
+			{Offset: 5, Text: "<b>bold</b> &amp; ---> done", IsFinal: true, Speaker: SpeakerAssistant},
+			{Offset: 9, Text: "two\n\nlines\r\nhere", IsFinal: true, Speaker: SpeakerUser},
+			{Offset: 12, Text: "interim only", IsFinal: false, Speaker: SpeakerUser},
+		},
+	},
+	"long": {
+		SessionID: "long",
+		Duration:  3*3600 + 5,
+		Transcripts: []TranscriptEntry{
+			{Offset: 59.9996, Text: "just under a minute", IsFinal: true, Speaker: SpeakerUser},
+			{Offset: 3599.5, Text: "crossing the hour", IsFinal: true, Speaker: SpeakerAssistant},
+			{Offset: 3*3600 + 1.25, Text: "three hours in", IsFinal: true, Speaker: SpeakerUser},
+		},
+	},
+	"words": {
+		SessionID: "words",
+		Duration:  30,
+		Transcripts: []TranscriptEntry{
+			// Delivered after the assistant started, but spoken before
+			{Offset: 4, Text: "hello there", IsFinal: true, Speaker: SpeakerUser, Words: []WordTiming{
+				{Text: "hello", Start: 1.5, End: 2, Confidence: 0.9},
+				{Text: "there", Start: 2.1, End: 2.6, Confidence: 0.8},
+			}},
+			{Offset: 3, Text: "hi how can I help", IsFinal: true, Speaker: SpeakerAssistant},
+			{Offset: 8, Text: "book a table", IsFinal: true, Speaker: SpeakerUser, Words: []WordTiming{
+				{Text: "book", Start: 7.5, End: 7.8},
+				{Text: "a", Start: 7.8, End: 7.9},
+				{Text: "table", Start: 7.9, End: 8.4},
+			}},
+		},
+		ToolCalls: []ToolCall{
+			{Offset: 9, Tool: "book", Arguments: json.RawMessage(`{"party":2}`), Result: json.RawMessage(`{"ok":true}`)},
+		},
+		BargeIns: []BargeIn{{Offset: 7.5, Speaker: SpeakerUser}},
+	},
+	"empty": {
+		SessionID:   "empty",
+		Duration:    10,
+		Transcripts: []TranscriptEntry{},
+	},
+}
+
+func TestTimelineGolden(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, metadata := range timelineCases {
+		metadata.StartTime = start
+		timeline := NewTimeline(metadata)
+		for _, format := range []string{TranscriptVTT, TranscriptSRT, TranscriptJSON} {
+			t.Run(name+"."+format, func(t *testing.T) {
+				var out bytes.Buffer
+				if err := timeline.Write(&out, format); err != nil {
+					t.Fatal(err)
+				}
+
+				path := filepath.Join("testdata", "timeline", name+"."+format)
+				if *update {
+					if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out.Bytes(), want) {
+					t.Errorf("%s differs from %s:\n%s", format, path, out.Bytes())
+				}
+			})
+		}
+	}
+}
+
+func TestCueTime(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		vtt     string
+	}{
+		{0, "00:00:00.000"},
+		{-1, "00:00:00.000"},
+		{1.2345, "00:00:01.235"},
+		{59.9996, "00:01:00.000"},
+		{3599.999, "00:59:59.999"},
+		{3600, "01:00:00.000"},
+		{3*3600 + 25*60 + 7.5, "03:25:07.500"},
+		{100 * 3600, "100:00:00.000"},
+	}
+	for _, tt := range tests {
+		if got := cueTime(tt.seconds, '.'); got != tt.vtt {
+			t.Errorf("cueTime(%v) = %s, want %s", tt.seconds, got, tt.vtt)
+		}
+	}
+	if got := cueTime(3661.001, ','); got != "01:01:01,001" {
+		t.Errorf("SRT cue time %s", got)
+	}
+}
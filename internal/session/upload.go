@@ -0,0 +1,140 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"voice-gateway/internal/envelope"
+	"voice-gateway/internal/storage"
+)
+
+// channelUpload streams a channel's audio to storage as it is recorded, so
+// an upload at the end of the call need not start from scratch
+type channelUpload struct {
+	writer storage.Writer
+	// What the audio is written to: writer, or encryption in front of it
+	out io.Writer
+	enc *envelope.Writer
+	// Kept for the first failure, after which nothing more is sent
+	err error
+	// Set once completed or discarded
+	finished bool
+}
+
+// newChannelUpload starts an object holding a mono WAV file of unknown
+// length, encrypted with dataKey unless it is nil
+func newChannelUpload(ctx context.Context, store storage.Storage, key string, sampleRate int, dataKey *envelope.DataKey) (*channelUpload, error) {
+	writer, err := store.Create(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	u := &channelUpload{writer: writer, out: writer}
+
+	if dataKey != nil {
+		if u.enc, err = dataKey.NewWriter(writer); err != nil {
+			writer.Abort()
+			return nil, err
+		}
+		u.out = u.enc
+	}
+
+	if err := writeUnknownSizeWAVHeader(u.out, sampleRate, 1); err != nil {
+		writer.Abort()
+		return nil, err
+	}
+	return u, nil
+}
+
+// Write sends audio, returning an error only for the write that fails
+func (u *channelUpload) Write(data []byte) error {
+	if u.err != nil {
+		return nil
+	}
+	if _, err := u.out.Write(data); err != nil {
+		u.err = err
+		u.writer.Abort()
+		return fmt.Errorf("failed to upload audio, continuing locally: %w", err)
+	}
+	return nil
+}
+
+// finish completes the object, or discards it if it isn't wanted. Only
+// the first call does anything.
+func (u *channelUpload) finish(keep bool) error {
+	if u.finished {
+		return nil
+	}
+	u.finished = true
+	if u.err != nil {
+		return u.err
+	}
+	if !keep {
+		return u.writer.Abort()
+	}
+	if u.enc != nil {
+		if err := u.enc.Close(); err != nil {
+			return errors.Join(err, u.writer.Abort())
+		}
+	}
+	return u.writer.Close()
+}
+
+// recordingKey returns the storage key of a file of a session's recording
+func recordingKey(sessionID, name string) string {
+	return path.Join(sessionID, name)
+}
+
+// UploadRecording copies a finished recording from its session directory
+// to storage, then removes the local copy. The metadata goes last, so a
+// recording whose metadata is in storage is complete there.
+func UploadRecording(ctx context.Context, store storage.Storage, sessionDir string) error {
+	return uploadRecording(ctx, store, sessionDir, nil)
+}
+
+// uploadRecording is UploadRecording skipping files already uploaded
+func uploadRecording(ctx context.Context, store storage.Storage, sessionDir string, uploaded map[string]bool) error {
+	sessionID := filepath.Base(sessionDir)
+
+	entries, err := os.ReadDir(sessionDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		// Metadata goes last; temporary files are incomplete
+		if entry.IsDir() || name == MetadataFile || strings.HasSuffix(name, ".tmp") || uploaded[name] {
+			continue
+		}
+		if err := uploadFile(ctx, store, recordingKey(sessionID, name), filepath.Join(sessionDir, name)); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", name, err)
+		}
+	}
+
+	if err := uploadFile(ctx, store, recordingKey(sessionID, MetadataFile), filepath.Join(sessionDir, MetadataFile)); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", MetadataFile, err)
+	}
+
+	return os.RemoveAll(sessionDir)
+}
+
+func uploadFile(ctx context.Context, store storage.Storage, key, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return storage.Upload(ctx, store, key, file)
+}
+
+// uploadMetadata replaces a recording's metadata in storage
+func uploadMetadata(ctx context.Context, store storage.Storage, sessionDir string) error {
+	return uploadFile(ctx, store, recordingKey(filepath.Base(sessionDir), MetadataFile), filepath.Join(sessionDir, MetadataFile))
+}
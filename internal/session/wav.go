@@ -0,0 +1,370 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"voice-gateway/internal/envelope"
+)
+
+const (
+	// Size of the canonical PCM WAV header written by writeWAVHeader
+	wavHeaderSize = 44
+
+	// How often a streaming WAV file's header is updated with the current
+	// length, bounding how much audio a crash can leave unaccounted for
+	wavPatchInterval = time.Second
+
+	// Size fields of a WAV header whose length isn't known when it is
+	// written. Readers take the audio to run to the end of the file.
+	wavUnknownSize = 0xffffffff
+)
+
+// wavWriter writes a WAV file incrementally. The header is rewritten with
+// the current data length by patchIfDue and on Close, so a file cut short by
+// a crash is still playable up to the last patch and can be fully repaired
+// by repairWAV. An encrypted file can't be patched, so its header gives the
+// length as unknown and patchIfDue writes out the audio held back for
+// encryption instead.
+type wavWriter struct {
+	out         *sealedFile
+	dataSize    int64
+	lastPatched time.Time
+}
+
+// newWAVWriter creates a 16-bit PCM WAV file, encrypted with dataKey
+// unless it is nil
+func newWAVWriter(path string, sampleRate, channels int, dataKey *envelope.DataKey) (*wavWriter, error) {
+	out, err := createSealedFile(path, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if dataKey != nil {
+		err = writeUnknownSizeWAVHeader(out, sampleRate, channels)
+	} else {
+		err = writeWAVHeader(out, uint32(sampleRate), bytesPerSample*8, uint16(channels), 0)
+	}
+	if err != nil {
+		out.Close()
+		return nil, fmt.Errorf("failed to write WAV header: %w", err)
+	}
+
+	return &wavWriter{out: out, lastPatched: time.Now()}, nil
+}
+
+// Write appends PCM data
+func (w *wavWriter) Write(data []byte) (int, error) {
+	n, err := w.out.Write(data)
+	w.dataSize += int64(n)
+	return n, err
+}
+
+// patchIfDue updates the header if it hasn't been for wavPatchInterval
+func (w *wavWriter) patchIfDue() error {
+	if time.Since(w.lastPatched) < wavPatchInterval {
+		return nil
+	}
+	if err := w.patchHeader(); err != nil {
+		return fmt.Errorf("failed to update WAV header: %w", err)
+	}
+	return nil
+}
+
+// patchHeader records the current data length in the RIFF and data chunk
+// sizes
+func (w *wavWriter) patchHeader() error {
+	w.lastPatched = time.Now()
+	if w.out.enc != nil {
+		return w.out.Flush()
+	}
+	return patchWAVSizes(w.out.file, w.dataSize)
+}
+
+// Close patches the header a final time and closes the file
+func (w *wavWriter) Close() error {
+	if w.out.enc == nil {
+		if err := w.patchHeader(); err != nil {
+			w.out.Close()
+			return fmt.Errorf("failed to update WAV header: %w", err)
+		}
+	}
+	return w.out.Close()
+}
+
+// patchWAVSizes overwrites the size fields of a canonical WAV header
+func patchWAVSizes(f io.WriterAt, dataSize int64) error {
+	size := make([]byte, 4)
+
+	binary.LittleEndian.PutUint32(size, uint32(dataSize+wavHeaderSize-8))
+	if _, err := f.WriteAt(size, 4); err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(size, uint32(dataSize))
+	_, err := f.WriteAt(size, wavHeaderSize-4)
+	return err
+}
+
+// wavInfo is the format of a WAV file written by wavWriter
+type wavInfo struct {
+	sampleRate int
+	channels   int
+	dataSize   int64
+}
+
+// repairWAV fixes the header of a WAV file written by wavWriter to match
+// the audio actually in the file, dropping any partial trailing sample
+func repairWAV(path string) (wavInfo, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return wavInfo{}, err
+	}
+	defer file.Close()
+
+	info, err := readWAVHeader(file)
+	if err != nil {
+		return wavInfo{}, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return wavInfo{}, err
+	}
+
+	frameSize := int64(info.channels * bytesPerSample)
+	info.dataSize = (stat.Size() - wavHeaderSize) / frameSize * frameSize
+
+	if err := file.Truncate(wavHeaderSize + info.dataSize); err != nil {
+		return wavInfo{}, fmt.Errorf("failed to truncate partial sample: %w", err)
+	}
+	if err := patchWAVSizes(file, info.dataSize); err != nil {
+		return wavInfo{}, fmt.Errorf("failed to update WAV header: %w", err)
+	}
+
+	return info, file.Close()
+}
+
+// repairChannel is repairWAV for a channel file of a recording encrypted
+// with dataKey, or not if it is nil. An encrypted file's header isn't
+// patched: the length comes from completing the encrypted stream, and any
+// partial trailing sample is left for readers to ignore.
+func repairChannel(path string, dataKey *envelope.DataKey) (wavInfo, error) {
+	if dataKey == nil {
+		return repairWAV(path)
+	}
+
+	size, err := finishSealedFile(path, dataKey)
+	if err != nil {
+		return wavInfo{}, err
+	}
+
+	in, err := openSealedFile(path, dataKey)
+	if err != nil {
+		return wavInfo{}, err
+	}
+	defer in.Close()
+
+	info, err := readWAVHeader(in)
+	if err != nil {
+		return wavInfo{}, err
+	}
+	frameSize := int64(info.channels * bytesPerSample)
+	info.dataSize = (size - wavHeaderSize) / frameSize * frameSize
+	return info, nil
+}
+
+// readWAVHeader reads the format from the header of a WAV file written by
+// wavWriter
+func readWAVHeader(in io.Reader) (wavInfo, error) {
+	header := make([]byte, wavHeaderSize)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return wavInfo{}, fmt.Errorf("failed to read WAV header: %w", err)
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" || string(header[36:40]) != "data" {
+		return wavInfo{}, fmt.Errorf("not a WAV file written by the recorder")
+	}
+
+	info := wavInfo{
+		channels:   int(binary.LittleEndian.Uint16(header[22:])),
+		sampleRate: int(binary.LittleEndian.Uint32(header[24:])),
+	}
+	if info.channels <= 0 || info.sampleRate <= 0 {
+		return wavInfo{}, fmt.Errorf("invalid WAV format %dHz/%dch", info.sampleRate, info.channels)
+	}
+	return info, nil
+}
+
+// writeStereoWAV interleaves mono WAV files written by wavWriter into one
+// WAV file with a channel per input, padding shorter inputs with silence.
+// samples gives how many samples of each input to use. The inputs are
+// decrypted with inputKey and the output encrypted with outputKey, where
+// not nil.
+func writeStereoWAV(outputPath string, inputPaths []string, samples []int64, sampleRate int, inputKey, outputKey *envelope.DataKey) error {
+	wavFile, err := createSealedFile(outputPath, outputKey)
+	if err != nil {
+		return fmt.Errorf("failed to create WAV file: %w", err)
+	}
+	defer wavFile.Close()
+
+	// WAV header parameters
+	numChannels := uint16(len(inputPaths))
+	dataSize := uint32(longest(samples) * int64(numChannels) * bytesPerSample)
+
+	out := bufio.NewWriter(wavFile)
+
+	// Write WAV header
+	if err := writeWAVHeader(out, uint32(sampleRate), bytesPerSample*8, numChannels, dataSize); err != nil {
+		return fmt.Errorf("failed to write WAV header: %w", err)
+	}
+
+	if err := interleaveWAVs(out, inputPaths, samples, inputKey); err != nil {
+		return err
+	}
+
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("failed to write audio data: %w", err)
+	}
+
+	return wavFile.Close()
+}
+
+// interleaveWAVs writes the PCM of mono WAV files written by wavWriter as
+// interleaved frames with a channel per input, padding shorter inputs with
+// silence. samples gives how many samples of each input to use. The inputs
+// are decrypted with dataKey unless it is nil.
+func interleaveWAVs(out io.Writer, inputPaths []string, samples []int64, dataKey *envelope.DataKey) error {
+	inputs := make([]*bufio.Reader, len(inputPaths))
+	for i, path := range inputPaths {
+		in, err := openChannel(path, dataKey)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		inputs[i] = bufio.NewReader(in)
+	}
+
+	// Interleave the channels, padding shorter ones with silence
+	frames := longest(samples)
+	sample := make([]byte, bytesPerSample)
+	for i := int64(0); i < frames; i++ {
+		for ch, in := range inputs {
+			if i >= samples[ch] {
+				clear(sample)
+			} else if _, err := io.ReadFull(in, sample); err != nil {
+				return fmt.Errorf("failed to read %s audio: %w", Channel(ch), err)
+			}
+			if _, err := out.Write(sample); err != nil {
+				return fmt.Errorf("failed to write audio data: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// openChannel opens a mono WAV file written by wavWriter positioned at the
+// start of its audio
+func openChannel(path string, dataKey *envelope.DataKey) (io.ReadCloser, error) {
+	in, err := openSealedFile(path, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel audio: %w", err)
+	}
+	if _, err := io.CopyN(io.Discard, in, wavHeaderSize); err != nil {
+		in.Close()
+		return nil, fmt.Errorf("failed to read channel audio: %w", err)
+	}
+	return in, nil
+}
+
+// longest returns the largest of a list of sample counts
+func longest(samples []int64) int64 {
+	var n int64
+	for _, s := range samples {
+		n = max(n, s)
+	}
+	return n
+}
+
+// writeUnknownSizeWAVHeader writes the header of a 16-bit PCM WAV file whose
+// length isn't known
+func writeUnknownSizeWAVHeader(w io.Writer, sampleRate, channels int) error {
+	var header bytes.Buffer
+	if err := writeWAVHeader(&header, uint32(sampleRate), bytesPerSample*8, uint16(channels), 0); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(header.Bytes()[4:], wavUnknownSize)
+	binary.LittleEndian.PutUint32(header.Bytes()[wavHeaderSize-4:], wavUnknownSize)
+
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+// writeWAVHeader writes a WAV file header
+func writeWAVHeader(w io.Writer, sampleRate uint32, bitsPerSample, numChannels uint16, dataSize uint32) error {
+	byteRate := sampleRate * uint32(numChannels) * uint32(bitsPerSample/8)
+	blockAlign := numChannels * (bitsPerSample / 8)
+
+	// RIFF header
+	if _, err := w.Write([]byte("RIFF")); err != nil {
+		return err
+	}
+	if err := writeUint32(w, dataSize+36); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("WAVE")); err != nil {
+		return err
+	}
+
+	// fmt chunk
+	if _, err := w.Write([]byte("fmt ")); err != nil {
+		return err
+	}
+	if err := writeUint32(w, 16); err != nil { // chunk size
+		return err
+	}
+	if err := writeUint16(w, 1); err != nil { // audio format (PCM)
+		return err
+	}
+	if err := writeUint16(w, numChannels); err != nil {
+		return err
+	}
+	if err := writeUint32(w, sampleRate); err != nil {
+		return err
+	}
+	if err := writeUint32(w, byteRate); err != nil {
+		return err
+	}
+	if err := writeUint16(w, blockAlign); err != nil {
+		return err
+	}
+	if err := writeUint16(w, bitsPerSample); err != nil {
+		return err
+	}
+
+	// data chunk
+	if _, err := w.Write([]byte("data")); err != nil {
+		return err
+	}
+	if err := writeUint32(w, dataSize); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func writeUint16(w io.Writer, val uint16) error {
+	bytes := []byte{byte(val), byte(val >> 8)}
+	_, err := w.Write(bytes)
+	return err
+}
+
+func writeUint32(w io.Writer, val uint32) error {
+	bytes := []byte{byte(val), byte(val >> 8), byte(val >> 16), byte(val >> 24)}
+	_, err := w.Write(bytes)
+	return err
+}
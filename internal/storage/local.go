@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Local stores objects as files under a root directory, a key's slashes
+// separating subdirectories
+type Local struct {
+	root string
+}
+
+// NewLocal creates storage rooted at dir, creating it if need be
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &Local{root: dir}, nil
+}
+
+// Root returns the directory objects are stored in
+func (l *Local) Root() string {
+	return l.root
+}
+
+// path returns the file for a key, rejecting keys that would escape the
+// root
+func (l *Local) path(key string) (string, error) {
+	if !fs.ValidPath(key) || key == "." {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Create writes the object to a temporary file beside it, renamed into
+// place on Close
+func (l *Local) Create(ctx context.Context, key string) (Writer, error) {
+	target, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+
+	// Hidden, so List skips it
+	file, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &localWriter{file: file, target: target}, nil
+}
+
+func (l *Local) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (l *Local) OpenAt(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	r, err := l.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.(*os.File).Seek(offset, io.SeekStart); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	stat, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && stat.IsDir()) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	// Only the directory the prefix points into needs walking
+	start := l.root
+	if dir := path.Dir(prefix + "x"); dir != "." {
+		var err error
+		if start, err = l.path(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && p == start {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != start {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Delete removes the object's file, and any directories it leaves empty,
+// as a key prefix stops existing in an object store once its last object is
+// deleted
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	root := filepath.Clean(l.root)
+	for dir := filepath.Dir(p); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // not empty, or already gone
+		}
+	}
+	return nil
+}
+
+// localWriter writes a Local object's temporary file
+type localWriter struct {
+	file   *os.File
+	target string
+	done   bool
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *localWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.target); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Parts kept in memory for upload while earlier ones are sent. Any more
+// are spilled to a temporary file until the uploader catches up, so Write
+// never waits on the store.
+const queuedParts = 2
+
+// s3Writer buffers an object until it reaches the part size, then switches
+// to a multipart upload whose parts are sent by a goroutine of its own as
+// they fill, starting the upload with the first. Write only waits on the
+// local disk: parts that can't be queued in memory are spilled to a
+// temporary file. An object smaller than one part is sent in one request
+// on Close.
+type s3Writer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	store  *S3
+	key    string
+
+	buf     []byte
+	parts   int // queued so far
+	started bool
+	done    bool
+
+	// Closed when the uploader has finished
+	uploaded chan struct{}
+	// Only used by the uploader until it has finished
+	uploadID string
+
+	mu        sync.Mutex
+	queued    sync.Cond // signalled when a part is queued or the queue closed
+	queue     []queuedPart
+	inMemory  int
+	spill     *os.File // nil until a part is spilled
+	spillSize int64
+	closing   bool // no more parts will be queued
+	completed []completedPart
+	err       error // first failed part
+}
+
+// queuedPart is a part waiting to be uploaded, in memory or in the spill
+// file
+type queuedPart struct {
+	number int
+	data   []byte // nil if spilled
+	offset int64
+	size   int
+}
+
+func newS3Writer(ctx context.Context, store *S3, key string) *s3Writer {
+	// The writer may outlive the context it was created with, e.g. the
+	// request that started a call, but can still be aborted
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	w := &s3Writer{ctx: ctx, cancel: cancel, store: store, key: key}
+	w.queued.L = &w.mu
+	return w
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("object writer closed")
+	}
+	if err := w.failed(); err != nil {
+		return 0, err
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		take := min(len(p), int(w.store.partSize)-len(w.buf))
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+
+		if len(w.buf) == int(w.store.partSize) {
+			if err := w.queuePart(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// queuePart hands the buffered part to the uploader, starting it with the
+// first part. The part is kept in memory if few are waiting, and spilled
+// otherwise.
+func (w *s3Writer) queuePart() error {
+	if !w.started {
+		w.started = true
+		w.uploaded = make(chan struct{})
+		go w.upload()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.parts++
+	part := queuedPart{number: w.parts, size: len(w.buf)}
+	if w.inMemory < queuedParts {
+		part.data = w.buf
+		w.inMemory++
+		w.buf = make([]byte, 0, w.store.partSize)
+	} else {
+		if err := w.spillPart(&part); err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			w.queued.Signal()
+			return err
+		}
+		w.buf = w.buf[:0]
+	}
+
+	w.queue = append(w.queue, part)
+	w.queued.Signal()
+	return nil
+}
+
+// spillPart appends the buffered part to the spill file
+func (w *s3Writer) spillPart(part *queuedPart) error {
+	if w.spill == nil {
+		file, err := os.CreateTemp("", "s3-upload-*")
+		if err != nil {
+			return fmt.Errorf("failed to spill part %d of %s: %w", part.number, w.key, err)
+		}
+		w.spill = file
+	}
+	if _, err := w.spill.WriteAt(w.buf, w.spillSize); err != nil {
+		return fmt.Errorf("failed to spill part %d of %s: %w", part.number, w.key, err)
+	}
+	part.offset = w.spillSize
+	w.spillSize += int64(len(w.buf))
+	return nil
+}
+
+// upload sends queued parts in order until the queue is closed. After a
+// failure the remaining parts are discarded.
+func (w *s3Writer) upload() {
+	defer close(w.uploaded)
+
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.closing {
+			w.queued.Wait()
+		}
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			return
+		}
+		part := w.queue[0]
+		w.queue = w.queue[1:]
+		if part.data != nil {
+			w.inMemory--
+		}
+		spill, failed := w.spill, w.err != nil
+		w.mu.Unlock()
+
+		if failed {
+			continue
+		}
+
+		etag, err := w.uploadPart(part, spill)
+
+		w.mu.Lock()
+		if err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+		} else {
+			w.completed = append(w.completed, completedPart{PartNumber: part.number, ETag: etag})
+		}
+		w.mu.Unlock()
+	}
+}
+
+// uploadPart sends one part, starting the multipart upload first if need
+// be, and returns its ETag
+func (w *s3Writer) uploadPart(part queuedPart, spill *os.File) (string, error) {
+	if w.uploadID == "" {
+		uploadID, err := w.store.createMultipartUpload(w.ctx, w.key)
+		if err != nil {
+			return "", fmt.Errorf("failed to start upload of %s: %w", w.key, err)
+		}
+		w.uploadID = uploadID
+	}
+
+	data := part.data
+	if data == nil {
+		data = make([]byte, part.size)
+		if _, err := spill.ReadAt(data, part.offset); err != nil {
+			return "", fmt.Errorf("failed to read spilled part %d of %s: %w", part.number, w.key, err)
+		}
+	}
+
+	etag, err := w.store.uploadPart(w.ctx, w.key, w.uploadID, part.number, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload part %d of %s: %w", part.number, w.key, err)
+	}
+	return etag, nil
+}
+
+// failed returns the error of a failed part upload, if any
+func (w *s3Writer) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// finishUpload closes the queue and waits for the uploader to send or
+// discard what is in it
+func (w *s3Writer) finishUpload() {
+	w.mu.Lock()
+	w.closing = true
+	w.queued.Signal()
+	w.mu.Unlock()
+	<-w.uploaded
+}
+
+// removeSpill deletes the spill file, if there is one
+func (w *s3Writer) removeSpill() {
+	if w.spill != nil {
+		w.spill.Close()
+		os.Remove(w.spill.Name())
+		w.spill = nil
+	}
+}
+
+func (w *s3Writer) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	defer w.cancel()
+	defer w.removeSpill()
+
+	if !w.started {
+		if err := w.store.putObject(w.ctx, w.key, w.buf); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", w.key, err)
+		}
+		return nil
+	}
+
+	// The last part may be smaller than the rest, but not empty unless it
+	// is the only one
+	var err error
+	if len(w.buf) > 0 {
+		err = w.queuePart()
+	}
+	w.finishUpload()
+
+	if err == nil {
+		err = w.failed()
+	}
+	if err == nil {
+		if err = w.store.completeMultipartUpload(w.ctx, w.key, w.uploadID, w.completed); err != nil {
+			err = fmt.Errorf("failed to complete upload of %s: %w", w.key, err)
+		}
+	}
+	if err != nil && w.uploadID != "" {
+		w.store.abortMultipartUpload(w.ctx, w.key, w.uploadID)
+	}
+	return err
+}
+
+func (w *s3Writer) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	defer w.cancel()
+	defer w.removeSpill()
+
+	if !w.started {
+		return nil
+	}
+
+	// Skip the queued parts and wait out any in flight, then discard the
+	// parts already stored
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = errors.New("upload aborted")
+	}
+	w.mu.Unlock()
+	w.finishUpload()
+
+	if w.uploadID == "" {
+		return nil
+	}
+	return w.store.abortMultipartUpload(w.ctx, w.key, w.uploadID)
+}
@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"voice-gateway/internal/config"
+)
+
+const (
+	// Smallest part S3 accepts in a multipart upload, other than the last
+	minPartSize = 5 << 20
+
+	// Delay before the first retry, doubling for each one after
+	retryBackoff    = 200 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+
+	// How long to wait for the response to a request once it is sent, so a
+	// stalled connection is retried rather than holding up a recording
+	responseTimeout = time.Minute
+)
+
+// Server-side encryption modes
+const (
+	SSES3  = "AES256"
+	SSEKMS = "aws:kms"
+)
+
+// S3 stores objects in a bucket of S3 or an S3-compatible object store,
+// using the REST API directly. Objects larger than the part size are
+// written with multipart uploads, their parts sent while the rest is still
+// being written.
+type S3 struct {
+	endpoint   *url.URL
+	bucket     string
+	prefix     string
+	pathStyle  bool
+	sse        string
+	kmsKeyID   string
+	partSize   int64
+	maxRetries int
+	signer     signer
+	client     *http.Client
+}
+
+// NewS3 creates storage in the configured bucket
+func NewS3(cfg config.S3Config) (*S3, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("no S3 bucket configured")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, errors.New("no S3 credentials configured")
+	}
+	if cfg.PartSize < minPartSize {
+		return nil, fmt.Errorf("S3 part size %d is below the minimum of %d", cfg.PartSize, minPartSize)
+	}
+	switch cfg.SSE {
+	case "", SSES3:
+		if cfg.KMSKeyID != "" {
+			return nil, fmt.Errorf("a KMS key needs server-side encryption %q", SSEKMS)
+		}
+	case SSEKMS:
+	default:
+		return nil, fmt.Errorf("unknown server-side encryption %q, expected %s or %s", cfg.SSE, SSES3, SSEKMS)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = responseTimeout
+
+	return &S3{
+		endpoint:   endpoint,
+		bucket:     cfg.Bucket,
+		prefix:     cfg.Prefix,
+		pathStyle:  cfg.PathStyle,
+		sse:        cfg.SSE,
+		kmsKeyID:   cfg.KMSKeyID,
+		partSize:   cfg.PartSize,
+		maxRetries: max(cfg.MaxRetries, 0),
+		signer: signer{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			sessionToken:    cfg.SessionToken,
+			region:          cfg.Region,
+		},
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+// String describes where objects are stored, e.g. s3://bucket/prefix/
+func (s *S3) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// S3Error is an error response from the object store
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("S3 request failed with status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// retryable reports whether an error may succeed if the request is sent
+// again
+func retryable(err error) bool {
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) {
+		switch s3Err.Code {
+		case "SlowDown", "InternalError", "RequestTimeout", "ServiceUnavailable":
+			return true
+		}
+		return s3Err.StatusCode == http.StatusTooManyRequests || s3Err.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// request describes an S3 API call
+type request struct {
+	method string
+	key    string // "" for the bucket
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// do sends a request, retrying failures that may be transient, and returns
+// the response if it succeeded. The caller must close its body.
+func (s *S3) do(ctx context.Context, r request) (*http.Response, error) {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		resp, err = s.send(ctx, r)
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= s.maxRetries || !retryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		// Exponential backoff with full jitter
+		backoff := min(retryBackoff<<attempt, maxRetryBackoff)
+		select {
+		case <-time.After(rand.N(backoff) + 1):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// send makes one attempt at a request
+func (s *S3) send(ctx context.Context, r request) (*http.Response, error) {
+	u := *s.endpoint
+	key := r.key
+	if key != "" {
+		key = s.prefix + key
+	}
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = canonicalPath(u.Path)
+	u.RawQuery = canonicalQuery(r.query)
+
+	// The body is a byte slice so each attempt can resend it
+	req, err := http.NewRequestWithContext(ctx, r.method, u.String(), bytes.NewReader(r.body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(r.body) > 0 {
+		payloadHash = hashHex(r.body)
+	}
+	s.signer.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, readError(resp)
+	}
+	return resp, nil
+}
+
+// readError decodes an error response
+func readError(resp *http.Response) error {
+	s3Err := &S3Error{StatusCode: resp.StatusCode}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		// Treat like a dropped connection so it is retried
+		return fmt.Errorf("failed to read S3 error response: %w", io.ErrUnexpectedEOF)
+	}
+	// HEAD responses and some proxies have no XML body
+	xml.Unmarshal(body, s3Err)
+	if s3Err.Code == "" && resp.StatusCode == http.StatusNotFound {
+		s3Err.Code = "NoSuchKey"
+	}
+	return s3Err
+}
+
+// notFound converts the object store's missing object errors to
+// ErrNotFound
+func notFound(err error) error {
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) && s3Err.Code == "NoSuchKey" {
+		return ErrNotFound
+	}
+	return err
+}
+
+// encryptionHeader returns the headers requesting server-side encryption
+// of a new object
+func (s *S3) encryptionHeader() http.Header {
+	header := http.Header{}
+	if s.sse != "" {
+		header.Set("X-Amz-Server-Side-Encryption", s.sse)
+	}
+	if s.kmsKeyID != "" {
+		header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", s.kmsKeyID)
+	}
+	return header
+}
+
+func (s *S3) Create(ctx context.Context, key string) (Writer, error) {
+	if key == "" {
+		return nil, errors.New("empty object key")
+	}
+	return newS3Writer(ctx, s, key), nil
+}
+
+// putObject uploads a whole object in one request
+func (s *S3) putObject(ctx context.Context, key string, data []byte) error {
+	resp, err := s.do(ctx, request{method: http.MethodPut, key: key, header: s.encryptionHeader(), body: data})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, request{method: http.MethodGet, key: key})
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) OpenAt(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	if offset <= 0 {
+		return s.Open(ctx, key)
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := s.do(ctx, request{method: http.MethodGet, key: key, header: header})
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return io.NopCloser(strings.NewReader("")), nil // at or past the end
+	}
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	resp, err := s.do(ctx, request{method: http.MethodHead, key: key})
+	if err != nil {
+		return ObjectInfo{}, notFound(err)
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// listResult is a page of ListObjectsV2 results
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(ctx, request{method: http.MethodGet, query: query})
+		if err != nil {
+			return nil, err
+		}
+		var page listResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse object listing: %w", err)
+		}
+
+		for _, c := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     strings.TrimPrefix(c.Key, s.prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, request{method: http.MethodDelete, key: key})
+	if err != nil {
+		if notFound(err) == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// createMultipartUpload starts a multipart upload and returns its ID
+func (s *S3) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	resp, err := s.do(ctx, request{
+		method: http.MethodPost,
+		key:    key,
+		query:  url.Values{"uploads": {""}},
+		header: s.encryptionHeader(),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("failed to parse multipart upload: %v", err)
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart uploads one part and returns its ETag
+func (s *S3) uploadPart(ctx context.Context, key, uploadID string, number int, data []byte) (string, error) {
+	resp, err := s.do(ctx, request{
+		method: http.MethodPut,
+		key:    key,
+		query:  url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}},
+		body:   data,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("no ETag for part %d", number)
+	}
+	return etag, nil
+}
+
+// completedPart identifies an uploaded part when completing an upload
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// completeMultipartUpload assembles the uploaded parts into the object
+func (s *S3) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, request{
+		method: http.MethodPost,
+		key:    key,
+		query:  url.Values{"uploadId": {uploadID}},
+		body:   body,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Failures while assembling are reported in a 200 response
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read completion response: %w", err)
+	}
+	var s3Err S3Error
+	if xml.Unmarshal(result, &s3Err) == nil && s3Err.Code != "" {
+		s3Err.StatusCode = resp.StatusCode
+		return &s3Err
+	}
+	return nil
+}
+
+// abortMultipartUpload discards an upload's parts
+func (s *S3) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	resp, err := s.do(ctx, request{
+		method: http.MethodDelete,
+		key:    key,
+		query:  url.Values{"uploadId": {uploadID}},
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
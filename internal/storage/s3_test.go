@@ -0,0 +1,231 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/storage"
+	"voice-gateway/internal/storage/storagetest"
+)
+
+const partSize = 5 << 20
+
+// newFakeS3 starts a stand-in store and S3 storage in front of it
+func newFakeS3(t *testing.T, maxRetries int) (*storagetest.FakeS3, *storage.S3) {
+	t.Helper()
+	standin := storagetest.NewFakeS3()
+	t.Cleanup(func() {
+		standin.Resume()
+		standin.Close()
+	})
+
+	store, err := storage.NewS3(fakeS3Config(standin, "", maxRetries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return standin, store
+}
+
+func fakeS3Config(standin *storagetest.FakeS3, prefix string, maxRetries int) config.S3Config {
+	return config.S3Config{
+		Endpoint:        standin.URL(),
+		Region:          standin.Region,
+		Bucket:          standin.Bucket,
+		AccessKeyID:     standin.AccessKeyID,
+		SecretAccessKey: standin.SecretAccessKey,
+		PathStyle:       true,
+		SSE:             storage.SSES3,
+		Prefix:          prefix,
+		PartSize:        partSize,
+		MaxRetries:      maxRetries,
+	}
+}
+
+// spillDir makes temporary files, where parts are spilled, go to a
+// directory of the test's
+func spillDir(t *testing.T) string {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	return dir
+}
+
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func pattern(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+// writeChunks writes data in small pieces, as audio is, and returns the
+// longest a write took
+func writeChunks(t *testing.T, w io.Writer, data []byte) time.Duration {
+	t.Helper()
+	var longest time.Duration
+	for len(data) > 0 {
+		n := min(len(data), 64<<10)
+		start := time.Now()
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		longest = max(longest, time.Since(start))
+		data = data[n:]
+	}
+	return longest
+}
+
+func TestConformance(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, r := range storagetest.Run(func(prefix string) (storage.Storage, error) {
+			return storage.NewLocal(filepath.Join(dir, prefix))
+		}) {
+			if r.Err != nil {
+				t.Errorf("%s: %v", r.Name, r.Err)
+			}
+		}
+	})
+
+	t.Run("s3", func(t *testing.T) {
+		standin, _ := newFakeS3(t, 3)
+		standin.FailEvery(7)
+		standin.SetPageSize(2)
+
+		for _, r := range storagetest.Run(func(prefix string) (storage.Storage, error) {
+			return storage.NewS3(fakeS3Config(standin, prefix, 3))
+		}) {
+			if r.Err != nil {
+				t.Errorf("%s: %v", r.Name, r.Err)
+			}
+		}
+		if n := standin.PendingUploads(); n > 0 {
+			t.Errorf("%d multipart uploads left incomplete", n)
+		}
+	})
+}
+
+func TestS3WriteWhileStoreStalls(t *testing.T) {
+	dir := spillDir(t)
+	standin, store := newFakeS3(t, 0)
+	ctx := context.Background()
+
+	// Nothing reaches the store, not even the start of the upload, while
+	// six parts are written
+	standin.Pause()
+	data := pattern(6*partSize + 12345)
+	w, err := store.Create(ctx, "stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longest := writeChunks(t, w, data); longest > time.Second {
+		t.Errorf("a write took %v while the store stalled", longest)
+	}
+	if n := countFiles(t, dir); n != 1 {
+		t.Errorf("%d spill files while the store stalled, want 1", n)
+	}
+
+	standin.Resume()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := store.Open(ctx, "stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("stored %d bytes differing from the %d written", len(got), len(data))
+	}
+	if n := countFiles(t, dir); n != 0 {
+		t.Errorf("%d spill files left", n)
+	}
+	if n := standin.PendingUploads(); n != 0 {
+		t.Errorf("%d multipart uploads left incomplete", n)
+	}
+}
+
+func TestS3AbortWhileStoreStalls(t *testing.T) {
+	dir := spillDir(t)
+	standin, store := newFakeS3(t, 0)
+	ctx := context.Background()
+
+	standin.Pause()
+	w, err := store.Create(ctx, "aborted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChunks(t, w, pattern(4*partSize))
+	standin.Resume()
+
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(ctx, "aborted"); !errors.Is(err, storage.ErrNotFound) {
+		t.Error("aborted object stored")
+	}
+	if n := countFiles(t, dir); n != 0 {
+		t.Errorf("%d spill files left", n)
+	}
+	if n := standin.PendingUploads(); n != 0 {
+		t.Errorf("%d multipart uploads left incomplete", n)
+	}
+}
+
+func TestS3FailedPart(t *testing.T) {
+	dir := spillDir(t)
+	standin, store := newFakeS3(t, 0)
+	ctx := context.Background()
+
+	// The upload starts, then its first part fails without retries and the
+	// rest are discarded
+	standin.FailEvery(2)
+	w, err := store.Create(ctx, "failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure is reported by a later write or by Close
+	data := pattern(partSize)
+	failed := false
+	for range 8 {
+		if _, err := w.Write(data); err != nil {
+			failed = true
+			break
+		}
+	}
+	if err := w.Close(); err == nil && !failed {
+		t.Fatal("upload succeeded")
+	}
+
+	standin.FailEvery(0)
+	if _, err := store.Stat(ctx, "failed"); !errors.Is(err, storage.ErrNotFound) {
+		t.Error("failed object stored")
+	}
+	if n := countFiles(t, dir); n != 0 {
+		t.Errorf("%d spill files left", n)
+	}
+	if n := standin.PendingUploads(); n != 0 {
+		t.Errorf("%d multipart uploads left incomplete", n)
+	}
+}
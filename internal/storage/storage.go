@@ -0,0 +1,87 @@
+// Package storage keeps recordings somewhere other than the gateway's own
+// disk, which in a container does not outlive it.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"voice-gateway/internal/config"
+)
+
+// ErrNotFound is returned for an object that does not exist
+var ErrNotFound = errors.New("object not found")
+
+// Storage holds objects under slash-separated keys, e.g.
+// "<sessionID>/metadata.json". Local implements it on a directory and S3 on
+// an S3-compatible object store.
+type Storage interface {
+	// Create starts writing an object. Nothing is visible under the key
+	// until the writer is closed, when the object replaces any previous
+	// one; Abort discards it instead.
+	Create(ctx context.Context, key string) (Writer, error)
+	// Open reads an object
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// OpenAt reads an object from offset on; from its end or past it,
+	// there is nothing to read
+	OpenAt(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+	// Stat describes an object
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// List describes every object whose key starts with prefix, in key
+	// order
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Delete removes an object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Writer writes an object created by Storage.Create
+type Writer interface {
+	io.Writer
+	// Close completes the object
+	Close() error
+	// Abort discards what has been written. It is a no-op after Close.
+	Abort() error
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage backends selectable with RECORDING_STORAGE
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+// New creates the recording storage selected in the configuration. Local
+// storage is the recording directory itself.
+func New(cfg config.RecordingConfig) (Storage, error) {
+	switch strings.ToLower(cfg.Storage) {
+	case "", BackendLocal:
+		return NewLocal(cfg.Dir)
+	case BackendS3:
+		return NewS3(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown recording storage %q", cfg.Storage)
+	}
+}
+
+// Upload copies r to a new object
+func Upload(ctx context.Context, store Storage, key string, r io.Reader) error {
+	w, err := store.Create(ctx, key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
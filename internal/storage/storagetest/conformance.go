@@ -0,0 +1,318 @@
+// Package storagetest checks that a recording storage backend behaves like
+// the others, and provides an in-process S3 stand-in to check the S3
+// backend against without a real object store.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"voice-gateway/internal/storage"
+)
+
+// Large enough to span several parts of a multipart upload at the minimum
+// part size
+const largeObjectSize = 12<<20 + 12345
+
+// Factory creates storage whose keys are isolated under the given prefix,
+// so checks cannot see each other's objects
+type Factory func(prefix string) (storage.Storage, error)
+
+// Result is the outcome of one check
+type Result struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+type check struct {
+	name string
+	run  func(ctx context.Context, s storage.Storage) error
+}
+
+var checks = []check{
+	{"write and read", checkRoundTrip},
+	{"unusual keys", checkKeys},
+	{"empty object", checkEmpty},
+	{"invisible until closed", checkInvisible},
+	{"replace", checkReplace},
+	{"multipart", checkLarge},
+	{"abort", checkAbort},
+	{"read from offset", checkOpenAt},
+	{"missing object", checkMissing},
+	{"list by prefix", checkList},
+	{"delete", checkDelete},
+}
+
+// Run runs every check against storage from factory, each under a fresh
+// prefix
+func Run(factory Factory) []Result {
+	run := time.Now().UnixNano()
+	results := make([]Result, 0, len(checks))
+
+	for i, c := range checks {
+		start := time.Now()
+
+		err := func() error {
+			s, err := factory(fmt.Sprintf("conform%dc%d/", run, i))
+			if err != nil {
+				return fmt.Errorf("failed to create storage: %w", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+			return c.run(ctx, s)
+		}()
+
+		results = append(results, Result{Name: c.name, Err: err, Duration: time.Since(start)})
+	}
+
+	return results
+}
+
+// put writes an object in chunks of an awkward size, as a recorder would
+func put(ctx context.Context, s storage.Storage, key string, data []byte) error {
+	w, err := s.Create(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", key, err)
+	}
+	for off := 0; off < len(data); off += 100003 {
+		if _, err := w.Write(data[off:min(off+100003, len(data))]); err != nil {
+			w.Abort()
+			return fmt.Errorf("failed to write %s: %w", key, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", key, err)
+	}
+	return nil
+}
+
+// expect checks an object's content and size
+func expect(ctx context.Context, s storage.Storage, key string, want []byte) error {
+	r, err := s.Open(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", key, err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%s holds %d bytes, not the %d written", key, len(got), len(want))
+	}
+
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", key, err)
+	}
+	if info.Key != key || info.Size != int64(len(want)) {
+		return fmt.Errorf("stat of %s gave %s of %d bytes, expected %d", key, info.Key, info.Size, len(want))
+	}
+	if time.Since(info.ModTime) > time.Hour || time.Until(info.ModTime) > time.Hour {
+		return fmt.Errorf("%s modified at %s, expected about now", key, info.ModTime)
+	}
+	return nil
+}
+
+// pattern returns n bytes that differ at every offset of a part, so
+// misplaced data is detected
+func pattern(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*31+i>>8) ^ seed
+	}
+	return data
+}
+
+func checkRoundTrip(ctx context.Context, s storage.Storage) error {
+	data := []byte(`{"session_id":"abc"}`)
+	if err := put(ctx, s, "abc/metadata.json", data); err != nil {
+		return err
+	}
+	return expect(ctx, s, "abc/metadata.json", data)
+}
+
+func checkKeys(ctx context.Context, s storage.Storage) error {
+	for _, key := range []string{"a b/c+d=e&f.wav", "ünïcødé/🎙.ogg", "x/y~z(1)!*'.jsonl"} {
+		data := []byte(key)
+		if err := put(ctx, s, key, data); err != nil {
+			return err
+		}
+		if err := expect(ctx, s, key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkEmpty(ctx context.Context, s storage.Storage) error {
+	if err := put(ctx, s, "empty", nil); err != nil {
+		return err
+	}
+	return expect(ctx, s, "empty", []byte{})
+}
+
+func checkInvisible(ctx context.Context, s storage.Storage) error {
+	w, err := s.Create(ctx, "pending")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("partial")); err != nil {
+		w.Abort()
+		return err
+	}
+
+	if _, err := s.Stat(ctx, "pending"); !errors.Is(err, storage.ErrNotFound) {
+		w.Abort()
+		return fmt.Errorf("object being written is visible: stat gave %v", err)
+	}
+	if objects, err := s.List(ctx, ""); err != nil || len(objects) != 0 {
+		w.Abort()
+		return fmt.Errorf("object being written is listed: %v %v", objects, err)
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return expect(ctx, s, "pending", []byte("partial"))
+}
+
+func checkReplace(ctx context.Context, s storage.Storage) error {
+	if err := put(ctx, s, "metadata.json", []byte(`{"status":"recording"}`)); err != nil {
+		return err
+	}
+	if err := put(ctx, s, "metadata.json", []byte(`{"status":"complete"}`)); err != nil {
+		return err
+	}
+	return expect(ctx, s, "metadata.json", []byte(`{"status":"complete"}`))
+}
+
+func checkLarge(ctx context.Context, s storage.Storage) error {
+	data := pattern(largeObjectSize, 0x5a)
+	if err := put(ctx, s, "s/caller.wav", data); err != nil {
+		return err
+	}
+	return expect(ctx, s, "s/caller.wav", data)
+}
+
+func checkAbort(ctx context.Context, s storage.Storage) error {
+	// Kept, to check an aborted replacement leaves it alone
+	if err := put(ctx, s, "kept", []byte("original")); err != nil {
+		return err
+	}
+
+	for _, key := range []string{"kept", "discarded"} {
+		w, err := s.Create(ctx, key)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(pattern(largeObjectSize, 1)); err != nil {
+			w.Abort()
+			return err
+		}
+		if err := w.Abort(); err != nil {
+			return fmt.Errorf("failed to abort %s: %w", key, err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("close after abort failed: %w", err)
+		}
+	}
+
+	if _, err := s.Stat(ctx, "discarded"); !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("aborted object exists: stat gave %v", err)
+	}
+	return expect(ctx, s, "kept", []byte("original"))
+}
+
+func checkOpenAt(ctx context.Context, s storage.Storage) error {
+	data := pattern(100000, 9)
+	if err := put(ctx, s, "ranged", data); err != nil {
+		return err
+	}
+
+	for _, offset := range []int64{0, 1, 65537, int64(len(data)) - 1, int64(len(data)), int64(len(data)) + 10} {
+		r, err := s.OpenAt(ctx, "ranged", offset)
+		if err != nil {
+			return fmt.Errorf("open at %d failed: %w", offset, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("read at %d failed: %w", offset, err)
+		}
+		want := data[min(offset, int64(len(data))):]
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("read at %d gave %d bytes, expected %d", offset, len(got), len(want))
+		}
+	}
+
+	if _, err := s.OpenAt(ctx, "missing", 10); !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("open at offset of missing object gave %v, expected ErrNotFound", err)
+	}
+	return nil
+}
+
+func checkMissing(ctx context.Context, s storage.Storage) error {
+	if _, err := s.Open(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("open of missing object gave %v, expected ErrNotFound", err)
+	}
+	if _, err := s.Stat(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("stat of missing object gave %v, expected ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, "missing"); err != nil {
+		return fmt.Errorf("delete of missing object failed: %w", err)
+	}
+	return nil
+}
+
+func checkList(ctx context.Context, s storage.Storage) error {
+	keys := []string{"s1/metadata.json", "s1/audio.wav", "s10/metadata.json", "s2/metadata.json", "s1x"}
+	for _, key := range keys {
+		if err := put(ctx, s, key, []byte(key)); err != nil {
+			return err
+		}
+	}
+
+	for prefix, want := range map[string][]string{
+		"":    {"s1/audio.wav", "s1/metadata.json", "s10/metadata.json", "s1x", "s2/metadata.json"},
+		"s1/": {"s1/audio.wav", "s1/metadata.json"},
+		"s1":  {"s1/audio.wav", "s1/metadata.json", "s10/metadata.json", "s1x"},
+		"s3/": nil,
+	} {
+		objects, err := s.List(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("failed to list %q: %w", prefix, err)
+		}
+		var got []string
+		for _, o := range objects {
+			got = append(got, o.Key)
+			if o.Size != int64(len(o.Key)) {
+				return fmt.Errorf("listing gave %s as %d bytes, expected %d", o.Key, o.Size, len(o.Key))
+			}
+		}
+		if !slices.Equal(got, want) {
+			return fmt.Errorf("listing %q gave %v, expected %v", prefix, got, want)
+		}
+	}
+	return nil
+}
+
+func checkDelete(ctx context.Context, s storage.Storage) error {
+	if err := put(ctx, s, "s/audio.wav", []byte("audio")); err != nil {
+		return err
+	}
+	if err := s.Delete(ctx, "s/audio.wav"); err != nil {
+		return err
+	}
+	if _, err := s.Open(ctx, "s/audio.wav"); !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("deleted object still readable: %v", err)
+	}
+	return nil
+}
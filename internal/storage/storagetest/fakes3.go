@@ -0,0 +1,488 @@
+package storagetest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Smallest part S3 accepts in a multipart upload, other than the last
+const minPartSize = 5 << 20
+
+// FakeS3 is an in-process stand-in for an S3-compatible object store. It
+// serves one bucket with path-style addressing, implementing the object,
+// listing and multipart upload calls the storage package makes, and checks
+// every request's AWS Signature Version 4 as S3 would.
+type FakeS3 struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string
+	Bucket          string
+
+	server *httptest.Server
+
+	mu        sync.Mutex
+	objects   map[string]fakeObject
+	uploads   map[string]*fakeUpload
+	nextID    int
+	requests  int
+	failEvery int
+	pageSize  int
+	paused    chan struct{} // closed on Resume
+}
+
+type fakeObject struct {
+	data       []byte
+	modTime    time.Time
+	encryption string
+}
+
+type fakeUpload struct {
+	key        string
+	parts      map[int][]byte
+	encryption string
+}
+
+// NewFakeS3 starts a stand-in store
+func NewFakeS3() *FakeS3 {
+	f := &FakeS3{
+		AccessKeyID:     "AKIAFAKEFAKEFAKE",
+		SecretAccessKey: "fake/secret/key",
+		Region:          "us-east-1",
+		Bucket:          "recordings",
+		objects:         make(map[string]fakeObject),
+		uploads:         make(map[string]*fakeUpload),
+		pageSize:        1000,
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// URL returns the endpoint to configure, with path-style addressing
+func (f *FakeS3) URL() string {
+	return f.server.URL
+}
+
+// Close stops the server
+func (f *FakeS3) Close() {
+	f.server.Close()
+}
+
+// FailEvery makes every nth request fail with a transient error, so clients
+// must retry; 0 disables it
+func (f *FakeS3) FailEvery(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failEvery = n
+}
+
+// SetPageSize sets how many objects a listing returns before continuing on
+// another page
+func (f *FakeS3) SetPageSize(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pageSize = n
+}
+
+// Pause holds every request until Resume, as an unresponsive store would
+func (f *FakeS3) Pause() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paused == nil {
+		f.paused = make(chan struct{})
+	}
+}
+
+// Resume serves the requests held since Pause, and any more
+func (f *FakeS3) Resume() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.paused != nil {
+		close(f.paused)
+		f.paused = nil
+	}
+}
+
+// PendingUploads returns how many multipart uploads were started but
+// neither completed nor aborted
+func (f *FakeS3) PendingUploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
+
+// Encryption returns the server-side encryption an object was stored with
+func (f *FakeS3) Encryption(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key].encryption
+}
+
+func (f *FakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	paused := f.paused
+	f.mu.Unlock()
+	if paused != nil {
+		select {
+		case <-paused:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	if code, msg := f.authenticate(r, body); code != "" {
+		writeError(w, http.StatusForbidden, code, msg)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests++
+	if f.failEvery > 0 && f.requests%f.failEvery == 0 {
+		writeError(w, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, query)
+	case key == "":
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "bucket operation not supported")
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.createUpload(w, r, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		f.uploadPart(w, query, body)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.completeUpload(w, key, query, body)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		if _, ok := f.uploads[query.Get("uploadId")]; !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+			return
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = fakeObject{data: body, modTime: time.Now(), encryption: r.Header.Get("X-Amz-Server-Side-Encryption")}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		data, status := obj.data, http.StatusOK
+		// Only the open-ended ranges the client asks for are supported
+		if spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok && r.Method == http.MethodGet {
+			start, err := strconv.Atoi(strings.TrimSuffix(spec, "-"))
+			if err != nil || !strings.HasSuffix(spec, "-") {
+				writeError(w, http.StatusNotImplemented, "NotImplemented", "range not supported")
+				return
+			}
+			if start >= len(data) {
+				writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+			data, status = data[start:], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", etag(obj.data))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (f *FakeS3) list(w http.ResponseWriter, query url.Values) {
+	if query.Get("list-type") != "2" {
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "only ListObjectsV2 is supported")
+		return
+	}
+
+	prefix := query.Get("prefix")
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		Size         int    `xml:"Size"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{}
+
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		obj := f.objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: obj.modTime.UTC().Format(time.RFC3339Nano),
+			Size:         len(obj.data),
+		})
+	}
+	writeXML(w, result)
+}
+
+func (f *FakeS3) createUpload(w http.ResponseWriter, r *http.Request, key string) {
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = &fakeUpload{
+		key:        key,
+		parts:      make(map[int][]byte),
+		encryption: r.Header.Get("X-Amz-Server-Side-Encryption"),
+	}
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Bucket: f.Bucket, Key: key, UploadID: id})
+}
+
+func (f *FakeS3) uploadPart(w http.ResponseWriter, query url.Values, body []byte) {
+	upload, ok := f.uploads[query.Get("uploadId")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || number < 1 || number > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return
+	}
+	upload.parts[number] = body
+	w.Header().Set("ETag", etag(body))
+}
+
+func (f *FakeS3) completeUpload(w http.ResponseWriter, key string, query url.Values, body []byte) {
+	id := query.Get("uploadId")
+	upload, ok := f.uploads[id]
+	if !ok || upload.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	var request struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil || len(request.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "invalid part list")
+		return
+	}
+
+	var data []byte
+	for i, part := range request.Parts {
+		stored, ok := upload.parts[part.PartNumber]
+		if !ok || etag(stored) != part.ETag {
+			writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d not found", part.PartNumber))
+			return
+		}
+		if i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			writeError(w, http.StatusBadRequest, "InvalidPartOrder", "parts must be in ascending order")
+			return
+		}
+		if i < len(request.Parts)-1 && len(stored) < minPartSize {
+			// Real S3 reports this in a 200 response once the upload is
+			// assembled; clients must check the body
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"Error"`
+				Code    string   `xml:"Code"`
+				Message string   `xml:"Message"`
+			}{Code: "EntityTooSmall", Message: "Your proposed upload is smaller than the minimum allowed object size."})
+			return
+		}
+		data = append(data, stored...)
+	}
+
+	f.objects[key] = fakeObject{data: data, modTime: time.Now(), encryption: upload.encryption}
+	delete(f.uploads, id)
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+	}{Bucket: f.Bucket, Key: key})
+}
+
+// authenticate checks a request's signature, returning an S3 error code if
+// it is invalid
+func (f *FakeS3) authenticate(r *http.Request, body []byte) (code, message string) {
+	auth := r.Header.Get("Authorization")
+	fields := map[string]string{}
+	rest, ok := strings.CutPrefix(auth, "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return "AccessDenied", "missing or unsupported authorization"
+	}
+	for _, field := range strings.Split(rest, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[name] = value
+	}
+
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != f.AccessKeyID {
+		return "InvalidAccessKeyId", "unknown access key"
+	}
+	date, region := credential[1], credential[2]
+	if region != f.Region || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return "AuthorizationHeaderMalformed", "invalid credential scope"
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	sum := sha256.Sum256(body)
+	if payloadHash != hex.EncodeToString(sum[:]) {
+		return "XAmzContentSHA256Mismatch", "payload hash does not match the body"
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, date) {
+		return "AccessDenied", "invalid request date"
+	}
+	if skew := time.Since(signedAt); skew > 15*time.Minute || skew < -15*time.Minute {
+		return "RequestTimeTooSkewed", "request time too far from server time"
+	}
+
+	// Canonical request from what actually arrived
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	var headers strings.Builder
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	query := r.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+
+	segments := strings.Split(r.URL.Path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		strings.Join(segments, "/"),
+		strings.Join(params, "&"),
+		headers.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := strings.Join(credential[1:], "/")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + f.SecretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSum(key, part)
+	}
+	expected := hex.EncodeToString(hmacSum(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."
+	}
+	return "", ""
+}
+
+// awsEscape percent-encodes all but unreserved characters
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(buf.Bytes())
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
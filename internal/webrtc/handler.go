@@ -1,20 +1,32 @@
 package webrtc
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"sync"
 
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
+	"voice-gateway/internal/bus"
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/envelope"
 	"voice-gateway/internal/session"
+	"voice-gateway/internal/storage"
 )
 
 // Handler manages WebRTC peer connections
 type Handler struct {
 	config         *webrtc.Configuration
 	sessionManager *session.Manager
+	bus            bus.Bus
+	recording      config.RecordingConfig
+	recordingStore storage.Storage // nil if recordings stay in the recording directory
+	recordingKEK   *envelope.KEK   // nil if recordings aren't encrypted
+	audio          config.AudioConfig
 	mu             sync.RWMutex
 }
 
@@ -36,18 +48,90 @@ func NewHandler(iceServers []string, sessionMgr *session.Manager) *Handler {
 	}
 }
 
-// HandleOffer processes a WebRTC offer and returns an answer
-func (h *Handler) HandleOffer(offerJSON string) (string, error) {
+// SetBus enables publishing session lifecycle events and receiving control
+// commands over the bus
+func (h *Handler) SetBus(busClient bus.Bus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bus = busClient
+}
+
+// SetRecording enables or disables recording of new calls, which are
+// uploaded to store once finished and, if kek is not nil, encrypted with
+// data keys it wraps
+func (h *Handler) SetRecording(cfg config.RecordingConfig, store storage.Storage, kek *envelope.KEK) {
+	// Local storage is the recording directory, where they already are
+	if _, local := store.(*storage.Local); local {
+		store = nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recording = cfg
+	h.recordingStore = store
+	h.recordingKEK = kek
+}
+
+// SetAudio sets how the caller's audio is preprocessed in new calls
+func (h *Handler) SetAudio(cfg config.AudioConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.audio = cfg
+}
+
+// HandleOffer processes a WebRTC offer from a tenant and returns an answer.
+// Only an authenticated tenant can opt out of recording.
+func (h *Handler) HandleOffer(offerJSON string, tenantID string, authenticated bool) (_ string, err error) {
 	// Create a new session
-	sess := h.sessionManager.Create()
+	sess := h.sessionManager.Create(tenantID)
 	log.Printf("Created new session: %s", sess.ID)
 
+	// A failed offer leaves nothing behind: deleting the session closes
+	// its recorder, bus subscriptions and ingest path. It is deleted before
+	// the peer connection is closed, which would delete it in the
+	// background.
+	var peerConnection *webrtc.PeerConnection
+	defer func() {
+		if err == nil {
+			return
+		}
+		h.sessionManager.Delete(sess.ID)
+		if peerConnection != nil {
+			if closeErr := peerConnection.Close(); closeErr != nil {
+				log.Printf("Session %s: failed to close peer connection: %v", sess.ID, closeErr)
+			}
+		}
+	}()
+
+	// Calls that must be recorded are refused if recording can't start
+	recorder, err := h.startRecording(sess, authenticated)
+	if err != nil {
+		return "", err
+	}
+
 	// Create a new peer connection
-	peerConnection, err := webrtc.NewPeerConnection(*h.config)
+	peerConnection, err = webrtc.NewPeerConnection(*h.config)
 	if err != nil {
 		return "", fmt.Errorf("failed to create peer connection: %w", err)
 	}
 
+	h.attachBus(sess, peerConnection, recorder)
+
+	// The caller's audio goes to the recorder and to speech recognition
+	// over the bus. Stopped before the recorder is closed, once what it
+	// has taken is recorded.
+	h.mu.RLock()
+	busClient, audioConfig := h.bus, h.audio
+	h.mu.RUnlock()
+	var inbound *callerAudio
+	if busClient != nil || recorder != nil {
+		if inbound, err = newCallerAudio(sess, busClient, recorder, audioConfig); err != nil {
+			log.Printf("Session %s: not processing caller audio: %v", sess.ID, err)
+		} else {
+			sess.OnClose(inbound.close)
+		}
+	}
+
 	// Create a local audio track for echo
 	localTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
 	if err != nil {
@@ -60,6 +144,9 @@ func (h *Handler) HandleOffer(offerJSON string) (string, error) {
 		return "", fmt.Errorf("failed to add track: %w", err)
 	}
 
+	// Record what is played to the caller
+	recordOutbound := recordRTP(sess, recorder, session.ChannelAgent, opusClockRate, true)
+
 	// Read RTCP packets (keep connection alive)
 	go func() {
 		rtcpBuf := make([]byte, 1500)
@@ -73,12 +160,21 @@ func (h *Handler) HandleOffer(offerJSON string) (string, error) {
 	// Handle incoming tracks (echo logic)
 	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		log.Printf("Session %s: Received track: %s (codec: %s)", sess.ID, track.ID(), track.Codec().MimeType)
-		sess.UpdateState(session.StateListening)
+		h.setState(sess, session.StateListening)
+
+		var recordInbound func(*rtp.Packet)
+		opus := strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeOpus)
+		if opus {
+			// Decoded by the ingest path, if there is one
+			recordInbound = recordRTP(sess, recorder, session.ChannelCaller, track.Codec().ClockRate, inbound == nil)
+		} else if recorder != nil || inbound != nil {
+			log.Printf("Session %s: not recording or recognizing track %s, unsupported codec %s", sess.ID, track.ID(), track.Codec().MimeType)
+		}
 
 		// Echo: read RTP packets and write them to the local track
 		go func() {
 			defer func() {
-				sess.UpdateState(session.StateDisconnected)
+				h.setState(sess, session.StateDisconnected)
 				log.Printf("Session %s: Track ended", sess.ID)
 			}()
 
@@ -93,12 +189,26 @@ func (h *Handler) HandleOffer(offerJSON string) (string, error) {
 					return
 				}
 
+				if recordInbound != nil {
+					recordInbound(rtp)
+				}
+				if inbound != nil && opus {
+					inbound.received(rtp)
+				}
+
 				// Echo back: write the same packet to the local track
 				if writeErr := localTrack.WriteRTP(rtp); writeErr != nil {
 					if writeErr == io.ErrClosedPipe {
 						return
 					}
 					log.Printf("Session %s: Error writing RTP: %v", sess.ID, writeErr)
+				} else {
+					if recordOutbound != nil {
+						recordOutbound(rtp)
+					}
+					if inbound != nil {
+						inbound.played(rtp)
+					}
 				}
 			}
 		}()
@@ -110,9 +220,9 @@ func (h *Handler) HandleOffer(offerJSON string) (string, error) {
 
 		switch s {
 		case webrtc.PeerConnectionStateConnected:
-			sess.UpdateState(session.StateConnected)
+			h.setState(sess, session.StateConnected)
 		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
-			sess.UpdateState(session.StateDisconnected)
+			h.setState(sess, session.StateDisconnected)
 			h.sessionManager.Delete(sess.ID)
 		}
 	})
@@ -146,3 +256,103 @@ func (h *Handler) HandleOffer(offerJSON string) (string, error) {
 
 	return string(answerJSON), nil
 }
+
+// attachBus announces the session on the bus, listens for control commands
+// and for transcripts and tool calls for the recorder, if any, and arranges
+// for teardown to be published when the session is deleted
+func (h *Handler) attachBus(sess *session.Session, pc *webrtc.PeerConnection, recorder *session.Recorder) {
+	h.mu.RLock()
+	busClient := h.bus
+	h.mu.RUnlock()
+
+	if busClient == nil {
+		return
+	}
+
+	h.publishEvent(bus.NewEvent(bus.EventSessionStarted, sess.ID))
+
+	_, err := busClient.SubscribeControl(sess.ID, func(msg *bus.Message) error {
+		switch msg.Event.Type {
+		case bus.EventEndSession:
+			log.Printf("Session %s: end requested by %s: %s", sess.ID, msg.Event.Source, msg.Event.Reason)
+			return pc.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Session %s: failed to subscribe to control: %v", sess.ID, err)
+	}
+
+	if recorder != nil {
+		_, err = busClient.SubscribeEvents(sess.ID, func(msg *bus.Message) error {
+			// Redelivery won't fix a disk error, so just log it
+			event := msg.Event
+			switch event.Type {
+			case bus.EventTranscript:
+				if err := recorder.AddTranscript(event.Text, event.IsFinal, event.Speaker, event.Timestamp, wordTimings(event.Words)); err != nil {
+					log.Printf("Session %s: failed to record transcript: %v", sess.ID, err)
+				}
+			case bus.EventToolCall:
+				err := recorder.AddToolCall(session.ToolCall{
+					Timestamp: event.Timestamp,
+					Tool:      event.Tool,
+					Arguments: event.Arguments,
+					Result:    event.Result,
+					Error:     event.Error,
+				})
+				if err != nil {
+					log.Printf("Session %s: failed to record tool call: %v", sess.ID, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Session %s: failed to subscribe to transcripts: %v", sess.ID, err)
+		}
+	}
+
+	sess.OnClose(func() {
+		h.publishEvent(bus.NewEvent(bus.EventSessionEnded, sess.ID))
+		if err := busClient.CloseSession(sess.ID); err != nil {
+			log.Printf("Session %s: failed to close bus subscriptions: %v", sess.ID, err)
+		}
+	})
+}
+
+// wordTimings converts the word timings of a transcript event for the
+// recorder
+func wordTimings(words []bus.Word) []session.WordTiming {
+	var timings []session.WordTiming
+	for _, w := range words {
+		timings = append(timings, session.WordTiming{Text: w.Text, Start: w.Start, End: w.End, Confidence: w.Confidence})
+	}
+	return timings
+}
+
+// setState updates the session state and publishes the change
+func (h *Handler) setState(sess *session.Session, state session.State) {
+	if sess.GetState() == state {
+		return
+	}
+	sess.UpdateState(state)
+
+	event := bus.NewEvent(bus.EventStateChanged, sess.ID)
+	event.State = string(state)
+	h.publishEvent(event)
+}
+
+// publishEvent publishes a gateway event if a bus is attached
+func (h *Handler) publishEvent(event *bus.Event) {
+	h.mu.RLock()
+	busClient := h.bus
+	h.mu.RUnlock()
+
+	if busClient == nil {
+		return
+	}
+
+	event.Source = "gateway"
+	if err := busClient.PublishEvent(context.Background(), event); err != nil {
+		log.Printf("Session %s: failed to publish %s event: %v", event.SessionID, event.Type, err)
+	}
+}
@@ -0,0 +1,103 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/session"
+)
+
+func TestHandleOfferCleanup(t *testing.T) {
+	tests := []struct {
+		name  string
+		offer string
+	}{
+		{"unparseable offer", "not json"},
+		{"invalid SDP", `{"type":"offer","sdp":"v=0"}`},
+		{"answer instead of offer", `{"type":"answer","sdp":""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			manager := session.NewManager()
+			var deleted []*session.Session
+			manager.OnDelete(func(s *session.Session) { deleted = append(deleted, s) })
+
+			h := NewHandler(nil, manager)
+			h.SetRecording(config.RecordingConfig{Enabled: true, Dir: dir, Format: "wav"}, nil, nil)
+
+			if _, err := h.HandleOffer(tt.offer, "acme", true); err == nil {
+				t.Fatal("offer accepted")
+			}
+			if len(deleted) != 1 {
+				t.Fatalf("%d sessions deleted, want 1", len(deleted))
+			}
+			id := deleted[0].ID
+			if _, ok := manager.Get(id); ok {
+				t.Error("session still registered")
+			}
+			// The recorder was closed, finalizing the recording
+			if _, err := os.Stat(filepath.Join(dir, id, session.MetadataFile)); err != nil {
+				t.Errorf("recording not finalized: %v", err)
+			}
+		})
+	}
+}
+
+func TestStartRecordingOptOut(t *testing.T) {
+	tests := []struct {
+		name          string
+		tenant        string
+		authenticated bool
+		recorded      bool
+		// Whether the metadata vouches for the tenant
+		verified bool
+	}{
+		{"authenticated opt-out", "acme", true, false, false},
+		{"claimed opt-out", "acme", false, true, false},
+		{"authenticated", "globex", true, true, true},
+		{"claimed", "globex", false, true, false},
+		{"no tenant", "", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			manager := session.NewManager()
+			h := NewHandler(nil, manager)
+			h.SetRecording(config.RecordingConfig{
+				Enabled:       true,
+				Dir:           dir,
+				Format:        "wav",
+				OptOutTenants: []string{"acme"},
+			}, nil, nil)
+
+			sess := manager.Create(tt.tenant)
+			defer manager.Delete(sess.ID)
+			recorder, err := h.startRecording(sess, tt.authenticated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recorded := recorder != nil; recorded != tt.recorded {
+				t.Errorf("recorded %v, want %v", recorded, tt.recorded)
+			}
+			if recorder == nil {
+				return
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, sess.ID, session.MetadataFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var metadata session.RecordingMetadata
+			if err := json.Unmarshal(data, &metadata); err != nil {
+				t.Fatal(err)
+			}
+			if metadata.TenantID != tt.tenant || metadata.TenantAuthenticated != tt.verified {
+				t.Errorf("metadata has tenant %q, authenticated %v", metadata.TenantID, metadata.TenantAuthenticated)
+			}
+		})
+	}
+}
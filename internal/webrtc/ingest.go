@@ -0,0 +1,355 @@
+package webrtc
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"voice-gateway/internal/audio"
+	"voice-gateway/internal/bus"
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/ingest"
+	"voice-gateway/internal/session"
+)
+
+const (
+	// Longest echo path modelled, from the caller's speaker to their
+	// microphone
+	echoTail = 128 * time.Millisecond
+
+	// Longest gap in a stream filled with silence. Longer ones are logged
+	// as discontinuities; the position still moves past them.
+	maxConcealment = 2 * time.Second
+
+	// RMS level above which the caller is taken to be speaking, and how
+	// long they must be quiet before their utterance ends
+	vadThreshold = 0.02
+	vadSilence   = 300 * time.Millisecond
+
+	// Length of the chunks the caller's audio is recorded and published in
+	ingestChunk = ingest.FrameDuration20ms
+)
+
+// Format the caller's audio is processed in, the recording's as the
+// caller's channel is recorded from it
+var ingestFormat = recordingFormat
+
+// Format the caller's audio is sent for speech recognition in, converted
+// from the ingest format if the recording's differs
+var recognitionFormat = audio.FormatASR
+
+// Chunks queued for each consumer of the caller's audio. The recorder
+// holds up the call rather than lose audio; speech recognition only wants
+// the latest, so the oldest is dropped.
+const (
+	recorderQueue    = 50
+	recognitionQueue = 25
+)
+
+// callerAudio is the ingest path of a session's inbound audio. It decodes
+// the caller's Opus packets, removes the echo of the agent's audio picked up
+// by their microphone, using what was played to them as the reference, and
+// cuts the result into chunks. A fan-out hands each chunk to the recorder,
+// which records the caller's channel from it, and to speech recognition,
+// which cleans it up with the configured preprocessing and publishes it
+// with its voice activity. Gaps in either direction, e.g. from
+// discontinuous transmission, are filled with silence so the two stay in
+// step for the echo canceller.
+type callerAudio struct {
+	sess      *session.Session
+	bus       bus.Bus           // nil if not recognized
+	recorder  *session.Recorder // nil if not recorded
+	decoder   *audio.OpusDecoder
+	reference *audio.OpusDecoder
+	echo      *ingest.EchoCanceller
+	chunker   *ingest.Chunker
+
+	inbound, outbound rtpStream
+	// Recording offset of the first packet
+	anchor time.Duration
+	// Position of the next chunk from the first packet: the audio chunked
+	// so far plus gaps too long to fill
+	chunked  int
+	skipped  time.Duration
+	sequence uint64
+
+	// Chunks go to the fan-out as audio envelopes, carrying their position
+	fanout      *ingest.FanOut
+	in          chan []byte
+	recognition *ingest.Consumer
+	done        sync.WaitGroup
+	closed      bool
+
+	// Used by speech recognition's consumer only
+	converter    *audio.Converter
+	preprocessor *ingest.Preprocessor
+	vad          *ingest.VAD
+	flags        bus.VADFlags
+	// Carries the trace of the utterance being published, or of the
+	// silence since the last; nil to start a new one with the next chunk
+	trace context.Context
+
+	// Log the first failure of each kind rather than one per packet
+	decodeFailed bool
+	mu           sync.Mutex
+}
+
+// newCallerAudio creates the ingest path of a session, publishing to
+// busClient and recording to recorder, either of which may be nil, until
+// it is closed
+func newCallerAudio(sess *session.Session, busClient bus.Bus, recorder *session.Recorder, cfg config.AudioConfig) (*callerAudio, error) {
+	decoder, err := audio.NewOpusDecoder(ingestFormat)
+	if err != nil {
+		return nil, err
+	}
+	reference, err := audio.NewOpusDecoder(ingestFormat)
+	if err != nil {
+		return nil, err
+	}
+	converter, err := audio.NewConverter(ingestFormat, recognitionFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &callerAudio{
+		sess:      sess,
+		bus:       busClient,
+		recorder:  recorder,
+		decoder:   decoder,
+		reference: reference,
+		echo:      ingest.NewEchoCanceller(ingestFormat.SampleRate, echoTail),
+		fanout:    ingest.NewFanOut(),
+		in:        make(chan []byte, 1),
+		converter: converter,
+		preprocessor: ingest.NewPreprocessor(recognitionFormat.SampleRate, ingest.PreprocessConfig{
+			HighPassCutoff:     cfg.HighPassCutoff,
+			NoiseSuppression:   cfg.NoiseSuppression,
+			NoiseSuppressionDB: cfg.NoiseSuppressionDB,
+			AGC:                cfg.AGC,
+			AGCTargetDBFS:      cfg.AGCTargetDBFS,
+			AGCMaxGainDB:       cfg.AGCMaxGainDB,
+		}),
+		vad: ingest.NewVAD(vadThreshold, vadSilence),
+	}
+	c.chunker = ingest.NewChunker(ingestFormat.SampleRate, ingestChunk, c.dispatch)
+	c.vad.SetCallbacks(
+		func() { c.flags |= bus.VADSpeechStart },
+		func() { c.flags |= bus.VADSpeechEnd },
+	)
+
+	c.done.Add(1)
+	go func() {
+		defer c.done.Done()
+		c.fanout.Run(context.Background(), c.in)
+	}()
+
+	if recorder != nil {
+		consumer, err := c.fanout.Add("recorder", recorderQueue, ingest.PolicyBlock)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		c.consume(consumer, c.record)
+	}
+	if busClient != nil {
+		consumer, err := c.fanout.Add("recognition", recognitionQueue, ingest.PolicyDropOldest)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		c.recognition = consumer
+		c.consume(consumer, c.recognize)
+	}
+	return c, nil
+}
+
+// consume hands each chunk delivered to a consumer to fn until the
+// fan-out stops
+func (c *callerAudio) consume(consumer *ingest.Consumer, fn func(*bus.AudioChunk) error) {
+	c.done.Add(1)
+	go func() {
+		defer c.done.Done()
+
+		// Log the first failure rather than one per chunk
+		failed := false
+		for data := range consumer.C() {
+			chunk, err := bus.UnmarshalAudioChunk(data)
+			if err == nil {
+				err = fn(chunk)
+			}
+			if err != nil && !failed {
+				log.Printf("Session %s: %s failed to take caller audio: %v", c.sess.ID, consumer.Name(), err)
+				failed = true
+			}
+		}
+	}()
+}
+
+// close stops taking packets and waits for the audio already taken to be
+// recorded and published
+func (c *callerAudio) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.in)
+	c.mu.Unlock()
+
+	c.done.Wait()
+	if c.recognition != nil && c.recognition.Dropped() > 0 {
+		log.Printf("Session %s: dropped %d chunks of caller audio for speech recognition", c.sess.ID, c.recognition.Dropped())
+	}
+}
+
+// played takes an Opus packet written to the local track as the echo
+// canceller's reference
+func (c *callerAudio) played(packet *rtp.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	samples, gap, ok := c.outbound.advance(c.sess, "outbound", packet)
+	if !ok {
+		return
+	}
+	if gap > 0 {
+		c.echo.WriteReference(silence(gap))
+	}
+
+	pcm, err := c.reference.Decode(packet.Payload)
+	if err != nil {
+		pcm = silence(int64(samples))
+	}
+	c.echo.WriteReference(pcm)
+}
+
+// received processes an Opus packet from the caller
+func (c *callerAudio) received(packet *rtp.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	first := !c.inbound.started
+	samples, gap, ok := c.inbound.advance(c.sess, "inbound", packet)
+	if !ok {
+		return
+	}
+	if first && c.recorder != nil {
+		c.anchor = c.recorder.Elapsed()
+	}
+	if gap > 0 {
+		fill := silence(gap)
+		c.deliver(fill)
+		c.skipped += ticksDuration(gap) - ingestFormat.Duration(len(fill))
+	}
+
+	pcm, err := c.decoder.Decode(packet.Payload)
+	if err != nil {
+		if !c.decodeFailed {
+			log.Printf("Session %s: failed to decode caller audio: %v", c.sess.ID, err)
+			c.decodeFailed = true
+		}
+		pcm = silence(int64(samples))
+	}
+	c.deliver(pcm)
+}
+
+// deliver removes echo from decoded caller audio and chunks it
+func (c *callerAudio) deliver(pcm []byte) {
+	if len(pcm) > 0 {
+		c.chunker.Write(c.echo.Process(pcm))
+	}
+}
+
+// dispatch hands a chunk to the fan-out, waiting if the recorder is behind
+func (c *callerAudio) dispatch(pcm []byte) {
+	chunk := &bus.AudioChunk{
+		Codec:          bus.CodecPCM16,
+		SampleRate:     ingestFormat.SampleRate,
+		Channels:       ingestFormat.Channels,
+		Sequence:       c.sequence,
+		MediaTimestamp: c.skipped + ingestFormat.Duration(c.chunked),
+		CaptureTime:    time.Now(),
+		Data:           pcm,
+	}
+	c.sequence++
+	c.chunked += len(pcm)
+	c.in <- chunk.Marshal()
+}
+
+// record writes a chunk to the caller's channel of the recording
+func (c *callerAudio) record(chunk *bus.AudioChunk) error {
+	return c.recorder.WriteAudio(session.ChannelCaller, chunk.Data, c.anchor+chunk.MediaTimestamp)
+}
+
+// recognize converts a chunk to the recognition format, preprocesses it,
+// runs the VAD over it and publishes it. The chunks of an utterance, from
+// speech start to end, share a trace, as do those of the silence between.
+func (c *callerAudio) recognize(chunk *bus.AudioChunk) error {
+	chunk.SampleRate, chunk.Channels = recognitionFormat.SampleRate, recognitionFormat.Channels
+	chunk.Data = c.preprocessor.Process(c.converter.Convert(chunk.Data))
+	if c.vad.Process(chunk.Data) || c.vad.IsSpeaking() {
+		c.flags |= bus.VADSpeech
+	}
+	chunk.VAD, c.flags = c.flags, 0
+
+	if c.trace == nil || chunk.VAD&bus.VADSpeechStart != 0 {
+		c.trace = bus.WithTrace(context.Background(), bus.NewTrace(""))
+	}
+	err := c.bus.PublishAudio(c.trace, c.sess.ID, chunk)
+	if chunk.VAD&bus.VADSpeechEnd != 0 {
+		c.trace = nil
+	}
+	return err
+}
+
+// silence returns silent PCM in the ingest format lasting the given number
+// of RTP ticks, at most maxConcealment
+func silence(ticks int64) []byte {
+	ticks = min(ticks, int64(maxConcealment.Seconds()*opusClockRate))
+	samples := ticks * int64(ingestFormat.SampleRate) / opusClockRate
+	return make([]byte, samples*int64(ingestFormat.BytesPerFrame()))
+}
+
+// rtpStream follows the RTP timestamps of one direction of a call
+type rtpStream struct {
+	started bool
+	next    uint32
+}
+
+// advance returns the length of a packet and of the gap before it, both in
+// RTP ticks, or false if the packet is late or repeated and so covered
+// already, or can't be parsed
+func (s *rtpStream) advance(sess *session.Session, direction string, packet *rtp.Packet) (int, int64, bool) {
+	samples, err := audio.OpusPacketSamples(packet.Payload)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	limit := int64(maxConcealment.Seconds() * opusClockRate)
+	gap := int64(int32(packet.Timestamp - s.next))
+	switch {
+	case !s.started:
+		gap = 0
+	case gap < -limit:
+		log.Printf("Session %s: %s RTP timestamps jumped back %v, resyncing", sess.ID, direction, ticksDuration(-gap))
+		gap = 0
+	case gap < 0:
+		return 0, 0, false
+	case gap > limit:
+		log.Printf("Session %s: %s audio discontinuity of %v, filling %v", sess.ID, direction, ticksDuration(gap), maxConcealment)
+	}
+
+	s.started = true
+	s.next = packet.Timestamp + uint32(samples)
+	return samples, gap, true
+}
+
+func ticksDuration(ticks int64) time.Duration {
+	return time.Duration(ticks) * time.Second / opusClockRate
+}
@@ -0,0 +1,98 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+
+	"voice-gateway/internal/audio"
+	"voice-gateway/internal/bus"
+	"voice-gateway/internal/config"
+	"voice-gateway/internal/session"
+)
+
+// ingestChunkPCM returns one chunk of caller audio, loud if speech is set
+func ingestChunkPCM(speech bool) []byte {
+	samples := make([]float32, int(ingestChunk.Seconds()*float64(ingestFormat.SampleRate)))
+	if speech {
+		for i := range samples {
+			samples[i] = 0.3
+			if i/8%2 == 0 {
+				samples[i] = -0.3
+			}
+		}
+	}
+	return audio.Float32ToBytes(samples)
+}
+
+func TestRecognitionTraces(t *testing.T) {
+	b, err := bus.NewMemoryBus(config.Load().NATS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	sess := &session.Session{ID: "traced"}
+	published := make(chan *bus.Message, 100)
+	if _, err := b.SubscribeAudio(sess.ID, func(m *bus.Message) error {
+		published <- m
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := newCallerAudio(sess, b, nil, config.AudioConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	// Silence, an utterance and its trailing silence, more silence and the
+	// start of the next utterance, each wanting a trace of its own. The VAD
+	// ends an utterance after a stretch of silence in real time, so the
+	// trailing silence is spread out.
+	chunks := []struct {
+		group  int
+		speech bool
+		wait   bool
+	}{
+		{0, false, false}, {0, false, false}, {0, false, false},
+		{1, true, false}, {1, true, false}, {1, true, false}, {1, true, false},
+		{1, false, false}, {1, false, true},
+		{2, false, false}, {2, false, false},
+		{3, true, false},
+	}
+	for i, tt := range chunks {
+		if tt.wait {
+			time.Sleep(vadSilence + 50*time.Millisecond)
+		}
+		chunk := &bus.AudioChunk{Codec: bus.CodecPCM16, Sequence: uint64(i), Data: ingestChunkPCM(tt.speech)}
+		if err := c.recognize(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	traces := make([]string, len(chunks))
+	for i := range chunks {
+		select {
+		case m := <-published:
+			if m.Audio == nil || int(m.Audio.Sequence) >= len(chunks) {
+				t.Fatalf("unexpected message %+v", m)
+			}
+			traces[m.Audio.Sequence] = m.Trace.TraceID
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d chunks published", i, len(chunks))
+		}
+	}
+
+	for i := range chunks {
+		if traces[i] == "" {
+			t.Fatalf("chunk %d published without a trace", i)
+		}
+		if i == 0 {
+			continue
+		}
+		if same := traces[i] == traces[i-1]; same != (chunks[i].group == chunks[i-1].group) {
+			t.Errorf("chunk %d shares its trace with chunk %d: %v, want %v", i, i-1, same, !same)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package webrtc
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"voice-gateway/internal/audio"
+	"voice-gateway/internal/session"
+)
+
+// RTP clock rate of Opus, whatever the rate of the encoded audio
+const opusClockRate = 48000
+
+// Format each channel is decoded to for recording
+var recordingFormat = audio.FormatASR
+
+// startRecording creates the session's recorder, unless recording is
+// disabled or the tenant, if authenticated, has opted out, and closes it on
+// teardown
+func (h *Handler) startRecording(sess *session.Session, authenticated bool) (*session.Recorder, error) {
+	h.mu.RLock()
+	cfg, store, kek := h.recording, h.recordingStore, h.recordingKEK
+	h.mu.RUnlock()
+
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if slices.Contains(cfg.OptOutTenants, sess.TenantID) {
+		if authenticated {
+			log.Printf("Session %s: not recording, tenant %s opted out", sess.ID, sess.TenantID)
+			return nil, nil
+		}
+		log.Printf("Session %s: recording, tenant %s opted out but did not authenticate", sess.ID, sess.TenantID)
+	}
+
+	recorder, err := session.NewRecorder(sess.ID, cfg.Dir, session.RecorderOptions{
+		TenantID:            sess.TenantID,
+		TenantAuthenticated: authenticated && sess.TenantID != "",
+		SampleRate:          recordingFormat.SampleRate,
+		Format:              cfg.Format,
+		Store:               store,
+		KEK:                 kek,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start recording: %w", err)
+	}
+	log.Printf("Session %s: recording to %s", sess.ID, filepath.Join(cfg.Dir, sess.ID))
+
+	// Registered before the bus hooks so it runs after them, once the
+	// last transcripts have been delivered
+	sess.OnClose(func() {
+		if err := recorder.Close(); err != nil {
+			log.Printf("Session %s: failed to finalize recording: %v", sess.ID, err)
+		}
+	})
+
+	return recorder, nil
+}
+
+// recordRTP returns a function that writes Opus RTP packets, and unless
+// decode is false the audio decoded from them, to one channel of the
+// recorder, or nil if the session isn't recorded.
+// Packets are placed on the recording timeline by their RTP timestamps, so
+// gaps such as discontinuous transmission are kept as silence. The function
+// must not be called concurrently.
+func recordRTP(sess *session.Session, recorder *session.Recorder, channel session.Channel, clockRate uint32, decode bool) func(*rtp.Packet) {
+	if recorder == nil {
+		return nil
+	}
+
+	decoder, err := audio.NewOpusDecoder(recordingFormat)
+	if err != nil {
+		log.Printf("Session %s: not recording %s audio: %v", sess.ID, channel, err)
+		return nil
+	}
+
+	if clockRate == 0 {
+		clockRate = opusClockRate
+	}
+	clock := &rtpClock{rate: clockRate}
+	recorder.SetSource(channel, fmt.Sprintf("%s %dHz", webrtc.MimeTypeOpus, clockRate))
+
+	// Log the first failure of each kind rather than one per packet
+	var decodeFailed, writeFailed bool
+
+	return func(packet *rtp.Packet) {
+		at, drift := clock.position(packet.Timestamp, recorder.Elapsed())
+		if drift != 0 {
+			log.Printf("Session %s: %s RTP timestamps %v off from arrival, resyncing", sess.ID, channel, drift)
+		}
+
+		// Kept as is when recording to Ogg, so it is never re-encoded
+		if err := recorder.WriteOpus(channel, packet.Payload, at); err != nil && !writeFailed {
+			log.Printf("Session %s: failed to write %s recording: %v", sess.ID, channel, err)
+			writeFailed = true
+		}
+
+		if !decode {
+			return
+		}
+		pcm, err := decoder.Decode(packet.Payload)
+		if err != nil {
+			if !decodeFailed {
+				log.Printf("Session %s: failed to decode %s audio for recording: %v", sess.ID, channel, err)
+				decodeFailed = true
+			}
+			return
+		}
+
+		if err := recorder.WriteAudio(channel, pcm, at); err != nil && !writeFailed {
+			log.Printf("Session %s: failed to write %s recording: %v", sess.ID, channel, err)
+			writeFailed = true
+		}
+	}
+}
+
+// Furthest a packet's RTP timestamp may place it from when it arrived
+// before its stream is resynced to its arrival, e.g. after the sender reset
+// its timestamps
+const maxClockDrift = 3 * time.Second
+
+// rtpClock maps a stream's RTP timestamps onto the recording timeline. The
+// first packet is placed at the time it is seen; later packets are offset
+// from it by their timestamp difference, which survives wraparound, as long
+// as that keeps them within maxClockDrift of their arrival.
+type rtpClock struct {
+	rate    uint32
+	started bool
+	anchor  time.Duration
+	last    uint32
+	ticks   int64
+}
+
+// position returns the recording offset of a packet's timestamp, given the
+// offset it arrived at, and how far off its arrival the timestamp placed it
+// if the stream was resynced
+func (c *rtpClock) position(timestamp uint32, arrival time.Duration) (time.Duration, time.Duration) {
+	if !c.started {
+		c.started = true
+		c.anchor = arrival
+		c.last = timestamp
+	}
+
+	c.ticks += int64(int32(timestamp - c.last))
+	c.last = timestamp
+
+	at := c.anchor + time.Duration(c.ticks)*time.Second/time.Duration(c.rate)
+	if drift := at - arrival; drift > maxClockDrift || drift < -maxClockDrift {
+		c.anchor, c.ticks = arrival, 0
+		return arrival, drift
+	}
+	return at, 0
+}
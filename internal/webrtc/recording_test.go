@@ -0,0 +1,60 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTPClock(t *testing.T) {
+	const frame = 960 // 20ms at 48kHz
+	type packet struct {
+		timestamp uint32
+		arrival   time.Duration
+		at        time.Duration
+		resync    bool
+	}
+	tests := []struct {
+		name    string
+		packets []packet
+	}{
+		{"contiguous", []packet{
+			{1000, time.Second, time.Second, false},
+			{1000 + frame, time.Second + 25*time.Millisecond, time.Second + 20*time.Millisecond, false},
+		}},
+		{"gap", []packet{
+			{1000, 0, 0, false},
+			{1000 + 100*frame, 2 * time.Second, 2 * time.Second, false},
+		}},
+		{"wraparound", []packet{
+			{1<<32 - frame, 0, 0, false},
+			{0, 20 * time.Millisecond, 20 * time.Millisecond, false},
+			{frame, 40 * time.Millisecond, 40 * time.Millisecond, false},
+		}},
+		{"reset ahead", []packet{
+			{1000, 0, 0, false},
+			{1000 + frame, 20 * time.Millisecond, 20 * time.Millisecond, false},
+			{1 << 30, 40 * time.Millisecond, 40 * time.Millisecond, true},
+			{1<<30 + frame, 60 * time.Millisecond, 60 * time.Millisecond, false},
+		}},
+		{"reset back", []packet{
+			{1 << 30, 0, 0, false},
+			{1000, 20 * time.Millisecond, 20 * time.Millisecond, true},
+			{1000 + frame, 40 * time.Millisecond, 40 * time.Millisecond, false},
+		}},
+		{"timestamps paused", []packet{
+			{1000, 0, 0, false},
+			{1000 + frame, 10 * time.Second, 10 * time.Second, true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &rtpClock{rate: opusClockRate}
+			for i, p := range tt.packets {
+				at, drift := clock.position(p.timestamp, p.arrival)
+				if at != p.at || (drift != 0) != p.resync {
+					t.Errorf("packet %d placed at %v with drift %v, want %v resynced %v", i, at, drift, p.at, p.resync)
+				}
+			}
+		})
+	}
+}